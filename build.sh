@@ -11,6 +11,8 @@ else
 fi
 
 VERSION=${VERSION:=$DEV_VER}
+COMMIT=$(git rev-parse HEAD 2> /dev/null)
+BUILD_DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
 
 build() {
     EXT=""
@@ -18,7 +20,9 @@ build() {
     echo "Building ${GOOS} ${GOARCH}"
     CGO_ENABLED=0 go build \
         -trimpath \
-        -ldflags="-s -w -X 'github.com/ferama/rospo/cmd.Version=$VERSION'" \
+        -ldflags="-s -w -X 'github.com/ferama/rospo/pkg/version.version=$VERSION' \
+            -X 'github.com/ferama/rospo/pkg/version.commit=$COMMIT' \
+            -X 'github.com/ferama/rospo/pkg/version.buildDate=$BUILD_DATE'" \
         -o ./bin/rospo-${GOOS}-${GOARCH}${EXT} .
 }
 
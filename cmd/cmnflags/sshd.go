@@ -2,6 +2,7 @@ package cmnflags
 
 import (
 	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
@@ -10,7 +11,15 @@ import (
 func AddSshDFlags(fs *pflag.FlagSet) {
 	fs.StringP("sshd-authorized-keys", "K", "./authorized_keys", "ssh server authorized keys path.\nhttp url like https://github.com/<username>.keys are supported too")
 	fs.StringP("sshd-listen-address", "P", ":2222", "the ssh server tcp port")
-	fs.StringP("sshd-key", "I", "./server_key", "the ssh server key path")
+	fs.StringP("sshd-key", "I", "./server_key", "the ssh server key path, env:VAR for a key in the VAR env var or - to read it from stdin")
+	fs.StringSlice("sshd-keys", nil, "more ssh server key paths, of different algorithms. Example: --sshd-keys ./server_key_rsa")
+	fs.Duration("sshd-login-grace-time", sshd.DefaultLoginGraceTime, "the clients that don't log in within this time are disconnected")
+	fs.Duration("sshd-client-alive-interval", 0, "the interval of the keep alive requests sent to the clients. 0 disables them")
+	fs.Int("sshd-client-alive-count-max", sshd.DefaultClientAliveCountMax, "the consecutive unanswered keep alive requests after which a client is disconnected")
+	fs.Float64("sshd-max-conn-rate", 0, "the new connections accepted per second at most. 0 is unlimited")
+	fs.Int("sshd-max-conn-burst", 0, "the new connections accepted at once at most. Defaults to the max conn rate")
+	fs.String("sshd-key-type", utils.KeyAlgorithmEd25519, "the type of the server key generated if it doesn't exist. One of: ed25519, ecdsa, rsa")
+	fs.Int("sshd-key-bits", 0, "the size of the generated server key. 0 is the type default")
 	fs.BoolP("disable-auth", "T", false, "if set clients can connect without authentication")
 	fs.StringP("sshd-authorized-password", "A", "", "ssh server authorized password. Disabled if empty")
 }
@@ -18,16 +27,32 @@ func AddSshDFlags(fs *pflag.FlagSet) {
 // GetSshDConf builds an SshDConf object from cmd
 func GetSshDConf(cmd *cobra.Command) *sshd.SshDConf {
 	sshdKey, _ := cmd.Flags().GetString("sshd-key")
+	sshdKeys, _ := cmd.Flags().GetStringSlice("sshd-keys")
+	sshdKeyType, _ := cmd.Flags().GetString("sshd-key-type")
+	sshdKeyBits, _ := cmd.Flags().GetInt("sshd-key-bits")
 	sshdAuthorizedKeys, _ := cmd.Flags().GetString("sshd-authorized-keys")
 	sshdListenAddress, _ := cmd.Flags().GetString("sshd-listen-address")
+	loginGraceTime, _ := cmd.Flags().GetDuration("sshd-login-grace-time")
+	clientAliveInterval, _ := cmd.Flags().GetDuration("sshd-client-alive-interval")
+	clientAliveCountMax, _ := cmd.Flags().GetInt("sshd-client-alive-count-max")
+	maxConnRate, _ := cmd.Flags().GetFloat64("sshd-max-conn-rate")
+	maxConnBurst, _ := cmd.Flags().GetInt("sshd-max-conn-burst")
 	authorizedPasssword, _ := cmd.Flags().GetString("sshd-authorized-password")
 	disableAuth, _ := cmd.Flags().GetBool("disable-auth")
 
 	return &sshd.SshDConf{
-		Key:                sshdKey,
-		AuthorizedKeysURI:  []string{sshdAuthorizedKeys},
-		ListenAddress:      sshdListenAddress,
-		AuthorizedPassword: authorizedPasssword,
-		DisableAuth:        disableAuth,
+		Key:                 sshdKey,
+		Keys:                sshdKeys,
+		KeyType:             sshdKeyType,
+		KeyBits:             sshdKeyBits,
+		AuthorizedKeysURI:   []string{sshdAuthorizedKeys},
+		ListenAddress:       sshdListenAddress,
+		LoginGraceTime:      loginGraceTime,
+		ClientAliveInterval: clientAliveInterval,
+		ClientAliveCountMax: clientAliveCountMax,
+		MaxConnRate:         maxConnRate,
+		MaxConnBurst:        maxConnBurst,
+		AuthorizedPassword:  authorizedPasssword,
+		DisableAuth:         disableAuth,
 	}
 }
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+
+	configValidateCmd.Flags().String("config", "", "the config file path")
+	configValidateCmd.MarkFlagRequired("config")
+	configValidateCmd.Flags().Bool("json", false, "if set the result is printed as json")
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Config file utilities",
+	Long:  "Config file utilities",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validates a config file without starting anything",
+	Long: `Validates a config file without starting anything. All the invalid values
+are listed with their field path. The exit code is 0 if the config is valid,
+1 otherwise`,
+	Example: `
+  $ rospo config validate --config conf.yaml
+  # machine readable, for the CI pipelines
+  $ rospo config validate --config conf.yaml --json | jq .errors
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, _ := cmd.Flags().GetString("config")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		var errs conf.ValidationErrors
+		cfg, err := conf.LoadConfig(path)
+		if err != nil {
+			errs = conf.ValidationErrors{{Field: "", Message: err.Error()}}
+		} else if err := cfg.Validate(); err != nil && !errors.As(err, &errs) {
+			errs = conf.ValidationErrors{{Field: "", Message: err.Error()}}
+		}
+
+		if asJSON {
+			if errs == nil {
+				errs = conf.ValidationErrors{}
+			}
+			json.NewEncoder(os.Stdout).Encode(map[string]any{
+				"valid":  len(errs) == 0,
+				"errors": errs,
+			})
+		} else if len(errs) == 0 {
+			fmt.Printf("%s is valid\n", path)
+		} else {
+			fmt.Printf("%s is not valid:\n", path)
+			for i, e := range errs {
+				if e.Field == "" {
+					fmt.Printf("  %d. %s\n", i+1, e.Message)
+				} else {
+					fmt.Printf("  %d. %s: %s\n", i+1, e.Field, e.Message)
+				}
+			}
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+	},
+}
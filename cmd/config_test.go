@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/ferama/rospo/pkg/conf"
+)
+
+// TestMain runs the rospo command with the ROSPO_TEST_COMMAND_ARGS json
+// args instead of the tests, so that the tests can check its exit code
+// running the test binary
+func TestMain(m *testing.M) {
+	if args := os.Getenv("ROSPO_TEST_COMMAND_ARGS"); args != "" {
+		var list []string
+		json.Unmarshal([]byte(args), &list)
+		rootCmd.SetArgs(list)
+		if err := Execute(); err != nil {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs rospo with args, returning its stdout and exit code
+func runCommand(t *testing.T, args ...string) ([]byte, int) {
+	t.Helper()
+	encoded, _ := json.Marshal(args)
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "ROSPO_TEST_COMMAND_ARGS="+string(encoded))
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return out, exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, 0
+}
+
+type validateResult struct {
+	Valid  bool                  `json:"valid"`
+	Errors conf.ValidationErrors `json:"errors"`
+}
+
+func TestConfigValidate(t *testing.T) {
+	out, code := runCommand(t, "config", "validate", "--json", "--config", "../pkg/conf/testdata/invalid.yaml")
+	if code != 1 {
+		t.Fatalf("expected the exit code 1, got %d", code)
+	}
+	res := validateResult{}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("invalid json output %q: %s", out, err)
+	}
+	if res.Valid || len(res.Errors) == 0 {
+		t.Fatalf("expected the validation errors, got %+v", res)
+	}
+	fields := map[string]bool{}
+	for _, e := range res.Errors {
+		if e.Message == "" {
+			t.Fatalf("missing the message of %+v", e)
+		}
+		fields[e.Field] = true
+	}
+	for _, field := range []string{"sshclient.server", "sshclient.compression_level", "log_format"} {
+		if !fields[field] {
+			t.Fatalf("missing the %s error in %+v", field, res.Errors)
+		}
+	}
+
+	// the files that can't be parsed are reported without a field
+	out, code = runCommand(t, "config", "validate", "--json", "--config", "../pkg/conf/testdata/unparsable.yaml")
+	res = validateResult{}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("invalid json output %q: %s", out, err)
+	}
+	if code != 1 || res.Valid || len(res.Errors) != 1 || res.Errors[0].Field != "" {
+		t.Fatalf("unexpected result %+v, exit code %d", res, code)
+	}
+
+	out, code = runCommand(t, "config", "validate", "--json", "--config", "../pkg/conf/testdata/sshd.yaml")
+	res = validateResult{}
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("invalid json output %q: %s", out, err)
+	}
+	if code != 0 || !res.Valid || len(res.Errors) != 0 {
+		t.Fatalf("expected a valid config, got %+v, exit code %d", res, code)
+	}
+}
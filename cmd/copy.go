@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(copyCmd)
+
+	addTransferFlags(copyCmd)
+}
+
+var copyCmd = &cobra.Command{
+	Use:   "copy [user@]hostA:src [user@]hostB:dst",
+	Short: "Copies files between two remote hosts",
+	Long: `Copies files between two remote hosts
+
+Rospo connects to both hosts and streams the data between the two sftp
+sessions: nothing is written to the local disk. The paths are in the
+[user@]host:path form, as scp does. The hosts defined in the OpenSSH client
+config are reached with their own user, port, identity and jump hosts.
+If dst is an existing directory, src is copied into it. The directories
+are copied with -r: the files that fail are listed at the end and the
+others are copied anyway.
+With --preserve the permissions and modification times are copied too.
+With --resume a destination file smaller than the source is completed.
+The exit code is 1 if a file fails, 2 if the authentication fails and
+255 if a server can't be reached.
+Both hosts need the sftp subsystem to be enabled.
+`,
+	Example: `
+  # copies a file between two servers
+  $ rospo copy user@hostA:/tmp/file.txt user@hostB:/tmp/
+
+  # copies a directory between two OpenSSH config hosts, at most 2MB/s
+  $ rospo copy -r --bwlimit 2M hostA:/var/backups hostB:/srv/
+	`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		src := parseRemotePath(args[0])
+		dst := parseRemotePath(args[1])
+		if src == nil || dst == nil {
+			transferExit(transferExitFailed, errors.New("src and dst should be [user@]host:path remote paths"))
+		}
+		recursive, _ := cmd.Flags().GetBool("recursive")
+
+		srcConn, srcTransfer := startTransfer(cmd, src.server)
+		defer srcConn.Stop()
+		defer srcTransfer.Close()
+		dstConn, dstTransfer := startTransfer(cmd, dst.server)
+		defer dstConn.Stop()
+		defer dstTransfer.Close()
+
+		var err error
+		if src.path == "" {
+			if src.path, err = srcTransfer.Getwd(); err != nil {
+				transferExit(transferExitFailed, err)
+			}
+		}
+		if dst.path == "" {
+			if dst.path, err = dstTransfer.Getwd(); err != nil {
+				transferExit(transferExitFailed, err)
+			}
+		}
+
+		err = srcTransfer.CopyTo(dstTransfer, src.path, dst.path, recursive)
+		var failed sshc.TransferErrors
+		if errors.As(err, &failed) {
+			fmt.Fprintln(os.Stderr, "failed files:")
+			for _, f := range failed {
+				fmt.Fprintf(os.Stderr, "  %s: %s\n", f.Path, f.Err)
+			}
+			os.Exit(transferExitFailed)
+		}
+		if err != nil {
+			transferExit(transferExitFailed, err)
+		}
+	},
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/cheggaaa/pb/v3"
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+
+	cmnflags.AddSshClientFlags(cpCmd.Flags())
+	cpCmd.Flags().BoolP("recursive", "r", false, "if the copy should be recursive")
+	cpCmd.Flags().IntP("port", "P", 22, "the remote server port")
+}
+
+// remotePath holds an scp like [user@]host:path remote path
+type remotePath struct {
+	server string
+	path   string
+}
+
+// parseRemotePath parses an scp like [user@]host:path argument. It returns
+// nil if the argument is a local path
+func parseRemotePath(arg string) *remotePath {
+	idx := strings.Index(arg, ":")
+	if idx <= 0 {
+		return nil
+	}
+	// a local path containing a colon
+	if slash := strings.IndexAny(arg, `/\`); slash >= 0 && slash < idx {
+		return nil
+	}
+	// a windows drive letter
+	if idx == 1 && filepath.VolumeName(arg) != "" {
+		return nil
+	}
+	return &remotePath{
+		server: arg[:idx],
+		path:   arg[idx+1:],
+	}
+}
+
+func progressBar(name string, size int64) chan int64 {
+	byteswrittench := make(chan int64)
+	go func() {
+		tmpl := `{{string . "target" | white}} {{with string . "prefix"}}{{.}} {{end}}{{counters . | blue }} {{bar . "[" "=" (cycle . "" "" "" "" ) " " "]" }} {{percent . | blue }} {{speed . | blue }} {{rtime . "ETA %s" | blue }}{{with string . "suffix"}} {{.}}{{end}}`
+		pbar := pb.ProgressBarTemplate(tmpl).Start(0)
+		pbar.Set(pb.Bytes, true)
+		pbar.Set(pb.SIBytesPrefix, true)
+
+		pbar.Set("target", name)
+		pbar.SetTotal(size)
+		for w := range byteswrittench {
+			pbar.Add64(w)
+		}
+		pbar.Finish()
+	}()
+	return byteswrittench
+}
+
+var cpCmd = &cobra.Command{
+	Use:   "cp src dst",
+	Short: "Copies files from and to a remote host",
+	Long: `Copies files from and to a remote host
+
+Remote paths are in the [user@]host:path form, as scp does. File
+permissions and modification times are preserved.
+The remote host needs the sftp subsystem to be enabled.
+`,
+	Example: `
+  # uploads a file to the remote server home directory
+  $ rospo cp -P 2222 ./myfile.txt user@myserver:
+
+  # downloads a file from the remote server
+  $ rospo cp -P 2222 user@myserver:/tmp/myfile.txt .
+
+  # uploads recursively a directory to the remote server
+  $ rospo cp -P 2222 -r ./mylocalfolder user@myserver:/home/user/
+	`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		src := parseRemotePath(args[0])
+		dst := parseRemotePath(args[1])
+		if src != nil && dst != nil {
+			log.Fatalln("remote to remote copy is not supported. Use rospo copy")
+		}
+		if src == nil && dst == nil {
+			log.Fatalln("one of src and dst should be a remote path")
+		}
+		remote := src
+		if remote == nil {
+			remote = dst
+		}
+
+		recursive, _ := cmd.Flags().GetBool("recursive")
+		port, _ := cmd.Flags().GetInt("port")
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, fmt.Sprintf("%s:%d", remote.server, port))
+		sshcConf.Quiet = true
+		conn := newConnection(sshcConf)
+		go startConnection(cmd.Context(), conn)
+
+		transfer, err := sshc.NewSftpTransfer(conn, progressBar)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer transfer.Close()
+
+		if remote.path == "" {
+			remote.path, err = transfer.Getwd()
+			if err != nil {
+				log.Fatalf("remote path is empty and I can't get cwd, %s", err)
+			}
+		}
+
+		if dst != nil {
+			err = transfer.Upload(args[0], dst.path, recursive)
+		} else {
+			err = transfer.Download(src.path, args[1], recursive)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/pkg/ctl"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(ctlCmd)
+	ctlCmd.AddCommand(ctlListCmd)
+	ctlCmd.AddCommand(ctlStatusCmd)
+	ctlCmd.AddCommand(ctlReloadCmd)
+	ctlCmd.AddCommand(ctlPauseCmd)
+	ctlCmd.AddCommand(ctlResumeCmd)
+	ctlCmd.AddCommand(ctlAddCmd)
+	ctlCmd.AddCommand(ctlStopCmd)
+	ctlCmd.AddCommand(ctlDisconnectCmd)
+
+	ctlCmd.PersistentFlags().StringP("socket", "s", ctl.DefaultSocketPath(), "the management socket path of the running rospo (the management_socket config value)")
+	ctlCmd.PersistentFlags().Bool("json", false, "if set the commands data is printed as json, for the commands that have it")
+
+	ctlAddCmd.Flags().StringP("local", "l", "", "the local tunnel endpoint")
+	ctlAddCmd.Flags().StringP("remote", "r", "", "the remote tunnel endpoint")
+	ctlAddCmd.Flags().Bool("forward", false, "if set the tunnel is a forward one, a reverse one otherwise")
+	ctlAddCmd.MarkFlagRequired("local")
+	ctlAddCmd.MarkFlagRequired("remote")
+}
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Controls a running rospo instance",
+	Long:  `Controls a running rospo instance through its management socket`,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   func(cmd *cobra.Command, args []string) {},
+}
+
+var ctlListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the tunnels",
+	Long:  `Lists the tunnels with their state, listener address and active clients`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCtl(cmd, "list")
+	},
+}
+
+var ctlStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the ssh connections state",
+	Long:  `Shows the ssh connections state`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCtl(cmd, "status")
+	},
+}
+
+var ctlReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reloads the tunnels from the config file",
+	Long: `Reads the config file again and applies the tunnels changes: the removed
+and the changed tunnels are stopped, the new ones are started. The changes
+of the other sections need a restart`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runCtl(cmd, "reload")
+	},
+}
+
+var ctlPauseCmd = &cobra.Command{
+	Use:   "pause tunnel_name...",
+	Short: "Closes the tunnels listeners until they are resumed",
+	Long:  `Closes the tunnels listeners until they are resumed. The ssh connection and the active clients are kept`,
+	Example: `
+  # stops accepting new clients on the web tunnel
+  $ rospo ctl pause web
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCtl(cmd, "pause", args...)
+	},
+}
+
+var ctlResumeCmd = &cobra.Command{
+	Use:   "resume tunnel_name...",
+	Short: "Opens again the paused tunnels listeners",
+	Long:  `Opens again the paused tunnels listeners`,
+	Example: `
+  $ rospo ctl resume web
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCtl(cmd, "resume", args...)
+	},
+}
+
+var ctlAddCmd = &cobra.Command{
+	Use:   "add tunnel_name",
+	Short: "Starts a new tunnel",
+	Long:  `Starts a new tunnel on the global ssh client. It is lost on restart: add it to the config file to keep it`,
+	Example: `
+  # forwards the local port 8080 to the port 80 of the server
+  $ rospo ctl add --forward -l :8080 -r localhost:80 web
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		local, _ := cmd.Flags().GetString("local")
+		remote, _ := cmd.Flags().GetString("remote")
+		forward, _ := cmd.Flags().GetBool("forward")
+		body, _ := json.Marshal(&tun.TunnelConf{
+			Name:    args[0],
+			Local:   local,
+			Remote:  remote,
+			Forward: forward,
+		})
+		doCtl(cmd, &ctl.Request{Command: "add", Body: body})
+	},
+}
+
+var ctlStopCmd = &cobra.Command{
+	Use:   "stop tunnel_name...",
+	Short: "Stops and removes the tunnels",
+	Long:  `Stops and removes the tunnels. The tunnels of the config file are started again on reload`,
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCtl(cmd, "stop", args...)
+	},
+}
+
+var ctlDisconnectCmd = &cobra.Command{
+	Use:   "disconnect fingerprint...",
+	Short: "Disconnects the sshd clients",
+	Long:  `Disconnects the sshd clients logged in with the public key fingerprints`,
+	Example: `
+  $ rospo ctl disconnect SHA256:uwhOOq0jvqZDWsDXQo2l9GSjRUXmYEcz4yQ7jIE1dYk
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCtl(cmd, "disconnect", args...)
+	},
+}
+
+// runCtl sends the command to the management socket and prints its output
+func runCtl(cmd *cobra.Command, command string, args ...string) {
+	doCtl(cmd, &ctl.Request{Command: command, Args: args})
+}
+
+// doCtl sends the request to the management socket and prints its output,
+// or its data if the json flag is set
+func doCtl(cmd *cobra.Command, req *ctl.Request) {
+	socket, _ := cmd.Flags().GetString("socket")
+	jsonOutput, _ := cmd.Flags().GetBool("json")
+	reply, err := ctl.Do(socket, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if jsonOutput && reply.Data != nil {
+		var out bytes.Buffer
+		json.Indent(&out, reply.Data, "", "  ")
+		fmt.Println(out.String())
+		return
+	}
+	fmt.Print(reply.Output)
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(execCmd)
+
+	cmnflags.AddSshClientFlags(execCmd.Flags())
+	cmnflags.AddAgentForwardingFlags(execCmd.Flags())
+	execCmd.Flags().BoolP("pty", "t", false, "request a pseudo terminal for the remote command")
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [user@]host[:port] -- command [args...]",
+	Short: "Runs a command on the remote host",
+	Long: `Runs a command on the remote host
+
+The remote command stdout and stderr are streamed to the local terminal and
+rospo exits with the remote command exit code. An interrupt (Ctrl-C) without
+--pty sends the remote command a TERM signal and closes the session.
+`,
+	Example: `
+  # lists the remote home directory
+  $ rospo exec user@server:2222 -- ls -la
+
+  # runs top on the remote host inside a pseudo terminal
+  $ rospo exec --pty user@server:2222 -- top
+	`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		requestPty, _ := cmd.Flags().GetBool("pty")
+		command := strings.Join(args[1:], " ")
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		sshcConf.Quiet = true
+		conn := newConnection(sshcConf)
+		go startConnection(cmd.Context(), conn)
+
+		var (
+			code int
+			err  error
+		)
+		if requestPty {
+			remoteShell := sshc.NewRemoteShell(conn)
+			code, err = sshc.ExitCode(remoteShell.Start(command, true))
+		} else {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+			code, err = conn.RunCommand(ctx, command, os.Stdin, os.Stdout, os.Stderr)
+			stop()
+		}
+		conn.Stop()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(code)
+	},
+}
@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/utils"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func init() {
@@ -14,24 +20,82 @@ func init() {
 	usr := utils.CurrentUser()
 	knownHostFile := filepath.Join(usr.HomeDir, ".ssh", "known_hosts")
 	grabpubkeyCmd.PersistentFlags().StringP("known-hosts", "k", knownHostFile, "the known_hosts file absolute path")
+	grabpubkeyCmd.Flags().Bool("hash", false, "if set the hostnames written to the known_hosts file are hashed")
+	grabpubkeyCmd.Flags().Bool("json", false, "if set the keys are printed as json. The known_hosts file is updated only if -k is set too")
+	grabpubkeyCmd.Flags().Bool("dry-run", false, "if set the lines to append are printed and the known_hosts file is not touched")
+	grabpubkeyCmd.Flags().Bool("update", false, "if set the known keys mismatching the grabbed ones, like after a key rotation, are replaced instead of failing")
+	grabpubkeyCmd.Flags().Duration("timeout", 5*time.Second, "the max time to connect to the server and to get each host key")
 }
 
 var grabpubkeyCmd = &cobra.Command{
 	Use:   "grabpubkey host:port",
-	Short: "Grab the host pubkey and put it into the known_hosts file",
-	Long:  `Grab the host pubkey and put it into the known_hosts file`,
+	Short: "Grab the host pubkeys and put them into the known_hosts file",
+	Long: `Grab the host pubkeys and put them into the known_hosts file.
+A key is grabbed for each host key algorithm supported by the server`,
 	Example: `
  # grabs the pubkey from the server at host:port and put it into ./known file
  $ rospo grabpubkey -k ./known host:port
+
+ # prints the host keys as json, without touching the known_hosts file
+ $ rospo grabpubkey --json host:port
+
+ # shows the hashed lines that would be appended to ./known
+ $ rospo grabpubkey --hash --dry-run -k ./known host:port
+
+ # replaces the rotated host keys in ./known
+ $ rospo grabpubkey --update -k ./known host:port
 	`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		hash, _ := cmd.Flags().GetBool("hash")
+		jsonOutput, _ := cmd.Flags().GetBool("json")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		update, _ := cmd.Flags().GetBool("update")
+
 		sshcConf := &sshc.SshClientConf{
-			KnownHosts: knownHosts,
-			ServerURI:  args[0],
+			KnownHosts:     knownHosts,
+			ServerURI:      args[0],
+			ConnectTimeout: timeout,
+		}
+		client := newConnection(sshcConf)
+		keys, err := client.GrabPubKey()
+		var keyErr *knownhosts.KeyError
+		if err != nil && update && errors.As(err, &keyErr) {
+			fmt.Fprintf(os.Stderr, "warning: %s. Replacing the known key\n", err)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if jsonOutput {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(keys)
+			if !cmd.Flags().Changed("known-hosts") {
+				return
+			}
+		} else {
+			for _, k := range keys {
+				fmt.Printf("%s %s %s\n", k.Fingerprint, k.Type, k.Key)
+			}
+		}
+
+		if dryRun {
+			// keeps stdout a valid json document
+			out := os.Stdout
+			if jsonOutput {
+				out = os.Stderr
+			}
+			for _, line := range client.HostKeyLines(keys, hash) {
+				fmt.Fprintf(out, "would append: %s\n", line)
+			}
+			return
+		}
+		if err := client.AddHostKeys(keys, hash); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		client := sshc.NewSshConnection(sshcConf)
-		client.GrabPubKey()
 	},
 }
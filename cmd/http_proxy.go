@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(httpProxyCmd)
+	// sshc options
+	cmnflags.AddSshClientFlags(httpProxyCmd.Flags())
+
+	httpProxyCmd.Flags().StringP("listen-address", "l", "127.0.0.1:3128", "the http proxy listener address")
+}
+
+var httpProxyCmd = &cobra.Command{
+	Use:   "http-proxy [user@]host[:port]",
+	Short: "Starts an HTTP CONNECT proxy",
+	Long: `Starts an HTTP CONNECT proxy
+
+The CONNECT requests destinations are reached through the ssh server, as with
+the SOCKS proxy. Use it with the clients that can't use a SOCKS proxy, setting
+it as their https proxy. The plain http requests are declined.
+	`,
+	Example: `
+  # start an http proxy on 127.0.0.1:3128
+  $ rospo http-proxy sshhost:sshport
+  $ https_proxy=http://127.0.0.1:3128 curl https://internal.example.com
+
+	`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		conn := newConnection(sshcConf)
+		go startConnection(cmd.Context(), conn)
+
+		listenAddress, _ := cmd.Flags().GetString("listen-address")
+
+		gateway := tun.NewHTTPConnectGateway(conn)
+		if err := gateway.Start(listenAddress); err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/ferama/rospo/pkg/utils"
 	"github.com/spf13/cobra"
@@ -14,6 +16,9 @@ func init() {
 	keygenCmd.Flags().BoolP("store", "s", false, "optional store the keys to files")
 	keygenCmd.Flags().StringP("path", "p", ".", "key pair destination path")
 	keygenCmd.Flags().StringP("name", "n", "identity", "output file name")
+	keygenCmd.Flags().StringP("type", "t", utils.KeyAlgorithmEd25519,
+		fmt.Sprintf("the key algorithm. One of: %s", strings.Join(utils.KeyAlgorithms, ", ")))
+	keygenCmd.Flags().Bool("passphrase", false, "asks a passphrase to encrypt the private key, twice to confirm it")
 }
 
 var keygenCmd = &cobra.Command{
@@ -23,24 +28,44 @@ var keygenCmd = &cobra.Command{
 	Example: `
   # generates a key pair an store it into identiy and identity.pub files
   $ rospo keygen -s
+
+  # generates an rsa key pair
+  $ rospo keygen -s -t rsa-4096
+
+  # generates a passphrase protected key pair
+  $ rospo keygen -s --passphrase
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		path, _ := cmd.Flags().GetString("path")
 		name, _ := cmd.Flags().GetString("name")
 		storeKeys, _ := cmd.Flags().GetBool("store")
+		algorithm, _ := cmd.Flags().GetString("type")
+		askPassphrase, _ := cmd.Flags().GetBool("passphrase")
 
-		key, err := utils.GeneratePrivateKey()
+		key, err := utils.GeneratePrivateKey(algorithm, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		publicKey, err := utils.GeneratePublicKey(key.Public())
 		if err != nil {
 			panic(err)
 		}
-		publicKey, err := utils.GeneratePublicKey(&key.PublicKey)
+		var passphrase []byte
+		if askPassphrase {
+			passphrase, err = utils.TerminalNewPassphrasePrompt(filepath.Join(path, name))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		encodedKey, err := utils.EncodePrivateKeyToPEM(key, passphrase)
 		if err != nil {
 			panic(err)
 		}
-		encodedKey := utils.EncodePrivateKeyToPEM(key)
 		if storeKeys {
 			utils.WriteKeyToFile(encodedKey, filepath.Join(path, name))
-			utils.WriteKeyToFile(publicKey, filepath.Join(path, name+".pub"))
+			utils.WritePublicKeyToFile(publicKey, filepath.Join(path, name+".pub"))
 		} else {
 			fmt.Printf("%s", encodedKey)
 			fmt.Printf("%s", publicKey)
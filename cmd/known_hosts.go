@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func init() {
+	rootCmd.AddCommand(knownHostsCmd)
+	knownHostsCmd.AddCommand(knownHostsAddCmd)
+	knownHostsCmd.AddCommand(knownHostsRemoveCmd)
+	knownHostsCmd.AddCommand(knownHostsListCmd)
+	knownHostsCmd.AddCommand(knownHostsVerifyCmd)
+
+	usr := utils.CurrentUser()
+	knownHostFile := filepath.Join(usr.HomeDir, ".ssh", "known_hosts")
+	knownHostsCmd.PersistentFlags().StringP("known-hosts", "k", knownHostFile, "the known_hosts file absolute path")
+	knownHostsAddCmd.Flags().Duration("timeout", 5*time.Second, "the max time to connect to the server and to get each host key")
+}
+
+var knownHostsCmd = &cobra.Command{
+	Use:   "known-hosts",
+	Short: "Manages the known_hosts file entries",
+	Long:  `Manages the known_hosts file entries`,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   func(cmd *cobra.Command, args []string) {},
+}
+
+var knownHostsAddCmd = &cobra.Command{
+	Use:   "add host:port",
+	Short: "Grabs the host pubkey and adds it to the known_hosts file",
+	Long:  `Grabs the host pubkey and adds it to the known_hosts file`,
+	Example: `
+  # adds the server at host:port to the ./known file
+  $ rospo known-hosts add -k ./known host:port
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		client := newConnection(&sshc.SshClientConf{
+			KnownHosts:     knownHosts,
+			ServerURI:      args[0],
+			ConnectTimeout: timeout,
+		})
+		keys, err := client.GrabPubKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := client.AddHostKeys(keys, false); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+var knownHostsRemoveCmd = &cobra.Command{
+	Use:   "remove host[:port]",
+	Short: "Removes the host entries from the known_hosts file",
+	Long: `Removes the host entries from the known_hosts file
+
+If the port is omitted, the host entries for any port are removed.
+`,
+	Example: `
+  # removes all the entries of myserver
+  $ rospo known-hosts remove myserver
+
+  # removes the myserver entries for the port 2222 only
+  $ rospo known-hosts remove myserver:2222
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		if err := utils.RemoveKnownHostEntry(knownHosts, args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
+
+var knownHostsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the known_hosts file entries",
+	Long:  `Lists the known_hosts file entries with their key fingerprints`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		entries, err := utils.ListKnownHostEntries(knownHosts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, e := range entries {
+			hosts := strings.Join(e.Hosts, ",")
+			if e.Marker != "" {
+				hosts = "@" + e.Marker + " " + hosts
+			}
+			fmt.Printf("%s %s %s\n", hosts, e.Key.Type(), e.Fingerprint())
+		}
+	},
+}
+
+var knownHostsVerifyCmd = &cobra.Command{
+	Use:   "verify host:port",
+	Short: "Checks the host pubkey against the known_hosts file ones",
+	Long: `Checks the host pubkey against the known_hosts file ones
+
+Exits with a non zero code if the key is unknown, mismatches or is revoked.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		knownHosts, _ := cmd.Flags().GetString("known-hosts")
+		client := newConnection(&sshc.SshClientConf{
+			KnownHosts: knownHosts,
+			ServerURI:  args[0],
+		})
+		key, err := client.VerifyHostKey()
+		if key == nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		var keyErr *knownhosts.KeyError
+		var revokedErr *knownhosts.RevokedError
+		switch {
+		case err == nil:
+			fmt.Printf("match: %s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+		case errors.As(err, &revokedErr):
+			fmt.Printf("revoked: %s %s (%s:%d)\n", key.Type(), ssh.FingerprintSHA256(key),
+				revokedErr.Revoked.Filename, revokedErr.Revoked.Line)
+			os.Exit(1)
+		case errors.As(err, &keyErr) && len(keyErr.Want) > 0:
+			fmt.Printf("mismatch: the server presented %s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+			for _, k := range keyErr.Want {
+				fmt.Printf("  known: %s %s (%s:%d)\n", k.Key.Type(), ssh.FingerprintSHA256(k.Key), k.Filename, k.Line)
+			}
+			os.Exit(1)
+		case errors.As(err, &keyErr):
+			fmt.Printf("unknown: %s %s is not in %s\n", key.Type(), ssh.FingerprintSHA256(key), knownHosts)
+			os.Exit(1)
+		default:
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ferama/rospo/pkg/ctl"
+	"github.com/ferama/rospo/pkg/monitor"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func init() {
+	rootCmd.AddCommand(monitorCmd)
+
+	monitorCmd.Flags().StringP("socket", "s", ctl.DefaultSocketPath(), "the management socket path of the running rospo (the management_socket config value)")
+	monitorCmd.Flags().Duration("interval", time.Second, "the refresh interval")
+	monitorCmd.Flags().Bool("json-stream", false, "if set a json line with the tunnels is printed at every refresh, instead of the dashboard")
+}
+
+var monitorCmd = &cobra.Command{
+	Use:   "monitor",
+	Short: "Shows the live tunnels statistics of a running rospo instance",
+	Long: `Shows the live tunnels statistics of a running rospo instance, polling its
+management socket. The rows are green if the tunnel is healthy, yellow if it
+is paused or its endpoint dials failed recently and red if it is not connected.
+Press q to quit, s to sort by the next column and f to filter the tunnels by name`,
+	Example: `
+  $ rospo monitor
+  # one json object per line, for the scripts
+  $ rospo monitor --json-stream | jq .tunnels
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		socket, _ := cmd.Flags().GetString("socket")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		jsonStream, _ := cmd.Flags().GetBool("json-stream")
+
+		aggregator := monitor.NewAggregator(monitor.DefaultWindow)
+		poll := func() ([]monitor.Row, error) {
+			reply, err := ctl.Do(socket, &ctl.Request{Command: "list"})
+			if err != nil {
+				return nil, err
+			}
+			stats := []tun.Stats{}
+			if err := json.Unmarshal(reply.Data, &stats); err != nil {
+				return nil, err
+			}
+			return aggregator.Add(time.Now(), stats), nil
+		}
+
+		if jsonStream {
+			monitorJSONStream(poll, interval)
+			return
+		}
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			fmt.Fprintln(os.Stderr, "the dashboard needs a terminal, use --json-stream")
+			os.Exit(1)
+		}
+		monitorDashboard(poll, interval)
+	},
+}
+
+// monitorJSONStream prints the rows as a json line at every interval
+func monitorJSONStream(poll func() ([]monitor.Row, error), interval time.Duration) {
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		rows, err := poll()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		encoder.Encode(map[string]any{
+			"time":    time.Now(),
+			"tunnels": rows,
+		})
+		time.Sleep(interval)
+	}
+}
+
+// monitorDashboard draws the rows at every interval until q is pressed
+func monitorDashboard(poll func() ([]monitor.Row, error), interval time.Duration) {
+	state, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the alternate screen, without the cursor
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		term.Restore(int(os.Stdin.Fd()), state)
+	}()
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			for _, b := range buf[:n] {
+				keys <- b
+			}
+		}
+	}()
+
+	view := monitor.View{}
+	var rows []monitor.Row
+	refresh := func() {
+		var err error
+		if rows, err = poll(); err != nil {
+			rows = nil
+		}
+		view.Err = err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	refresh()
+	for {
+		monitor.Render(os.Stdout, rows, view)
+		select {
+		case <-ticker.C:
+			refresh()
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			if view.EditingFilter {
+				switch key {
+				case '\r', '\n':
+					view.EditingFilter = false
+				case 27: // esc
+					view.EditingFilter = false
+					view.Filter = ""
+				case 127, '\b':
+					if len(view.Filter) > 0 {
+						view.Filter = view.Filter[:len(view.Filter)-1]
+					}
+				default:
+					if key >= ' ' && key < 127 {
+						view.Filter += string(key)
+					}
+				}
+				continue
+			}
+			switch key {
+			case 'q', 3: // ctrl+c
+				return
+			case 's':
+				view.SortColumn = (view.SortColumn + 1) % len(monitor.Columns)
+			case 'f':
+				view.EditingFilter = true
+			}
+		}
+	}
+}
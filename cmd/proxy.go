@@ -35,8 +35,8 @@ the proxy configuration form.
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
-		conn := sshc.NewSshConnection(sshcConf)
-		go conn.Start()
+		conn := newConnection(sshcConf)
+		go startConnection(cmd.Context(), conn)
 
 		listenAddress, _ := cmd.Flags().GetString("listen-address")
 
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().String("speed", "1x", "the playback speed. Example: 2x or 0.5x")
+}
+
+// parseSpeed parses a playback speed like 2x, 0.5x or 2
+func parseSpeed(value string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid speed %q", value)
+	}
+	return speed, nil
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay castfile",
+	Short: "Plays back a session recording",
+	Long: `Plays back in the terminal a session recorded by the sshd record_sessions
+option, at the original speed or at the --speed one`,
+	Example: `
+  $ rospo replay /var/log/rospo/sessions/2024-01-02-15-04-05-abc.cast
+  $ rospo replay --speed 2x session.cast
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		speedFlag, _ := cmd.Flags().GetString("speed")
+		speed, err := parseSpeed(speedFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		if !scanner.Scan() {
+			fmt.Fprintln(os.Stderr, "empty recording")
+			os.Exit(1)
+		}
+		header := sshd.CastHeader{}
+		if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != 2 {
+			fmt.Fprintln(os.Stderr, "not an asciicast v2 recording")
+			os.Exit(1)
+		}
+
+		var last float64
+		for line := 2; scanner.Scan(); line++ {
+			event := sshd.CastEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				fmt.Fprintf(os.Stderr, "line %d: %s\n", line, err)
+				os.Exit(1)
+			}
+			if event.Time > last {
+				time.Sleep(time.Duration((event.Time - last) / speed * float64(time.Second)))
+				last = event.Time
+			}
+			if event.Type == "o" {
+				os.Stdout.WriteString(event.Data)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
@@ -1,9 +1,10 @@
 package cmd
 
 import (
+	"log"
+
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/conf"
-	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/sshd"
 	"github.com/ferama/rospo/pkg/tun"
 	"github.com/spf13/cobra"
@@ -44,8 +45,15 @@ Preliminary checks:
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		sshdConf := cmnflags.GetSshDConf(cmd)
-		s := sshd.NewSshServer(sshdConf)
-		go s.Start()
+		s, err := sshd.NewSshServer(sshdConf)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			if err := s.Start(cmd.Context()); err != nil {
+				log.Fatalln(err)
+			}
+		}()
 
 		remote, _ := cmd.Flags().GetString("remote")
 
@@ -61,9 +69,9 @@ Preliminary checks:
 			},
 		}
 
-		client := sshc.NewSshConnection(config.SshClient)
-		go client.Start()
+		client := newConnection(config.SshClient)
+		go startConnection(cmd.Context(), client)
 
-		tun.NewTunnel(client, config.Tunnel[0], false).Start()
+		tun.NewTunnel(client, config.Tunnel[0], false).Start(cmd.Context())
 	},
 }
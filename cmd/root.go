@@ -1,27 +1,32 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 
 	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/version"
 	"github.com/spf13/cobra"
 )
 
-// Version is the actual rospo version. This value
-// is set during the build process using -ldflags="-X 'github.com/ferama/rospo/cmd.Version=
-var Version = "development"
-
 func init() {
 	rootCmd.PersistentFlags().BoolP("quiet", "q", false, "if set disable all logs")
+	rootCmd.PersistentFlags().String("log-format", logger.FormatText, "the logs format: text or json, one object per line")
 }
 
 var rootCmd = &cobra.Command{
 	Use:     "rospo",
 	Long:    "The tool to create relieable ssh tunnels.",
-	Version: Version,
+	Version: version.Version().Version,
 	Args:    cobra.MinimumNArgs(1),
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		logFormat, _ := cmd.Flags().GetString("log-format")
+		if err := logger.SetFormat(logFormat); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		if quiet, _ := cmd.Flags().GetBool("quiet"); quiet {
 			logger.DisableLoggers()
 		}
@@ -36,3 +41,23 @@ var rootCmd = &cobra.Command{
 func Execute() error {
 	return rootCmd.Execute()
 }
+
+// startConnection starts the ssh connection. rospo exits if the
+// connection gives up reconnecting, instead of waiting for it forever
+func startConnection(ctx context.Context, conn *sshc.SshConnection) {
+	if err := conn.Start(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// newConnection builds the ssh connection. rospo exits if conf is not
+// valid
+func newConnection(conf *sshc.SshClientConf) *sshc.SshConnection {
+	conn, err := sshc.NewSshConnection(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return conn
+}
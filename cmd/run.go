@@ -1,19 +1,27 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 
 	"github.com/ferama/rospo/pkg/conf"
-	"github.com/ferama/rospo/pkg/sshc"
-	"github.com/ferama/rospo/pkg/sshd"
-	"github.com/ferama/rospo/pkg/tun"
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/metrics"
+	"github.com/ferama/rospo/pkg/rospo"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 )
 
 func init() {
 	rootCmd.AddCommand(runCmd)
+
+	runCmd.Flags().String("metrics-addr", "", "if set, exposes the prometheus metrics at the /metrics path on this address. Example: ':9090'")
+	runCmd.Flags().String("api-addr", "", "if set, serves the rest management api on this address, overriding the sshd api_addr. Example: ':8081'")
+	runCmd.Flags().String("dashboard-addr", "", "if set, serves the web dashboard on this address, overriding the dashboard listen_address. Example: ':8090'")
 }
 
 var runCmd = &cobra.Command{
@@ -32,67 +40,41 @@ var runCmd = &cobra.Command{
 		if err != nil {
 			log.Fatalln(err)
 		}
-		somethingRun := false
-
-		var sshConn *sshc.SshConnection
-
-		if conf.SshClient != nil {
-			sshConn = sshc.NewSshConnection(conf.SshClient)
-			go sshConn.Start()
-			somethingRun = true
-		}
-
-		failIfNoClient := func(item string) {
-			if sshConn == nil {
-				log.Fatalf("you need to configure sshclient section to support %s", item)
-			}
-		}
-
-		if conf.SshD != nil {
-			sshServer := sshd.NewSshServer(conf.SshD)
-			go sshServer.Start()
-			somethingRun = true
-		}
-
-		if conf.Tunnel != nil && len(conf.Tunnel) > 0 {
-			for _, c := range conf.Tunnel {
-				if c.SshClientConf != nil {
-					conn := sshc.NewSshConnection(c.SshClientConf)
-					go conn.Start()
-					go tun.NewTunnel(conn, c, false).Start()
-				} else {
-					failIfNoClient("tunnel")
-					go tun.NewTunnel(sshConn, c, false).Start()
-				}
+		if !cmd.Flags().Changed("log-format") {
+			if err := logger.SetFormat(conf.LogFormat); err != nil {
+				log.Fatalln(err)
 			}
 		}
 
-		if conf.SocksProxy != nil {
-			var sockProxy *sshc.SocksProxy
-			if conf.SocksProxy.SshClientConf == nil {
-				failIfNoClient("socks proxy")
-				sockProxy = sshc.NewSocksProxy(sshConn)
-			} else {
-				proxySshConn := sshc.NewSshConnection(conf.SocksProxy.SshClientConf)
-				go proxySshConn.Start()
-				sockProxy = sshc.NewSocksProxy(proxySshConn)
-			}
-			somethingRun = true
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		// a failing metrics endpoint stops rospo like a failing service
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
 
+		var recorder metrics.Recorder = metrics.Nop
+		if metricsAddr, _ := cmd.Flags().GetString("metrics-addr"); metricsAddr != "" {
+			registry := prometheus.NewRegistry()
+			recorder = metrics.NewPrometheus(registry)
 			go func() {
-				err := sockProxy.Start(conf.SocksProxy.ListenAddress)
-				if err != nil {
-					log.Fatal(err)
-				}
+				cancel(fmt.Errorf("metrics endpoint: %w", metrics.Serve(metricsAddr, registry)))
 			}()
 		}
 
-		if somethingRun {
-			c := make(chan os.Signal, 1)
-			signal.Notify(c, os.Interrupt)
-			<-c
-		} else {
-			log.Println("nothing to run")
+		apiAddr, _ := cmd.Flags().GetString("api-addr")
+		dashboardAddr, _ := cmd.Flags().GetString("dashboard-addr")
+		err = rospo.Run(ctx, conf,
+			rospo.WithMetricsRecorder(recorder),
+			rospo.WithConfigFile(args[0]),
+			rospo.WithAPIAddr(apiAddr),
+			rospo.WithDashboardAddr(dashboardAddr))
+		if cause := context.Cause(ctx); err == nil && cause != nil && !errors.Is(cause, context.Canceled) {
+			err = cause
+		}
+		if errors.Is(err, rospo.ErrNothingToRun) {
+			log.Println(err)
+		} else if err != nil {
+			log.Fatal(err)
 		}
 	},
 }
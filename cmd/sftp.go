@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chzyer/readline"
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// the smaller transfers don't show the progress bar
+const sftpProgressMinSize = 1024 * 1024
+
+func init() {
+	rootCmd.AddCommand(sftpCmd)
+
+	cmnflags.AddSshClientFlags(sftpCmd.Flags())
+	sftpCmd.Flags().String("batch", "", "reads the commands from this file instead of the terminal. Use - for stdin")
+}
+
+func sftpProgressBar(name string, size int64) chan int64 {
+	if size < sftpProgressMinSize {
+		return nil
+	}
+	return progressBar(name, size)
+}
+
+// sftpInteractive runs the shell commands read from the terminal, with
+// line editing and history. Ctrl-C clears the line, Ctrl-D ends the session
+func sftpInteractive(shell *sshc.SftpShell) error {
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          shell.Prompt(),
+		InterruptPrompt: "^C",
+		EOFPrompt:       "exit",
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	for {
+		rl.SetPrompt(shell.Prompt())
+		line, err := rl.Readline()
+		if errors.Is(err, readline.ErrInterrupt) {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = shell.Exec(line)
+		if errors.Is(err, sshc.ErrSftpExit) {
+			return nil
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+var sftpCmd = &cobra.Command{
+	Use:   "sftp [user@]host[:port]",
+	Short: "Starts an interactive sftp session",
+	Long: `Starts an interactive sftp session
+
+The commands are the OpenSSH sftp client ones: cd, lcd, pwd, lpwd, ls, lls,
+get, put, mkdir, rmdir, rm and exit. The remote and local paths can contain
+wildcards. Type help in the session for the details.
+With --batch the commands are read from a file: the execution stops on the
+first failed command, unless its line starts with -.
+The remote host needs the sftp subsystem to be enabled.
+`,
+	Example: `
+  # starts an interactive session
+  $ rospo sftp user@myserver:2222
+
+  # downloads all the remote logs running the commands in a script
+  $ cat script.sftp
+  cd /var/log
+  get *.log
+  $ rospo sftp --batch script.sftp user@myserver:2222
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		batch, _ := cmd.Flags().GetString("batch")
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		sshcConf.Quiet = true
+		conn := newConnection(sshcConf)
+		go startConnection(cmd.Context(), conn)
+
+		var progress sshc.ProgressFunc
+		if term.IsTerminal(int(os.Stdout.Fd())) {
+			progress = sftpProgressBar
+		}
+		transfer, err := sshc.NewSftpTransfer(conn, progress)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer transfer.Close()
+
+		shell, err := sshc.NewSftpShell(transfer, os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		switch {
+		case batch == "-" || (batch == "" && !term.IsTerminal(int(os.Stdin.Fd()))):
+			err = shell.RunBatch(os.Stdin)
+		case batch != "":
+			var f *os.File
+			f, err = os.Open(batch)
+			if err == nil {
+				err = shell.RunBatch(f)
+				f.Close()
+			}
+		default:
+			err = sftpInteractive(shell)
+		}
+		if err != nil {
+			transfer.Close()
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	},
+}
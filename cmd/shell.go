@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"context"
+	"log"
+	"os"
 	"strings"
 
 	"github.com/ferama/rospo/cmd/cmnflags"
@@ -12,19 +15,54 @@ func init() {
 	rootCmd.AddCommand(shellCmd)
 
 	cmnflags.AddSshClientFlags(shellCmd.Flags())
+	cmnflags.AddBindAddressFlag(shellCmd.Flags())
+	cmnflags.AddAgentForwardingFlags(shellCmd.Flags())
+	shellCmd.Flags().StringP("command", "c", "", "runs this command with the local stdio instead of the interactive shell")
 }
 
 var shellCmd = &cobra.Command{
 	Use:   "shell [user@]host[:port] [cmd_string]",
 	Short: "Starts a remote shell",
-	Long:  "Starts a remote shell",
-	Args:  cobra.MinimumNArgs(1),
+	Long: `Starts a remote shell
+
+The shell runs inside a pseudo terminal sized as the local one and following
+its resizes. The local TERM is forwarded and rospo exits with the remote
+shell exit code.
+With --command a single command runs without the pseudo terminal, using the
+local stdin, stdout and stderr.
+`,
+	Example: `
+  # starts an interactive shell
+  $ rospo shell user@server:2222
+
+  # runs a command, piping a local file to its stdin
+  $ rospo shell --command "wc -l" user@server:2222 < file.txt
+	`,
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		command, _ := cmd.Flags().GetString("command")
+
 		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
-		conn := sshc.NewSshConnection(sshcConf)
-		go conn.Start()
+		if command != "" {
+			sshcConf.Quiet = true
+		}
+		conn := newConnection(sshcConf)
+		go startConnection(cmd.Context(), conn)
 
-		remoteShell := sshc.NewRemoteShell(conn)
-		remoteShell.Start(strings.Join(args[1:], " "), true)
+		var (
+			code int
+			err  error
+		)
+		if command != "" {
+			code, err = conn.RunCommand(context.Background(), command, os.Stdin, os.Stdout, os.Stderr)
+		} else {
+			remoteShell := sshc.NewRemoteShell(conn)
+			code, err = sshc.ExitCode(remoteShell.Start(strings.Join(args[1:], " "), true))
+		}
+		conn.Stop()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		os.Exit(code)
 	},
 }
@@ -1,7 +1,13 @@
 package cmd
 
 import (
+	"log"
+	"os"
+
 	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/api"
+	"github.com/ferama/rospo/pkg/health"
+	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/sshd"
 
 	"github.com/spf13/cobra"
@@ -12,6 +18,10 @@ func init() {
 
 	cmnflags.AddSshDFlags(sshdCmd.Flags())
 	sshdCmd.Flags().BoolP("disable-shell", "D", false, "if set disable shell/exec")
+	sshdCmd.Flags().String("health-addr", "", "if set, serves the /healthz and /readyz probes on this address. Example: ':8080'")
+	sshdCmd.Flags().String("api-addr", "", "if set, serves the rest management api on this address. The bearer token is read from the ROSPO_API_TOKEN env var. Example: ':8081'")
+	sshdCmd.Flags().Int("buffer-size", rio.DefaultBufferSize, "the forwards copy buffer size in bytes. Bigger buffers help on the high bandwidth-delay links, at the cost of more memory per connection")
+	sshdCmd.Flags().Duration("forward-stats-interval", 0, "if set, logs a summary of every active reverse forward at this interval. Example: 1m")
 }
 
 var sshdCmd = &cobra.Command{
@@ -22,6 +32,35 @@ var sshdCmd = &cobra.Command{
 		disableShell, _ := cmd.Flags().GetBool("disable-shell")
 		config := cmnflags.GetSshDConf(cmd)
 		config.DisableShell = disableShell
-		sshd.NewSshServer(config).Start()
+		config.HealthAddr, _ = cmd.Flags().GetString("health-addr")
+		config.ForwardStatsInterval, _ = cmd.Flags().GetDuration("forward-stats-interval")
+		config.APIAddr, _ = cmd.Flags().GetString("api-addr")
+		config.BufferSize, _ = cmd.Flags().GetInt("buffer-size")
+		config.APIToken = os.Getenv("ROSPO_API_TOKEN")
+
+		sshServer, err := sshd.NewSshServer(config)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		healthServer := health.NewServer(config.HealthAddr)
+		healthServer.AddCheck("sshd", health.ListenerCheck(sshServer))
+		if config.HealthAddr != "" {
+			go func() {
+				if err := healthServer.Start(); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+		if config.APIAddr != "" {
+			apiServer := api.NewServer(config.APIAddr, config.APIToken, nil, sshServer, healthServer)
+			go func() {
+				if err := apiServer.Start(); err != nil {
+					log.Fatal(err)
+				}
+			}()
+		}
+		if err := sshServer.Start(cmd.Context()); err != nil {
+			log.Fatalln(err)
+		}
 	},
 }
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/diag"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(testCmd)
+
+	cmnflags.AddSshClientFlags(testCmd.Flags())
+	testCmd.Flags().Bool("json", false, "if set the checks results are printed as json")
+}
+
+var testCmd = &cobra.Command{
+	Use:   "test [user@]host[:port]",
+	Short: "Checks the connectivity with an ssh server step by step",
+	Long: `Checks the connectivity with an ssh server step by step
+
+The checks are: the TCP reachability, the ssh banner exchange, the
+authentication, a reverse tunnel opening and a data round trip through it.
+The checks after a failed one are skipped. The exit code is 1 if a check
+failed.
+`,
+	Example: `
+  # checks that the tunnels to myserver can work
+  $ rospo test user@myserver:2222
+
+  # prints the results as json
+  $ rospo test --json user@myserver:2222
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
+		report, err := diag.Run(cmd.Context(), sshcConf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if asJSON {
+			json.NewEncoder(os.Stdout).Encode(report)
+		} else {
+			fmt.Printf("testing %s\n", report.Server)
+			for _, step := range report.Steps {
+				fmt.Printf("  %-8s %-4s %6dms", step.Name, step.Status, step.Millis)
+				if step.Detail != "" {
+					fmt.Printf("  %s", step.Detail)
+				}
+				fmt.Println()
+				if step.Error != "" {
+					fmt.Printf("           error: %s\n", step.Error)
+				}
+			}
+		}
+		if !report.OK {
+			os.Exit(1)
+		}
+	},
+}
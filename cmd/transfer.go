@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/cmd/cmnflags"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// the get, put and copy exit codes
+const (
+	transferExitFailed  = 1
+	transferExitAuth    = 2
+	transferExitConnect = 255
+)
+
+// addTransferFlags adds the get, put and copy flags
+func addTransferFlags(cmd *cobra.Command) {
+	cmnflags.AddSshClientFlags(cmd.Flags())
+	cmd.Flags().BoolP("recursive", "r", false, "if the copy should be recursive")
+	cmd.Flags().IntP("port", "P", 22, "the remote server port")
+	cmd.Flags().Bool("preserve", false, "preserves the files permissions and modification times")
+	cmd.Flags().Bool("resume", false, "completes the partially transferred files, comparing the sizes")
+	cmd.Flags().String("bwlimit", "", "the max transfer rate in bytes per second, with an optional k, M or G suffix. Example: '500k'")
+}
+
+// transferExit prints err and exits with code
+func transferExit(code int, err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(code)
+}
+
+// startTransfer connects to the server and starts the sftp session of the
+// get, put and copy commands. It exits if the connection fails, with distinct
+// codes for the authentication failures
+func startTransfer(cmd *cobra.Command, server string) (*sshc.SshConnection, *sshc.SftpTransfer) {
+	port, _ := cmd.Flags().GetInt("port")
+	preserve, _ := cmd.Flags().GetBool("preserve")
+	resume, _ := cmd.Flags().GetBool("resume")
+	bwlimit, _ := cmd.Flags().GetString("bwlimit")
+	var bandwidthLimit int64
+	if bwlimit != "" {
+		var err error
+		bandwidthLimit, err = utils.ParseByteCount(bwlimit)
+		if err != nil {
+			transferExit(transferExitFailed, fmt.Errorf("invalid --bwlimit: %s", err))
+		}
+	}
+
+	sshcConf := cmnflags.GetSshClientConf(cmd, fmt.Sprintf("%s:%d", server, port))
+	sshcConf.Quiet = true
+	// a failed connection is reported, not retried
+	if sshcConf.MaxReconnectAttempts == 0 {
+		sshcConf.MaxReconnectAttempts = 1
+	}
+	conn := newConnection(sshcConf)
+	if err := conn.ConnectWithContext(cmd.Context()); err != nil {
+		if sshc.IsAuthError(err) {
+			transferExit(transferExitAuth, err)
+		}
+		transferExit(transferExitConnect, err)
+	}
+
+	var progress sshc.ProgressFunc
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		progress = progressBar
+	}
+	transfer, err := sshc.NewSftpTransfer(conn, progress)
+	if err != nil {
+		conn.Stop()
+		transferExit(transferExitFailed, err)
+	}
+	transfer.SetPreserve(preserve)
+	transfer.SetResume(resume)
+	transfer.SetBandwidthLimit(bandwidthLimit)
+	return conn, transfer
+}
@@ -9,6 +9,7 @@ func init() {
 	rootCmd.AddCommand(tunCmd)
 
 	cmnflags.AddSshClientFlags(tunCmd.PersistentFlags())
+	cmnflags.AddBindAddressFlag(tunCmd.PersistentFlags())
 
 	tunCmd.PersistentFlags().StringP("local", "l", "127.0.0.1:2222", "the local tunnel endpoint")
 	tunCmd.PersistentFlags().StringP("remote", "r", "127.0.0.1:2222", "the remote tunnel endpoint")
@@ -1,9 +1,10 @@
 package cmd
 
 import (
+	"log"
+
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/conf"
-	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/tun"
 
 	"github.com/spf13/cobra"
@@ -11,6 +12,10 @@ import (
 
 func init() {
 	tunCmd.AddCommand(tunForwardCmd)
+
+	tunForwardCmd.Flags().String("tls-cert", "", "if set with --tls-key, the local listener terminates TLS with this certificate")
+	tunForwardCmd.Flags().String("tls-key", "", "the TLS termination certificate key")
+	tunForwardCmd.Flags().String("tls-client-ca", "", "if set, the TLS clients must present a certificate signed by one of this file CAs")
 }
 
 var tunForwardCmd = &cobra.Command{
@@ -26,26 +31,38 @@ Preliminary checks:
 	Example: `
   # Forwards the local 8080 port to the remote 8080 
   $ rospo tun forward -l :8080 -r :8080 user@server:port
+
+  # Exposes the remote plain http 8080 port as https on the local 8443
+  $ rospo tun forward -l :8443 -r :8080 --tls-cert web.crt --tls-key web.key user@server:port
 	`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		local, _ := cmd.Flags().GetString("local")
 		remote, _ := cmd.Flags().GetString("remote")
+		tlsCert, _ := cmd.Flags().GetString("tls-cert")
+		tlsKey, _ := cmd.Flags().GetString("tls-key")
+		tlsClientCA, _ := cmd.Flags().GetString("tls-client-ca")
 
 		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
 		config := &conf.Config{
 			SshClient: sshcConf,
 			Tunnel: []*tun.TunnelConf{
 				{
-					Remote:  remote,
-					Local:   local,
-					Forward: true,
+					Remote:      remote,
+					Local:       local,
+					Forward:     true,
+					TLSCert:     tlsCert,
+					TLSKey:      tlsKey,
+					TLSClientCA: tlsClientCA,
 				},
 			},
 		}
+		if err := config.Tunnel[0].Validate(); err != nil {
+			log.Fatalln(err)
+		}
 
-		client := sshc.NewSshConnection(config.SshClient)
-		go client.Start()
-		tun.NewTunnel(client, config.Tunnel[0], false).Start()
+		client := newConnection(config.SshClient)
+		go startConnection(cmd.Context(), client)
+		tun.NewTunnel(client, config.Tunnel[0], false).Start(cmd.Context())
 	},
 }
@@ -3,7 +3,6 @@ package cmd
 import (
 	"github.com/ferama/rospo/cmd/cmnflags"
 	"github.com/ferama/rospo/pkg/conf"
-	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/tun"
 
 	"github.com/spf13/cobra"
@@ -11,6 +10,10 @@ import (
 
 func init() {
 	tunCmd.AddCommand(tunReverseCmd)
+
+	tunReverseCmd.Flags().Int("bind-retries", tun.DefaultBindRetries, "how many times the remote listener request is retried if the server denies it. -1 disables the retries")
+	tunReverseCmd.Flags().Duration("bind-retry-delay", tun.DefaultBindRetryDelay, "the delay between the remote listener request retries")
+	tunReverseCmd.Flags().String("local-bind-address", "", "the ip address or interface name the local endpoint is dialed from")
 }
 
 var tunReverseCmd = &cobra.Command{
@@ -32,23 +35,29 @@ Preliminary checks:
 	Run: func(cmd *cobra.Command, args []string) {
 		local, _ := cmd.Flags().GetString("local")
 		remote, _ := cmd.Flags().GetString("remote")
+		bindRetries, _ := cmd.Flags().GetInt("bind-retries")
+		bindRetryDelay, _ := cmd.Flags().GetDuration("bind-retry-delay")
+		localBindAddress, _ := cmd.Flags().GetString("local-bind-address")
 
 		sshcConf := cmnflags.GetSshClientConf(cmd, args[0])
 		config := &conf.Config{
 			SshClient: sshcConf,
 			Tunnel: []*tun.TunnelConf{
 				{
-					Remote:  remote,
-					Local:   local,
-					Forward: false,
+					Remote:           remote,
+					Local:            local,
+					Forward:          false,
+					BindRetries:      bindRetries,
+					BindRetryDelay:   bindRetryDelay,
+					LocalBindAddress: localBindAddress,
 				},
 			},
 		}
 
-		client := sshc.NewSshConnection(config.SshClient)
-		go client.Start()
+		client := newConnection(config.SshClient)
+		go startConnection(cmd.Context(), client)
 		// I can easily run multiple tunnels in their respective
 		// go routine here using the same client
-		tun.NewTunnel(client, config.Tunnel[0], false).Start()
+		tun.NewTunnel(client, config.Tunnel[0], false).Start(cmd.Context())
 	},
 }
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/pkg/version"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(versionCmd)
+
+	versionCmd.Flags().Bool("json", false, "if set the build info is printed as json")
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Prints the version and the build info",
+	Long:  "Prints the version, the git commit, the build date, the go toolchain version and the module build info",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		info := version.Version()
+		if asJSON {
+			json.NewEncoder(os.Stdout).Encode(info)
+			return
+		}
+		fmt.Printf("rospo %s\n", info.Version)
+		fmt.Printf("  commit:     %s\n", info.Commit)
+		fmt.Printf("  build date: %s\n", info.BuildDate)
+		fmt.Printf("  go:         %s %s\n", info.GoVersion, info.Platform)
+		fmt.Printf("  module:     %s\n", info.BuildInfo)
+	},
+}
@@ -0,0 +1,285 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+// the api paths prefix
+const prefix = "/api/v1"
+
+// ErrNotFound is returned by the TunnelManager when the tunnel
+// doesn't exist
+var ErrNotFound = errors.New("not found")
+
+// TunnelManager is the tunnels manager as seen by the api
+type TunnelManager interface {
+	Tunnels() []tun.Stats
+	Add(conf *tun.TunnelConf) (tun.Stats, error)
+	// Remove stops the tunnels named name. It returns an error wrapping
+	// ErrNotFound if there isn't any
+	Remove(name string) error
+}
+
+// SSHServer is the sshd server as seen by the api
+type SSHServer interface {
+	GetConnectedClients() []sshd.ConnectedClient
+	// DisconnectClient closes the connections of the clients logged in
+	// with the fingerprint and returns how many were closed
+	DisconnectClient(fingerprint string) int
+}
+
+// Checker runs the readiness checks. The passed ones map to nil
+type Checker interface {
+	Check() map[string]error
+}
+
+// Status is the GET /api/v1/status reply
+type Status struct {
+	Ready bool `json:"ready"`
+	// the checks results: "ok" or the failure reason
+	Checks map[string]string `json:"checks"`
+}
+
+// Server serves the rest management api. All the requests need the
+// "Authorization: Bearer <token>" header
+type Server struct {
+	token string
+
+	tunnels   TunnelManager
+	sshServer SSHServer
+	checker   Checker
+
+	httpServer *http.Server
+	listener   net.Listener
+	listenerMU sync.RWMutex
+
+	log *slog.Logger
+}
+
+// NewServer builds an api server that will listen on addr. The
+// components that are nil are reported as not configured
+func NewServer(addr string, token string, tunnels TunnelManager, sshServer SSHServer, checker Checker, opts ...Option) *Server {
+	o := options.Build(opts)
+	s := &Server{
+		token:     token,
+		tunnels:   tunnels,
+		sshServer: sshServer,
+		checker:   checker,
+		log:       o.Logger.With("subsystem", "api"),
+	}
+	s.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+	return s
+}
+
+// Handler returns the http handler serving the api
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+"/tunnels", s.tunnelsHandler)
+	mux.HandleFunc(prefix+"/tunnels/", s.tunnelHandler)
+	mux.HandleFunc(prefix+"/sshd/clients", s.clientsHandler)
+	mux.HandleFunc(prefix+"/sshd/clients/", s.clientHandler)
+	mux.HandleFunc(prefix+"/status", s.statusHandler)
+	return s.authenticate(mux)
+}
+
+// authenticate rejects the requests without the bearer token
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rospo"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// allowMethod replies 405 if the request method is not method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	return true
+}
+
+// GET lists the tunnels, POST adds one
+func (s *Server) tunnelsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.tunnels == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tunnels not available"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.tunnels.Tunnels())
+	case http.MethodPost:
+		conf := &tun.TunnelConf{}
+		if err := json.NewDecoder(r.Body).Decode(conf); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid tunnel: %w", err))
+			return
+		}
+		if err := conf.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		// the tunnels are removed by name
+		for _, t := range s.tunnels.Tunnels() {
+			if t.Name == conf.GetName() {
+				writeError(w, http.StatusConflict, fmt.Errorf("tunnel %q already exists", t.Name))
+				return
+			}
+		}
+		stats, err := s.tunnels.Add(conf)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.log.Info("tunnel added", "tunnel_name", stats.Name)
+		writeJSON(w, http.StatusCreated, stats)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// DELETE /tunnels/{name} stops the tunnel
+func (s *Server) tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	if s.tunnels == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("tunnels not available"))
+		return
+	}
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, prefix+"/tunnels/")
+	if err := s.tunnels.Remove(name); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err)
+		return
+	}
+	s.log.Info("tunnel removed", "tunnel_name", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET lists the sshd clients
+func (s *Server) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sshServer == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("sshd not configured"))
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.sshServer.GetConnectedClients())
+}
+
+// POST /sshd/clients/{fp}/disconnect kicks the clients logged in with
+// the fingerprint. The fingerprint can contain slashes
+func (s *Server) clientHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sshServer == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("sshd not configured"))
+		return
+	}
+	fp, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, prefix+"/sshd/clients/"), "/disconnect")
+	if !ok || fp == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	n := s.sshServer.DisconnectClient(fp)
+	if n == 0 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no client logged in with %s", fp))
+		return
+	}
+	s.log.Info("clients disconnected", "fingerprint", fp, "count", n)
+	writeJSON(w, http.StatusOK, map[string]int{"disconnected": n})
+}
+
+// GET reports the readiness checks
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := Status{Ready: true, Checks: map[string]string{}}
+	if s.checker != nil {
+		for name, err := range s.checker.Check() {
+			if err != nil {
+				status.Ready = false
+				status.Checks[name] = err.Error()
+			} else {
+				status.Checks[name] = "ok"
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Start listens for the api requests. It blocks until the server fails
+// or it is stopped. In the latter case nil is returned
+func (s *Server) Start() error {
+	if s.token == "" {
+		return fmt.Errorf("the api needs a token")
+	}
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	s.listenerMU.Lock()
+	s.listener = listener
+	s.listenerMU.Unlock()
+
+	s.log.Info("api listening", "addr", listener.Addr().String())
+	err = s.httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Stop closes the server listener
+func (s *Server) Stop() error {
+	return s.httpServer.Close()
+}
+
+// GetListenerAddr returns the server listener address. nil if the
+// server is not listening
+func (s *Server) GetListenerAddr() net.Addr {
+	s.listenerMU.RLock()
+	defer s.listenerMU.RUnlock()
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
+	return nil
+}
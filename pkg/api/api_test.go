@@ -0,0 +1,280 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+const token = "secret"
+
+type fakeTunnelManager struct {
+	mu      sync.Mutex
+	tunnels []tun.Stats
+}
+
+func (f *fakeTunnelManager) Tunnels() []tun.Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]tun.Stats{}, f.tunnels...)
+}
+
+func (f *fakeTunnelManager) Add(conf *tun.TunnelConf) (tun.Stats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := tun.Stats{Name: conf.GetName(), Forward: conf.Forward, State: tun.StateConnecting}
+	f.tunnels = append(f.tunnels, stats)
+	return stats, nil
+}
+
+func (f *fakeTunnelManager) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, t := range f.tunnels {
+		if t.Name == name {
+			f.tunnels = append(f.tunnels[:i], f.tunnels[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: tunnel %s", ErrNotFound, name)
+}
+
+type fakeSSHServer struct {
+	clients []sshd.ConnectedClient
+}
+
+func (f *fakeSSHServer) GetConnectedClients() []sshd.ConnectedClient {
+	return f.clients
+}
+
+func (f *fakeSSHServer) DisconnectClient(fingerprint string) int {
+	n := 0
+	for _, c := range f.clients {
+		if c.Fingerprint == fingerprint {
+			n++
+		}
+	}
+	return n
+}
+
+type fakeChecker map[string]error
+
+func (f fakeChecker) Check() map[string]error {
+	return f
+}
+
+func newTestServer(t *testing.T, tunnels TunnelManager, sshServer SSHServer, checker Checker) *httptest.Server {
+	s := NewServer("", token, tunnels, sshServer, checker)
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(data)
+}
+
+func TestAuthentication(t *testing.T) {
+	ts := newTestServer(t, &fakeTunnelManager{}, nil, nil)
+
+	for _, header := range []string{"", "Bearer wrong", "Basic " + token, token} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/status", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%q: expected 401, got %d", header, res.StatusCode)
+		}
+		if res.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("%q: missing WWW-Authenticate header", header)
+		}
+	}
+
+	if status, _ := do(t, http.MethodGet, ts.URL+"/api/v1/status", ""); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+}
+
+func TestTunnels(t *testing.T) {
+	tunnels := &fakeTunnelManager{}
+	ts := newTestServer(t, tunnels, nil, nil)
+	url := ts.URL + "/api/v1/tunnels"
+
+	status, body := do(t, http.MethodGet, url, "")
+	if status != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Fatalf("unexpected list reply: %d %s", status, body)
+	}
+
+	status, body = do(t, http.MethodPost, url, `{"name": "web", "local": ":8080", "remote": "localhost:80", "forward": true}`)
+	if status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d %s", status, body)
+	}
+	var stats tun.Stats
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Name != "web" || !stats.Forward {
+		t.Fatalf("unexpected added tunnel: %+v", stats)
+	}
+
+	status, _ = do(t, http.MethodPost, url, `{"name": "web", "local": ":8081", "remote": "localhost:81"}`)
+	if status != http.StatusConflict {
+		t.Fatalf("expected 409 on duplicated name, got %d", status)
+	}
+	status, _ = do(t, http.MethodPost, url, `{"name": "nolocal", "remote": "localhost:81"}`)
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected 400 on missing local, got %d", status)
+	}
+	status, _ = do(t, http.MethodPost, url, `{not json`)
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected 400 on invalid json, got %d", status)
+	}
+
+	status, body = do(t, http.MethodGet, url, "")
+	var list []tun.Stats
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(list) != 1 || list[0].Name != "web" {
+		t.Fatalf("unexpected list reply: %d %s", status, body)
+	}
+
+	status, _ = do(t, http.MethodDelete, url+"/web", "")
+	if status != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", status)
+	}
+	status, _ = do(t, http.MethodDelete, url+"/web", "")
+	if status != http.StatusNotFound {
+		t.Fatalf("expected 404 on missing tunnel, got %d", status)
+	}
+	if len(tunnels.Tunnels()) != 0 {
+		t.Fatalf("the tunnel wasn't removed")
+	}
+
+	status, _ = do(t, http.MethodPut, url, "")
+	if status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", status)
+	}
+	status, _ = do(t, http.MethodGet, url+"/web", "")
+	if status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", status)
+	}
+}
+
+func TestSSHDClients(t *testing.T) {
+	fp := "SHA256:abc/def+ghi"
+	sshServer := &fakeSSHServer{clients: []sshd.ConnectedClient{
+		{RemoteAddr: "127.0.0.1:1234", User: "rospo", Fingerprint: fp},
+	}}
+	ts := newTestServer(t, nil, sshServer, nil)
+	url := ts.URL + "/api/v1/sshd/clients"
+
+	status, body := do(t, http.MethodGet, url, "")
+	var clients []sshd.ConnectedClient
+	if err := json.Unmarshal([]byte(body), &clients); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || len(clients) != 1 || clients[0].Fingerprint != fp {
+		t.Fatalf("unexpected clients reply: %d %s", status, body)
+	}
+
+	status, body = do(t, http.MethodPost, url+"/"+fp+"/disconnect", "")
+	if status != http.StatusOK || !strings.Contains(body, `"disconnected":1`) {
+		t.Fatalf("unexpected disconnect reply: %d %s", status, body)
+	}
+	status, _ = do(t, http.MethodPost, url+"/SHA256:missing/disconnect", "")
+	if status != http.StatusNotFound {
+		t.Fatalf("expected 404 on unknown fingerprint, got %d", status)
+	}
+	status, _ = do(t, http.MethodGet, url+"/"+fp+"/disconnect", "")
+	if status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", status)
+	}
+
+	// no tunnels manager
+	status, _ = do(t, http.MethodGet, ts.URL+"/api/v1/tunnels", "")
+	if status != http.StatusNotFound {
+		t.Fatalf("expected 404 without tunnels, got %d", status)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	checker := fakeChecker{"sshd": nil, "tunnel 0": errors.New("not active")}
+	ts := newTestServer(t, nil, nil, checker)
+
+	status, body := do(t, http.MethodGet, ts.URL+"/api/v1/status", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	var s Status
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Ready || s.Checks["sshd"] != "ok" || s.Checks["tunnel 0"] != "not active" {
+		t.Fatalf("unexpected status: %+v", s)
+	}
+
+	delete(checker, "tunnel 0")
+	_, body = do(t, http.MethodGet, ts.URL+"/api/v1/status", "")
+	if err := json.Unmarshal([]byte(body), &s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Ready {
+		t.Fatalf("expected ready: %+v", s)
+	}
+}
+
+func TestStart(t *testing.T) {
+	s := NewServer("127.0.0.1:0", "", nil, nil, nil)
+	if err := s.Start(); err == nil {
+		t.Fatal("expected an error without token")
+	}
+
+	s = NewServer("127.0.0.1:0", token, nil, nil, nil)
+	done := make(chan error)
+	go func() {
+		done <- s.Start()
+	}()
+	for s.GetListenerAddr() == nil {
+		select {
+		case err := <-done:
+			t.Fatal(err)
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	status, _ := do(t, http.MethodGet, fmt.Sprintf("http://%s/api/v1/status", s.GetListenerAddr()), "")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	s.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,15 @@
+package api
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+)
+
+// Option configures the api server
+type Option = options.Option
+
+// WithLogger sets the api server logger
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
@@ -3,6 +3,7 @@ package conf
 import (
 	"os"
 
+	"github.com/ferama/rospo/pkg/dashboard"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/sshd"
 	"github.com/ferama/rospo/pkg/tun"
@@ -15,6 +16,21 @@ type Config struct {
 	Tunnel     []*tun.TunnelConf    `yaml:"tunnel"`
 	SshD       *sshd.SshDConf       `yaml:"sshd"`
 	SocksProxy *sshc.SocksProxyConf `yaml:"socksproxy"`
+	// the local http CONNECT proxy
+	HTTPProxy *tun.HTTPConnectConf `yaml:"httpproxy"`
+	// if set, the /healthz and /readyz probes are served on this
+	// address. Example: ":8080"
+	HealthAddr string `yaml:"health_addr"`
+	// if set, the management commands (rospo ctl) are served on this
+	// unix socket path. See ctl.DefaultSocketPath for the rospo ctl
+	// default one
+	ManagementSocket string `yaml:"management_socket"`
+	// if set, a web page listing the tunnels and the ssh connections
+	// status is served
+	Dashboard *dashboard.Conf `yaml:"dashboard"`
+	// the logs format: text (the default) or json. The --log-format flag
+	// takes precedence
+	LogFormat string `yaml:"log_format"`
 }
 
 // LoadConfig parses the [config].yaml file and loads its values
@@ -26,12 +42,7 @@ func LoadConfig(filePath string) (*Config, error) {
 	}
 	defer f.Close()
 
-	cfg := Config{
-		nil,
-		nil,
-		nil,
-		nil,
-	}
+	cfg := Config{}
 
 	decoder := yaml.NewDecoder(f)
 	err = decoder.Decode(&cfg)
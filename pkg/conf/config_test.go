@@ -1,6 +1,8 @@
 package conf
 
 import (
+	"encoding/json"
+	"errors"
 	"path/filepath"
 	"testing"
 )
@@ -78,3 +80,83 @@ func TestFailOnNonExistendUnparsableConf(t *testing.T) {
 		t.Fatalf("should fail on not parsable conf")
 	}
 }
+
+func TestSshcIdentities(t *testing.T) {
+	path := filepath.Join("testdata", "sshc.yaml")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("can't parse config")
+	}
+	if len(cfg.SshClient.Identity) != 1 || cfg.SshClient.Identity[0] != "~/.ssh/id_rsa" {
+		t.Fatalf("unexpected identity %v", cfg.SshClient.Identity)
+	}
+
+	path = filepath.Join("testdata", "sshc_identities.yaml")
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatalf("can't parse config: %s", err)
+	}
+	identities := cfg.SshClient.Identity
+	if len(identities) != 2 || identities[0] != "~/.ssh/id_ed25519" || identities[1] != "~/.ssh/id_rsa" {
+		t.Fatalf("unexpected identities %v", identities)
+	}
+	jhIdentity := cfg.SshClient.JumpHosts[0].Identity
+	if len(jhIdentity) != 1 || jhIdentity[0] != "~/.ssh/id_jump" {
+		t.Fatalf("unexpected jump host identity %v", jhIdentity)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := LoadConfig(filepath.Join("testdata", "sshd.yaml"))
+	if err != nil {
+		t.Fatalf("can't parse config")
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %s", err)
+	}
+
+	cfg, err = LoadConfig(filepath.Join("testdata", "invalid.yaml"))
+	if err != nil {
+		t.Fatalf("can't parse config")
+	}
+	err = cfg.Validate()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+	expected := []string{
+		"sshclient.server",
+		"sshclient.ciphers",
+		"sshclient.proxy",
+		"sshclient.compression_level",
+		"sshclient.keep_alive_max_misses",
+		"tunnel[0].local",
+		"tunnel[0].bind_retries",
+		"tunnel[0].tls_cert",
+		"sshd.server_key",
+		"sshd.server_key_type",
+		"sshd.allowed_commands",
+		"sshd.totp_secrets_file",
+		"sshd.authorized_password",
+		"sshd.login_grace_time",
+		"sshd.client_alive_count_max",
+		"log_format",
+		"dashboard.password",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("unexpected errors %+v", errs)
+	}
+	for i, field := range expected {
+		if errs[i].Field != field {
+			t.Fatalf("expected error %d on %s, got %+v", i, field, errs[i])
+		}
+	}
+	if errs[0].Message != "port out of range" {
+		t.Fatalf("unexpected message %q", errs[0].Message)
+	}
+
+	data, _ := json.Marshal(errs[:1])
+	if string(data) != `[{"field":"sshclient.server","message":"port out of range"}]` {
+		t.Fatalf("unexpected json %s", data)
+	}
+}
@@ -0,0 +1,221 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/rio"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// FieldError is a config value validation error
+type FieldError struct {
+	// the yaml path of the value. Example: "tunnel[0].remote"
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationErrors are all the errors found validating a config
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks the config values without starting anything. It returns
+// ValidationErrors listing all the invalid values, nil if the config is
+// valid
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if c.SshClient == nil && c.SshD == nil && len(c.Tunnel) == 0 && c.SocksProxy == nil && c.HTTPProxy == nil {
+		v.add("", "nothing to run: configure at least one of sshclient, sshd, tunnel, socksproxy and httpproxy")
+	}
+	if c.SshClient != nil {
+		v.sshClient("sshclient", c.SshClient)
+	}
+	for i, t := range c.Tunnel {
+		field := fmt.Sprintf("tunnel[%d]", i)
+		v.tunnel(field, t)
+		if t.SshClientConf != nil {
+			v.sshClient(field+".sshclient", t.SshClientConf)
+		} else if c.SshClient == nil {
+			v.add(field+".sshclient", "you need to configure sshclient section to support tunnel")
+		}
+	}
+	if c.SshD != nil {
+		v.sshD("sshd", c.SshD)
+	}
+	if c.SocksProxy != nil {
+		v.address("socksproxy.listen_address", c.SocksProxy.ListenAddress, true)
+		if c.SocksProxy.SshClientConf != nil {
+			v.sshClient("socksproxy.sshclient", c.SocksProxy.SshClientConf)
+		} else if c.SshClient == nil {
+			v.add("socksproxy.sshclient", "you need to configure sshclient section to support socks proxy")
+		}
+	}
+	if c.HTTPProxy != nil {
+		v.address("httpproxy.listen_address", c.HTTPProxy.ListenAddress, true)
+		if c.HTTPProxy.SshClientConf != nil {
+			v.sshClient("httpproxy.sshclient", c.HTTPProxy.SshClientConf)
+		} else if c.SshClient == nil {
+			v.add("httpproxy.sshclient", "you need to configure sshclient section to support http proxy")
+		}
+	}
+	v.address("health_addr", c.HealthAddr, false)
+	v.err("log_format", logger.ValidateFormat(c.LogFormat))
+	if c.Dashboard != nil {
+		v.address("dashboard.listen_address", c.Dashboard.ListenAddress, false)
+		if (c.Dashboard.Username == "") != (c.Dashboard.Password == "") {
+			v.add("dashboard.password", "username and password must be both set")
+		}
+	}
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// validator collects the validation errors
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) add(field string, format string, args ...any) {
+	v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err(field string, err error) {
+	if err != nil {
+		v.add(field, "%s", err)
+	}
+}
+
+// address checks a [user@]host[:port] value. The port can be omitted
+func (v *validator) address(field string, value string, required bool) {
+	if value == "" {
+		if required {
+			v.add(field, "required")
+		}
+		return
+	}
+	var addrErr *utils.AddressError
+	if errors.As(utils.ValidateSSHUrl(value), &addrErr) {
+		v.add(field, "%s", addrErr.Reason)
+	}
+}
+
+// tunnel maps the tun.TunnelConf.Validate errors to the config fields
+func (v *validator) tunnel(field string, t *tun.TunnelConf) {
+	var errs tun.ConfErrors
+	if !errors.As(t.Validate(), &errs) {
+		return
+	}
+	for _, ce := range errs {
+		var addrErr *utils.AddressError
+		if errors.As(ce.Err, &addrErr) {
+			v.add(field+"."+ce.Field, "%s", addrErr.Reason)
+		} else {
+			v.err(field+"."+ce.Field, ce.Err)
+		}
+	}
+}
+
+func (v *validator) sshClient(field string, c *sshc.SshClientConf) {
+	v.address(field+".server", c.ServerURI, true)
+	v.err(field+".host_key_algorithms", sshc.ValidateHostKeyAlgorithms(c.HostKeyAlgorithms))
+	v.algorithms(field, c.Ciphers, c.KeyExchanges, c.MACs)
+	if c.Proxy != "" {
+		if c.ProxyCommand != "" {
+			v.add(field+".proxy", "can't be set with proxy_command")
+		} else if _, err := sshc.ParseProxyURL(c.Proxy); err != nil {
+			v.err(field+".proxy", err)
+		}
+	}
+	if c.BindAddress != "" && net.ParseIP(c.BindAddress) == nil {
+		v.add(field+".bind_address", "must be an ip address")
+	}
+	v.err(field+".compression_level", rio.ValidateCompressionLevel(c.CompressionLevel))
+	v.err(field+".buffer_size", rio.ValidateBufferSize(c.BufferSize))
+	if c.ReconnectMultiplier < 0 {
+		v.add(field+".reconnect_multiplier", "must not be negative")
+	}
+	if c.MaxReconnectAttempts < 0 {
+		v.add(field+".max_reconnect_attempts", "must not be negative")
+	}
+	if c.KeepAliveInterval != nil && *c.KeepAliveInterval < 0 {
+		v.add(field+".keep_alive_interval", "must not be negative")
+	}
+	if c.KeepAliveMaxMisses < 0 {
+		v.add(field+".keep_alive_max_misses", "must not be negative")
+	}
+	for i, j := range c.JumpHosts {
+		jfield := fmt.Sprintf("%s.jump_hosts[%d]", field, i)
+		v.address(jfield+".uri", j.URI, true)
+		v.algorithms(jfield, j.Ciphers, j.KeyExchanges, j.MACs)
+	}
+}
+
+func (v *validator) algorithms(field string, ciphers, keyExchanges, macs []string) {
+	v.err(field+".ciphers", sshc.ValidateAlgorithms(ciphers, nil, nil))
+	v.err(field+".key_exchanges", sshc.ValidateAlgorithms(nil, keyExchanges, nil))
+	v.err(field+".macs", sshc.ValidateAlgorithms(nil, nil, macs))
+}
+
+func (v *validator) sshD(field string, c *sshd.SshDConf) {
+	if c.Key == "" && len(c.Keys) == 0 {
+		v.add(field+".server_key", "required")
+	}
+	v.err(field+".server_key_type", utils.ValidateKeyAlgorithm(c.KeyType, c.KeyBits))
+	v.address(field+".listen_address", c.ListenAddress, false)
+	v.address(field+".health_addr", c.HealthAddr, false)
+	v.address(field+".api_addr", c.APIAddr, false)
+	v.err(field+".allowed_commands", sshd.ValidateAllowedCommands(c.AllowedCommands))
+	v.err(field+".accept_env", sshd.ValidateAcceptEnv(c.AcceptEnv))
+	if c.RequireTOTP && c.TOTPSecretsFile == "" {
+		v.add(field+".totp_secrets_file", "required when require_totp is set")
+	}
+	if c.RequireTOTP && c.AuthorizedPassword != "" {
+		v.add(field+".authorized_password", "can't be set with require_totp")
+	}
+	if c.RecordSessions && c.RecordingDir == "" {
+		v.add(field+".recording_dir", "required when record_sessions is set")
+	}
+	if c.LoginGraceTime < 0 {
+		v.add(field+".login_grace_time", "must not be negative")
+	}
+	if c.ClientAliveInterval < 0 {
+		v.add(field+".client_alive_interval", "must not be negative")
+	}
+	if c.ClientAliveCountMax < 0 {
+		v.add(field+".client_alive_count_max", "must not be negative")
+	}
+	if c.MaxConnRate < 0 {
+		v.add(field+".max_conn_rate", "must not be negative")
+	}
+	if c.MaxConnBurst < 0 {
+		v.add(field+".max_conn_burst", "must not be negative")
+	}
+	if c.SftpMaxConcurrentRequests < 0 {
+		v.add(field+".sftp_max_concurrent_requests", "must not be negative")
+	}
+	if c.SftpMaxFileSize < 0 {
+		v.add(field+".sftp_max_file_size", "must not be negative")
+	}
+	v.err(field+".buffer_size", rio.ValidateBufferSize(c.BufferSize))
+}
@@ -0,0 +1,298 @@
+package ctl
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// DefaultSocketPath returns the socket path used by rospo ctl if not set:
+// rospo.sock in $XDG_RUNTIME_DIR if set, in the rospo-<uid> dir of the
+// temp dir otherwise. The server creates that dir accessible by the
+// owner only
+func DefaultSocketPath() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "rospo.sock")
+	}
+	if uid := os.Getuid(); uid >= 0 {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("rospo-%d", uid), "rospo.sock")
+	}
+	// windows has no uid
+	return filepath.Join(os.TempDir(), "rospo.sock")
+}
+
+// the max time a client has to send its command
+const requestTimeout = 10 * time.Second
+
+// the max size of a message
+const maxFrameSize = 1 << 20
+
+// Request is a command sent to the server
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	// the structured command input, like the tunnel to add
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// Reply is the server reply to a Request
+type Reply struct {
+	// the human readable output
+	Output string `json:"output,omitempty"`
+	// the machine readable output, like the tunnels list
+	Data json.RawMessage `json:"data,omitempty"`
+	// the failure reason. Empty if the command succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// HandlerFunc runs a control command. The returned reply is sent back to
+// the client, an error as the reply Error
+type HandlerFunc func(req *Request) (*Reply, error)
+
+// TextHandler adapts a command with a text output only to a HandlerFunc
+func TextHandler(fn func(args []string) (string, error)) HandlerFunc {
+	return func(req *Request) (*Reply, error) {
+		out, err := fn(req.Args)
+		if err != nil {
+			return nil, err
+		}
+		return &Reply{Output: out}, nil
+	}
+}
+
+// NewReply builds a reply with the human readable output and the data
+// encoded as json
+func NewReply(output string, data any) (*Reply, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Reply{Output: output, Data: raw}, nil
+}
+
+// writeFrame sends v as a message: a 4 bytes big endian length followed
+// by the json encoded value
+func writeFrame(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxFrameSize {
+		return fmt.Errorf("message too big: %d bytes", len(data))
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
+
+// readFrame reads a message sent by writeFrame into v
+func readFrame(r io.Reader, v any) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxFrameSize {
+		return fmt.Errorf("message too big: %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Server serves the control commands on a unix socket. The messages are
+// length prefixed json: a 4 bytes big endian length followed by the json
+// document. The client sends a Request, the server replies with a Reply
+// and closes the connection
+type Server struct {
+	path string
+
+	handlers   map[string]HandlerFunc
+	handlersMU sync.RWMutex
+
+	listener   net.Listener
+	listenerMU sync.RWMutex
+
+	log *slog.Logger
+}
+
+// NewServer builds a control server that will listen on the unix
+// socket at path
+func NewServer(path string, opts ...Option) *Server {
+	o := options.Build(opts)
+	return &Server{
+		path:     path,
+		handlers: make(map[string]HandlerFunc),
+		log:      o.Logger.With("subsystem", "ctl"),
+	}
+}
+
+// Handle registers the handler of a command. A handler for the same
+// command is replaced
+func (s *Server) Handle(command string, fn HandlerFunc) {
+	s.handlersMU.Lock()
+	defer s.handlersMU.Unlock()
+	s.handlers[command] = fn
+}
+
+// Start listens for the control commands. It blocks until the server
+// fails or it is stopped. In the latter case nil is returned.
+// A missing socket dir is created with 0700 permissions. A stale socket
+// file left by a previous run is removed, while a socket another process
+// is listening on is an error. The socket controls the tunnels: it is
+// created accessible by the owner only, and the dir or a previous file
+// owned by another user are refused
+func (s *Server) Start() error {
+	path, err := utils.ExpandUserHome(s.path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := checkOwner(dir, true); err != nil {
+		return fmt.Errorf("unsafe control socket dir: %w", err)
+	}
+	if err := checkOwner(path, false); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s already in use", path)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unsafe control socket: %w", err)
+	}
+	listener, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+
+	s.listenerMU.Lock()
+	s.listener = listener
+	s.listenerMU.Unlock()
+	s.log.Info("control socket listening", "path", path)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Stop closes the server listener
+func (s *Server) Stop() error {
+	s.listenerMU.RLock()
+	defer s.listenerMU.RUnlock()
+	if s.listener == nil {
+		return nil
+	}
+	// closing the unix listener removes the socket file too
+	return s.listener.Close()
+}
+
+// GetListenerAddr returns the server listener address. nil if the
+// server is not listening
+func (s *Server) GetListenerAddr() net.Addr {
+	s.listenerMU.RLock()
+	defer s.listenerMU.RUnlock()
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	req := &Request{}
+	if err := readFrame(conn, req); err != nil {
+		s.log.Warn("cannot read the control command", "error", err)
+		writeFrame(conn, &Reply{Error: fmt.Sprintf("invalid request: %s", err)})
+		return
+	}
+	if req.Command == "" {
+		writeFrame(conn, &Reply{Error: "empty command"})
+		return
+	}
+
+	s.handlersMU.RLock()
+	fn, ok := s.handlers[req.Command]
+	s.handlersMU.RUnlock()
+	if !ok {
+		writeFrame(conn, &Reply{Error: fmt.Sprintf("unknown command %q", req.Command)})
+		return
+	}
+
+	s.log.Info("control command", "command", req.Command, "args", req.Args)
+	reply, err := fn(req)
+	if err != nil {
+		s.log.Warn("control command failed", "command", req.Command, "error", err)
+		reply = &Reply{Error: err.Error()}
+	}
+	if reply == nil {
+		reply = &Reply{}
+	}
+	if err := writeFrame(conn, reply); err != nil {
+		s.log.Warn("cannot send the control reply", "command", req.Command, "error", err)
+	}
+}
+
+// Do sends the request to the control server listening at path and
+// returns its reply. A failed command is returned as an error
+func Do(path string, req *Request) (*Reply, error) {
+	path, err := utils.ExpandUserHome(path)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", path, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := writeFrame(conn, req); err != nil {
+		return nil, err
+	}
+	reply := &Reply{}
+	if err := readFrame(conn, reply); err != nil {
+		return nil, fmt.Errorf("invalid control server reply: %w", err)
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+// Send runs the command on the control server listening at path and
+// returns its human readable output
+func Send(path string, command string, args ...string) (string, error) {
+	reply, err := Do(path, &Request{Command: command, Args: args})
+	if err != nil {
+		return "", err
+	}
+	return reply.Output, nil
+}
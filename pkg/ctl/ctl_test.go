@@ -0,0 +1,189 @@
+package ctl
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T, path string) *Server {
+	s := NewServer(path)
+	s.Handle("echo", TextHandler(func(args []string) (string, error) {
+		return strings.Join(args, " ") + "\n", nil
+	}))
+	s.Handle("fail", TextHandler(func(args []string) (string, error) {
+		return "", fmt.Errorf("failed")
+	}))
+	s.Handle("body", func(req *Request) (*Reply, error) {
+		var v map[string]int
+		if err := json.Unmarshal(req.Body, &v); err != nil {
+			return nil, err
+		}
+		v["n"]++
+		return NewReply("", v)
+	})
+	go s.Start()
+	for i := 0; s.GetListenerAddr() == nil; i++ {
+		if i == 50 {
+			t.Fatal("control server not listening")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return s
+}
+
+func TestCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	s := startServer(t, path)
+	defer s.Stop()
+
+	out, err := Send(path, "echo", "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "a b\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	if _, err := Send(path, "fail"); err == nil || err.Error() != "failed" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := Send(path, "missing"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	reply, err := Do(path, &Request{Command: "body", Body: json.RawMessage(`{"n": 1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply.Data) != `{"n":2}` {
+		t.Fatalf("unexpected data %s", reply.Data)
+	}
+}
+
+func TestFraming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	s := startServer(t, path)
+	defer s.Stop()
+
+	// a raw client: 4 bytes big endian length followed by the json
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte(`{"command": "echo", "args": ["framed"]}`)
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(msg)))
+	conn.Write(append(frame, msg...))
+
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"output":"framed\n"}` {
+		t.Fatalf("unexpected reply %s", data)
+	}
+
+	// the oversized messages are rejected
+	conn2, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.Write(binary.BigEndian.AppendUint32(nil, maxFrameSize+1))
+	reply := &Reply{}
+	if err := readFrame(conn2, reply); err != nil || !strings.Contains(reply.Error, "too big") {
+		t.Fatalf("unexpected reply %+v %v", reply, err)
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	s := startServer(t, path)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket permissions %s", info.Mode().Perm())
+	}
+	// the socket is removed on stop
+	s.Stop()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the socket file is still there: %v", err)
+	}
+}
+
+func TestSocketDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions on windows")
+	}
+	// a missing dir is created private
+	dir := filepath.Join(t.TempDir(), "rospo")
+	s := startServer(t, filepath.Join(dir, "rospo.sock"))
+	s.Stop()
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Fatalf("unexpected dir permissions %s", info.Mode().Perm())
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("the files owned by another user can only be created by root")
+	}
+	// a file owned by another user is not replaced
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	os.WriteFile(path, nil, 0600)
+	os.Chown(path, 65534, 65534)
+	if err := NewServer(path).Start(); err == nil || !strings.Contains(err.Error(), "owned by uid 65534") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// nor a dir owned by another user
+	os.Chown(dir, 65534, 65534)
+	if err := NewServer(filepath.Join(dir, "rospo.sock")).Start(); err == nil || !strings.Contains(err.Error(), "unsafe control socket dir") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestDefaultSocketPath(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	if path := DefaultSocketPath(); path != filepath.Join("/run/user/1000", "rospo.sock") {
+		t.Fatalf("unexpected path %s", path)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	if path := DefaultSocketPath(); runtime.GOOS != "windows" && path != filepath.Join(os.TempDir(), fmt.Sprintf("rospo-%d", os.Getuid()), "rospo.sock") {
+		t.Fatalf("unexpected path %s", path)
+	}
+}
+
+func TestSocketInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rospo.sock")
+	s := startServer(t, path)
+
+	if err := NewServer(path).Start(); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the socket can be used again once the server is stopped
+	s.Stop()
+	s = startServer(t, path)
+	defer s.Stop()
+	if _, err := Send(path, "echo"); err != nil {
+		t.Fatal(err)
+	}
+}
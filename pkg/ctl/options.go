@@ -0,0 +1,15 @@
+package ctl
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+)
+
+// Option configures the control server
+type Option = options.Option
+
+// WithLogger sets the logger of the control socket commands
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package ctl
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnix listens on the unix socket at path under a 0177 umask, so
+// that the socket file is created accessible by the owner only: there is
+// no window where the other users can connect
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	return listener, err
+}
+
+// checkOwner returns an error if the file at path is not owned by the
+// current user. With allowRoot the files owned by root, like the temp
+// dir, are accepted too
+func checkOwner(path string, allowRoot bool) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if int(st.Uid) == os.Getuid() || (allowRoot && st.Uid == 0) {
+		return nil
+	}
+	return fmt.Errorf("%s is owned by uid %d", path, st.Uid)
+}
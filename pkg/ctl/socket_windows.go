@@ -0,0 +1,19 @@
+package ctl
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix listens on the unix socket at path. The socket file
+// inherits the parent directory ACL
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
+// checkOwner only checks that the file at path exists: the windows files
+// have no owner uid
+func checkOwner(path string, allowRoot bool) error {
+	_, err := os.Lstat(path)
+	return err
+}
@@ -0,0 +1,168 @@
+package dashboard
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+//go:embed dashboard.html
+var page []byte
+
+// Conf holds the web dashboard configuration
+type Conf struct {
+	// the dashboard is served on this address. Example: ":8090"
+	ListenAddress string `yaml:"listen_address"`
+	// if set, the requests need these basic auth credentials
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Connection is an ssh client connection as shown by the dashboard
+type Connection struct {
+	Name   string `json:"name"`
+	Server string `json:"server"`
+	Status string `json:"status"`
+}
+
+// Status is the data shown by the dashboard, served as json at /status
+type Status struct {
+	Tunnels     []tun.Stats  `json:"tunnels"`
+	Connections []Connection `json:"connections"`
+	// the clients logged in the sshd server. nil if it is not configured
+	SshdClients []sshd.ConnectedClient `json:"sshd_clients"`
+	Time        time.Time              `json:"time"`
+}
+
+// Source provides the dashboard data
+type Source interface {
+	Status() Status
+}
+
+// Server serves a web page listing the tunnels and the ssh connections
+// status. The page refreshes itself reading the /status json
+type Server struct {
+	username string
+	password string
+	source   Source
+
+	httpServer *http.Server
+	listener   net.Listener
+	listenerMU sync.RWMutex
+
+	log *slog.Logger
+}
+
+// NewServer builds a dashboard server that will listen on the conf address
+func NewServer(conf *Conf, source Source, opts ...Option) *Server {
+	o := options.Build(opts)
+	s := &Server{
+		username: conf.Username,
+		password: conf.Password,
+		source:   source,
+		log:      o.Logger.With("subsystem", "dashboard"),
+	}
+	s.httpServer = &http.Server{
+		Addr:    conf.ListenAddress,
+		Handler: s.Handler(),
+	}
+	return s
+}
+
+// Handler returns the http handler serving the dashboard
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.pageHandler)
+	mux.HandleFunc("/status", s.statusHandler)
+	if s.password == "" {
+		return mux
+	}
+	return s.authenticate(mux)
+}
+
+// authenticate rejects the requests without the basic auth credentials
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(username), []byte(s.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rospo"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) pageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+func (s *Server) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status := s.source.Status()
+	status.Time = time.Now()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Start listens for the dashboard requests. It blocks until the server
+// fails or it is stopped. In the latter case nil is returned
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	s.listenerMU.Lock()
+	s.listener = listener
+	s.listenerMU.Unlock()
+
+	s.log.Info("dashboard listening", "addr", listener.Addr().String(), "auth", s.password != "")
+	err = s.httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Stop closes the server listener
+func (s *Server) Stop() error {
+	return s.httpServer.Close()
+}
+
+// GetListenerAddr returns the server listener address. nil if the
+// server is not listening
+func (s *Server) GetListenerAddr() net.Addr {
+	s.listenerMU.RLock()
+	defer s.listenerMU.RUnlock()
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
+	return nil
+}
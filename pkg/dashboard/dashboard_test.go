@@ -0,0 +1,134 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+type fakeSource struct {
+	status Status
+}
+
+func (f *fakeSource) Status() Status {
+	return f.status
+}
+
+func get(t *testing.T, url, username, password string) (*http.Response, []byte) {
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res, body
+}
+
+func TestStatus(t *testing.T) {
+	source := &fakeSource{status: Status{
+		Tunnels: []tun.Stats{{Name: "web", Forward: true, State: tun.StateConnected, BytesPerSecond: 1024}},
+		Connections: []Connection{
+			{Name: "sshclient", Server: "example.com:22", Status: "Connected"},
+		},
+		SshdClients: []sshd.ConnectedClient{{User: "test", RemoteAddr: "127.0.0.1:1234"}},
+	}}
+	ts := httptest.NewServer(NewServer(&Conf{}, source).Handler())
+	defer ts.Close()
+
+	res, body := get(t, ts.URL+"/", "", "")
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("unexpected page reply %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), `fetch("status"`) {
+		t.Fatal("the page doesn't refresh the status")
+	}
+
+	res, body = get(t, ts.URL+"/status", "", "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected status reply %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	var status Status
+	if err := json.Unmarshal(body, &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Tunnels) != 1 || status.Tunnels[0].BytesPerSecond != 1024 {
+		t.Fatalf("unexpected tunnels %+v", status.Tunnels)
+	}
+	if len(status.Connections) != 1 || status.Connections[0].Status != "Connected" {
+		t.Fatalf("unexpected connections %+v", status.Connections)
+	}
+	if len(status.SshdClients) != 1 || status.SshdClients[0].User != "test" {
+		t.Fatalf("unexpected sshd clients %+v", status.SshdClients)
+	}
+	if time.Since(status.Time) > time.Minute {
+		t.Fatalf("unexpected time %s", status.Time)
+	}
+
+	if res, _ := get(t, ts.URL+"/nope", "", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", res.StatusCode)
+	}
+	res, err := http.Post(ts.URL+"/status", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", res.StatusCode)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	conf := &Conf{Username: "admin", Password: "secret"}
+	ts := httptest.NewServer(NewServer(conf, &fakeSource{}).Handler())
+	defer ts.Close()
+
+	for _, path := range []string{"/", "/status"} {
+		for _, creds := range [][2]string{{"", ""}, {"admin", "wrong"}, {"wrong", "secret"}} {
+			res, _ := get(t, ts.URL+path, creds[0], creds[1])
+			if res.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("%s %v: expected 401, got %d", path, creds, res.StatusCode)
+			}
+			if res.Header.Get("WWW-Authenticate") == "" {
+				t.Fatalf("%s: missing WWW-Authenticate header", path)
+			}
+		}
+		if res, _ := get(t, ts.URL+path, "admin", "secret"); res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	s := NewServer(&Conf{ListenAddress: "127.0.0.1:0"}, &fakeSource{})
+	done := make(chan error)
+	go func() {
+		done <- s.Start()
+	}()
+	for s.GetListenerAddr() == nil {
+		select {
+		case err := <-done:
+			t.Fatal(err)
+		default:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if res, _ := get(t, fmt.Sprintf("http://%s/status", s.GetListenerAddr()), "", ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	s.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
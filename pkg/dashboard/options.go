@@ -0,0 +1,15 @@
+package dashboard
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+)
+
+// Option configures the dashboard server
+type Option = options.Option
+
+// WithLogger sets the dashboard requests logger
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
@@ -0,0 +1,349 @@
+package diag
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// The checks, in the order they run
+const (
+	StepTCP      = "tcp"
+	StepBanner   = "banner"
+	StepAuth     = "auth"
+	StepTunnel   = "tunnel"
+	StepTransfer = "transfer"
+)
+
+// Status is a check outcome
+type Status string
+
+// The check outcomes
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	// the check didn't run, because a previous one failed or because it
+	// doesn't apply to the configuration
+	StatusSkip Status = "skip"
+)
+
+// the bytes sent through the tunnel by the transfer check
+const transferSize = 64 * 1024
+
+// StepResult is the outcome of a check
+type StepResult struct {
+	Name     string        `json:"name"`
+	Status   Status        `json:"status"`
+	Duration time.Duration `json:"-"`
+	Millis   int64         `json:"duration_ms"`
+	Detail   string        `json:"detail,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Report holds the checks outcomes. OK is true if none failed
+type Report struct {
+	Server string       `json:"server"`
+	OK     bool         `json:"ok"`
+	Steps  []StepResult `json:"steps"`
+}
+
+// Failed returns the failed check. nil if all passed
+func (r *Report) Failed() *StepResult {
+	for i := range r.Steps {
+		if r.Steps[i].Status == StatusFail {
+			return &r.Steps[i]
+		}
+	}
+	return nil
+}
+
+type options struct {
+	logger  *slog.Logger
+	timeout time.Duration
+	// called before each check runs. Used by the tests
+	beforeStep func(name string)
+}
+
+// Option configures the checks
+type Option func(*options)
+
+// WithLogger sets the logger of the ssh connection and of the tunnel
+// used by the checks. If not set, the logs are discarded
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithTimeout sets the max duration of each check. Defaults to
+// sshc.DefaultConnectTimeout
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+type runner struct {
+	conf *sshc.SshClientConf
+	o    options
+
+	// the connection the banner check reads. nil if the server is
+	// reached through a proxy
+	tcpConn net.Conn
+	sshConn *sshc.SshConnection
+	// the echo service and the tunnel remote end, on the server
+	echo     net.Listener
+	tunCtx   context.CancelFunc
+	tunnelTo string
+}
+
+// Run checks the connectivity with the server step by step: the TCP
+// reachability, the ssh banner exchange, the authentication, a reverse
+// tunnel opening and a data round trip through it. The checks after a
+// failed one are skipped. It returns an error if conf is not valid
+func Run(ctx context.Context, conf *sshc.SshClientConf, opts ...Option) (*Report, error) {
+	o := options{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		timeout: sshc.DefaultConnectTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	// a single attempt: the failure is reported, not retried
+	c := *conf
+	c.MaxReconnectAttempts = 1
+	c.Quiet = true
+	sshConn, err := sshc.NewSshConnection(&c, sshc.WithLogger(o.logger))
+	if err != nil {
+		return nil, err
+	}
+	r := &runner{conf: &c, o: o, sshConn: sshConn}
+	defer r.close()
+
+	server := r.sshConn.GetServerEndpoint()
+	report := &Report{Server: server.String(), OK: true}
+
+	steps := []struct {
+		name string
+		run  func(ctx context.Context) (string, error)
+	}{
+		{StepTCP, r.checkTCP},
+		{StepBanner, r.checkBanner},
+		{StepAuth, r.checkAuth},
+		{StepTunnel, r.checkTunnel},
+		{StepTransfer, r.checkTransfer},
+	}
+	for _, step := range steps {
+		result := StepResult{Name: step.name, Status: StatusSkip}
+		if !report.OK {
+			report.Steps = append(report.Steps, result)
+			continue
+		}
+		if o.beforeStep != nil {
+			o.beforeStep(step.name)
+		}
+		stepCtx, cancel := context.WithTimeout(ctx, o.timeout)
+		start := time.Now()
+		detail, err := step.run(stepCtx)
+		cancel()
+		result.Duration = time.Since(start)
+		result.Millis = result.Duration.Milliseconds()
+		result.Detail = detail
+		switch {
+		case errors.Is(err, errSkip):
+		case err != nil:
+			result.Status = StatusFail
+			result.Error = err.Error()
+			report.OK = false
+		default:
+			result.Status = StatusPass
+		}
+		report.Steps = append(report.Steps, result)
+	}
+	return report, nil
+}
+
+// errSkip marks the checks that don't apply
+var errSkip = errors.New("skipped")
+
+func (r *runner) close() {
+	if r.tcpConn != nil {
+		r.tcpConn.Close()
+	}
+	if r.tunCtx != nil {
+		r.tunCtx()
+	}
+	if r.echo != nil {
+		r.echo.Close()
+	}
+	r.sshConn.Stop()
+}
+
+func (r *runner) checkTCP(ctx context.Context) (string, error) {
+	if r.conf.Proxy != "" || r.conf.ProxyCommand != "" {
+		return "the server is reached through the proxy", errSkip
+	}
+	// the first jump host is the one dialed
+	server := r.sshConn.GetServerEndpoint()
+	addr := server.String()
+	if len(r.conf.JumpHosts) > 0 {
+		hop, err := utils.ParseSSHUrl(r.conf.JumpHosts[0].URI)
+		if err != nil {
+			return "", err
+		}
+		addr = net.JoinHostPort(strings.Trim(hop.Host, "[]"), fmt.Sprint(hop.Port))
+	}
+	d, err := sshc.BindDialer(r.conf.BindAddress)
+	if err != nil {
+		return "", err
+	}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	r.tcpConn = conn
+	return "connected to " + conn.RemoteAddr().String(), nil
+}
+
+// checkBanner reads the server identification string. The lines before
+// it are allowed by the protocol
+func (r *runner) checkBanner(ctx context.Context) (string, error) {
+	if r.tcpConn == nil {
+		return "the server is reached through the proxy", errSkip
+	}
+	defer func() {
+		r.tcpConn.Close()
+		r.tcpConn = nil
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		r.tcpConn.SetDeadline(deadline)
+	}
+	if _, err := fmt.Fprint(r.tcpConn, "SSH-2.0-rospo_test\r\n"); err != nil {
+		return "", err
+	}
+	reader := bufio.NewReaderSize(r.tcpConn, 256)
+	for i := 0; i < 32; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("no ssh identification string: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "SSH-") {
+			if !strings.HasPrefix(line, "SSH-2.0-") && !strings.HasPrefix(line, "SSH-1.99-") {
+				return line, errors.New("unsupported protocol version")
+			}
+			return line, nil
+		}
+	}
+	return "", errors.New("no ssh identification string")
+}
+
+func (r *runner) checkAuth(ctx context.Context) (string, error) {
+	// the untrusted host keys are reported here: the connection loop
+	// would exit instead
+	if !r.conf.Insecure && len(r.conf.JumpHosts) == 0 {
+		if _, err := r.sshConn.VerifyHostKey(); err != nil {
+			return "", fmt.Errorf("host key: %w", err)
+		}
+	}
+	// the connection outlives the check, it is used by the next ones
+	connected := make(chan error, 1)
+	go func() {
+		connected <- r.sshConn.ConnectWithContext(context.Background())
+	}()
+	var err error
+	select {
+	case err = <-connected:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		return "logged in", nil
+	}
+	if last := r.sshConn.LastError(); last != nil {
+		return "", last
+	}
+	return "", err
+}
+
+// checkTunnel opens a reverse tunnel from a random server loopback port
+// to a local echo service
+func (r *runner) checkTunnel(ctx context.Context) (string, error) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	r.echo = echo
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	tunnel := tun.NewTunnel(r.sshConn, &tun.TunnelConf{
+		Remote:  "127.0.0.1:0",
+		Local:   echo.Addr().String(),
+		Forward: false,
+	}, true, tun.WithLogger(r.o.logger))
+	tunCtx, cancel := context.WithCancel(context.Background())
+	r.tunCtx = cancel
+	go tunnel.Start(tunCtx)
+
+	for tunnel.State() != tun.StateConnected || tunnel.GetListenerAddr() == nil {
+		if r.sshConn.State() != sshc.ConnStateConnected {
+			return "", fmt.Errorf("ssh connection lost: %w", r.sshConn.LastError())
+		}
+		select {
+		case <-ctx.Done():
+			return "", errors.New("the server didn't open the remote listener. Is the tunnelling enabled?")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	r.tunnelTo = net.JoinHostPort("127.0.0.1", fmt.Sprint(tunnel.GetRemotePort()))
+	return "server " + r.tunnelTo + " forwarded to " + echo.Addr().String(), nil
+}
+
+// checkTransfer dials the tunnel remote end through the ssh connection and
+// reads back the data echoed by the local service
+func (r *runner) checkTransfer(ctx context.Context) (string, error) {
+	conn, err := r.sshConn.DialContext(ctx, r.tunnelTo)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	pattern := make([]byte, transferSize)
+	rand.Read(pattern)
+	start := time.Now()
+	go conn.Write(pattern)
+	got := make([]byte, len(pattern))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return "", fmt.Errorf("reading the echoed data: %w", err)
+	}
+	if !bytes.Equal(got, pattern) {
+		return "", errors.New("the echoed data differs")
+	}
+	return fmt.Sprintf("%s round trip in %s", utils.ByteCountSI(transferSize), time.Since(start).Round(time.Millisecond)), nil
+}
@@ -0,0 +1,123 @@
+package diag
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+)
+
+// startD starts a test server. It returns its address and the func
+// stopping it
+func startD() (string, func()) {
+	sd, err := sshd.NewSshServer(&sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	})
+	if err != nil {
+		panic(err)
+	}
+	go sd.Start(context.Background())
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return sd.GetListenerAddr().String(), sd.Stop
+}
+
+func clientConf(addr string) *sshc.SshClientConf {
+	return &sshc.SshClientConf{
+		Identity:  sshc.Identities{"../../testdata/client"},
+		Insecure:  true,
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: addr,
+	}
+}
+
+func TestRun(t *testing.T) {
+	addr, stop := startD()
+	defer stop()
+
+	report, err := Run(context.Background(), clientConf(addr), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK {
+		t.Fatalf("failed step: %+v", report.Failed())
+	}
+	want := []string{StepTCP, StepBanner, StepAuth, StepTunnel, StepTransfer}
+	if len(report.Steps) != len(want) {
+		t.Fatalf("got %d steps, want %d", len(report.Steps), len(want))
+	}
+	for i, step := range report.Steps {
+		if step.Name != want[i] {
+			t.Fatalf("step %d is %s, want %s", i, step.Name, want[i])
+		}
+		if step.Status != StatusPass {
+			t.Fatalf("step %s status is %s", step.Name, step.Status)
+		}
+	}
+}
+
+func TestRunServerUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	report, err := Run(context.Background(), clientConf(addr), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK {
+		t.Fatal("expected a failure")
+	}
+	if failed := report.Failed(); failed.Name != StepTCP || failed.Error == "" {
+		t.Fatalf("unexpected failed step: %+v", failed)
+	}
+	for _, step := range report.Steps[1:] {
+		if step.Status != StatusSkip {
+			t.Fatalf("step %s status is %s, want skip", step.Name, step.Status)
+		}
+	}
+}
+
+func TestRunServerDisconnect(t *testing.T) {
+	addr, stop := startD()
+
+	// the server goes away once the client is authenticated
+	hook := func(o *options) {
+		o.beforeStep = func(name string) {
+			if name == StepTunnel {
+				stop()
+			}
+		}
+	}
+	report, err := Run(context.Background(), clientConf(addr), WithTimeout(5*time.Second), hook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK {
+		t.Fatal("expected a failure")
+	}
+	if failed := report.Failed(); failed.Name != StepTunnel {
+		t.Fatalf("unexpected failed step: %+v", failed)
+	}
+	for _, step := range report.Steps {
+		switch step.Name {
+		case StepTCP, StepBanner, StepAuth:
+			if step.Status != StatusPass {
+				t.Fatalf("step %s status is %s, want pass", step.Name, step.Status)
+			}
+		case StepTransfer:
+			if step.Status != StatusSkip {
+				t.Fatalf("step %s status is %s, want skip", step.Name, step.Status)
+			}
+		}
+	}
+}
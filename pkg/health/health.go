@@ -0,0 +1,163 @@
+package health
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+// Check returns an error if the checked component is not ready
+type Check func() error
+
+// Connection is the ssh connection as seen by the readiness check
+type Connection interface {
+	IsConnected() bool
+}
+
+// Tunnel is the tunnel as seen by the readiness check
+type Tunnel interface {
+	GetName() string
+	State() tun.State
+}
+
+// Listener is a server as seen by the readiness check
+type Listener interface {
+	GetListenerAddr() net.Addr
+}
+
+// ListenerCheck builds a Check that fails until the server is listening
+func ListenerCheck(l Listener) Check {
+	return func() error {
+		if l.GetListenerAddr() == nil {
+			return fmt.Errorf("not listening")
+		}
+		return nil
+	}
+}
+
+// ConnectionCheck builds a Check that fails if the ssh client is
+// not connected
+func ConnectionCheck(conn Connection) Check {
+	return func() error {
+		if !conn.IsConnected() {
+			return fmt.Errorf("ssh client not connected")
+		}
+		return nil
+	}
+}
+
+// TunnelCheck builds a Check that fails until the tunnel establishes
+// its first connection
+func TunnelCheck(t Tunnel) Check {
+	return func() error {
+		if state := t.State(); state == tun.StateConnecting {
+			return fmt.Errorf("tunnel %s: %s", t.GetName(), state)
+		}
+		return nil
+	}
+}
+
+// Server exposes the liveness and readiness probes. /healthz always
+// replies 200 while the process is running, /readyz replies 200 only if
+// all the registered checks pass
+type Server struct {
+	httpServer *http.Server
+
+	checks   map[string]Check
+	checksMU sync.RWMutex
+
+	log *slog.Logger
+}
+
+// NewServer builds a health server that will listen on addr
+func NewServer(addr string, opts ...Option) *Server {
+	o := options.Build(opts)
+	s := &Server{
+		checks: make(map[string]Check),
+		log:    o.Logger.With("subsystem", "health"),
+	}
+	s.httpServer = &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+	}
+	return s
+}
+
+// AddCheck registers a readiness check. A check with the same name
+// is replaced
+func (s *Server) AddCheck(name string, check Check) {
+	s.checksMU.Lock()
+	defer s.checksMU.Unlock()
+	s.checks[name] = check
+}
+
+// RemoveCheck unregisters a readiness check
+func (s *Server) RemoveCheck(name string) {
+	s.checksMU.Lock()
+	defer s.checksMU.Unlock()
+	delete(s.checks, name)
+}
+
+// Handler returns the http handler serving the probes
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", s.readyz)
+	return mux
+}
+
+// Check runs all the registered checks. The passed ones map to nil
+func (s *Server) Check() map[string]error {
+	s.checksMU.RLock()
+	defer s.checksMU.RUnlock()
+	res := make(map[string]error, len(s.checks))
+	for name, check := range s.checks {
+		res[name] = check()
+	}
+	return res
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	s.checksMU.RLock()
+	names := make([]string, 0, len(s.checks))
+	for name := range s.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failures := []string{}
+	for _, name := range names {
+		if err := s.checks[name](); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	s.checksMU.RUnlock()
+
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failures, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Start listens for the probes requests. It blocks until the
+// server fails or it is stopped. In the latter case http.ErrServerClosed
+// is returned
+func (s *Server) Start() error {
+	s.log.Info("health endpoint listening", "addr", s.httpServer.Addr)
+	return s.httpServer.ListenAndServe()
+}
+
+// Stop closes the server listener
+func (s *Server) Stop() error {
+	return s.httpServer.Close()
+}
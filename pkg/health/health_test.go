@@ -0,0 +1,106 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+type fakeTunnel struct {
+	mu    sync.Mutex
+	state tun.State
+}
+
+func (f *fakeTunnel) GetName() string {
+	return "fake"
+}
+
+func (f *fakeTunnel) State() tun.State {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *fakeTunnel) setState(state tun.State) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+}
+
+type fakeConnection struct {
+	mu        sync.Mutex
+	connected bool
+}
+
+func (f *fakeConnection) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+func (f *fakeConnection) setConnected(connected bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = connected
+}
+
+func getStatus(t *testing.T, url string) int {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestProbes(t *testing.T) {
+	tunnel := &fakeTunnel{state: tun.StateConnecting}
+	conn := &fakeConnection{}
+
+	s := NewServer("")
+	s.AddCheck("sshclient", ConnectionCheck(conn))
+	s.AddCheck("tunnel", TunnelCheck(tunnel))
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	steps := []struct {
+		connected bool
+		state     tun.State
+		ready     int
+	}{
+		{false, tun.StateConnecting, http.StatusServiceUnavailable},
+		{true, tun.StateConnecting, http.StatusServiceUnavailable},
+		{false, tun.StateConnected, http.StatusServiceUnavailable},
+		{true, tun.StateConnected, http.StatusOK},
+		// the tunnel already established a connection
+		{true, tun.StateDisconnected, http.StatusOK},
+		{false, tun.StateDisconnected, http.StatusServiceUnavailable},
+	}
+	for _, step := range steps {
+		conn.setConnected(step.connected)
+		tunnel.setState(step.state)
+
+		if status := getStatus(t, ts.URL+"/healthz"); status != http.StatusOK {
+			t.Fatalf("unexpected liveness status %d", status)
+		}
+		if status := getStatus(t, ts.URL+"/readyz"); status != step.ready {
+			t.Fatalf("connected: %t, tunnel %s: expected readiness status %d, got %d",
+				step.connected, step.state, step.ready, status)
+		}
+	}
+}
+
+func TestNoChecks(t *testing.T) {
+	ts := httptest.NewServer(NewServer("").Handler())
+	defer ts.Close()
+
+	if status := getStatus(t, ts.URL+"/readyz"); status != http.StatusOK {
+		t.Fatalf("unexpected readiness status %d", status)
+	}
+	if status := getStatus(t, ts.URL+"/notexistent"); status != http.StatusNotFound {
+		t.Fatalf("unexpected status %d", status)
+	}
+}
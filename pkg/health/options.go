@@ -0,0 +1,15 @@
+package health
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+)
+
+// Option configures the health server
+type Option = options.Option
+
+// WithLogger sets the logger of the health endpoint
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
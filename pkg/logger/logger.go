@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"runtime"
 
@@ -21,13 +22,27 @@ const (
 	reset   = "\033[0m"
 )
 
+// The slog default logger formats
+const (
+	FormatText = "text"
+	// one json object per line. The message is in the event field
+	FormatJSON = "json"
+)
+
 var instances []*log.Logger
 
+// the slog default logger replaced by DisableLoggers
+var slogDefault *slog.Logger
+
 // DisableLoggers prevents any log output to be printed on console
 func DisableLoggers() {
 	for _, v := range instances {
 		v.SetOutput(io.Discard)
 	}
+	if slogDefault == nil {
+		slogDefault = slog.Default()
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
 }
 
 // EnableLoggers enables any disabled logger
@@ -35,6 +50,45 @@ func EnableLoggers() {
 	for _, v := range instances {
 		v.SetOutput(os.Stdout)
 	}
+	if slogDefault != nil {
+		slog.SetDefault(slogDefault)
+		slogDefault = nil
+	}
+}
+
+// ValidateFormat checks a SetFormat format
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q: it must be %s or %s", format, FormatText, FormatJSON)
+}
+
+// SetFormat sets the slog default logger format. The text one, or an
+// empty format, keeps the default. The loggers built before keep their
+// format, and the logs stay disabled if DisableLoggers was called
+func SetFormat(format string) error {
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	if format != FormatJSON {
+		return nil
+	}
+	l := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.MessageKey {
+				a.Key = "event"
+			}
+			return a
+		},
+	}))
+	if slogDefault != nil {
+		slogDefault = l
+	} else {
+		slog.SetDefault(l)
+	}
+	return nil
 }
 
 // NewLogger builds up and return a new logger
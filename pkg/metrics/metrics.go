@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The auth attempts results
+const (
+	AuthSuccess = "success"
+	AuthFailure = "failure"
+)
+
+// The tunnel bytes flows. Received are the bytes read from the tunnel
+// clients, sent the ones written to them
+const (
+	FlowReceived = "received"
+	FlowSent     = "sent"
+)
+
+// Recorder collects the rospo events. The sshd server, the ssh client and
+// the tunnels call its methods
+type Recorder interface {
+	TunnelConnectionOpened(name, direction string)
+	TunnelConnectionClosed(name, direction string)
+	TunnelBytes(name, direction, flow string, n int)
+
+	SshdAuthAttempt(result string)
+	SshdClientConnected()
+	SshdClientDisconnected()
+
+	SshReconnect()
+}
+
+type nopRecorder struct{}
+
+func (nopRecorder) TunnelConnectionOpened(name, direction string)   {}
+func (nopRecorder) TunnelConnectionClosed(name, direction string)   {}
+func (nopRecorder) TunnelBytes(name, direction, flow string, n int) {}
+func (nopRecorder) SshdAuthAttempt(result string)                   {}
+func (nopRecorder) SshdClientConnected()                            {}
+func (nopRecorder) SshdClientDisconnected()                         {}
+func (nopRecorder) SshReconnect()                                   {}
+
+// Nop is a Recorder that discards all the events. It is used when
+// no recorder is configured
+var Nop Recorder = nopRecorder{}
+
+// Prometheus is a Recorder that exposes the events as prometheus metrics
+type Prometheus struct {
+	tunnelActiveConnections *prometheus.GaugeVec
+	tunnelBytes             *prometheus.CounterVec
+	sshdAuthAttempts        *prometheus.CounterVec
+	sshdConnectedClients    prometheus.Gauge
+	sshReconnects           prometheus.Counter
+}
+
+// NewPrometheus builds a Prometheus recorder registering its
+// collectors into reg
+func NewPrometheus(reg prometheus.Registerer) *Prometheus {
+	p := &Prometheus{
+		tunnelActiveConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "rospo_tunnel_active_connections",
+			Help: "The number of active tunnel connections",
+		}, []string{"name", "direction"}),
+		tunnelBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rospo_tunnel_bytes_total",
+			Help: "The bytes transferred through the tunnels",
+		}, []string{"name", "direction", "flow"}),
+		sshdAuthAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rospo_sshd_auth_attempts_total",
+			Help: "The sshd authentication attempts",
+		}, []string{"result"}),
+		sshdConnectedClients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "rospo_sshd_connected_clients",
+			Help: "The number of clients connected to the sshd server",
+		}),
+		sshReconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rospo_ssh_reconnects_total",
+			Help: "The ssh client reconnections",
+		}),
+	}
+	reg.MustRegister(
+		p.tunnelActiveConnections,
+		p.tunnelBytes,
+		p.sshdAuthAttempts,
+		p.sshdConnectedClients,
+		p.sshReconnects,
+	)
+	return p
+}
+
+func (p *Prometheus) TunnelConnectionOpened(name, direction string) {
+	p.tunnelActiveConnections.WithLabelValues(name, direction).Inc()
+}
+
+func (p *Prometheus) TunnelConnectionClosed(name, direction string) {
+	p.tunnelActiveConnections.WithLabelValues(name, direction).Dec()
+}
+
+func (p *Prometheus) TunnelBytes(name, direction, flow string, n int) {
+	p.tunnelBytes.WithLabelValues(name, direction, flow).Add(float64(n))
+}
+
+func (p *Prometheus) SshdAuthAttempt(result string) {
+	p.sshdAuthAttempts.WithLabelValues(result).Inc()
+}
+
+func (p *Prometheus) SshdClientConnected() {
+	p.sshdConnectedClients.Inc()
+}
+
+func (p *Prometheus) SshdClientDisconnected() {
+	p.sshdConnectedClients.Dec()
+}
+
+func (p *Prometheus) SshReconnect() {
+	p.sshReconnects.Inc()
+}
+
+// Serve starts an http server exposing the gatherer metrics at
+// the /metrics path. It blocks until the server fails
+func Serve(addr string, gatherer prometheus.Gatherer, opts ...Option) error {
+	o := options.Build(opts)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	o.Logger.Info("metrics endpoint listening", "subsystem", "metrics", "addr", addr)
+	return http.ListenAndServe(addr, mux)
+}
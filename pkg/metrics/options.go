@@ -0,0 +1,15 @@
+package metrics
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+)
+
+// Option configures the metrics endpoint
+type Option = options.Option
+
+// WithLogger sets the logger of the metrics endpoint
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
@@ -0,0 +1,189 @@
+package monitor
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+// DefaultWindow is the default time window of the rates
+const DefaultWindow = time.Second
+
+// Health is the tunnel health as shown by the monitor
+type Health string
+
+// The tunnel health values
+const (
+	// the tunnel is connected and its endpoint dials don't fail
+	Healthy Health = "healthy"
+	// the tunnel is paused or some endpoint dials failed in the window
+	Degraded Health = "degraded"
+	// the tunnel is not connected
+	Failed Health = "failed"
+)
+
+// Row is a tunnel line of the monitor
+type Row struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"`
+	Local     string `json:"local"`
+	Remote    string `json:"remote"`
+	Health    Health `json:"health"`
+	// the active and the total clients connections
+	ActiveConns int   `json:"active_conns"`
+	TotalConns  int64 `json:"total_conns"`
+	// the bytes received from and sent to the tunnel clients per
+	// second, over the window
+	BytesInPerSecond  float64 `json:"bytes_in_per_second"`
+	BytesOutPerSecond float64 `json:"bytes_out_per_second"`
+	Errors            int64   `json:"errors"`
+	// how long the tunnel listener has been active. 0 if not connected
+	Uptime time.Duration `json:"uptime_ns"`
+}
+
+// sample is a tunnel counters snapshot
+type sample struct {
+	at       time.Time
+	bytesIn  int64
+	bytesOut int64
+	errors   int64
+}
+
+// Aggregator computes the tunnels rates from their stats snapshots
+type Aggregator struct {
+	window time.Duration
+	// the samples of each tunnel, oldest first
+	history map[string][]sample
+}
+
+// NewAggregator builds an aggregator computing the rates over window. If
+// window is not positive DefaultWindow is used
+func NewAggregator(window time.Duration) *Aggregator {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Aggregator{
+		window:  window,
+		history: map[string][]sample{},
+	}
+}
+
+// Add records the tunnels stats taken at now and returns their rows, in
+// the stats order. The rates are computed against the newest sample at
+// least a window old. They are 0 until such a sample exists
+func (a *Aggregator) Add(now time.Time, stats []tun.Stats) []Row {
+	rows := []Row{}
+	seen := map[string]bool{}
+	for _, s := range stats {
+		seen[s.Name] = true
+		curr := sample{at: now, bytesIn: s.BytesIn, bytesOut: s.BytesOut, errors: s.Errors}
+		history := a.history[s.Name]
+		// the counters restart if the tunnel was stopped and added again
+		if n := len(history); n > 0 && (curr.bytesIn < history[n-1].bytesIn ||
+			curr.bytesOut < history[n-1].bytesOut || curr.errors < history[n-1].errors) {
+			history = nil
+		}
+		history = append(history, curr)
+		// drop the samples not needed anymore: the newest one older than
+		// the window is kept as the base
+		for len(history) > 1 && now.Sub(history[1].at) >= a.window {
+			history = history[1:]
+		}
+		a.history[s.Name] = history
+
+		row := Row{
+			Name:        s.Name,
+			Direction:   "reverse",
+			Local:       s.Local,
+			Remote:      s.Remote,
+			ActiveConns: s.ActiveClients,
+			TotalConns:  s.TotalClients,
+			Errors:      s.Errors,
+		}
+		if s.Forward {
+			row.Direction = "forward"
+		}
+		if !s.ConnectedSince.IsZero() {
+			row.Uptime = now.Sub(s.ConnectedSince)
+		}
+
+		base := history[0]
+		if elapsed := now.Sub(base.at); elapsed >= a.window {
+			row.BytesInPerSecond = float64(curr.bytesIn-base.bytesIn) / elapsed.Seconds()
+			row.BytesOutPerSecond = float64(curr.bytesOut-base.bytesOut) / elapsed.Seconds()
+		}
+		recentErrors := curr.errors > base.errors
+		switch {
+		case s.State == tun.StatePaused || (s.State == tun.StateConnected && recentErrors):
+			row.Health = Degraded
+		case s.State == tun.StateConnected:
+			row.Health = Healthy
+		default:
+			row.Health = Failed
+		}
+		rows = append(rows, row)
+	}
+	// forget the removed tunnels
+	for name := range a.history {
+		if !seen[name] {
+			delete(a.history, name)
+		}
+	}
+	return rows
+}
+
+// Columns are the monitor columns, in order
+var Columns = []string{
+	"NAME", "DIRECTION", "LOCAL", "REMOTE", "ACTIVE", "TOTAL",
+	"IN/S", "OUT/S", "ERRORS", "UPTIME",
+}
+
+// SortRows sorts the rows by the column index. The numeric columns are
+// sorted in descending order, the others in ascending one
+func SortRows(rows []Row, column int) {
+	less := func(a, b Row) bool {
+		switch column {
+		case 1:
+			return a.Direction < b.Direction
+		case 2:
+			return a.Local < b.Local
+		case 3:
+			return a.Remote < b.Remote
+		case 4:
+			return a.ActiveConns > b.ActiveConns
+		case 5:
+			return a.TotalConns > b.TotalConns
+		case 6:
+			return a.BytesInPerSecond > b.BytesInPerSecond
+		case 7:
+			return a.BytesOutPerSecond > b.BytesOutPerSecond
+		case 8:
+			return a.Errors > b.Errors
+		case 9:
+			return a.Uptime > b.Uptime
+		default:
+			return a.Name < b.Name
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return less(rows[i], rows[j])
+	})
+}
+
+// FilterRows returns the rows whose name contains filter, ignoring the
+// case
+func FilterRows(rows []Row, filter string) []Row {
+	if filter == "" {
+		return rows
+	}
+	filter = strings.ToLower(filter)
+	res := []Row{}
+	for _, r := range rows {
+		if strings.Contains(strings.ToLower(r.Name), filter) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
@@ -0,0 +1,107 @@
+package monitor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/rospo/pkg/tun"
+)
+
+func TestByteRates(t *testing.T) {
+	a := NewAggregator(time.Second)
+	start := time.Now()
+	stats := func(in, out int64) []tun.Stats {
+		return []tun.Stats{{Name: "web", State: tun.StateConnected, BytesIn: in, BytesOut: out}}
+	}
+
+	// no rate until there is a sample a window old
+	rows := a.Add(start, stats(1000, 5000))
+	if rows[0].BytesInPerSecond != 0 || rows[0].BytesOutPerSecond != 0 {
+		t.Fatalf("unexpected rates without a base %+v", rows[0])
+	}
+	rows = a.Add(start.Add(500*time.Millisecond), stats(1500, 5000))
+	if rows[0].BytesInPerSecond != 0 {
+		t.Fatalf("unexpected rate within the window %+v", rows[0])
+	}
+
+	// the base is the first sample
+	rows = a.Add(start.Add(time.Second), stats(3000, 6000))
+	if rows[0].BytesInPerSecond != 2000 || rows[0].BytesOutPerSecond != 1000 {
+		t.Fatalf("unexpected rates %+v", rows[0])
+	}
+
+	// the base is the newest sample a window old: the 500ms one
+	rows = a.Add(start.Add(1500*time.Millisecond), stats(4500, 6000))
+	if rows[0].BytesInPerSecond != 3000 || rows[0].BytesOutPerSecond != 1000 {
+		t.Fatalf("unexpected rates %+v", rows[0])
+	}
+
+	// a late sample: the rate is over the whole elapsed time
+	rows = a.Add(start.Add(3500*time.Millisecond), stats(8500, 6000))
+	if rows[0].BytesInPerSecond != 2000 || rows[0].BytesOutPerSecond != 0 {
+		t.Fatalf("unexpected rates %+v", rows[0])
+	}
+
+	// the counters restart if the tunnel is added again
+	rows = a.Add(start.Add(4500*time.Millisecond), stats(100, 100))
+	if rows[0].BytesInPerSecond != 0 || rows[0].BytesOutPerSecond != 0 {
+		t.Fatalf("unexpected rates after the restart %+v", rows[0])
+	}
+}
+
+func TestHealth(t *testing.T) {
+	a := NewAggregator(time.Second)
+	now := time.Now()
+	rows := a.Add(now, []tun.Stats{
+		{Name: "ok", State: tun.StateConnected, Errors: 3, ConnectedSince: now.Add(-time.Minute)},
+		{Name: "paused", State: tun.StatePaused},
+		{Name: "down", State: tun.StateDisconnected},
+	})
+	if rows[0].Health != Healthy || rows[1].Health != Degraded || rows[2].Health != Failed {
+		t.Fatalf("unexpected health %+v", rows)
+	}
+	if rows[0].Uptime != time.Minute || rows[2].Uptime != 0 {
+		t.Fatalf("unexpected uptime %+v", rows)
+	}
+
+	// new dial errors in the window
+	rows = a.Add(now.Add(time.Second), []tun.Stats{{Name: "ok", State: tun.StateConnected, Errors: 4}})
+	if rows[0].Health != Degraded {
+		t.Fatalf("expected degraded, got %s", rows[0].Health)
+	}
+	rows = a.Add(now.Add(2*time.Second), []tun.Stats{{Name: "ok", State: tun.StateConnected, Errors: 4}})
+	if rows[0].Health != Healthy {
+		t.Fatalf("expected healthy, got %s", rows[0].Health)
+	}
+	if len(a.history) != 1 {
+		t.Fatalf("the removed tunnels history was kept")
+	}
+}
+
+func TestSortAndFilter(t *testing.T) {
+	rows := []Row{
+		{Name: "web", BytesInPerSecond: 10},
+		{Name: "db", BytesInPerSecond: 30},
+		{Name: "Website", BytesInPerSecond: 20},
+	}
+	SortRows(rows, 0)
+	if rows[0].Name != "Website" || rows[1].Name != "db" {
+		t.Fatalf("unexpected name order %+v", rows)
+	}
+	SortRows(rows, 6)
+	if rows[0].Name != "db" || rows[2].Name != "web" {
+		t.Fatalf("unexpected rate order %+v", rows)
+	}
+	if filtered := FilterRows(rows, "WEB"); len(filtered) != 2 {
+		t.Fatalf("unexpected filtered rows %+v", filtered)
+	}
+
+	var b bytes.Buffer
+	Render(&b, rows, View{Filter: "db", SortColumn: 6})
+	out := b.String()
+	if !strings.Contains(out, "IN/S*") || !strings.Contains(out, "db") || strings.Contains(out, "web") {
+		t.Fatalf("unexpected dashboard %q", out)
+	}
+}
@@ -0,0 +1,110 @@
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// the ansi escape sequences used by Render
+const (
+	clearScreen = "\x1b[H\x1b[2J"
+	reset       = "\x1b[0m"
+	bold        = "\x1b[1m"
+	reverse     = "\x1b[7m"
+	red         = "\x1b[31m"
+	green       = "\x1b[32m"
+	yellow      = "\x1b[33m"
+)
+
+var healthColors = map[Health]string{
+	Healthy:  green,
+	Degraded: yellow,
+	Failed:   red,
+}
+
+// View is the dashboard state set by the user
+type View struct {
+	// the Columns index the rows are sorted by
+	SortColumn int
+	// the tunnels name filter
+	Filter string
+	// true while the user types the filter
+	EditingFilter bool
+	// the last error getting the stats. Shown in the footer
+	Err error
+}
+
+// cells returns the row values, in the Columns order
+func (r Row) cells() []string {
+	uptime := "-"
+	if r.Uptime > 0 {
+		uptime = r.Uptime.Round(time.Second).String()
+	}
+	return []string{
+		r.Name, r.Direction, r.Local, r.Remote,
+		fmt.Sprint(r.ActiveConns), fmt.Sprint(r.TotalConns),
+		utils.ByteCountSI(int64(r.BytesInPerSecond)), utils.ByteCountSI(int64(r.BytesOutPerSecond)),
+		fmt.Sprint(r.Errors), uptime,
+	}
+}
+
+// Render draws the dashboard on the terminal w, sorting and filtering the
+// rows as set by view. The rows are colored by their health. The lines
+// end with \r\n as the terminal is in raw mode
+func Render(w io.Writer, rows []Row, view View) {
+	rows = FilterRows(append([]Row{}, rows...), view.Filter)
+	SortRows(rows, view.SortColumn)
+
+	table := [][]string{Columns}
+	for _, r := range rows {
+		table = append(table, r.cells())
+	}
+	widths := make([]int, len(Columns))
+	for _, cells := range table {
+		for i, c := range cells {
+			widths[i] = max(widths[i], utf8.RuneCountInString(c))
+		}
+	}
+	line := func(cells []string) string {
+		padded := make([]string, len(cells))
+		for i, c := range cells {
+			padded[i] = c + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c))
+		}
+		return strings.Join(padded, "  ")
+	}
+
+	var b strings.Builder
+	b.WriteString(clearScreen)
+	fmt.Fprintf(&b, "%srospo monitor%s  %s\r\n\r\n", bold, reset, time.Now().Format(time.TimeOnly))
+	header := make([]string, len(Columns))
+	copy(header, Columns)
+	header[view.SortColumn] += "*"
+	widths[view.SortColumn] = max(widths[view.SortColumn], len(header[view.SortColumn]))
+	fmt.Fprintf(&b, "%s%s%s\r\n", reverse, line(header), reset)
+	for i, r := range rows {
+		fmt.Fprintf(&b, "%s%s%s\r\n", healthColors[r.Health], line(table[i+1]), reset)
+	}
+	if len(rows) == 0 {
+		b.WriteString("no tunnels\r\n")
+	}
+
+	b.WriteString("\r\n")
+	if view.Err != nil {
+		fmt.Fprintf(&b, "%serror: %s%s\r\n", red, view.Err, reset)
+	}
+	if view.EditingFilter {
+		fmt.Fprintf(&b, "filter: %s_  (enter: apply, esc: clear)\r\n", view.Filter)
+	} else {
+		filter := ""
+		if view.Filter != "" {
+			filter = fmt.Sprintf("  filter: %q", view.Filter)
+		}
+		fmt.Fprintf(&b, "q: quit  s: sort by the next column  f: filter%s\r\n", filter)
+	}
+	io.WriteString(w, b.String())
+}
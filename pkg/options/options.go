@@ -0,0 +1,56 @@
+// Package options implements the functional options shared by the rospo
+// services. The sshc, sshd, tun, ctl, api, dashboard, health and metrics
+// packages alias Option and wrap its constructors, so that a single
+// logger or tracer setup serves all of them
+package options
+
+import (
+	"log/slog"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Options are the settings built from the Option list
+type Options struct {
+	Logger *slog.Logger
+	// nil if tracing is disabled
+	Tracer trace.Tracer
+}
+
+// Option configures a rospo service
+type Option func(*Options)
+
+// WithLogger sets the service logger. If not set, slog.Default() is used
+func WithLogger(l *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// WithTracer enables the tracing. The services that have no spans
+// ignore it
+func WithTracer(t trace.Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// Build applies opts over the defaults
+func Build(opts []Option) Options {
+	o := Options{
+		Logger: slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// GetTracer returns the configured tracer or a noop one
+func (o Options) GetTracer() trace.Tracer {
+	if o.Tracer == nil {
+		return noop.NewTracerProvider().Tracer("")
+	}
+	return o.Tracer
+}
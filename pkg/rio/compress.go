@@ -0,0 +1,94 @@
+package rio
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// compressedStream compresses the data written to the wrapped stream and
+// decompresses the data read from it. Every write is flushed, so that the
+// interactive protocols are not delayed
+type compressedStream struct {
+	rwc io.ReadWriteCloser
+	r   io.ReadCloser
+
+	w   *flate.Writer
+	wMU sync.Mutex
+}
+
+// ValidateCompressionLevel returns an error if level is neither 0 (the
+// default) nor between flate.BestSpeed and flate.BestCompression
+func ValidateCompressionLevel(level int) error {
+	if level != 0 && (level < flate.BestSpeed || level > flate.BestCompression) {
+		return fmt.Errorf("the compression level must be between %d and %d, or 0 for the default",
+			flate.BestSpeed, flate.BestCompression)
+	}
+	return nil
+}
+
+func newCompressedStream(rwc io.ReadWriteCloser, level int) *compressedStream {
+	level = min(max(level, flate.BestSpeed), flate.BestCompression)
+	// the error is returned for the invalid levels only
+	w, _ := flate.NewWriter(rwc, level)
+	return &compressedStream{
+		rwc: rwc,
+		r:   flate.NewReader(rwc),
+		w:   w,
+	}
+}
+
+func (c *compressedStream) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *compressedStream) Write(p []byte) (int, error) {
+	c.wMU.Lock()
+	defer c.wMU.Unlock()
+	if _, err := c.w.Write(p); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the wrapped stream, making a pending Read return. The flate
+// reader is not closed: its Close is not safe during a Read and it holds
+// no resource
+func (c *compressedStream) Close() error {
+	return c.rwc.Close()
+}
+
+// NewCompressed wraps rwc so that the data is flate compressed on the
+// wire. The other end must be wrapped too. The level is clamped between
+// flate.BestSpeed and flate.BestCompression, the callers reject the
+// others with ValidateCompressionLevel
+func NewCompressed(rwc io.ReadWriteCloser, level int) io.ReadWriteCloser {
+	return newCompressedStream(rwc, level)
+}
+
+type compressedConn struct {
+	net.Conn
+	stream *compressedStream
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	return c.stream.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	return c.stream.Write(p)
+}
+
+func (c *compressedConn) Close() error {
+	return c.stream.Close()
+}
+
+// NewCompressedConn is like NewCompressed for a net.Conn
+func NewCompressedConn(conn net.Conn, level int) net.Conn {
+	return &compressedConn{Conn: conn, stream: newCompressedStream(conn, level)}
+}
@@ -0,0 +1,139 @@
+package rio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingConn counts the bytes written on the wire
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestCompressedConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	counting := &countingConn{Conn: c1}
+	w := NewCompressedConn(counting, 6)
+	r := NewCompressed(c2, 6)
+	defer w.Close()
+	defer r.Close()
+
+	data := []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", 1000))
+	go func() {
+		// more writes, to check the flushed blocks are decoded
+		w.Write(data[:100])
+		w.Write(data[100:])
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the decompressed data doesn't match")
+	}
+	if written := counting.written.Load(); written >= int64(len(data))/10 {
+		t.Fatalf("%d bytes written for %d bytes of text", written, len(data))
+	}
+
+	// the other direction
+	go r.Write([]byte("pong"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(w, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("unexpected reply %q %v", buf, err)
+	}
+}
+
+func TestCompressedConnCloseDuringRead(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := NewCompressedConn(c1, 6)
+
+	done := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 16))
+		done <- err
+	}()
+	// let the Read block on the wire
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("the pending Read didn't fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending Read didn't return on Close")
+	}
+}
+
+func TestValidateCompressionLevel(t *testing.T) {
+	for _, level := range []int{0, 1, 6, 9} {
+		if err := ValidateCompressionLevel(level); err != nil {
+			t.Fatalf("unexpected error for %d: %s", level, err)
+		}
+	}
+	for _, level := range []int{-1, 10} {
+		if err := ValidateCompressionLevel(level); err == nil {
+			t.Fatalf("expected an error for %d", level)
+		}
+	}
+}
+
+// BenchmarkCompressedConn measures the throughput of a compressed stream
+// and the wire bytes ratio. On a Xeon core the repetitive text shrinks
+// below 1% at any level, while the throughput drops from ~800MB/s at
+// level 1 to ~350MB/s at level 6 and ~175MB/s at level 9: far above a
+// slow link bandwidth, so any level pays off there. The random data, like
+// the already compressed one, doesn't shrink and costs the cpu only, so
+// the compression should stay disabled for it and on the fast links
+func BenchmarkCompressedConn(b *testing.B) {
+	text := []byte(strings.Repeat("2024-01-01T00:00:00Z INFO request served path=/api/v1/tunnels status=200\n", 450))
+	random := make([]byte, len(text))
+	rand.Read(random)
+
+	for _, data := range []struct {
+		name string
+		buf  []byte
+	}{{"text", text}, {"random", random}} {
+		for _, level := range []int{0, 1, 6, 9} {
+			b.Run(fmt.Sprintf("%s/level=%d", data.name, level), func(b *testing.B) {
+				c1, c2 := net.Pipe()
+				counting := &countingConn{Conn: c1}
+				var w io.WriteCloser = counting
+				var r io.ReadCloser = c2
+				if level > 0 {
+					w = NewCompressedConn(counting, level)
+					r = NewCompressed(c2, level)
+				}
+				defer w.Close()
+				go io.Copy(io.Discard, r)
+
+				b.SetBytes(int64(len(data.buf)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := w.Write(data.buf); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(counting.written.Load())/float64(int64(b.N)*int64(len(data.buf))), "wire/byte")
+			})
+		}
+	}
+}
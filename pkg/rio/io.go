@@ -2,15 +2,40 @@ package rio
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"sync"
 )
 
-// borrowed from the official go io package with some changes to support
-// throughput metrics
+// DefaultBufferSize is the copy loops buffer size if not configured. It
+// is the io.Copy one
+const DefaultBufferSize = 32 * 1024
+
+// MinBufferSize is the smallest buffer size accepted by ValidateBufferSize
+const MinBufferSize = 4 * 1024
+
+// ValidateBufferSize returns an error if size is neither 0 (the default)
+// nor at least MinBufferSize
+func ValidateBufferSize(size int) error {
+	if size != 0 && size < MinBufferSize {
+		return fmt.Errorf("the buffer size must be at least %d bytes", MinBufferSize)
+	}
+	return nil
+}
+
+// CopyBuffer copies from src to dst with a DefaultBufferSize buffer
 func CopyBuffer(dst io.Writer, src io.Reader, wch chan int64) (err error) {
+	return CopyBufferSize(dst, src, wch, DefaultBufferSize)
+}
+
+// CopyBufferSize copies from src to dst with a size bytes buffer. Borrowed
+// from the official go io package with some changes to support throughput
+// metrics
+func CopyBufferSize(dst io.Writer, src io.Reader, wch chan int64, size int) (err error) {
 	var buf []byte
-	size := 32 * 1024
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
 	if l, ok := src.(*io.LimitedReader); ok && int64(size) > l.N {
 		if l.N < 1 {
 			size = 1
@@ -53,11 +78,13 @@ func CopyBuffer(dst io.Writer, src io.Reader, wch chan int64) (err error) {
 }
 
 // CopyConnWithOnClose copy packets from c1 to c2 and viceversa. Calls the onClose function
-// when the connection is interrupted
+// when the connection is interrupted. Each direction uses a bufferSize
+// bytes buffer, DefaultBufferSize if 0
 func CopyConnWithOnClose(
 	c1 io.ReadWriteCloser,
 	c2 io.ReadWriteCloser,
 	metrics bool,
+	bufferSize int,
 	onClose func()) chan int64 {
 
 	var bw chan int64
@@ -78,13 +105,13 @@ func CopyConnWithOnClose(
 
 	wg.Add(2)
 	go func() {
-		CopyBuffer(c1, c2, bw)
+		CopyBufferSize(c1, c2, bw, bufferSize)
 		once.Do(connClose)
 		wg.Done()
 	}()
 
 	go func() {
-		CopyBuffer(c2, c1, bw)
+		CopyBufferSize(c2, c1, bw, bufferSize)
 		once.Do(connClose)
 		wg.Done()
 	}()
@@ -101,5 +128,5 @@ func CopyConnWithOnClose(
 
 // CopyConn copy packets from c1 to c2 and viceversa
 func CopyConn(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser) {
-	CopyConnWithOnClose(c1, c2, false, func() {})
+	CopyConnWithOnClose(c1, c2, false, DefaultBufferSize, func() {})
 }
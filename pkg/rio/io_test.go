@@ -1,7 +1,9 @@
 package rio
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -115,7 +117,7 @@ func TestCopyConnWithOnClose(t *testing.T) {
 				log.Fatal(err)
 			}
 			conn, _ := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%s", port1))
-			bw := CopyConnWithOnClose(conn, client, true, func() {})
+			bw := CopyConnWithOnClose(conn, client, true, 0, func() {})
 			var totalBytes int64
 			totalBytes = 0
 			for w := range bw {
@@ -137,3 +139,46 @@ func TestCopyConnWithOnClose(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// maxReadReader records the biggest buffer it was asked to fill
+type maxReadReader struct {
+	io.Reader
+	max int
+}
+
+func (r *maxReadReader) Read(p []byte) (int, error) {
+	r.max = max(r.max, len(p))
+	return r.Reader.Read(p)
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	payload := bytes.Repeat([]byte("rospo"), 100*1024)
+	for _, size := range []int{0, MinBufferSize, 256 * 1024} {
+		src := &maxReadReader{Reader: bytes.NewReader(payload)}
+		dst := &bytes.Buffer{}
+		if err := CopyBufferSize(dst, src, nil, size); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dst.Bytes(), payload) {
+			t.Fatalf("size %d: the data was not copied", size)
+		}
+		expected := size
+		if size == 0 {
+			expected = DefaultBufferSize
+		}
+		if src.max != expected {
+			t.Fatalf("size %d: unexpected buffer size %d", size, src.max)
+		}
+	}
+
+	for _, size := range []int{0, MinBufferSize, 1024 * 1024} {
+		if err := ValidateBufferSize(size); err != nil {
+			t.Fatalf("unexpected error for %d: %s", size, err)
+		}
+	}
+	for _, size := range []int{-1, 1, MinBufferSize - 1} {
+		if err := ValidateBufferSize(size); err == nil {
+			t.Fatalf("expected an error for %d", size)
+		}
+	}
+}
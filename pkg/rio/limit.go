@@ -0,0 +1,43 @@
+package rio
+
+import (
+	"io"
+	"time"
+)
+
+// rateLimitedReader is an io.Reader reading at most bytesPerSecond
+type rateLimitedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+// NewRateLimitedReader returns a reader that reads from r at most
+// bytesPerSecond on average. r is returned as is if bytesPerSecond is
+// not positive
+func NewRateLimitedReader(r io.Reader, bytesPerSecond int64) io.Reader {
+	if bytesPerSecond <= 0 {
+		return r
+	}
+	return &rateLimitedReader{r: r, bytesPerSecond: bytesPerSecond}
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if l.start.IsZero() {
+		l.start = time.Now()
+	}
+	// the reads are split so that they take ~100ms each at most
+	if chunk := l.bytesPerSecond / 10; chunk > 0 && int64(len(p)) > chunk {
+		p = p[:chunk]
+	} else if chunk == 0 && len(p) > 1 {
+		p = p[:1]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	due := time.Duration(float64(l.read) / float64(l.bytesPerSecond) * float64(time.Second))
+	if wait := due - time.Since(l.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
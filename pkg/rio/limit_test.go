@@ -0,0 +1,29 @@
+package rio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	payload := bytes.Repeat([]byte("rospo"), 20*1024)
+	if r := NewRateLimitedReader(bytes.NewReader(payload), 0); r == nil {
+		t.Fatal("expected the reader")
+	}
+
+	// 100kB at 200kB/s
+	start := time.Now()
+	got, err := io.ReadAll(NewRateLimitedReader(bytes.NewReader(payload), 200*1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if !bytes.Equal(got, payload) {
+		t.Fatal("the data was not read")
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("unexpected read time %s", elapsed)
+	}
+}
@@ -0,0 +1,194 @@
+package rospo
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/ferama/rospo/pkg/ctl"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+	"gopkg.in/yaml.v3"
+)
+
+// namedConnection is an ssh connection as listed by the status command
+type namedConnection struct {
+	name string
+	conn *sshc.SshConnection
+}
+
+// control serves the commands of the control socket
+type control struct {
+	cfg        *conf.Config
+	configFile string
+	tunnels    *TunnelManager
+	// the sshd server. nil if not configured
+	sshServer SSHServerI
+	// the connections of the services other than the tunnels
+	connections []namedConnection
+}
+
+func (c *control) register(s *ctl.Server) {
+	s.Handle("list", c.list)
+	s.Handle("add", c.add)
+	s.Handle("stop", ctl.TextHandler(c.stop))
+	s.Handle("disconnect", c.disconnect)
+	s.Handle("status", ctl.TextHandler(c.status))
+	s.Handle("reload", ctl.TextHandler(c.reload))
+	s.Handle("pause", ctl.TextHandler(c.tunnels.tunnelsCommand((*tun.Tunnel).Pause)))
+	s.Handle("resume", ctl.TextHandler(c.tunnels.tunnelsCommand((*tun.Tunnel).Resume)))
+}
+
+// table formats the rows as aligned columns
+func table(header []string, rows [][]string) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+	return b.String()
+}
+
+// list shows the tunnels with their state. The data is the tunnels
+// []tun.Stats
+func (c *control) list(req *ctl.Request) (*ctl.Reply, error) {
+	rows := [][]string{}
+	stats := []tun.Stats{}
+	for _, mt := range c.tunnels.list() {
+		t := mt.tunnel
+		direction := "reverse"
+		if t.GetIsListenerLocal() {
+			direction = "forward"
+		}
+		listener := "-"
+		if addr := t.GetListenerAddr(); addr != nil {
+			listener = addr.String()
+		}
+		rows = append(rows, []string{
+			t.GetName(), direction, string(t.State()), listener,
+			fmt.Sprint(t.GetActiveClientsCount()),
+		})
+		stats = append(stats, t.Stats())
+	}
+	return ctl.NewReply(table([]string{"NAME", "DIRECTION", "STATE", "LISTENER", "CLIENTS"}, rows), stats)
+}
+
+// add starts the tunnel of the request body, a json tun.TunnelConf. The
+// data is the tunnel tun.Stats
+func (c *control) add(req *ctl.Request) (*ctl.Reply, error) {
+	conf := &tun.TunnelConf{}
+	if err := json.Unmarshal(req.Body, conf); err != nil {
+		return nil, fmt.Errorf("invalid tunnel: %w", err)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	// the tunnels are stopped by name
+	if len(c.tunnels.find(conf.GetName())) > 0 {
+		return nil, fmt.Errorf("tunnel %q already exists", conf.GetName())
+	}
+	t, err := c.tunnels.Add(conf)
+	if err != nil {
+		return nil, err
+	}
+	stats := t.Stats()
+	return ctl.NewReply(fmt.Sprintf("tunnel %s added\n", stats.Name), stats)
+}
+
+// stop stops the tunnels named as the args
+func (c *control) stop(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("missing tunnel name")
+	}
+	for _, name := range args {
+		if err := c.tunnels.Remove(name); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// disconnect kicks the sshd clients logged in with the fingerprints
+// of the args. The data is the disconnected clients count
+func (c *control) disconnect(req *ctl.Request) (*ctl.Reply, error) {
+	if c.sshServer == nil {
+		return nil, fmt.Errorf("sshd not configured")
+	}
+	if len(req.Args) == 0 {
+		return nil, fmt.Errorf("missing client fingerprint")
+	}
+	n := 0
+	for _, fp := range req.Args {
+		n += c.sshServer.DisconnectClient(fp)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("no client logged in with %s", strings.Join(req.Args, ", "))
+	}
+	return ctl.NewReply(fmt.Sprintf("%d clients disconnected\n", n), map[string]int{"disconnected": n})
+}
+
+// allConnections lists the services connections and the tunnels
+// dedicated ones
+func allConnections(connections []namedConnection, tunnels *TunnelManager) []namedConnection {
+	all := append([]namedConnection{}, connections...)
+	for _, mt := range tunnels.list() {
+		if mt.conn != nil {
+			all = append(all, namedConnection{
+				name: fmt.Sprintf("tunnel %s", mt.tunnel.GetName()),
+				conn: mt.conn.SshConnection,
+			})
+		}
+	}
+	return all
+}
+
+// status shows the ssh connections state
+func (c *control) status(args []string) (string, error) {
+	rows := [][]string{}
+	for _, nc := range allConnections(c.connections, c.tunnels) {
+		endpoint := nc.conn.GetServerEndpoint()
+		rows = append(rows, []string{nc.name, endpoint.String(), nc.conn.GetConnectionStatus()})
+	}
+	return table([]string{"NAME", "SERVER", "STATUS"}, rows), nil
+}
+
+// reload reads the config file again and applies the tunnels changes.
+// The changes of the other sections need a restart
+func (c *control) reload(args []string) (string, error) {
+	if c.configFile == "" {
+		return "", fmt.Errorf("the config file path is not known")
+	}
+	cfg, err := conf.LoadConfig(c.configFile)
+	if err != nil {
+		return "", err
+	}
+	summary, err := c.tunnels.Reload(cfg.Tunnel)
+	if err != nil {
+		return "", err
+	}
+
+	sections := []struct {
+		name      string
+		old, curr any
+	}{
+		{"sshclient", c.cfg.SshClient, cfg.SshClient},
+		{"sshd", c.cfg.SshD, cfg.SshD},
+		{"socksproxy", c.cfg.SocksProxy, cfg.SocksProxy},
+		{"health_addr", c.cfg.HealthAddr, cfg.HealthAddr},
+		{"management_socket", c.cfg.ManagementSocket, cfg.ManagementSocket},
+		{"dashboard", c.cfg.Dashboard, cfg.Dashboard},
+	}
+	lines := []string{summary}
+	for _, s := range sections {
+		old, _ := yaml.Marshal(s.old)
+		curr, _ := yaml.Marshal(s.curr)
+		if string(old) != string(curr) {
+			lines = append(lines, fmt.Sprintf("%s changed: restart rospo to apply it", s.name))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,29 @@
+package rospo
+
+import (
+	"github.com/ferama/rospo/pkg/dashboard"
+)
+
+// dashboardSource provides the web dashboard data
+type dashboardSource struct {
+	r *Rospo
+}
+
+func (d dashboardSource) Status() dashboard.Status {
+	status := dashboard.Status{
+		Tunnels:     apiTunnels{d.r.TunnelManager}.Tunnels(),
+		Connections: []dashboard.Connection{},
+	}
+	for _, nc := range allConnections(d.r.connections, d.r.TunnelManager) {
+		endpoint := nc.conn.GetServerEndpoint()
+		status.Connections = append(status.Connections, dashboard.Connection{
+			Name:   nc.name,
+			Server: endpoint.String(),
+			Status: nc.conn.GetConnectionStatus(),
+		})
+	}
+	if d.r.SSHServer != nil {
+		status.SshdClients = d.r.SSHServer.GetConnectedClients()
+	}
+	return status
+}
@@ -0,0 +1,79 @@
+package rospo
+
+import (
+	"context"
+	"io"
+
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+	"golang.org/x/crypto/ssh"
+)
+
+// TunnelI is a tunnel as seen by the library users
+type TunnelI interface {
+	// Start activates the tunnel. It blocks until ctx is canceled or
+	// Stop is called
+	Start(ctx context.Context)
+	Stop()
+	Stats() tun.Stats
+}
+
+// SSHClientI is an ssh client as seen by the library users
+type SSHClientI interface {
+	// ConnectWithContext connects to the server in the background and
+	// waits until the connection is established
+	ConnectWithContext(ctx context.Context) error
+	IsConnected() bool
+	// RunCommand runs cmd on the server and returns its exit code
+	RunCommand(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+}
+
+// SSHServerI is an sshd server as seen by the library users
+type SSHServerI interface {
+	// Start listens for the clients. It blocks until ctx is canceled or
+	// Stop is called. It returns an error if it can't listen
+	Start(ctx context.Context) error
+	Stop()
+	GetConnectedClients() []sshd.ConnectedClient
+	// DisconnectClient closes the connections of the clients logged in
+	// with the public key fingerprint and returns how many were closed
+	DisconnectClient(fingerprint string) int
+}
+
+// the sshd server type is not exported: NewSSHServer checks it
+var (
+	_ TunnelI    = (*tun.Tunnel)(nil)
+	_ SSHClientI = (*sshc.SshConnection)(nil)
+)
+
+// NewTunnel builds a stoppable tunnel on the client connection
+func NewTunnel(client *sshc.SshConnection, conf *tun.TunnelConf, opts ...tun.Option) TunnelI {
+	return tun.NewTunnel(client, conf, true, opts...)
+}
+
+// NewTunnelWithClient builds a stoppable tunnel on an ssh client the
+// caller connected. The tunnel never reconnects nor closes it
+func NewTunnelWithClient(client *ssh.Client, conf *tun.TunnelConf, opts ...tun.Option) TunnelI {
+	return tun.NewTunnelWithClient(client, conf, opts...)
+}
+
+// NewSSHClient builds an ssh client. It doesn't connect until
+// ConnectWithContext is called. It returns an error if conf is not valid
+func NewSSHClient(conf *sshc.SshClientConf, opts ...sshc.Option) (SSHClientI, error) {
+	conn, err := sshc.NewSshConnection(conf, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// NewSSHServer builds an sshd server. It doesn't listen until Start
+// is called. It returns an error if conf is not valid
+func NewSSHServer(conf *sshd.SshDConf, opts ...sshd.Option) (SSHServerI, error) {
+	server, err := sshd.NewSshServer(conf, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
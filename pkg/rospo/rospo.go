@@ -0,0 +1,494 @@
+package rospo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/ferama/rospo/pkg/api"
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/ferama/rospo/pkg/ctl"
+	"github.com/ferama/rospo/pkg/dashboard"
+	"github.com/ferama/rospo/pkg/health"
+	"github.com/ferama/rospo/pkg/metrics"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrNothingToRun is returned by Run if the config doesn't enable
+// any service
+var ErrNothingToRun = errors.New("nothing to run")
+
+type options struct {
+	logger   *slog.Logger
+	recorder metrics.Recorder
+	// nil if tracing is disabled
+	tracer trace.Tracer
+	pool   *sshc.ConnectionPool
+	// the config file, read again on reload
+	configFile string
+	// the api address. If empty the sshd api_addr is used
+	apiAddr string
+	// the dashboard address. If empty the dashboard listen_address is used
+	dashboardAddr string
+}
+
+// Option configures Run
+type Option func(*options)
+
+// WithLogger sets the logger used by all the services. If not set,
+// slog.Default() is used
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithMetricsRecorder sets the recorder that collects the services
+// events. If not set, the events are discarded
+func WithMetricsRecorder(recorder metrics.Recorder) Option {
+	return func(o *options) {
+		o.recorder = recorder
+	}
+}
+
+// WithTracer enables the tracing of the ssh connections, of the tunnels
+// and of the sshd forwards
+func WithTracer(t trace.Tracer) Option {
+	return func(o *options) {
+		o.tracer = t
+	}
+}
+
+// WithConnectionPool makes the ssh clients share the connections of the
+// pool: the tunnels and the socks proxy with the same sshclient
+// configuration use a single connection. The pool is not closed by Run
+func WithConnectionPool(pool *sshc.ConnectionPool) Option {
+	return func(o *options) {
+		o.pool = pool
+	}
+}
+
+// WithConfigFile sets the file cfg was loaded from. The control socket
+// reload command reads it again to apply the tunnels changes
+func WithConfigFile(path string) Option {
+	return func(o *options) {
+		o.configFile = path
+	}
+}
+
+// WithAPIAddr serves the rest management api on addr, overriding the
+// sshd api_addr config value
+func WithAPIAddr(addr string) Option {
+	return func(o *options) {
+		o.apiAddr = addr
+	}
+}
+
+// WithDashboardAddr serves the web dashboard on addr, overriding the
+// dashboard listen_address config value
+func WithDashboardAddr(addr string) Option {
+	return func(o *options) {
+		o.dashboardAddr = addr
+	}
+}
+
+// Rospo runs the services of a config: the sshd server, the ssh
+// clients, the tunnels, the socks proxy, the health probes and the
+// control socket. Build it with New
+type Rospo struct {
+	// the tunnels. They can be added and removed while running
+	TunnelManager *TunnelManager
+	// the sshd server. nil if not configured
+	SSHServer SSHServerI
+	// the global ssh client. nil if not configured
+	SSHClient SSHClientI
+
+	cfg *conf.Config
+	o   options
+
+	sshConn      *connection
+	healthServer *health.Server
+	healthAddr   string
+	// the services ssh connections, listed by the status control command
+	connections []namedConnection
+	// the socks proxy ssh connection. nil if not configured
+	socksConn *sshc.SshConnection
+	// the dedicated socks proxy connection. nil if it uses the global one
+	socksOwnConn *connection
+	// the http proxy ssh connection. nil if not configured
+	httpConn *sshc.SshConnection
+	// the dedicated http proxy connection. nil if it uses the global one
+	httpOwnConn *connection
+
+	// the rest management api. nil if not configured
+	apiServer *api.Server
+	// the web dashboard. nil if not configured
+	dashboardServer *dashboard.Server
+
+	// the background services failures
+	errCh chan error
+
+	started bool
+	stopped bool
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+}
+
+// New builds the services configured in cfg without starting them.
+// The ssh connections of a connection pool are the exception, as the
+// pool starts them
+func New(cfg *conf.Config, opts ...Option) (*Rospo, error) {
+	o := options{
+		logger:   slog.Default(),
+		recorder: metrics.Nop,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if cfg.SshClient == nil {
+		for _, c := range cfg.Tunnel {
+			if c.SshClientConf == nil {
+				return nil, fmt.Errorf("you need to configure sshclient section to support tunnel")
+			}
+		}
+		if cfg.SocksProxy != nil && cfg.SocksProxy.SshClientConf == nil {
+			return nil, fmt.Errorf("you need to configure sshclient section to support socks proxy")
+		}
+		if cfg.HTTPProxy != nil && cfg.HTTPProxy.SshClientConf == nil {
+			return nil, fmt.Errorf("you need to configure sshclient section to support http proxy")
+		}
+	}
+	if cfg.SshClient == nil && cfg.SshD == nil && len(cfg.Tunnel) == 0 && cfg.SocksProxy == nil && cfg.HTTPProxy == nil {
+		return nil, ErrNothingToRun
+	}
+
+	r := &Rospo{
+		cfg:   cfg,
+		o:     o,
+		errCh: make(chan error, 5),
+	}
+	r.healthAddr = cfg.HealthAddr
+	if r.healthAddr == "" && cfg.SshD != nil {
+		r.healthAddr = cfg.SshD.HealthAddr
+	}
+	r.healthServer = health.NewServer(r.healthAddr, health.WithLogger(o.logger))
+
+	sshdOpts := []sshd.Option{sshd.WithLogger(o.logger)}
+	tunOpts := []tun.Option{tun.WithLogger(o.logger)}
+	if o.tracer != nil {
+		sshdOpts = append(sshdOpts, sshd.WithTracer(o.tracer))
+		tunOpts = append(tunOpts, tun.WithTracer(o.tracer))
+	}
+
+	var sshConn *sshc.SshConnection
+	if cfg.SshClient != nil {
+		var err error
+		r.sshConn, err = r.newConnection(cfg.SshClient)
+		if err != nil {
+			return nil, err
+		}
+		sshConn = r.sshConn.SshConnection
+		r.SSHClient = sshConn
+		r.connections = append(r.connections, namedConnection{name: "sshclient", conn: sshConn})
+		r.healthServer.AddCheck("sshclient", health.ConnectionCheck(sshConn))
+	}
+
+	if cfg.SshD != nil {
+		sshServer, err := sshd.NewSshServer(cfg.SshD, sshdOpts...)
+		if err != nil {
+			r.release()
+			return nil, err
+		}
+		sshServer.SetMetricsRecorder(o.recorder)
+		r.healthServer.AddCheck("sshd", health.ListenerCheck(sshServer))
+		r.SSHServer = sshServer
+	}
+
+	r.TunnelManager = &TunnelManager{
+		sshConn:       sshConn,
+		newConnection: r.newConnection,
+		healthServer:  r.healthServer,
+		tunOpts:       tunOpts,
+		recorder:      o.recorder,
+	}
+	for _, c := range cfg.Tunnel {
+		if _, err := r.TunnelManager.add(c); err != nil {
+			r.release()
+			return nil, err
+		}
+	}
+
+	apiAddr, apiToken := o.apiAddr, os.Getenv("ROSPO_API_TOKEN")
+	if cfg.SshD != nil {
+		if apiAddr == "" {
+			apiAddr = cfg.SshD.APIAddr
+		}
+		if cfg.SshD.APIToken != "" {
+			apiToken = cfg.SshD.APIToken
+		}
+	}
+	if apiAddr != "" {
+		if apiToken == "" {
+			r.release()
+			return nil, fmt.Errorf("the api needs a token: set the sshd api_token or the ROSPO_API_TOKEN env var")
+		}
+		r.apiServer = api.NewServer(apiAddr, apiToken, apiTunnels{r.TunnelManager}, r.SSHServer, r.healthServer,
+			api.WithLogger(o.logger))
+	}
+
+	dashboardConf := dashboard.Conf{}
+	if cfg.Dashboard != nil {
+		dashboardConf = *cfg.Dashboard
+	}
+	if o.dashboardAddr != "" {
+		dashboardConf.ListenAddress = o.dashboardAddr
+	}
+	if dashboardConf.ListenAddress != "" {
+		r.dashboardServer = dashboard.NewServer(&dashboardConf, dashboardSource{r}, dashboard.WithLogger(o.logger))
+	}
+
+	if cfg.SocksProxy != nil {
+		r.socksConn = sshConn
+		if cfg.SocksProxy.SshClientConf != nil {
+			var err error
+			r.socksOwnConn, err = r.newConnection(cfg.SocksProxy.SshClientConf)
+			if err != nil {
+				r.release()
+				return nil, err
+			}
+			r.socksConn = r.socksOwnConn.SshConnection
+			r.connections = append(r.connections, namedConnection{name: "socksproxy", conn: r.socksConn})
+		}
+	}
+	if cfg.HTTPProxy != nil {
+		r.httpConn = sshConn
+		if cfg.HTTPProxy.SshClientConf != nil {
+			var err error
+			r.httpOwnConn, err = r.newConnection(cfg.HTTPProxy.SshClientConf)
+			if err != nil {
+				r.release()
+				return nil, err
+			}
+			r.httpConn = r.httpOwnConn.SshConnection
+			r.connections = append(r.connections, namedConnection{name: "httpproxy", conn: r.httpConn})
+		}
+	}
+	return r, nil
+}
+
+// release gives back the pool connections, and closes the sshd server
+// audit log, of a Rospo instance New failed to build
+func (r *Rospo) release() {
+	for _, conn := range []*connection{r.sshConn, r.socksOwnConn, r.httpOwnConn} {
+		if conn != nil {
+			conn.stop()
+		}
+	}
+	if r.TunnelManager != nil {
+		r.TunnelManager.close()
+	}
+	if r.SSHServer != nil {
+		r.SSHServer.Stop()
+	}
+}
+
+// newConnection builds an ssh connection, or gets it from the pool
+func (r *Rospo) newConnection(c *sshc.SshClientConf) (*connection, error) {
+	if r.o.pool != nil {
+		conn, err := r.o.pool.Get(c)
+		if err != nil {
+			return nil, err
+		}
+		return &connection{
+			SshConnection: conn,
+			stop:          sync.OnceFunc(func() { r.o.pool.Release(conn) }),
+		}, nil
+	}
+	sshcOpts := []sshc.Option{sshc.WithLogger(r.o.logger)}
+	if r.o.tracer != nil {
+		sshcOpts = append(sshcOpts, sshc.WithTracer(r.o.tracer))
+	}
+	conn, err := sshc.NewSshConnection(c, sshcOpts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMetricsRecorder(r.o.recorder)
+	return &connection{
+		SshConnection: conn,
+		start: func(ctx context.Context) {
+			if err := conn.Start(ctx); err != nil {
+				r.reportErr(err)
+			}
+		},
+		stop: conn.Stop,
+	}, nil
+}
+
+// reportErr hands the result of a background service to Start without
+// blocking. The first failure is enough to stop the services: the later
+// ones, like the errors caused by the shutdown, are dropped
+func (r *Rospo) reportErr(err error) {
+	select {
+	case r.errCh <- err:
+	default:
+	}
+}
+
+// Start starts all the services. It blocks until ctx is canceled, Stop
+// is called or a service fails, then it stops them all. A nil error is
+// returned if the services were stopped because ctx was canceled or
+// because of Stop. Start can be called only once
+func (r *Rospo) Start(ctx context.Context) error {
+	// the services started with ctx are stopped when it is canceled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r.mu.Lock()
+	if r.started {
+		r.mu.Unlock()
+		return fmt.Errorf("already started")
+	}
+	r.started = true
+	if r.stopped {
+		r.mu.Unlock()
+		return nil
+	}
+	r.cancel = cancel
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	start := func(fn func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(ctx)
+		}()
+	}
+	// stop functions of the services that don't take a context, called
+	// in reverse order on shutdown
+	stops := []func(){}
+
+	if r.sshConn != nil {
+		if r.sshConn.start != nil {
+			start(r.sshConn.start)
+		}
+		stops = append(stops, r.sshConn.stop)
+	}
+
+	if r.SSHServer != nil {
+		start(func(ctx context.Context) {
+			if err := r.SSHServer.Start(ctx); err != nil {
+				r.reportErr(err)
+			}
+		})
+	}
+
+	r.TunnelManager.start(start)
+	stops = append(stops, r.TunnelManager.close)
+
+	if r.cfg.SocksProxy != nil {
+		if r.socksOwnConn != nil {
+			if r.socksOwnConn.start != nil {
+				start(r.socksOwnConn.start)
+			}
+			stops = append(stops, r.socksOwnConn.stop)
+		}
+		sockProxy := sshc.NewSocksProxy(r.socksConn)
+		go func() {
+			r.reportErr(sockProxy.Start(r.cfg.SocksProxy.ListenAddress))
+		}()
+		stops = append(stops, sockProxy.Stop)
+	}
+
+	if r.cfg.HTTPProxy != nil {
+		if r.httpOwnConn != nil {
+			if r.httpOwnConn.start != nil {
+				start(r.httpOwnConn.start)
+			}
+			stops = append(stops, r.httpOwnConn.stop)
+		}
+		gateway := tun.NewHTTPConnectGateway(r.httpConn, tun.WithLogger(r.o.logger))
+		go func() {
+			r.reportErr(gateway.Start(r.cfg.HTTPProxy.ListenAddress))
+		}()
+		stops = append(stops, gateway.Stop)
+	}
+
+	if r.cfg.ManagementSocket != "" {
+		ctlServer := ctl.NewServer(r.cfg.ManagementSocket, ctl.WithLogger(r.o.logger))
+		c := &control{
+			cfg:         r.cfg,
+			configFile:  r.o.configFile,
+			tunnels:     r.TunnelManager,
+			sshServer:   r.SSHServer,
+			connections: r.connections,
+		}
+		c.register(ctlServer)
+		go func() {
+			r.reportErr(ctlServer.Start())
+		}()
+		stops = append(stops, func() { ctlServer.Stop() })
+	}
+
+	if r.apiServer != nil {
+		go func() {
+			r.reportErr(r.apiServer.Start())
+		}()
+		stops = append(stops, func() { r.apiServer.Stop() })
+	}
+
+	if r.dashboardServer != nil {
+		go func() {
+			r.reportErr(r.dashboardServer.Start())
+		}()
+		stops = append(stops, func() { r.dashboardServer.Stop() })
+	}
+
+	if r.healthAddr != "" {
+		go func() {
+			r.reportErr(r.healthServer.Start())
+		}()
+		stops = append(stops, func() { r.healthServer.Stop() })
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-r.errCh:
+	}
+	for i := len(stops) - 1; i >= 0; i-- {
+		stops[i]()
+	}
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// Stop stops the services started by Start, making it return
+func (r *Rospo) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Run builds the services configured in cfg and starts them. It blocks
+// until ctx is canceled or a service fails, then it stops them all.
+// A nil error is returned if the services were stopped because ctx
+// was canceled
+func Run(ctx context.Context, cfg *conf.Config, opts ...Option) error {
+	r, err := New(cfg, opts...)
+	if err != nil {
+		return err
+	}
+	return r.Start(ctx)
+}
@@ -0,0 +1,551 @@
+package rospo
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ferama/rospo/pkg/conf"
+	"github.com/ferama/rospo/pkg/ctl"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/tun"
+	"gopkg.in/yaml.v3"
+)
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func startEchoService(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go io.Copy(conn, conn)
+	}
+}
+
+func TestRun(t *testing.T) {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	sshdAddr := freeAddr(t)
+	tunnelAddr := freeAddr(t)
+	cfg := &conf.Config{
+		SshD: &sshd.SshDConf{
+			Key:               "../../testdata/server",
+			AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+			ListenAddress:     sshdAddr,
+		},
+		SshClient: &sshc.SshClientConf{
+			Identity:  sshc.Identities{"../../testdata/client"},
+			Insecure:  true,
+			ServerURI: sshdAddr,
+		},
+		Tunnel: []*tun.TunnelConf{
+			{
+				Remote:  echoListener.Addr().String(),
+				Local:   tunnelAddr,
+				Forward: true,
+			},
+		},
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, cfg, WithLogger(logger))
+	}()
+
+	echo := func() error {
+		conn, err := net.Dial("tcp", tunnelAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "ping\n" {
+			return fmt.Errorf("unexpected reply '%s'", line)
+		}
+		return nil
+	}
+	for i := 0; i < 40; i++ {
+		if err = echo(); err == nil {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("the tunnel is not working: %s", err)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context cancellation")
+	}
+
+	// the listeners are closed
+	for _, addr := range []string{sshdAddr, tunnelAddr} {
+		var conn net.Conn
+		for i := 0; i < 20; i++ {
+			if conn, err = net.Dial("tcp", addr); err != nil {
+				break
+			}
+			conn.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err == nil {
+			t.Fatalf("%s is still listening", addr)
+		}
+	}
+}
+
+func TestRunManagementSocket(t *testing.T) {
+	sshdAddr := freeAddr(t)
+	tunnelAddr := freeAddr(t)
+	socket := filepath.Join(t.TempDir(), "rospo.sock")
+	cfg := &conf.Config{
+		SshD: &sshd.SshDConf{
+			Key:               "../../testdata/server",
+			AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+			ListenAddress:     sshdAddr,
+		},
+		SshClient: &sshc.SshClientConf{
+			Identity:  sshc.Identities{"../../testdata/client"},
+			Insecure:  true,
+			ServerURI: sshdAddr,
+		},
+		Tunnel: []*tun.TunnelConf{
+			{
+				Name:    "web",
+				Remote:  sshdAddr,
+				Local:   tunnelAddr,
+				Forward: true,
+			},
+		},
+		ManagementSocket: socket,
+	}
+
+	configFile := filepath.Join(t.TempDir(), "rospo.yaml")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, cfg, WithLogger(logger), WithConfigFile(configFile))
+
+	listening := func() bool {
+		conn, err := net.Dial("tcp", tunnelAddr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	waitListening := func(expected bool) {
+		for i := 0; i < 40; i++ {
+			if listening() == expected {
+				return
+			}
+			time.Sleep(250 * time.Millisecond)
+		}
+		t.Fatalf("expected the tunnel listening %v", expected)
+	}
+	waitListening(true)
+
+	// a raw framed list request
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte(`{"command": "list"}`)
+	conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...))
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	var listReply struct {
+		Data []tun.Stats `json:"data"`
+	}
+	if err := json.Unmarshal(data, &listReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(listReply.Data) != 1 || listReply.Data[0].Name != "web" || !listReply.Data[0].Forward {
+		t.Fatalf("unexpected list reply %s", data)
+	}
+
+	// add and stop a tunnel
+	body, _ := json.Marshal(&tun.TunnelConf{Name: "extra", Remote: sshdAddr, Local: "127.0.0.1:0", Forward: true})
+	reply, err := ctl.Do(socket, &ctl.Request{Command: "add", Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(reply.Data), `"name":"extra"`) {
+		t.Fatalf("unexpected add reply %s", reply.Data)
+	}
+	if _, err := ctl.Do(socket, &ctl.Request{Command: "add", Body: body}); err == nil {
+		t.Fatal("expected an error adding a duplicated tunnel")
+	}
+	if _, err := ctl.Send(socket, "stop", "extra"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctl.Send(socket, "stop", "extra"); err == nil {
+		t.Fatal("expected an error stopping a missing tunnel")
+	}
+	if _, err := ctl.Send(socket, "disconnect", "SHA256:unknown"); err == nil {
+		t.Fatal("expected an error disconnecting an unknown client")
+	}
+
+	if _, err := ctl.Send(socket, "pause", "web"); err != nil {
+		t.Fatal(err)
+	}
+	waitListening(false)
+	if _, err := ctl.Send(socket, "resume", "web"); err != nil {
+		t.Fatal(err)
+	}
+	waitListening(true)
+
+	if _, err := ctl.Send(socket, "pause", "missing"); err == nil {
+		t.Fatal("expected an error for an unknown tunnel")
+	}
+
+	out, err := ctl.Send(socket, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "sshclient") || !strings.Contains(out, sshc.STATUS_CONNECTED) {
+		t.Fatalf("unexpected status %q", out)
+	}
+
+	// the reload starts the new tunnels and stops the removed ones
+	reverseAddr := freeAddr(t)
+	data, err = yaml.Marshal(&conf.Config{
+		SshD:      cfg.SshD,
+		SshClient: cfg.SshClient,
+		Tunnel: []*tun.TunnelConf{
+			{
+				Name:    "api",
+				Remote:  reverseAddr,
+				Local:   sshdAddr,
+				Forward: false,
+			},
+		},
+		ManagementSocket: socket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err = ctl.Send(socket, "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "1 added, 1 removed, 0 unchanged") {
+		t.Fatalf("unexpected reload summary %q", out)
+	}
+	waitListening(false)
+	for i := 0; i < 40; i++ {
+		out, err = ctl.Send(socket, "list")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out, "api") && strings.Contains(out, string(tun.StateConnected)) {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if strings.Contains(out, "web") || !strings.Contains(out, string(tun.StateConnected)) {
+		t.Fatalf("unexpected tunnels list %q", out)
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	ctx := context.Background()
+	if err := Run(ctx, &conf.Config{}); !errors.Is(err, ErrNothingToRun) {
+		t.Fatalf("expected ErrNothingToRun, got %v", err)
+	}
+
+	cfg := &conf.Config{
+		Tunnel: []*tun.TunnelConf{
+			{Remote: ":8000", Local: ":8000"},
+		},
+	}
+	if err := Run(ctx, cfg); err == nil {
+		t.Fatal("expected an error for a tunnel without ssh client")
+	}
+
+	// the invalid configs are returned, not exited on
+	cfg = &conf.Config{
+		SshClient: &sshc.SshClientConf{ServerURI: "127.0.0.1:65536"},
+	}
+	if err := Run(ctx, cfg); err == nil {
+		t.Fatal("expected an error for an invalid server uri")
+	}
+	cfg = &conf.Config{
+		SshD: &sshd.SshDConf{Key: "../../testdata/server", AuthorizedKeysURI: []string{"missing_authorized_keys"}},
+	}
+	if err := Run(ctx, cfg); err == nil {
+		t.Fatal("expected an error for an sshd without authorized keys")
+	}
+}
+
+func TestNew(t *testing.T) {
+	sshdAddr := freeAddr(t)
+	cfg := &conf.Config{
+		SshD: &sshd.SshDConf{
+			Key:               "../../testdata/server",
+			AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+			ListenAddress:     sshdAddr,
+		},
+		SshClient: &sshc.SshClientConf{
+			Identity:  sshc.Identities{"../../testdata/client"},
+			Insecure:  true,
+			ServerURI: sshdAddr,
+		},
+		Tunnel: []*tun.TunnelConf{
+			{Name: "a", Remote: sshdAddr, Local: "127.0.0.1:0", Forward: true},
+			{Name: "b", Remote: sshdAddr, Local: "127.0.0.1:0", Forward: true},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r, err := New(cfg, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SSHServer == nil || r.SSHClient == nil {
+		t.Fatal("expected the sshd server and the ssh client")
+	}
+	// nothing runs before Start
+	tunnels := r.TunnelManager.Tunnels()
+	if len(tunnels) != 2 {
+		t.Fatalf("expected 2 tunnels, got %d", len(tunnels))
+	}
+	for _, tunnel := range tunnels {
+		if stats := tunnel.Stats(); stats.State != tun.StateConnecting || stats.ListenerAddr != "" {
+			t.Fatalf("unexpected tunnel stats before start %+v", stats)
+		}
+	}
+	if _, err := net.Dial("tcp", sshdAddr); err == nil {
+		t.Fatal("the sshd server is listening before start")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- r.Start(context.Background())
+	}()
+	connected := func() bool {
+		for _, tunnel := range r.TunnelManager.Tunnels() {
+			if tunnel.Stats().State != tun.StateConnected {
+				return false
+			}
+		}
+		return r.SSHClient.IsConnected()
+	}
+	for i := 0; i < 40 && !connected(); i++ {
+		time.Sleep(250 * time.Millisecond)
+	}
+	if !connected() {
+		t.Fatal("the tunnels are not connected")
+	}
+	// the tunnels share the global ssh client
+	if clients := r.SSHServer.GetConnectedClients(); len(clients) != 1 {
+		t.Fatalf("expected 1 connected client, got %v", clients)
+	}
+
+	// the tunnels added while running are started at once
+	if _, err := r.TunnelManager.Add(&tun.TunnelConf{Name: "c", Remote: sshdAddr, Local: "127.0.0.1:0", Forward: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.TunnelManager.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.TunnelManager.Remove("a"); err == nil {
+		t.Fatal("expected an error removing a missing tunnel")
+	}
+	for i := 0; i < 40 && !connected(); i++ {
+		time.Sleep(250 * time.Millisecond)
+	}
+	names := []string{}
+	for _, tunnel := range r.TunnelManager.Tunnels() {
+		names = append(names, tunnel.Stats().Name)
+	}
+	if !connected() || strings.Join(names, ",") != "b,c" {
+		t.Fatalf("unexpected tunnels %v", names)
+	}
+
+	r.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Stop")
+	}
+	if err := r.Start(context.Background()); err == nil {
+		t.Fatal("expected an error starting again")
+	}
+}
+
+// pipeClient is an SSHClientI whose commands are served by a fake server
+// on the other side of a net.Pipe
+type pipeClient struct {
+	conn      net.Conn
+	connected bool
+}
+
+func newPipeClient() *pipeClient {
+	client, server := net.Pipe()
+	// the fake server replies to each command line with its uppercase
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				server.Close()
+				return
+			}
+			fmt.Fprint(server, strings.ToUpper(line))
+		}
+	}()
+	return &pipeClient{conn: client}
+}
+
+func (c *pipeClient) ConnectWithContext(ctx context.Context) error {
+	c.connected = true
+	return ctx.Err()
+}
+
+func (c *pipeClient) IsConnected() bool {
+	return c.connected
+}
+
+func (c *pipeClient) RunCommand(ctx context.Context, cmd string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if !c.connected {
+		return -1, errors.New("not connected")
+	}
+	fmt.Fprintln(c.conn, cmd)
+	line, err := bufio.NewReader(c.conn).ReadString('\n')
+	if err != nil {
+		return -1, err
+	}
+	io.WriteString(stdout, line)
+	return 0, nil
+}
+
+// uptime is a library user function written against SSHClientI
+func uptime(ctx context.Context, client SSHClientI) (string, error) {
+	if !client.IsConnected() {
+		if err := client.ConnectWithContext(ctx); err != nil {
+			return "", err
+		}
+	}
+	var out strings.Builder
+	code, err := client.RunCommand(ctx, "uptime", nil, &out, io.Discard)
+	if err != nil {
+		return "", err
+	}
+	if code != 0 {
+		return "", fmt.Errorf("exit code %d", code)
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+func TestSSHClientMock(t *testing.T) {
+	client := newPipeClient()
+	defer client.conn.Close()
+
+	out, err := uptime(context.Background(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "UPTIME" {
+		t.Fatalf("unexpected output %q", out)
+	}
+
+	// the real client implements the same interface
+	real, err := NewSSHClient(&sshc.SshClientConf{ServerURI: freeAddr(t), Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := uptime(ctx, real); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+}
+
+func TestNewAPIToken(t *testing.T) {
+	t.Setenv("ROSPO_API_TOKEN", "")
+	cfg := &conf.Config{
+		SshD: &sshd.SshDConf{
+			Key:               "../../testdata/server",
+			AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+			ListenAddress:     freeAddr(t),
+			APIAddr:           freeAddr(t),
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if _, err := New(cfg, WithLogger(logger)); err == nil {
+		t.Fatal("expected an error without the api token")
+	}
+
+	t.Setenv("ROSPO_API_TOKEN", "secret")
+	r, err := New(cfg, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.apiServer == nil {
+		t.Fatal("expected the api server")
+	}
+}
+
+func TestGetBuildInfo(t *testing.T) {
+	defer func(version, commit string) { Version, Commit = version, commit }(Version, Commit)
+	Version, Commit = "1.2.3", "abc"
+	info := GetBuildInfo()
+	if info.Version != "1.2.3" || info.Commit != "abc" || info.BuildDate == "" {
+		t.Fatalf("unexpected build info %+v", info)
+	}
+	if !strings.HasPrefix(info.GoVersion, "go") || !strings.Contains(info.Platform, "/") {
+		t.Fatalf("unexpected runtime info %+v", info)
+	}
+}
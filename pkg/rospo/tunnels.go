@@ -0,0 +1,346 @@
+package rospo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ferama/rospo/pkg/api"
+	"github.com/ferama/rospo/pkg/health"
+	"github.com/ferama/rospo/pkg/metrics"
+	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/tun"
+	"gopkg.in/yaml.v3"
+)
+
+// errClosed is returned by the TunnelManager after the shutdown
+var errClosed = errors.New("shutting down")
+
+// ErrTunnelNotFound is returned by TunnelManager.Remove if there isn't
+// any tunnel with the name
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
+// connection is an ssh connection built by Rospo
+type connection struct {
+	*sshc.SshConnection
+	// runs the connection. nil for the pool connections, as they are
+	// started by the pool
+	start func(ctx context.Context)
+	// stops the connection. It can be called more than once
+	stop func()
+}
+
+// managedTunnel is a tunnel of the TunnelManager
+type managedTunnel struct {
+	// the health checks index
+	id   int
+	conf *tun.TunnelConf
+	// the yaml config, used to detect the changes on reload
+	key    string
+	tunnel *tun.Tunnel
+	// the dedicated ssh connection. nil if the tunnel uses the global one
+	conn *connection
+}
+
+// TunnelManager runs the tunnels of a Rospo instance. Tunnels can be
+// added and removed while it runs
+type TunnelManager struct {
+	// the global ssh client. nil if not configured
+	sshConn       *sshc.SshConnection
+	newConnection func(c *sshc.SshClientConf) (*connection, error)
+	// runs fn until the Rospo instance stops. nil until it is started
+	run func(fn func(context.Context))
+
+	healthServer *health.Server
+	tunOpts      []tun.Option
+	recorder     metrics.Recorder
+
+	tunnels []*managedTunnel
+	nextID  int
+	closed  bool
+	mu      sync.Mutex
+}
+
+func tunnelKey(c *tun.TunnelConf) string {
+	data, _ := yaml.Marshal(c)
+	return string(data)
+}
+
+// validate returns an error if a tunnel of confs can't be started
+func (m *TunnelManager) validate(confs []*tun.TunnelConf) error {
+	for _, c := range confs {
+		if c.SshClientConf == nil && m.sshConn == nil {
+			return fmt.Errorf("you need to configure sshclient section to support tunnel")
+		}
+	}
+	return nil
+}
+
+// add builds the tunnel and starts it if the manager is running.
+// m.mu must be held
+func (m *TunnelManager) add(c *tun.TunnelConf) (*managedTunnel, error) {
+	mt, err := m.build(c)
+	if err != nil {
+		return nil, err
+	}
+	m.insert(mt)
+	return mt, nil
+}
+
+// build builds the tunnel and its dedicated connection, without adding
+// them. m.mu must be held
+func (m *TunnelManager) build(c *tun.TunnelConf) (*managedTunnel, error) {
+	mt := &managedTunnel{conf: c, key: tunnelKey(c)}
+	conn := m.sshConn
+	if c.SshClientConf != nil {
+		var err error
+		mt.conn, err = m.newConnection(c.SshClientConf)
+		if err != nil {
+			return nil, err
+		}
+		conn = mt.conn.SshConnection
+	}
+	mt.tunnel = tun.NewTunnel(conn, c, true, m.tunOpts...)
+	mt.tunnel.SetMetricsRecorder(m.recorder)
+	return mt, nil
+}
+
+// insert adds a built tunnel and starts it if the manager is running.
+// m.mu must be held
+func (m *TunnelManager) insert(mt *managedTunnel) {
+	mt.id = m.nextID
+	m.nextID++
+	if mt.conn != nil {
+		m.healthServer.AddCheck(fmt.Sprintf("tunnel %d sshclient", mt.id), health.ConnectionCheck(mt.conn.SshConnection))
+	}
+	m.healthServer.AddCheck(fmt.Sprintf("tunnel %d", mt.id), health.TunnelCheck(mt.tunnel))
+	m.tunnels = append(m.tunnels, mt)
+	if m.run != nil {
+		m.startTunnel(mt)
+	}
+}
+
+// startTunnel starts the tunnel and its dedicated connection. m.mu must
+// be held
+func (m *TunnelManager) startTunnel(mt *managedTunnel) {
+	if mt.conn != nil && mt.conn.start != nil {
+		m.run(mt.conn.start)
+	}
+	m.run(mt.tunnel.Start)
+}
+
+// remove stops the tunnel and its dedicated connection. m.mu must be held
+func (m *TunnelManager) remove(mt *managedTunnel) {
+	mt.tunnel.Stop()
+	m.healthServer.RemoveCheck(fmt.Sprintf("tunnel %d", mt.id))
+	if mt.conn != nil {
+		mt.conn.stop()
+		m.healthServer.RemoveCheck(fmt.Sprintf("tunnel %d sshclient", mt.id))
+	}
+	for i, v := range m.tunnels {
+		if v == mt {
+			m.tunnels = append(m.tunnels[:i], m.tunnels[i+1:]...)
+			break
+		}
+	}
+}
+
+// start runs the tunnels added so far, and the ones added from now on,
+// with run
+func (m *TunnelManager) start(run func(fn func(context.Context))) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.run = run
+	for _, mt := range m.tunnels {
+		m.startTunnel(mt)
+	}
+}
+
+// Add builds a tunnel. It is started at once if the Rospo instance
+// is running, otherwise it is started with it
+func (m *TunnelManager) Add(c *tun.TunnelConf) (TunnelI, error) {
+	if err := m.validate([]*tun.TunnelConf{c}); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errClosed
+	}
+	mt, err := m.add(c)
+	if err != nil {
+		return nil, err
+	}
+	return mt.tunnel, nil
+}
+
+// Remove stops the tunnels named name
+func (m *TunnelManager) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	found := false
+	for _, mt := range append([]*managedTunnel{}, m.tunnels...) {
+		if mt.tunnel.GetName() == name {
+			m.remove(mt)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, name)
+	}
+	return nil
+}
+
+// Tunnels returns the tunnels, in the order they were added
+func (m *TunnelManager) Tunnels() []TunnelI {
+	res := []TunnelI{}
+	for _, mt := range m.list() {
+		res = append(res, mt.tunnel)
+	}
+	return res
+}
+
+// Reload applies a new tunnels config: the unchanged tunnels keep
+// running, the removed and the changed ones are stopped and the new ones
+// are started. It returns a summary of the changes
+func (m *TunnelManager) Reload(confs []*tun.TunnelConf) (string, error) {
+	if err := m.validate(confs); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return "", errClosed
+	}
+
+	// the running tunnels by config. Duplicated configs are matched
+	// one by one
+	running := map[string][]*managedTunnel{}
+	for _, mt := range m.tunnels {
+		running[mt.key] = append(running[mt.key], mt)
+	}
+	added := []*managedTunnel{}
+	unchanged := 0
+	for _, c := range confs {
+		key := tunnelKey(c)
+		if len(running[key]) > 0 {
+			running[key] = running[key][1:]
+			unchanged++
+			continue
+		}
+		// the new tunnels are built first, so that an invalid one leaves
+		// the running tunnels untouched
+		mt, err := m.build(c)
+		if err != nil {
+			for _, built := range added {
+				if built.conn != nil {
+					built.conn.stop()
+				}
+			}
+			return "", err
+		}
+		added = append(added, mt)
+	}
+	removed := 0
+	for _, mts := range running {
+		for _, mt := range mts {
+			m.remove(mt)
+			removed++
+		}
+	}
+	for _, mt := range added {
+		m.insert(mt)
+	}
+	return fmt.Sprintf("tunnels: %d added, %d removed, %d unchanged", len(added), removed, unchanged), nil
+}
+
+// find returns the tunnels named name
+func (m *TunnelManager) find(name string) []*tun.Tunnel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := []*tun.Tunnel{}
+	for _, mt := range m.tunnels {
+		if mt.tunnel.GetName() == name {
+			res = append(res, mt.tunnel)
+		}
+	}
+	return res
+}
+
+// list returns the managed tunnels
+func (m *TunnelManager) list() []*managedTunnel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*managedTunnel{}, m.tunnels...)
+}
+
+// close stops the dedicated tunnels connections and prevents any
+// further change
+func (m *TunnelManager) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for _, mt := range m.tunnels {
+		if mt.conn != nil {
+			mt.conn.stop()
+		}
+	}
+}
+
+// tunnelsCommand builds a control command that calls fn on the tunnels
+// named as its args
+func (m *TunnelManager) tunnelsCommand(fn func(*tun.Tunnel)) func(args []string) (string, error) {
+	return func(args []string) (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("missing tunnel name")
+		}
+		missing := []string{}
+		for _, name := range args {
+			if len(m.find(name)) == 0 {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return "", fmt.Errorf("%w: %s", ErrTunnelNotFound, strings.Join(missing, ", "))
+		}
+		for _, name := range args {
+			for _, t := range m.find(name) {
+				fn(t)
+			}
+		}
+		return "", nil
+	}
+}
+
+// apiTunnels exposes the TunnelManager to the api
+type apiTunnels struct {
+	m *TunnelManager
+}
+
+func (a apiTunnels) Tunnels() []tun.Stats {
+	res := []tun.Stats{}
+	for _, t := range a.m.Tunnels() {
+		res = append(res, t.Stats())
+	}
+	return res
+}
+
+func (a apiTunnels) Add(c *tun.TunnelConf) (tun.Stats, error) {
+	t, err := a.m.Add(c)
+	if err != nil {
+		return tun.Stats{}, err
+	}
+	return t.Stats(), nil
+}
+
+func (a apiTunnels) Remove(name string) error {
+	if err := a.m.Remove(name); err != nil {
+		if errors.Is(err, ErrTunnelNotFound) {
+			return fmt.Errorf("%w: tunnel %s", api.ErrNotFound, name)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package rospo
+
+import "github.com/ferama/rospo/pkg/version"
+
+// The build info. They default to the pkg/version values, and can still be
+// set during the build process using
+// -ldflags="-X 'github.com/ferama/rospo/pkg/rospo.Version=...'"
+var (
+	Version   = ""
+	Commit    = ""
+	BuildDate = ""
+)
+
+func init() {
+	info := version.Version()
+	if Version == "" {
+		Version = info.Version
+	}
+	if Commit == "" {
+		Commit = info.Commit
+	}
+	if BuildDate == "" {
+		BuildDate = info.BuildDate
+	}
+}
+
+// BuildInfo describes the running rospo build
+type BuildInfo = version.Info
+
+// GetBuildInfo returns the running rospo build info. It is version.Version
+// with the Version, Commit and BuildDate values of this package
+func GetBuildInfo() BuildInfo {
+	info := version.Version()
+	info.Version = Version
+	info.Commit = Commit
+	info.BuildDate = BuildDate
+	return info
+}
@@ -1,8 +1,8 @@
 package rpty
 
 import (
+	"fmt"
 	"io"
-	"log"
 	"os/exec"
 	"sync"
 )
@@ -58,12 +58,12 @@ func (c *rconPty) Run(cm *exec.Cmd) error {
 	cpty, err := ConPTYStart(cm.Path)
 
 	if err != nil {
-		log.Fatalf("Failed to spawn a pty:  %v", err)
+		return fmt.Errorf("failed to spawn a pty: %w", err)
 	}
 	c.cpty = cpty
 	c.ready.Done()
 
-	return err
+	return nil
 }
 
 func (c *rconPty) WriteTo(dest io.Writer) (int64, error) {
@@ -0,0 +1,143 @@
+package sshc
+
+import (
+	"os"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// the channel type the server opens to reach the forwarded agent
+const agentChannelType = "auth-agent@openssh.com"
+
+// agentSocketPath returns the ssh-agent socket to use. The explicitly
+// configured one takes precedence over the SSH_AUTH_SOCK environment var
+func agentSocketPath(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		return sock
+	}
+	return defaultAgentSocket
+}
+
+// agentSigners returns the signers held by the ssh-agent. The agent
+// connection is established on first use and reused. Failures are logged
+// and an empty list is returned, so that the remaining auth methods
+// are tried
+func (s *SshConnection) agentSigners() ([]ssh.Signer, error) {
+	s.agentMU.Lock()
+	defer s.agentMU.Unlock()
+
+	if s.agentConn == nil {
+		conn, err := dialAgent(s.agentSocket)
+		if err != nil {
+			s.log.Error("cannot connect to ssh-agent", "path", s.agentSocket, "error", err)
+			return nil, nil
+		}
+		s.agentConn = conn
+	}
+
+	signers, err := agent.NewClient(s.agentConn).Signers()
+	if err != nil {
+		s.log.Error("cannot get keys from ssh-agent", "error", err)
+		// drop the connection. It will be established again on next try
+		s.agentConn.Close()
+		s.agentConn = nil
+		return nil, nil
+	}
+	return signers, nil
+}
+
+// closeAgent releases the ssh-agent connection if any
+func (s *SshConnection) closeAgent() {
+	s.agentMU.Lock()
+	defer s.agentMU.Unlock()
+
+	if s.agentConn != nil {
+		s.agentConn.Close()
+		s.agentConn = nil
+	}
+}
+
+// serveAgentChannels proxies the agent channels opened by the server to
+// the local agent. The channels are rejected if no session is forwarding
+// the agent
+func (s *SshConnection) serveAgentChannels(chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		s.agentMU.Lock()
+		active := s.agentForwards > 0
+		s.agentMU.Unlock()
+		if !active {
+			newChannel.Reject(ssh.Prohibited, "agent forwarding is not active")
+			continue
+		}
+		agentConn, err := dialAgent(s.agentSocket)
+		if err != nil {
+			s.log.Error("cannot connect to ssh-agent", "path", s.agentSocket, "error", err)
+			newChannel.Reject(ssh.ConnectionFailed, "cannot connect to the agent")
+			continue
+		}
+		channel, reqs, err := newChannel.Accept()
+		if err != nil {
+			agentConn.Close()
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+
+		s.agentMU.Lock()
+		s.agentChannels[channel] = struct{}{}
+		s.agentMU.Unlock()
+		rio.CopyConnWithOnClose(channel, agentConn, false, 0, func() {
+			s.agentMU.Lock()
+			delete(s.agentChannels, channel)
+			s.agentMU.Unlock()
+		})
+	}
+}
+
+// forwardAgent requests the agent forwarding on the session, if it is
+// enabled. The forwarding is refused if the server host key is not
+// verified, unless forward_agent_insecure is set too. The returned func
+// ends the session forwarding: when the last one ends, the open agent
+// channels are closed
+func (s *SshConnection) forwardAgent(session *ssh.Session) func() {
+	if !s.forwardAgentEnabled {
+		return func() {}
+	}
+	if s.agentSocket == "" {
+		s.log.Warn("agent forwarding skipped: no ssh-agent is configured")
+		return func() {}
+	}
+	if s.insecure && !s.forwardAgentInsecure {
+		s.log.Warn("agent forwarding refused: the server host key is not verified. Set forward_agent_insecure to forward it anyway")
+		return func() {}
+	}
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		s.log.Warn("the server refused the agent forwarding", "error", err)
+		return func() {}
+	}
+	s.agentMU.Lock()
+	s.agentForwards++
+	s.agentMU.Unlock()
+
+	released := false
+	return func() {
+		s.agentMU.Lock()
+		defer s.agentMU.Unlock()
+		if released {
+			return
+		}
+		released = true
+		s.agentForwards--
+		if s.agentForwards > 0 {
+			return
+		}
+		for channel := range s.agentChannels {
+			channel.Close()
+			delete(s.agentChannels, channel)
+		}
+	}
+}
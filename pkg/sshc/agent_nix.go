@@ -0,0 +1,15 @@
+//go:build !windows
+
+package sshc
+
+import (
+	"io"
+	"net"
+)
+
+// there is no well known agent socket on unix systems
+const defaultAgentSocket = ""
+
+func dialAgent(socket string) (io.ReadWriteCloser, error) {
+	return net.Dial("unix", socket)
+}
@@ -0,0 +1,13 @@
+package sshc
+
+import (
+	"io"
+	"os"
+)
+
+// the named pipe used by the OpenSSH for Windows agent service
+const defaultAgentSocket = `\\.\pipe\openssh-ssh-agent`
+
+func dialAgent(socket string) (io.ReadWriteCloser, error) {
+	return os.OpenFile(socket, os.O_RDWR, 0)
+}
@@ -0,0 +1,74 @@
+package sshc
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// supportedCiphers are the ciphers implemented by x/crypto/ssh. The
+// ones enabled by default come first
+var supportedCiphers = []string{
+	"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	"arcfour256", "arcfour128", "arcfour", "aes128-cbc", "3des-cbc",
+}
+
+// supportedKeyExchanges are the key exchanges implemented by the
+// x/crypto/ssh client. The ones enabled by default come first
+var supportedKeyExchanges = []string{
+	"curve25519-sha256", "curve25519-sha256@libssh.org",
+	"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+	"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512", "diffie-hellman-group14-sha1",
+	"diffie-hellman-group1-sha1",
+	"diffie-hellman-group-exchange-sha1", "diffie-hellman-group-exchange-sha256",
+}
+
+// supportedMACs are the MACs implemented by x/crypto/ssh. The ones
+// enabled by default come first
+var supportedMACs = []string{
+	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+	"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+}
+
+// ValidateAlgorithms returns an error if any of the ciphers, key
+// exchanges or MACs is not supported. The error lists the supported ones
+func ValidateAlgorithms(ciphers, keyExchanges, macs []string) error {
+	lists := []struct {
+		kind      string
+		names     []string
+		supported []string
+	}{
+		{"cipher", ciphers, supportedCiphers},
+		{"key exchange", keyExchanges, supportedKeyExchanges},
+		{"MAC", macs, supportedMACs},
+	}
+	for _, l := range lists {
+		for _, name := range l.names {
+			if !contains(l.supported, name) {
+				return fmt.Errorf("unsupported %s %q. Supported: %s", l.kind, name, strings.Join(l.supported, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// algorithmsConfig builds the ssh config negotiating the algorithms. The
+// empty lists keep the x/crypto/ssh defaults
+func algorithmsConfig(ciphers, keyExchanges, macs []string) ssh.Config {
+	return ssh.Config{
+		Ciphers:      nilIfEmpty(ciphers),
+		KeyExchanges: nilIfEmpty(keyExchanges),
+		MACs:         nilIfEmpty(macs),
+	}
+}
+
+// nilIfEmpty returns nil for the empty lists: x/crypto/ssh uses its
+// defaults for the nil ones only, and the unset flags are empty lists
+func nilIfEmpty(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}
@@ -0,0 +1,69 @@
+package sshc
+
+import (
+	"math/rand"
+	"time"
+)
+
+// The default reconnect backoff values, used if the configuration
+// doesn't set them
+const (
+	DefaultReconnectInitialDelay = time.Second
+	DefaultReconnectMultiplier   = 2.0
+	DefaultReconnectMaxDelay     = time.Minute
+	DefaultReconnectResetAfter   = time.Minute
+)
+
+// backoff computes the exponential delays between the reconnect attempts
+type backoff struct {
+	initialDelay time.Duration
+	multiplier   float64
+	maxDelay     time.Duration
+
+	// the attempts since the last reset
+	attempt int
+	delay   time.Duration
+}
+
+func newBackoff(initialDelay time.Duration, multiplier float64, maxDelay time.Duration) *backoff {
+	if initialDelay <= 0 {
+		initialDelay = DefaultReconnectInitialDelay
+	}
+	if multiplier < 1 {
+		multiplier = DefaultReconnectMultiplier
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultReconnectMaxDelay
+	}
+	if maxDelay < initialDelay {
+		maxDelay = initialDelay
+	}
+	return &backoff{
+		initialDelay: initialDelay,
+		multiplier:   multiplier,
+		maxDelay:     maxDelay,
+	}
+}
+
+// next counts an attempt and returns the delay before the following one.
+// The delay grows by multiplier up to maxDelay. A random jitter of up to
+// half of it is subtracted, so that many clients don't retry in sync
+func (b *backoff) next() time.Duration {
+	b.attempt++
+	if b.delay == 0 {
+		b.delay = b.initialDelay
+	} else {
+		b.delay = time.Duration(float64(b.delay) * b.multiplier)
+		if b.delay > b.maxDelay || b.delay <= 0 {
+			b.delay = b.maxDelay
+		}
+	}
+	half := int64(b.delay / 2)
+	return b.delay - time.Duration(rand.Int63n(half+1))
+}
+
+// reset starts again from the initial delay
+func (b *backoff) reset() {
+	b.attempt = 0
+	b.delay = 0
+}
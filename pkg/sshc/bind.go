@@ -0,0 +1,29 @@
+package sshc
+
+import (
+	"fmt"
+	"net"
+)
+
+// BindDialer returns the dialer of the tcp connections to the server, or
+// to the first jump host or the proxy. The connections originate from
+// bindAddress if set: it fails if no local interface has it
+func BindDialer(bindAddress string) (*net.Dialer, error) {
+	if bindAddress == "" {
+		return &net.Dialer{}, nil
+	}
+	ip := net.ParseIP(bindAddress)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid bind address %q: it is not an ip address", bindAddress)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the local addresses: %w", err)
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}, nil
+		}
+	}
+	return nil, fmt.Errorf("the bind address %s is not assigned to any local interface", bindAddress)
+}
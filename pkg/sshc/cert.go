@@ -0,0 +1,129 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// certSuffix is appended to an identity file path to find its
+// certificate, as OpenSSH does
+const certSuffix = "-cert.pub"
+
+// identityCert is a user certificate and the identity it certifies
+type identityCert struct {
+	path   string
+	cert   *ssh.Certificate
+	signer ssh.Signer
+	// set for the certificate_file one. Its errors fail the
+	// authentication, the others certificates are skipped
+	explicit bool
+}
+
+// loadCertificate parses the user certificate file
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the certificate %s: %w", path, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", path)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not a user certificate", path)
+	}
+	return cert, nil
+}
+
+// checkCertificateValidity returns an error if the certificate is not
+// valid at now. The servers reject it without telling the reason
+func checkCertificateValidity(path string, cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("the certificate %s expired at %s",
+			path, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("the certificate %s is not valid before %s",
+			path, time.Unix(int64(cert.ValidAfter), 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// loadIdentityCerts pairs the identities with their certificates: the
+// <identity>-cert.pub files and the certificateFile one, that must
+// certify one of the identities. The signers are the identities ones
+func (s *SshConnection) loadIdentityCerts(identities []string, signers []ssh.Signer, certificateFile string) ([]identityCert, error) {
+	certificateFile, _ = utils.ExpandUserHome(certificateFile)
+	certs := []identityCert{}
+	for i, identity := range identities {
+		path, _ := utils.ExpandUserHome(identity)
+		if !utils.IsKeyFile(path) || path+certSuffix == certificateFile {
+			continue
+		}
+		path += certSuffix
+		cert, err := loadCertificate(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			s.log.Warn("cannot load the identity certificate", "path", path, "error", err)
+			continue
+		}
+		if !keyEqual(cert.Key, signers[i].PublicKey()) {
+			s.log.Warn("the certificate is not of its identity", "path", path)
+			continue
+		}
+		s.log.Debug("using certificate", "path", path)
+		certs = append(certs, identityCert{path: path, cert: cert, signer: signers[i]})
+	}
+	if certificateFile == "" {
+		return certs, nil
+	}
+
+	cert, err := loadCertificate(certificateFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, signer := range signers {
+		if keyEqual(cert.Key, signer.PublicKey()) {
+			s.log.Debug("using certificate", "path", certificateFile)
+			// the explicit certificate is offered first
+			return append([]identityCert{{path: certificateFile, cert: cert, signer: signer, explicit: true}}, certs...), nil
+		}
+	}
+	return nil, fmt.Errorf("the certificate %s doesn't certify any of the identities", certificateFile)
+}
+
+// certSigners returns the signers of the certificates valid at now. The
+// certificate_file one fails the authentication if not valid: the server
+// would reject it without a reason
+func (s *SshConnection) certSigners(certs []identityCert, now time.Time) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	for _, c := range certs {
+		err := checkCertificateValidity(c.path, c.cert, now)
+		var signer ssh.Signer
+		if err == nil {
+			signer, err = ssh.NewCertSigner(c.cert, c.signer)
+		}
+		if err != nil {
+			if c.explicit {
+				return nil, err
+			}
+			s.log.Warn("skipping the identity certificate", "path", c.path, "error", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
@@ -0,0 +1,52 @@
+package sshc
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"golang.org/x/crypto/ssh"
+)
+
+// channelConn wraps a direct-tcpip channel into a net.Conn
+type channelConn struct {
+	ssh.Channel
+	laddr net.Addr
+	raddr net.Addr
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *channelConn) SetDeadline(deadline time.Time) error {
+	return c.SetReadDeadline(deadline)
+}
+
+func (c *channelConn) SetReadDeadline(deadline time.Time) error {
+	return errors.New("ssh: channel deadlines are not supported")
+}
+
+func (c *channelConn) SetWriteDeadline(deadline time.Time) error {
+	return errors.New("ssh: channel deadlines are not supported")
+}
+
+// compressedListener wraps the accepted forwarded-tcpip connections into
+// compressed ones
+type compressedListener struct {
+	net.Listener
+	level int
+}
+
+func (l *compressedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return rio.NewCompressedConn(conn, l.level), nil
+}
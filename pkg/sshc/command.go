@@ -0,0 +1,106 @@
+package sshc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RunCommand runs cmd on the remote server, writing the command output to
+// stdout and stderr. If stdin is not nil, it is used as the command
+// input. It waits for the connection to be established and
+// returns the remote exit code. If ctx is cancelled before the command
+// completes, the remote command is signaled and the session is closed.
+// In this case ctx.Err() is returned.
+// Each call opens its own session, so it is safe to call RunCommand
+// from multiple goroutines
+func (s *SshConnection) RunCommand(
+	ctx context.Context,
+	cmd string,
+	stdin io.Reader,
+	stdout, stderr io.Writer) (int, error) {
+
+	if err := s.readyWaitContext(ctx); err != nil {
+		return -1, err
+	}
+
+	s.clientMU.Lock()
+	client := s.Client
+	s.clientMU.Unlock()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+	defer s.forwardAgent(session)()
+
+	if stdin != nil {
+		session.Stdin = stdin
+	}
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(cmd)
+	}()
+
+	select {
+	case err = <-done:
+		return ExitCode(err)
+	case <-ctx.Done():
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+		return -1, ctx.Err()
+	}
+}
+
+// Run is like RunCommand, but it returns the collected stdout and stderr.
+// If stdin is not nil, it is used as the command input
+func (s *SshConnection) Run(ctx context.Context, cmd string, stdin io.Reader) (stdout, stderr []byte, exitCode int, err error) {
+	var outBuf, errBuf bytes.Buffer
+	exitCode, err = s.RunCommand(ctx, cmd, stdin, &outBuf, &errBuf)
+	return outBuf.Bytes(), errBuf.Bytes(), exitCode, err
+}
+
+// ErrExitStatusMissing is returned when the remote command completes
+// without reporting its exit status, like when it is killed by the server
+var ErrExitStatusMissing = errors.New("the remote command exited without an exit status")
+
+// ExitCode extracts the remote exit code from the error returned by
+// an ssh session Run or Wait call. A nil error maps to exit code 0.
+// A missing exit status is returned as ErrExitStatusMissing. The other
+// errors are returned as is
+func ExitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	var missingErr *ssh.ExitMissingError
+	if errors.As(err, &missingErr) {
+		return -1, ErrExitStatusMissing
+	}
+	return -1, err
+}
+
+// readyWaitContext is like ReadyWait but returns early with an error
+// if ctx is done before the connection is established
+func (s *SshConnection) readyWaitContext(ctx context.Context) error {
+	ready := make(chan error, 1)
+	go func() {
+		ready <- s.ReadyWait()
+	}()
+	select {
+	case err := <-ready:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
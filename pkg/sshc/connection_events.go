@@ -0,0 +1,107 @@
+package sshc
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the events buffered for each subscriber. When a subscriber doesn't keep
+// up the newer events are dropped, so that the connection loop never blocks
+const connectionEventsBuffer = 16
+
+// ConnectionEventType is the kind of a connection lifecycle event
+type ConnectionEventType int
+
+// The connection lifecycle events
+const (
+	// the connection is established
+	EventConnected ConnectionEventType = iota + 1
+	// the established connection failed. Err tells why
+	EventDisconnected
+	// a new connection attempt is starting. Attempt counts them since the
+	// last established connection and Err is the previous failure, if any
+	EventReconnecting
+	// the connection loop is over, because of Stop, the Start context
+	// cancellation or the max reconnect attempts (in Err)
+	EventStopped
+)
+
+func (t ConnectionEventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventReconnecting:
+		return "reconnecting"
+	case EventStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// ConnectionEvent is a connection lifecycle change
+type ConnectionEvent struct {
+	Type    ConnectionEventType
+	Time    time.Time
+	Err     error
+	Attempt int
+	// the events dropped for this subscriber since the previous delivered
+	// one, because its buffer was full
+	Dropped int64
+}
+
+type subscriber struct {
+	events  chan ConnectionEvent
+	dropped atomic.Int64
+}
+
+type subscribers struct {
+	list []*subscriber
+	mu   sync.Mutex
+}
+
+// Subscribe returns a channel receiving the connection lifecycle events.
+// Each subscriber has its own bounded buffer: the events that don't fit
+// are dropped and counted in the next delivered event. The channel is
+// closed by Unsubscribe
+func (s *SshConnection) Subscribe() <-chan ConnectionEvent {
+	sub := &subscriber{events: make(chan ConnectionEvent, connectionEventsBuffer)}
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+	s.subscribers.list = append(s.subscribers.list, sub)
+	return sub.events
+}
+
+// Unsubscribe stops the events delivery and closes the channel
+// returned by Subscribe
+func (s *SshConnection) Unsubscribe(events <-chan ConnectionEvent) {
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+	for i, sub := range s.subscribers.list {
+		if sub.events == events {
+			s.subscribers.list = append(s.subscribers.list[:i], s.subscribers.list[i+1:]...)
+			close(sub.events)
+			return
+		}
+	}
+}
+
+// emit delivers the event to the subscribers without blocking
+func (s *SshConnection) emit(event ConnectionEvent) {
+	event.Time = time.Now()
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+	for _, sub := range s.subscribers.list {
+		e := event
+		e.Dropped = sub.dropped.Load()
+		select {
+		case sub.events <- e:
+			sub.dropped.Add(-e.Dropped)
+		default:
+			sub.dropped.Add(1)
+			s.log.Debug("connection event dropped, slow subscriber", "event", event.Type.String())
+		}
+	}
+}
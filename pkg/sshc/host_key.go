@@ -0,0 +1,180 @@
+package sshc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errNoHostAuthority is returned by checkHostCertificate if none of the
+// @cert-authority entries matching the host signed the certificate
+var errNoHostAuthority = errors.New("no certificate authority for the host")
+
+// checkHostKey verifies the host key using the known_hosts callback clb.
+// Host certificates are validated against the @cert-authority entries of
+// the knownHostsPath file. If no authority trusts them, the certificate
+// key is checked as a plain key
+func checkHostKey(clb ssh.HostKeyCallback, knownHostsPath string, host string, remote net.Addr, key ssh.PublicKey) error {
+	entries, err := utils.ListKnownHostEntries(knownHostsPath)
+	if err != nil {
+		return err
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		err := checkHostCertificate(entries, knownHostsPath, host, cert)
+		if !errors.Is(err, errNoHostAuthority) {
+			return err
+		}
+		key = cert.Key
+	}
+	for _, e := range entries {
+		if e.Marker == "cert-authority" && utils.MatchKnownHostPatterns(e.Hosts, host) {
+			// the knownhosts package would take the authority keys as
+			// host keys, reporting a mismatch
+			return checkPlainHostKey(entries, knownHostsPath, host, key)
+		}
+	}
+	return clb(host, remote, key)
+}
+
+// checkPlainHostKey matches key against the known_hosts entries without
+// marker, with the same semantics of the knownhosts package: a host
+// presenting a different key, or a key of an unknown type, mismatches
+func checkPlainHostKey(entries []utils.KnownHostEntry, knownHostsPath string, host string, key ssh.PublicKey) error {
+	knownKeys := map[string]knownhosts.KnownKey{}
+	for _, e := range entries {
+		if e.Marker == "revoked" && keyEqual(e.Key, key) {
+			return &knownhosts.RevokedError{
+				Revoked: knownhosts.KnownKey{Key: e.Key, Filename: knownHostsPath, Line: e.Line},
+			}
+		}
+		if e.Marker != "" || !utils.MatchKnownHostPatterns(e.Hosts, host) {
+			continue
+		}
+		if _, ok := knownKeys[e.Key.Type()]; !ok {
+			knownKeys[e.Key.Type()] = knownhosts.KnownKey{Key: e.Key, Filename: knownHostsPath, Line: e.Line}
+		}
+	}
+	keyErr := &knownhosts.KeyError{}
+	for _, k := range knownKeys {
+		keyErr.Want = append(keyErr.Want, k)
+	}
+	if known, ok := knownKeys[key.Type()]; !ok || !keyEqual(known.Key, key) {
+		return keyErr
+	}
+	return nil
+}
+
+// checkHostCertificate validates the host certificate against the known_hosts
+// entries. Certificates signed by, or carrying, a revoked key are rejected
+// with a *knownhosts.RevokedError
+func checkHostCertificate(entries []utils.KnownHostEntry, knownHostsPath string, host string, cert *ssh.Certificate) error {
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("%s: certificate presented as a host key has type %d", host, cert.CertType)
+	}
+	for _, e := range entries {
+		if e.Marker != "revoked" {
+			continue
+		}
+		revokedErr := &knownhosts.RevokedError{
+			Revoked: knownhosts.KnownKey{Key: e.Key, Filename: knownHostsPath, Line: e.Line},
+		}
+		if keyEqual(e.Key, cert.SignatureKey) {
+			return fmt.Errorf("%s: the host certificate authority %s is revoked: %w",
+				host, ssh.FingerprintSHA256(e.Key), revokedErr)
+		}
+		if keyEqual(e.Key, cert.Key) || keyEqual(e.Key, cert) {
+			return fmt.Errorf("%s: the host certificate key %s is revoked: %w",
+				host, ssh.FingerprintSHA256(e.Key), revokedErr)
+		}
+	}
+
+	trusted := false
+	for _, e := range entries {
+		if e.Marker == "cert-authority" && keyEqual(e.Key, cert.SignatureKey) &&
+			utils.MatchKnownHostPatterns(e.Hosts, host) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return errNoHostAuthority
+	}
+
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	// checks the principals, the validity window and the signature
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert(hostname, cert); err != nil {
+		return fmt.Errorf("%s: invalid host certificate: %w", host, err)
+	}
+	return nil
+}
+
+func keyEqual(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// hasKeyType reports if the known keys contain a key of type keyType
+func hasKeyType(known []knownhosts.KnownKey, keyType string) bool {
+	for _, k := range known {
+		if k.Key.Type() == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPinnedCA parses the certificate authority public key file
+func loadPinnedCA(path string) (ssh.PublicKey, error) {
+	path, _ = utils.ExpandUserHome(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the pinned certificate authority %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// checkPinnedCertificate verifies that the host presented a valid host
+// certificate signed by ca for one of the principals. If principals is
+// empty, the certificate must be valid for the host name
+func checkPinnedCertificate(ca ssh.PublicKey, principals []string, host string, key ssh.PublicKey) error {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("%s: %w: the host key is not a certificate", host, ErrUntrustedHost)
+	}
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("%s: %w: the certificate is not a host certificate", host, ErrUntrustedHost)
+	}
+	if !keyEqual(cert.SignatureKey, ca) {
+		return fmt.Errorf("%s: %w: the host certificate is signed by %s, not by the pinned authority",
+			host, ErrUntrustedHost, ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+	if len(principals) == 0 {
+		hostname, _, err := net.SplitHostPort(host)
+		if err != nil {
+			return err
+		}
+		principals = []string{hostname}
+	}
+	// checks the validity window and the signature too
+	checker := &ssh.CertChecker{}
+	var err error
+	for _, principal := range principals {
+		if err = checker.CheckCert(principal, cert); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w: invalid host certificate: %s", host, ErrUntrustedHost, err)
+}
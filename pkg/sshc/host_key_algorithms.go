@@ -0,0 +1,116 @@
+package sshc
+
+import (
+	"fmt"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// certHostKeyAlgorithms are the host certificate algorithms supported
+// by the client
+var certHostKeyAlgorithms = []string{
+	ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+}
+
+// defaultHostKeyAlgorithms are the host key algorithms supported by the
+// client, in the x/crypto/ssh default preference order
+var defaultHostKeyAlgorithms = append(append([]string{}, certHostKeyAlgorithms...),
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	ssh.KeyAlgoED25519,
+)
+
+// ValidateHostKeyAlgorithms returns an error if any of the names is not
+// a supported host key algorithm
+func ValidateHostKeyAlgorithms(names []string) error {
+	for _, name := range names {
+		if !contains(defaultHostKeyAlgorithms, name) {
+			return fmt.Errorf("unsupported host key algorithm %q", name)
+		}
+	}
+	return nil
+}
+
+// keyTypeAlgorithms returns the host key algorithms that can produce a
+// key of type keyType
+func keyTypeAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// preferredHostKeyAlgorithms returns the algorithms to negotiate with the
+// host. Like OpenSSH does, the algorithms of the keys already known for
+// the host are moved first, so that the server doesn't pick a key type
+// that isn't in the known_hosts file, failing the check. The certificate
+// algorithms come first if an @cert-authority entry matches the host.
+// If configured is empty, the default algorithms are used
+func preferredHostKeyAlgorithms(configured []string, knownHostsPath string, host string) []string {
+	algorithms := configured
+	if len(algorithms) == 0 {
+		algorithms = defaultHostKeyAlgorithms
+	}
+	entries, err := utils.ListKnownHostEntries(knownHostsPath)
+	if err != nil {
+		return algorithms
+	}
+
+	preferred := []string{}
+	for _, e := range entries {
+		if !utils.MatchKnownHostPatterns(e.Hosts, host) {
+			continue
+		}
+		switch e.Marker {
+		case "":
+			preferred = append(preferred, keyTypeAlgorithms(e.Key.Type())...)
+		case "cert-authority":
+			preferred = append(append([]string{}, certHostKeyAlgorithms...), preferred...)
+		}
+	}
+	if len(preferred) == 0 {
+		return algorithms
+	}
+
+	res := []string{}
+	for _, algorithm := range preferred {
+		if contains(algorithms, algorithm) && !contains(res, algorithm) {
+			res = append(res, algorithm)
+		}
+	}
+	for _, algorithm := range algorithms {
+		if !contains(res, algorithm) {
+			res = append(res, algorithm)
+		}
+	}
+	return res
+}
+
+// pinnedHostKeyAlgorithms returns the certificate algorithms among the
+// configured ones, or all of them if configured is empty, so that the
+// server presents its certificate
+func pinnedHostKeyAlgorithms(configured []string) []string {
+	if len(configured) == 0 {
+		return certHostKeyAlgorithms
+	}
+	res := []string{}
+	for _, algorithm := range configured {
+		if contains(certHostKeyAlgorithms, algorithm) {
+			res = append(res, algorithm)
+		}
+	}
+	return res
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// the env var holding the identity passphrase
+const passphraseEnvVar = "ROSPO_KEY_PASSPHRASE"
+
+// loadIdentity loads the identity signer. If the key is passphrase protected
+// the passphrase is taken from the configured one, from the
+// ROSPO_KEY_PASSPHRASE env var or asked with the passphrase prompt, in
+// this order.
+// Decrypted keys are kept in memory, so that the passphrase is not asked
+// again on reconnections
+func (s *SshConnection) loadIdentity(identity string, passphrase string) (ssh.Signer, error) {
+	s.identitiesMU.Lock()
+	defer s.identitiesMU.Unlock()
+
+	if signer, ok := s.decryptedIdentities[identity]; ok {
+		return signer, nil
+	}
+
+	signer, err := utils.LoadIdentitySigner(identity)
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return signer, err
+	}
+
+	secret, err := s.getPassphrase(identity, passphrase)
+	if err != nil {
+		s.log.Error("cannot get identity passphrase", "path", utils.KeySourceName(identity), "error", err)
+		return nil, err
+	}
+	signer, err = utils.LoadIdentitySignerWithPassphrase(identity, secret)
+	if err != nil {
+		s.log.Error("cannot decrypt identity", "path", utils.KeySourceName(identity), "error", err)
+		return nil, err
+	}
+	s.decryptedIdentities[identity] = signer
+	return signer, nil
+}
+
+func (s *SshConnection) getPassphrase(identity string, passphrase string) ([]byte, error) {
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if env := os.Getenv(passphraseEnvVar); env != "" {
+		return []byte(env), nil
+	}
+	name := utils.KeySourceName(identity)
+	secret, err := s.passphrasePrompt(name)
+	if err != nil {
+		return nil, fmt.Errorf(`identity %s is passphrase protected. Set the passphrase `+
+			`config option, the %s env var or run rospo from an interactive terminal: %w`, name, passphraseEnvVar, err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,71 @@
+package sshc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// kbdInteractiveAuthMethod builds the keyboard interactive auth method. The
+// configured answers are used first, in order across all the challenge
+// rounds, then the prompts are asked interactively if rospo runs in a
+// terminal. It returns nil if there is no way to answer
+func (s *SshConnection) kbdInteractiveAuthMethod(answers []string) ssh.AuthMethod {
+	if len(answers) == 0 && s.kbdInteractivePrompt == nil {
+		return nil
+	}
+
+	next := 0
+	return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if s.kbdInteractivePrompt != nil && !s.quiet {
+			if name != "" {
+				fmt.Println(name)
+			}
+			if instruction != "" {
+				fmt.Println(instruction)
+			}
+		}
+		replies := make([]string, len(questions))
+		for i, q := range questions {
+			if next < len(answers) {
+				replies[i] = answers[next]
+				next++
+				continue
+			}
+			if s.kbdInteractivePrompt == nil {
+				return nil, errors.New("no more keyboard interactive answers available")
+			}
+			reply, err := s.kbdInteractivePrompt(q, echos[i])
+			if err != nil {
+				return nil, err
+			}
+			replies[i] = reply
+		}
+		return replies, nil
+	})
+}
+
+// terminalKbdInteractivePrompt prints the question and reads the answer from
+// the terminal, disabling echo if requested. It is nil if stdin
+// is not a terminal
+func terminalKbdInteractivePrompt() func(question string, echo bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	return func(question string, echo bool) (string, error) {
+		fmt.Print(question)
+		if !echo {
+			answer, err := term.ReadPassword(fd)
+			fmt.Println()
+			return string(answer), err
+		}
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		return strings.TrimRight(answer, "\r\n"), err
+	}
+}
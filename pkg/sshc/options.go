@@ -0,0 +1,22 @@
+package sshc
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures the ssh connection
+type Option = options.Option
+
+// WithLogger sets the connection logger
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
+
+// WithTracer enables the tracing of the connection establishment and of
+// the channels opened with DialContext
+func WithTracer(t trace.Tracer) Option {
+	return options.WithTracer(t)
+}
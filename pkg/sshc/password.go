@@ -0,0 +1,51 @@
+package sshc
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// maxPasswordAttempts bounds the password auth tries when the
+// password is asked interactively
+const maxPasswordAttempts = 3
+
+// passwordAuthMethod builds the password auth method. The configured password
+// is tried first. If askPassword is true and rospo runs in a terminal, the
+// password is asked interactively on the following tries.
+// It returns nil if there is no password to offer
+func (s *SshConnection) passwordAuthMethod(password string, askPassword bool) ssh.AuthMethod {
+	canAsk := askPassword && s.passwordPrompt != nil
+	if !canAsk {
+		if password == "" {
+			return nil
+		}
+		return ssh.Password(password)
+	}
+
+	attempt := 0
+	return ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+		attempt++
+		if attempt == 1 && password != "" {
+			return password, nil
+		}
+		return s.passwordPrompt()
+	}), maxPasswordAttempts)
+}
+
+// terminalPasswordPrompt reads the password from the terminal with echo
+// disabled. It is nil if stdin is not a terminal
+func terminalPasswordPrompt() func() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	return func() (string, error) {
+		fmt.Print("\nThe server asks for a password\nPassword: ")
+		p, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(p), err
+	}
+}
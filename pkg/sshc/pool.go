@@ -0,0 +1,144 @@
+package sshc
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/ferama/rospo/pkg/metrics"
+	"gopkg.in/yaml.v3"
+)
+
+type pooledConnection struct {
+	conn   *SshConnection
+	key    [sha256.Size]byte
+	refs   int
+	cancel context.CancelFunc
+}
+
+// ConnectionPool shares the ssh connections among the users of the same
+// server, like the tunnels, so that they use a single TCP connection.
+// The connections are started by the pool
+type ConnectionPool struct {
+	// the number of connections kept open when nobody uses them. The
+	// least recently released ones are closed first
+	MaxIdleConns int
+
+	opts     []Option
+	recorder metrics.Recorder
+
+	conns map[[sha256.Size]byte]*pooledConnection
+	// the unused connections, least recently released first
+	idle []*pooledConnection
+	mu   sync.Mutex
+}
+
+// NewConnectionPool builds a ConnectionPool. The options are applied to
+// the connections it creates
+func NewConnectionPool(opts ...Option) *ConnectionPool {
+	return &ConnectionPool{
+		opts:     opts,
+		recorder: metrics.Nop,
+		conns:    make(map[[sha256.Size]byte]*pooledConnection),
+	}
+}
+
+// SetMetricsRecorder sets the recorder of the connections created
+// from now on
+func (p *ConnectionPool) SetMetricsRecorder(recorder metrics.Recorder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recorder = recorder
+}
+
+// poolKey identifies the connections to the same server with the same
+// credentials and settings
+func poolKey(conf *SshClientConf) [sha256.Size]byte {
+	data, _ := yaml.Marshal(conf)
+	return sha256.Sum256(data)
+}
+
+// Get returns the connection for conf. A connection to the same server
+// with the same credentials is reused if still open, otherwise a new one
+// is created and started. Each successful Get must be paired with a
+// Release. It returns an error if conf is not valid
+func (p *ConnectionPool) Get(conf *SshClientConf) (*SshConnection, error) {
+	key := poolKey(conf)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc, ok := p.conns[key]; ok && !pc.conn.isStopped.Load() {
+		if pc.refs == 0 {
+			p.removeIdle(pc)
+		}
+		pc.refs++
+		return pc.conn, nil
+	}
+
+	conn, err := NewSshConnection(conf, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMetricsRecorder(p.recorder)
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := &pooledConnection{conn: conn, key: key, refs: 1, cancel: cancel}
+	p.conns[key] = pc
+	// set by Start too. Set it here so that a Get running before Start
+	// doesn't take the connection for a stopped one
+	conn.isStopped.Store(false)
+	go conn.Start(ctx)
+	return conn, nil
+}
+
+// Release gives back a connection returned by Get. A connection nobody
+// uses is closed if there are more than MaxIdleConns idle connections
+func (p *ConnectionPool) Release(conn *SshConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		if pc.conn != conn || pc.refs == 0 {
+			continue
+		}
+		pc.refs--
+		if pc.refs == 0 {
+			p.idle = append(p.idle, pc)
+		}
+		break
+	}
+	for len(p.idle) > p.MaxIdleConns {
+		p.closeConn(p.idle[0])
+	}
+}
+
+// Close stops all the pool connections, the used ones too
+func (p *ConnectionPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		p.closeConn(pc)
+	}
+}
+
+// Len returns the number of the open pool connections
+func (p *ConnectionPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func (p *ConnectionPool) closeConn(pc *pooledConnection) {
+	p.removeIdle(pc)
+	if p.conns[pc.key] == pc {
+		delete(p.conns, pc.key)
+	}
+	pc.cancel()
+}
+
+func (p *ConnectionPool) removeIdle(pc *pooledConnection) {
+	for i, v := range p.idle {
+		if v == pc {
+			p.idle = append(p.idle[:i], p.idle[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package sshc
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// ProxyError is a failure reaching the first hop through the proxy. It
+// tells the proxy failures apart from the ssh ones
+type ProxyError struct {
+	// the proxy url, without the password
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %s", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// ParseProxyURL parses a socks5://, http:// or https://
+// [user:pass@]host:port proxy url. The port defaults to 1080 for SOCKS5,
+// to 80 and 443 for the http proxies
+func ParseProxyURL(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5, http or https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("the proxy host is missing")
+	}
+	return u, nil
+}
+
+// environmentProxy returns the ALL_PROXY and the NO_PROXY environment
+// variables. The lowercase names are used if the uppercase ones are unset
+func environmentProxy() (string, string) {
+	get := func(name string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return os.Getenv(strings.ToLower(name))
+	}
+	return get("ALL_PROXY"), get("NO_PROXY")
+}
+
+// bypassProxy reports if host matches one of the comma separated noProxy
+// entries: an ip, a cidr network, a domain matching its subdomains too
+// or "*" matching everything. The entries ports are ignored
+func bypassProxy(noProxy string, host string) bool {
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyDial connects to addr through the proxy. The errors are
+// ProxyError
+func proxyDial(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "http" || proxyURL.Scheme == "https" {
+		conn, err = httpConnectDial(ctx, dialer, proxyURL, addr)
+	} else {
+		var proxyDialer proxy.Dialer
+		proxyDialer, err = proxy.FromURL(proxyURL, dialer)
+		if err == nil {
+			conn, err = proxyDialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		}
+	}
+	if err != nil {
+		return nil, &ProxyError{Proxy: proxyURL.Redacted(), Err: err}
+	}
+	return conn, nil
+}
+
+// httpConnectDial connects to addr through the http proxy, with a CONNECT
+// request. The proxy connection is a tls one for the https scheme
+func httpConnectDial(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	port := proxyURL.Port()
+	if port == "" {
+		port = "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(proxyURL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	// the CONNECT exchange is aborted if ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s refused: %s %s", addr, resp.Proto, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// the server could have sent its banner along with the response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into
+// the reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
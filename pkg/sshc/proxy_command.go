@@ -0,0 +1,170 @@
+package sshc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// expandProxyCommand replaces the %h, %p and %r tokens of the proxy
+// command with the host, the port and the user, and %u with the local
+// user. %% is a literal %
+func expandProxyCommand(command string, host string, port int, user string) string {
+	var b strings.Builder
+	for i := 0; i < len(command); i++ {
+		if command[i] != '%' || i == len(command)-1 {
+			b.WriteByte(command[i])
+			continue
+		}
+		i++
+		switch command[i] {
+		case 'h':
+			b.WriteString(host)
+		case 'p':
+			b.WriteString(strconv.Itoa(port))
+		case 'r':
+			b.WriteString(user)
+		case 'u':
+			b.WriteString(utils.CurrentUser().Username)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(command[i])
+		}
+	}
+	return b.String()
+}
+
+// proxyCommandAddr is the address of a proxy command connection
+type proxyCommandAddr struct {
+	command string
+}
+
+func (a proxyCommandAddr) Network() string { return "proxycommand" }
+func (a proxyCommandAddr) String() string  { return a.command }
+
+// proxyCommandConn is a connection over the stdin and the stdout of a
+// proxy command. The command is killed when the connection is closed
+type proxyCommandConn struct {
+	cmd *exec.Cmd
+	// the command stdin write side and stdout read side
+	stdin  *os.File
+	stdout *os.File
+
+	closeOnce sync.Once
+	addr      proxyCommandAddr
+}
+
+// startProxyCommand runs the command through the shell and returns the
+// connection over its stdio. The command stderr lines are logged. It is
+// not started if ctx is done and it is killed once ctx is done. As for
+// the tcp connections, the handshake closes the connection, killing the
+// command, if the server key doesn't come within the connect timeout
+func startProxyCommand(ctx context.Context, command string, log *slog.Logger) (net.Conn, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", command)
+	} else {
+		// exec, so that the killed process is the proxy one
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", "exec "+command)
+	}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+
+	err = cmd.Start()
+	// the child ends are owned by the command now
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, fmt.Errorf("cannot start the proxy command: %w", err)
+	}
+	log = log.With("proxy_command", command, "pid", cmd.Process.Pid)
+	log.Debug("proxy command started")
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Info("proxy command output", "stderr", scanner.Text())
+		}
+		// all the stderr needs to be read before waiting
+		err := cmd.Wait()
+		log.Debug("proxy command exited", "error", err)
+	}()
+
+	return &proxyCommandConn{
+		cmd:    cmd,
+		stdin:  stdinW,
+		stdout: stdoutR,
+		addr:   proxyCommandAddr{command: command},
+	}, nil
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *proxyCommandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// Close closes the command stdio and kills it
+func (c *proxyCommandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.stdout.Close()
+		c.cmd.Process.Kill()
+	})
+	return nil
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr  { return c.addr }
+func (c *proxyCommandConn) RemoteAddr() net.Addr { return c.addr }
+
+// SetDeadline sets the pipes deadlines. Not all the platforms support them
+func (c *proxyCommandConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
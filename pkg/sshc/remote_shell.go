@@ -3,7 +3,6 @@ package sshc
 import (
 	"os"
 	"sync"
-	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
@@ -16,25 +15,27 @@ type RemoteShell struct {
 
 	session *ssh.Session
 	sessMU  sync.Mutex
-	stopCh  chan bool
 }
 
 // NewRemoteShell creates a new RemoteShell object
 func NewRemoteShell(sshConn *SshConnection) *RemoteShell {
 	rs := &RemoteShell{
 		sshConn: sshConn,
-		stopCh:  make(chan bool, 1),
 	}
 	return rs
 }
 
-// Start starts the remote shell
+// Start starts the remote shell. If cmd is empty an interactive shell is
+// requested. The returned error wraps the remote exit status: use ExitCode
+// to get it
 func (rs *RemoteShell) Start(cmd string, requestPty bool) error {
-	rs.sshConn.ReadyWait()
+	if err := rs.sshConn.ReadyWait(); err != nil {
+		return err
+	}
 
 	session, err := rs.sshConn.Client.NewSession()
 	if err != nil {
-		log.Fatalf("Failed to create session: " + err.Error())
+		rs.sshConn.log.Error("failed to create session", "error", err)
 		return err
 	}
 
@@ -42,6 +43,7 @@ func (rs *RemoteShell) Start(cmd string, requestPty bool) error {
 	rs.session = session
 	rs.sessMU.Unlock()
 	defer session.Close()
+	defer rs.sshConn.forwardAgent(session)()
 
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
@@ -51,26 +53,19 @@ func (rs *RemoteShell) Start(cmd string, requestPty bool) error {
 	if term.IsTerminal(fd) && requestPty {
 		state, err := term.MakeRaw(fd)
 		if err != nil {
-			log.Printf("terminal make raw: %s", err)
+			rs.sshConn.log.Error("terminal make raw", "error", err)
 		}
 		defer term.Restore(fd, state)
 
-		// terminal size poller
-		go func() {
-			for {
-				select {
-				case <-time.After(100 * time.Millisecond):
-					w, h, _ := term.GetSize(fd)
-					session.WindowChange(h, w)
-				case <-rs.stopCh:
-					return
-				}
-			}
-		}()
+		// forwards the local terminal resizes
+		stopWatch := watchWindowSize(fd, func(w, h int) {
+			session.WindowChange(h, w)
+		})
+		defer stopWatch()
 
 		w, h, err := term.GetSize(fd)
 		if err != nil {
-			log.Printf("terminal get size: %s", err)
+			rs.sshConn.log.Error("terminal get size", "error", err)
 		}
 
 		// Set up terminal modes
@@ -86,26 +81,27 @@ func (rs *RemoteShell) Start(cmd string, requestPty bool) error {
 		}
 		// Request pseudo terminal
 		if err := session.RequestPty(terminal, h, w, modes); err != nil {
-			log.Fatalf("request for pseudo terminal failed: %s", err)
+			rs.sshConn.log.Error("request for pseudo terminal failed", "error", err)
 			return err
 		}
 	}
 	if cmd == "" {
 		// Start remote shell
 		if err := session.Shell(); err != nil {
-			log.Fatalf("failed to start shell: %s", err)
+			rs.sshConn.log.Error("failed to start shell", "error", err)
 			return err
 		}
-		session.Wait()
-
-	} else {
-		// run the cmd
-		return session.Run(cmd)
+		return session.Wait()
 	}
-	return nil
+	// run the cmd
+	return session.Run(cmd)
 }
 
-// Stop stops the remote shell
+// Stop stops the remote shell closing its session
 func (rs *RemoteShell) Stop() {
-	rs.stopCh <- true
+	rs.sessMU.Lock()
+	defer rs.sessMU.Unlock()
+	if rs.session != nil {
+		rs.session.Close()
+	}
 }
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package sshc
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// watchWindowSize calls resize with the terminal fd size on every SIGWINCH.
+// The returned func stops the watch
+func watchWindowSize(fd int, resize func(width, height int)) func() {
+	sigwinch := make(chan os.Signal, 1)
+	signal.Notify(sigwinch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-sigwinch:
+				if w, h, err := term.GetSize(fd); err == nil {
+					resize(w, h)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigwinch)
+		close(done)
+	}
+}
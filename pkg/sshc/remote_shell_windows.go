@@ -0,0 +1,37 @@
+package sshc
+
+import (
+	"time"
+
+	"golang.org/x/term"
+)
+
+// the console has no resize signal: its size is polled
+const windowSizePollInterval = 250 * time.Millisecond
+
+// watchWindowSize calls resize with the terminal fd size each time it
+// changes. The returned func stops the watch
+func watchWindowSize(fd int, resize func(width, height int)) func() {
+	done := make(chan struct{})
+	go func() {
+		lastW, lastH, _ := term.GetSize(fd)
+		ticker := time.NewTicker(windowSizePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w, h, err := term.GetSize(fd)
+				if err != nil || (w == lastW && h == lastH) {
+					continue
+				}
+				lastW, lastH = w, h
+				resize(w, h)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,428 @@
+package sshc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// ErrSftpExit is returned by SftpShell.Exec for the exit commands
+var ErrSftpExit = errors.New("exit")
+
+const sftpShellHelp = `Available commands:
+  cd path                    change the remote directory
+  lcd path                   change the local directory
+  pwd                        print the remote directory
+  lpwd                       print the local directory
+  ls [path...]               list the remote directory or files
+  lls [path...]              list the local directory or files
+  get [-r] remote... [local] download the remote files
+  put [-r] local... [remote] upload the local files
+  mkdir path                 create a remote directory
+  rmdir path                 remove a remote directory
+  rm path...                 remove the remote files
+  help                       print this help
+  exit, quit, bye            end the session
+The remote and local paths can contain the *, ? and [] wildcards
+`
+
+// SftpShell runs the sftp commands, like the OpenSSH sftp client does, on
+// a transfer session. It keeps its own remote and local working
+// directories, the process one is not changed
+type SftpShell struct {
+	transfer *SftpTransfer
+	out      io.Writer
+
+	remoteWd string
+	localWd  string
+}
+
+// NewSftpShell builds a shell on the transfer session. The commands output
+// is written to out. The remote working directory starts from the session
+// one and the local from the process one
+func NewSftpShell(transfer *SftpTransfer, out io.Writer) (*SftpShell, error) {
+	remoteWd, err := transfer.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the remote directory: %w", err)
+	}
+	localWd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the local directory: %w", err)
+	}
+	return &SftpShell{
+		transfer: transfer,
+		out:      out,
+		remoteWd: remoteWd,
+		localWd:  localWd,
+	}, nil
+}
+
+// Prompt returns the interactive prompt, with the remote directory
+func (s *SftpShell) Prompt() string {
+	return "sftp " + s.remoteWd + "> "
+}
+
+// RunBatch executes the commands read from r, one per line. The empty
+// lines and the ones starting with # are skipped. It stops on the first
+// failed command, unless its line starts with -, and on the exit commands
+func (s *SftpShell) RunBatch(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ignoreErr := strings.HasPrefix(line, "-")
+		line = strings.TrimPrefix(line, "-")
+		fmt.Fprintf(s.out, "sftp> %s\n", line)
+		err := s.Exec(line)
+		if errors.Is(err, ErrSftpExit) {
+			return nil
+		}
+		if err != nil {
+			if !ignoreErr {
+				return fmt.Errorf("line %d: %w", n, err)
+			}
+			fmt.Fprintln(s.out, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Exec executes a command line. It returns ErrSftpExit for the exit
+// commands
+func (s *SftpShell) Exec(line string) error {
+	args, err := splitQuotedArgs(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "exit", "quit", "bye":
+		return ErrSftpExit
+	case "help", "?":
+		fmt.Fprint(s.out, sftpShellHelp)
+		return nil
+	case "pwd":
+		fmt.Fprintf(s.out, "Remote working directory: %s\n", s.remoteWd)
+		return nil
+	case "lpwd":
+		fmt.Fprintf(s.out, "Local working directory: %s\n", s.localWd)
+		return nil
+	case "cd":
+		return s.cd(args)
+	case "lcd":
+		return s.lcd(args)
+	case "ls":
+		return s.ls(args)
+	case "lls":
+		return s.lls(args)
+	case "get":
+		return s.get(args)
+	case "put":
+		return s.put(args)
+	case "mkdir":
+		if len(args) != 1 {
+			return errors.New("usage: mkdir path")
+		}
+		return s.transfer.client.Mkdir(s.remotePath(args[0]))
+	case "rmdir":
+		if len(args) != 1 {
+			return errors.New("usage: rmdir path")
+		}
+		return s.transfer.client.RemoveDirectory(s.remotePath(args[0]))
+	case "rm":
+		return s.rm(args)
+	}
+	return fmt.Errorf("invalid command %s. Type help for the available ones", cmd)
+}
+
+// remotePath resolves p against the remote working directory
+func (s *SftpShell) remotePath(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(s.remoteWd, p)
+}
+
+// localPath resolves p against the local working directory
+func (s *SftpShell) localPath(p string) string {
+	p, _ = utils.ExpandUserHome(p)
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(s.localWd, p)
+}
+
+// remoteGlob expands the remote pattern. It fails if nothing matches
+func (s *SftpShell) remoteGlob(pattern string) ([]string, error) {
+	p := s.remotePath(pattern)
+	if !hasGlobMeta(pattern) {
+		return []string{p}, nil
+	}
+	matches, err := s.transfer.client.Glob(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory", pattern)
+	}
+	return matches, nil
+}
+
+// localGlob expands the local pattern. It fails if nothing matches
+func (s *SftpShell) localGlob(pattern string) ([]string, error) {
+	p := s.localPath(pattern)
+	if !hasGlobMeta(pattern) {
+		return []string{p}, nil
+	}
+	matches, err := filepath.Glob(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no such file or directory", pattern)
+	}
+	return matches, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+func (s *SftpShell) cd(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: cd [path]")
+	}
+	// without arguments it goes back to the session start directory
+	if len(args) == 0 {
+		home, err := s.transfer.client.RealPath(".")
+		if err != nil {
+			return err
+		}
+		args = []string{home}
+	}
+	dir := args[0]
+	p := s.remotePath(dir)
+	stat, err := s.transfer.client.Stat(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	s.remoteWd = p
+	return nil
+}
+
+func (s *SftpShell) lcd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: lcd path")
+	}
+	p := s.localPath(args[0])
+	stat, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s is not a directory", args[0])
+	}
+	s.localWd = p
+	return nil
+}
+
+// listing writes the files in the ls -l like format
+func (s *SftpShell) listing(files []os.FileInfo, names []string) {
+	w := tabwriter.NewWriter(s.out, 0, 0, 1, ' ', tabwriter.AlignRight)
+	for i, f := range files {
+		fmt.Fprintf(w, "%s\t %d\t %s\t %s\t\n",
+			f.Mode().String(), f.Size(), f.ModTime().Format("Jan _2 15:04"), names[i])
+	}
+	w.Flush()
+}
+
+func (s *SftpShell) ls(args []string) error {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	files := []os.FileInfo{}
+	names := []string{}
+	for _, arg := range args {
+		matches, err := s.remoteGlob(arg)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			stat, err := s.transfer.client.Stat(m)
+			if err != nil {
+				return fmt.Errorf("%s: %w", arg, err)
+			}
+			if !stat.IsDir() || hasGlobMeta(arg) {
+				files = append(files, stat)
+				names = append(names, stat.Name())
+				continue
+			}
+			entries, err := s.transfer.client.ReadDir(m)
+			if err != nil {
+				return fmt.Errorf("%s: %w", arg, err)
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+			for _, e := range entries {
+				files = append(files, e)
+				names = append(names, e.Name())
+			}
+		}
+	}
+	s.listing(files, names)
+	return nil
+}
+
+func (s *SftpShell) lls(args []string) error {
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+	files := []os.FileInfo{}
+	names := []string{}
+	for _, arg := range args {
+		matches, err := s.localGlob(arg)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			stat, err := os.Stat(m)
+			if err != nil {
+				return err
+			}
+			if !stat.IsDir() || hasGlobMeta(arg) {
+				files = append(files, stat)
+				names = append(names, stat.Name())
+				continue
+			}
+			entries, err := os.ReadDir(m)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				info, err := e.Info()
+				if err != nil {
+					continue
+				}
+				files = append(files, info)
+				names = append(names, e.Name())
+			}
+		}
+	}
+	s.listing(files, names)
+	return nil
+}
+
+// transferArgs splits the get and put arguments in the recursive flag,
+// the sources and the destination. With a single argument the
+// destination is empty
+func transferArgs(args []string) (bool, []string, string, error) {
+	recursive := false
+	if len(args) > 0 && args[0] == "-r" {
+		recursive = true
+		args = args[1:]
+	}
+	switch len(args) {
+	case 0:
+		return false, nil, "", errors.New("missing the source path")
+	case 1:
+		return recursive, args, "", nil
+	}
+	return recursive, args[:len(args)-1], args[len(args)-1], nil
+}
+
+func (s *SftpShell) get(args []string) error {
+	recursive, sources, dst, err := transferArgs(args)
+	if err != nil {
+		return fmt.Errorf("usage: get [-r] remote... [local]: %w", err)
+	}
+	local := s.localWd
+	if dst != "" {
+		local = s.localPath(dst)
+	}
+	remotes := []string{}
+	for _, src := range sources {
+		matches, err := s.remoteGlob(src)
+		if err != nil {
+			return err
+		}
+		remotes = append(remotes, matches...)
+	}
+	if len(remotes) > 1 {
+		if stat, err := os.Stat(local); err != nil || !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", local)
+		}
+	}
+	for _, remote := range remotes {
+		fmt.Fprintf(s.out, "Fetching %s to %s\n", remote, local)
+		if err := s.transfer.Download(remote, local, recursive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SftpShell) put(args []string) error {
+	recursive, sources, dst, err := transferArgs(args)
+	if err != nil {
+		return fmt.Errorf("usage: put [-r] local... [remote]: %w", err)
+	}
+	remote := s.remoteWd
+	if dst != "" {
+		remote = s.remotePath(dst)
+	}
+	locals := []string{}
+	for _, src := range sources {
+		matches, err := s.localGlob(src)
+		if err != nil {
+			return err
+		}
+		locals = append(locals, matches...)
+	}
+	if len(locals) > 1 {
+		if stat, err := s.transfer.client.Stat(remote); err != nil || !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", remote)
+		}
+	}
+	for _, local := range locals {
+		fmt.Fprintf(s.out, "Uploading %s to %s\n", local, remote)
+		if err := s.transfer.Upload(local, remote, recursive); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SftpShell) rm(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: rm path...")
+	}
+	for _, arg := range args {
+		matches, err := s.remoteGlob(arg)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			fmt.Fprintf(s.out, "Removing %s\n", m)
+			if err := s.transfer.client.Remove(m); err != nil {
+				return fmt.Errorf("%s: %w", m, err)
+			}
+		}
+	}
+	return nil
+}
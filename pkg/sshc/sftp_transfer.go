@@ -0,0 +1,376 @@
+package sshc
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"github.com/pkg/sftp"
+)
+
+// ProgressFunc is called when a file transfer starts. It receives the
+// file name and size and returns a channel that will receive the
+// written bytes counts. The channel is closed when the transfer ends.
+// A nil channel can be returned if no progress tracking is needed
+type ProgressFunc func(name string, size int64) chan int64
+
+// SftpTransfer copies files between the local machine and the remote
+// server using the sftp subsystem. By default the file permissions and
+// modification times are preserved
+type SftpTransfer struct {
+	client   *sftp.Client
+	progress ProgressFunc
+	// if true the permissions and modification times are copied
+	preserve bool
+	// if true the partially transferred files are completed
+	resume bool
+	// the max copy rate in bytes per second. Unlimited if 0
+	bandwidthLimit int64
+}
+
+// FileError is the failed copy of a file
+type FileError struct {
+	Path string
+	Err  error
+}
+
+// TransferErrors lists the files a recursive copy failed. The copy goes on
+// with the other files
+type TransferErrors []FileError
+
+func (e TransferErrors) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("%s: %s", e[0].Path, e[0].Err)
+	}
+	return fmt.Sprintf("%d files failed", len(e))
+}
+
+// NewSftpTransfer waits for the ssh connection to be established and
+// starts an sftp session on it
+func NewSftpTransfer(sshConn *SshConnection, progress ProgressFunc) (*SftpTransfer, error) {
+	if err := sshConn.ReadyWait(); err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(sshConn.Client)
+	if err != nil {
+		return nil, err
+	}
+	return &SftpTransfer{
+		client:   client,
+		progress: progress,
+		preserve: true,
+	}, nil
+}
+
+// SetPreserve sets if the permissions and modification times of the
+// files are copied. Defaults to true
+func (t *SftpTransfer) SetPreserve(preserve bool) {
+	t.preserve = preserve
+}
+
+// SetResume sets if a destination file smaller than the source is
+// completed instead of copied again. The destination sizes are compared
+// only: a destination bigger than the source is copied again
+func (t *SftpTransfer) SetResume(resume bool) {
+	t.resume = resume
+}
+
+// SetBandwidthLimit sets the max copy rate in bytes per second. 0, the
+// default, is unlimited
+func (t *SftpTransfer) SetBandwidthLimit(bytesPerSecond int64) {
+	t.bandwidthLimit = bytesPerSecond
+}
+
+// resumeOffset returns where the copy of a srcSize file starts, given the
+// destination file stat. It is 0 if the copy is not resumed
+func (t *SftpTransfer) resumeOffset(dstStat os.FileInfo, dstErr error, srcSize int64) int64 {
+	if !t.resume || dstErr != nil || dstStat.IsDir() || dstStat.Size() > srcSize {
+		return 0
+	}
+	return dstStat.Size()
+}
+
+// copyFrom copies src to dst starting at offset, reporting the progress
+// of the name file
+func (t *SftpTransfer) copyFrom(dst io.WriteSeeker, src io.ReadSeeker, offset int64, name string, size int64) error {
+	if offset > 0 {
+		if _, err := dst.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	byteswrittench := t.startProgress(name, size)
+	if byteswrittench != nil && offset > 0 {
+		byteswrittench <- offset
+	}
+	err := rio.CopyBuffer(dst, rio.NewRateLimitedReader(src, t.bandwidthLimit), byteswrittench)
+	if byteswrittench != nil {
+		close(byteswrittench)
+	}
+	return err
+}
+
+// Close ends the sftp session
+func (t *SftpTransfer) Close() error {
+	return t.client.Close()
+}
+
+// Getwd returns the remote working directory
+func (t *SftpTransfer) Getwd() (string, error) {
+	return t.client.Getwd()
+}
+
+func (t *SftpTransfer) startProgress(name string, size int64) chan int64 {
+	if t.progress == nil {
+		return nil
+	}
+	return t.progress(name, size)
+}
+
+// Upload copies the local path to the remote one. If remote is an existing
+// directory, the file is copied into it. Directories are copied only
+// if recursive is true
+func (t *SftpTransfer) Upload(local, remote string, recursive bool) error {
+	localStat, err := os.Stat(local)
+	if err != nil {
+		return fmt.Errorf("cannot stat local path: %s", local)
+	}
+	if remoteStat, err := t.client.Stat(remote); err == nil && remoteStat.IsDir() {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+	if !localStat.IsDir() {
+		return t.uploadFile(local, remote, localStat)
+	}
+	if !recursive {
+		return fmt.Errorf("%s is a directory", local)
+	}
+
+	return filepath.WalkDir(local, func(localPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, localPath)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(remote, filepath.ToSlash(rel))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if err := t.client.MkdirAll(remotePath); err != nil {
+				return fmt.Errorf("cannot create directory %s: %s", remotePath, err)
+			}
+			if t.preserve {
+				t.client.Chmod(remotePath, info.Mode().Perm())
+			}
+			return nil
+		}
+		return t.uploadFile(localPath, remotePath, info)
+	})
+}
+
+func (t *SftpTransfer) uploadFile(localPath, remotePath string, localStat os.FileInfo) error {
+	lFile, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("cannot open local file for read: %s", err)
+	}
+	defer lFile.Close()
+
+	remoteStat, statErr := t.client.Stat(remotePath)
+	offset := t.resumeOffset(remoteStat, statErr, localStat.Size())
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR
+	}
+	rFile, err := t.client.OpenFile(remotePath, flags)
+	if err != nil {
+		return fmt.Errorf("cannot open remote file for write: %s", err)
+	}
+	defer rFile.Close()
+
+	err = t.copyFrom(rFile, lFile, offset, filepath.Base(localPath), localStat.Size())
+	if err != nil {
+		return fmt.Errorf("error while writing remote file: %s", err)
+	}
+	if !t.preserve {
+		return nil
+	}
+	if err := rFile.Chmod(localStat.Mode().Perm()); err != nil {
+		return fmt.Errorf("cannot set remote file permissions: %s", err)
+	}
+	if err := t.client.Chtimes(remotePath, localStat.ModTime(), localStat.ModTime()); err != nil {
+		return fmt.Errorf("cannot set remote file times: %s", err)
+	}
+	return nil
+}
+
+// Download copies the remote path to the local one. If local is an existing
+// directory, the file is copied into it. Directories are copied only
+// if recursive is true
+func (t *SftpTransfer) Download(remote, local string, recursive bool) error {
+	remoteStat, err := t.client.Stat(remote)
+	if err != nil {
+		return fmt.Errorf("cannot stat remote path: %s", remote)
+	}
+	if localStat, err := os.Stat(local); err == nil && localStat.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+	if !remoteStat.IsDir() {
+		return t.downloadFile(remote, local, remoteStat)
+	}
+	if !recursive {
+		return fmt.Errorf("%s is a directory", remote)
+	}
+
+	walker := t.client.Walk(remote)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		remotePath := walker.Path()
+		rel := strings.TrimPrefix(remotePath, remote)
+		localPath := filepath.Join(local, filepath.FromSlash(rel))
+		stat := walker.Stat()
+		if stat.IsDir() {
+			if err := os.MkdirAll(localPath, stat.Mode().Perm()); err != nil {
+				return fmt.Errorf("cannot create directory %s: %s", localPath, err)
+			}
+			continue
+		}
+		if err := t.downloadFile(remotePath, localPath, stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *SftpTransfer) downloadFile(remotePath, localPath string, remoteStat os.FileInfo) error {
+	rFile, err := t.client.Open(remotePath)
+	if err != nil {
+		return fmt.Errorf("cannot open remote file for read: %s", err)
+	}
+	defer rFile.Close()
+
+	localStat, statErr := os.Stat(localPath)
+	offset := t.resumeOffset(localStat, statErr, remoteStat.Size())
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR
+	}
+	lFile, err := os.OpenFile(localPath, flags, 0666)
+	if err != nil {
+		return fmt.Errorf("cannot open local file for write: %s", err)
+	}
+	defer lFile.Close()
+
+	err = t.copyFrom(lFile, rFile, offset, path.Base(remotePath), remoteStat.Size())
+	if err != nil {
+		return fmt.Errorf("error while writing local file: %s", err)
+	}
+	if !t.preserve {
+		return nil
+	}
+	if err := lFile.Chmod(remoteStat.Mode().Perm()); err != nil {
+		return fmt.Errorf("cannot set local file permissions: %s", err)
+	}
+	if err := os.Chtimes(localPath, remoteStat.ModTime(), remoteStat.ModTime()); err != nil {
+		return fmt.Errorf("cannot set local file times: %s", err)
+	}
+	return nil
+}
+
+// CopyTo copies the src path to the dst path of the dstT server, streaming
+// the data between the two sftp sessions. If dst is an existing directory,
+// the file is copied into it. Directories are copied only if recursive is
+// true: a failed file doesn't stop the copy and the failures are returned
+// as TransferErrors
+func (t *SftpTransfer) CopyTo(dstT *SftpTransfer, src, dst string, recursive bool) error {
+	srcStat, err := t.client.Stat(src)
+	if err != nil {
+		return fmt.Errorf("cannot stat source path: %s", src)
+	}
+	if dstStat, err := dstT.client.Stat(dst); err == nil && dstStat.IsDir() {
+		dst = path.Join(dst, path.Base(src))
+	}
+	if !srcStat.IsDir() {
+		return t.copyFile(dstT, src, dst, srcStat)
+	}
+	if !recursive {
+		return fmt.Errorf("%s is a directory", src)
+	}
+
+	var failed TransferErrors
+	walker := t.client.Walk(src)
+	for walker.Step() {
+		srcPath := walker.Path()
+		if err := walker.Err(); err != nil {
+			failed = append(failed, FileError{Path: srcPath, Err: err})
+			continue
+		}
+		dstPath := path.Join(dst, strings.TrimPrefix(srcPath, src))
+		stat := walker.Stat()
+		if stat.IsDir() {
+			if err := dstT.client.MkdirAll(dstPath); err != nil {
+				failed = append(failed, FileError{Path: srcPath, Err: fmt.Errorf("cannot create directory %s: %s", dstPath, err)})
+				walker.SkipDir()
+				continue
+			}
+			if t.preserve {
+				dstT.client.Chmod(dstPath, stat.Mode().Perm())
+			}
+			continue
+		}
+		if err := t.copyFile(dstT, srcPath, dstPath, stat); err != nil {
+			failed = append(failed, FileError{Path: srcPath, Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+func (t *SftpTransfer) copyFile(dstT *SftpTransfer, srcPath, dstPath string, srcStat os.FileInfo) error {
+	sFile, err := t.client.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("cannot open source file for read: %s", err)
+	}
+	defer sFile.Close()
+
+	dstStat, statErr := dstT.client.Stat(dstPath)
+	offset := t.resumeOffset(dstStat, statErr, srcStat.Size())
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_RDWR
+	}
+	dFile, err := dstT.client.OpenFile(dstPath, flags)
+	if err != nil {
+		return fmt.Errorf("cannot open destination file for write: %s", err)
+	}
+	defer dFile.Close()
+
+	err = t.copyFrom(dFile, sFile, offset, path.Base(srcPath), srcStat.Size())
+	if err != nil {
+		return fmt.Errorf("error while writing destination file: %s", err)
+	}
+	if !t.preserve {
+		return nil
+	}
+	if err := dFile.Chmod(srcStat.Mode().Perm()); err != nil {
+		return fmt.Errorf("cannot set destination file permissions: %s", err)
+	}
+	if err := dstT.client.Chtimes(dstPath, srcStat.ModTime(), srcStat.ModTime()); err != nil {
+		return fmt.Errorf("cannot set destination file times: %s", err)
+	}
+	return nil
+}
@@ -2,13 +2,18 @@ package sshc
 
 import (
 	"context"
+	"log/slog"
 	"net"
+	"sync"
 
 	"github.com/ferama/go-socks"
 )
 
 type SocksProxy struct {
 	sshConn *SshConnection
+
+	listener   net.Listener
+	listenerMU sync.Mutex
 }
 
 func NewSocksProxy(sshConn *SshConnection) *SocksProxy {
@@ -21,18 +26,37 @@ func NewSocksProxy(sshConn *SshConnection) *SocksProxy {
 
 // Start starts the local socks proxy
 func (p *SocksProxy) Start(socksAddress string) error {
-	p.sshConn.ReadyWait()
+	if err := p.sshConn.ReadyWait(); err != nil {
+		return err
+	}
 
 	server, _ := socks.New(&socks.Config{
-		Logger: log,
+		Logger: slog.NewLogLogger(p.sshConn.log.Handler(), slog.LevelDebug),
 		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return p.sshConn.Client.Dial(network, addr)
 		},
 	})
 
-	log.Printf("local socks proxy listening at '%s'", socksAddress)
-	if err := server.ListenAndServe("tcp", socksAddress); err != nil {
+	listener, err := net.Listen("tcp", socksAddress)
+	if err != nil {
+		return err
+	}
+	p.listenerMU.Lock()
+	p.listener = listener
+	p.listenerMU.Unlock()
+
+	p.sshConn.log.Info("local socks proxy listening", "addr", socksAddress)
+	if err := server.Serve(listener); err != nil {
 		return err
 	}
 	return nil
 }
+
+// Stop closes the socks proxy listener
+func (p *SocksProxy) Stop() {
+	p.listenerMU.Lock()
+	defer p.listenerMU.Unlock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+}
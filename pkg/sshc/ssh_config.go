@@ -0,0 +1,559 @@
+package sshc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// the max Include nesting, like OpenSSH
+const sshConfigMaxDepth = 16
+
+// defaultSshConfigPath returns the OpenSSH user config path
+func defaultSshConfigPath() string {
+	return filepath.Join(utils.CurrentUser().HomeDir, ".ssh", "config")
+}
+
+// sshConfigLine is a keyword line of an OpenSSH client config file. The
+// keyword is lowercase
+type sshConfigLine struct {
+	keyword string
+	args    []string
+	// the arguments as written. ProxyCommand is a shell command line
+	raw  string
+	file string
+	line int
+}
+
+// parseSshConfigFile reads the keyword lines of an OpenSSH client config
+// file. Both the "Keyword value" and the "Keyword=value" forms are
+// supported, with double quoted arguments
+func parseSshConfigFile(path string) ([]sshConfigLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []sshConfigLine{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		keyword, rest := text, ""
+		if i := strings.IndexAny(text, " \t="); i >= 0 {
+			keyword, rest = text[:i], strings.TrimSpace(text[i:])
+			// a single = can separate the keyword from the arguments
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+		}
+		args, err := splitQuotedArgs(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, n, err)
+		}
+		lines = append(lines, sshConfigLine{
+			keyword: strings.ToLower(keyword),
+			args:    args,
+			raw:     rest,
+			file:    path,
+			line:    n,
+		})
+	}
+	return lines, scanner.Err()
+}
+
+// splitQuotedArgs splits the arguments on the whitespaces. The double
+// quoted ones can contain whitespaces
+func splitQuotedArgs(s string) ([]string, error) {
+	args := []string{}
+	var b strings.Builder
+	quoted, inArg := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		default:
+			b.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted argument")
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// matchSshPattern reports if s matches the OpenSSH pattern, with the *
+// and ? wildcards
+func matchSshPattern(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchSshPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchSshPatternList reports if s matches the comma or space separated
+// pattern list: at least one pattern matches and none of the negated
+// (!pattern) ones does
+func matchSshPatternList(patterns []string, s string) bool {
+	s = strings.ToLower(s)
+	matched := false
+	for _, arg := range patterns {
+		for _, p := range strings.Split(strings.ToLower(arg), ",") {
+			if p == "" {
+				continue
+			}
+			if strings.HasPrefix(p, "!") {
+				if matchSshPattern(p[1:], s) {
+					return false
+				}
+				continue
+			}
+			if matchSshPattern(p, s) {
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+// SshConfigHost holds the OpenSSH client config values of a host. The
+// zero values are the unset ones
+type SshConfigHost struct {
+	HostName      string
+	Port          int
+	User          string
+	IdentityFiles []string
+	// the jump hosts, in order
+	ProxyJump []string
+	// the command line, with its tokens not expanded
+	ProxyCommand string
+	// yes, no, accept-new, ask or off
+	StrictHostKeyChecking string
+	UserKnownHostsFile    string
+}
+
+// sshConfigLookup walks the config files collecting the values of a host.
+// As with OpenSSH, the first obtained value of a keyword is used, except
+// the identity files that accumulate
+type sshConfigLookup struct {
+	// the host as given, before the HostName substitution
+	originalHost string
+	// the remote user as given. Empty if not set
+	user    string
+	baseDir string
+	result  SshConfigHost
+	seen    map[string]bool
+}
+
+// LookupSshConfig returns the values of the OpenSSH client config file
+// that apply to host. user is the remote user given explicitly, if any,
+// used by the Match user criteria. The Host and Match blocks and the
+// Include directive are supported
+func LookupSshConfig(path string, host string, user string) (*SshConfigHost, error) {
+	l := &sshConfigLookup{
+		originalHost: host,
+		user:         user,
+		baseDir:      filepath.Dir(path),
+		seen:         map[string]bool{},
+	}
+	if err := l.walk(path, 0); err != nil {
+		return nil, err
+	}
+	return &l.result, nil
+}
+
+func (l *sshConfigLookup) walk(path string, depth int) error {
+	if depth > sshConfigMaxDepth {
+		return fmt.Errorf("%s: too many nested includes", path)
+	}
+	lines, err := parseSshConfigFile(path)
+	if err != nil {
+		return err
+	}
+	// the lines before the first Host or Match apply to every host
+	active := true
+	for _, line := range lines {
+		switch line.keyword {
+		case "host":
+			active = matchSshPatternList(line.args, l.originalHost)
+			continue
+		case "match":
+			active, err = l.match(line)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !active {
+			continue
+		}
+		if line.keyword == "include" {
+			if err := l.include(line, depth); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := l.set(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// include walks the files matching the Include arguments. The relative
+// paths are relative to the user config dir
+func (l *sshConfigLookup) include(line sshConfigLine, depth int) error {
+	for _, arg := range line.args {
+		pattern, _ := utils.ExpandUserHome(arg)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(l.baseDir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", line.file, line.line, err)
+		}
+		for _, f := range files {
+			if err := l.walk(f, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// match evaluates the Match line criteria. The host ones are checked
+// against the HostName obtained so far. exec is not supported: the
+// blocks using it never match
+func (l *sshConfigLookup) match(line sshConfigLine) (bool, error) {
+	args := line.args
+	if len(args) == 0 {
+		return false, fmt.Errorf("%s line %d: Match without criteria", line.file, line.line)
+	}
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negated := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+		var matched bool
+		switch criterion {
+		case "all":
+			matched = true
+		case "canonical", "final":
+			// there is no canonicalization, so that a single pass is done
+			matched = true
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf("%s line %d: Match %s without argument", line.file, line.line, criterion)
+			}
+			i++
+			patterns := []string{args[i]}
+			switch criterion {
+			case "host":
+				host := l.result.HostName
+				if host == "" {
+					host = l.originalHost
+				}
+				matched = matchSshPatternList(patterns, host)
+			case "originalhost":
+				matched = matchSshPatternList(patterns, l.originalHost)
+			case "user":
+				user := l.user
+				if user == "" {
+					user = l.result.User
+				}
+				if user == "" {
+					user = utils.CurrentUser().Username
+				}
+				matched = matchSshPatternList(patterns, user)
+			case "localuser":
+				matched = matchSshPatternList(patterns, utils.CurrentUser().Username)
+			case "exec":
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("%s line %d: unsupported Match criteria %q", line.file, line.line, criterion)
+		}
+		if matched == negated {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// set sets the keyword value, if not set yet
+func (l *sshConfigLookup) set(line sshConfigLine) error {
+	if len(line.args) == 0 {
+		return fmt.Errorf("%s line %d: %s without value", line.file, line.line, line.keyword)
+	}
+	if line.keyword == "identityfile" {
+		l.result.IdentityFiles = append(l.result.IdentityFiles, line.args[0])
+		return nil
+	}
+	if l.seen[line.keyword] {
+		return nil
+	}
+	// ProxyJump and ProxyCommand compete: the first one wins
+	if (line.keyword == "proxyjump" || line.keyword == "proxycommand") && (l.seen["proxyjump"] || l.seen["proxycommand"]) {
+		return nil
+	}
+	value := line.args[0]
+	switch line.keyword {
+	case "hostname":
+		l.result.HostName = strings.ReplaceAll(value, "%h", l.originalHost)
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("%s line %d: invalid port %q", line.file, line.line, value)
+		}
+		l.result.Port = port
+	case "user":
+		l.result.User = value
+	case "proxyjump":
+		if !strings.EqualFold(value, "none") {
+			l.result.ProxyJump = strings.Split(value, ",")
+		}
+	case "proxycommand":
+		if !strings.EqualFold(value, "none") {
+			l.result.ProxyCommand = line.raw
+		}
+	case "stricthostkeychecking":
+		l.result.StrictHostKeyChecking = strings.ToLower(value)
+	case "userknownhostsfile":
+		l.result.UserKnownHostsFile = value
+	default:
+		// the other keywords are ignored
+		return nil
+	}
+	l.seen[line.keyword] = true
+	return nil
+}
+
+// hasExplicitSshConfigHost reports if a Host line of the config names host without
+// wildcards. The included files are not looked up
+func hasExplicitSshConfigHost(path string, host string) bool {
+	lines, err := parseSshConfigFile(path)
+	if err != nil {
+		return false
+	}
+	for _, line := range lines {
+		if line.keyword != "host" {
+			continue
+		}
+		for _, arg := range line.args {
+			for _, p := range strings.Split(arg, ",") {
+				if strings.EqualFold(p, host) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// expandSshConfigTokens replaces the IdentityFile and UserKnownHostsFile
+// tokens: %d the local home, %u the local user, %h the host name, %n the
+// original host, %p the port, %r the remote user and %% a literal %. A
+// leading ~ is the local home
+func expandSshConfigTokens(value string, originalHost string, host string, port int, user string) string {
+	usr := utils.CurrentUser()
+	value = strings.NewReplacer(
+		"%%", "%",
+		"%d", usr.HomeDir,
+		"%u", usr.Username,
+		"%h", host,
+		"%n", originalHost,
+		"%p", strconv.Itoa(port),
+		"%r", user,
+	).Replace(value)
+	if value == "~" {
+		return usr.HomeDir
+	}
+	expanded, _ := utils.ExpandUserHome(value)
+	return expanded
+}
+
+// splitSshURI splits a [user@]host[:port] uri. The missing parts are
+// empty, 0 for the port
+func splitSshURI(uri string) (string, string, int) {
+	user := ""
+	if i := strings.LastIndex(uri, "@"); i >= 0 {
+		user, uri = uri[:i], uri[i+1:]
+	}
+	host, portStr, err := net.SplitHostPort(uri)
+	if err != nil {
+		return user, strings.Trim(uri, "[]"), 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return user, host, port
+}
+
+// joinSshURI builds a user@host:port uri
+func joinSshURI(user string, host string, port int) string {
+	if port == 0 {
+		port = 22
+	}
+	uri := net.JoinHostPort(host, strconv.Itoa(port))
+	if user != "" {
+		uri = user + "@" + uri
+	}
+	return uri
+}
+
+// usesSshConfig reports if the OpenSSH config applies to the client: it
+// is enabled explicitly or the server host has no dots and it is named
+// by a Host line
+func (c *SshClientConf) usesSshConfig() (string, bool) {
+	path := c.SshConfigFile
+	if path == "" {
+		path = defaultSshConfigPath()
+	} else {
+		path, _ = utils.ExpandUserHome(path)
+	}
+	if c.UseSshConfig {
+		return path, true
+	}
+	_, host, _ := splitSshURI(c.ServerURI)
+	if host == "" || strings.Contains(host, ".") || strings.Contains(host, ":") {
+		return path, false
+	}
+	return path, hasExplicitSshConfigHost(path, host)
+}
+
+// resolveSshURI returns the uri with its host, port and user resolved
+// through the config. The uri values win. It returns the host values too
+func resolveSshURI(path string, uri string) (string, *SshConfigHost, error) {
+	user, host, port := splitSshURI(uri)
+	values, err := LookupSshConfig(path, host, user)
+	if err != nil {
+		return "", nil, err
+	}
+	hostName := host
+	if values.HostName != "" {
+		hostName = values.HostName
+	}
+	if port == 0 {
+		port = values.Port
+	}
+	if user == "" {
+		user = values.User
+	}
+	if user == "" {
+		user = utils.CurrentUser().Username
+	}
+	for i, f := range values.IdentityFiles {
+		values.IdentityFiles[i] = expandSshConfigTokens(f, host, hostName, port, user)
+	}
+	if values.UserKnownHostsFile != "" {
+		values.UserKnownHostsFile = expandSshConfigTokens(values.UserKnownHostsFile, host, hostName, port, user)
+	}
+	return joinSshURI(user, hostName, port), values, nil
+}
+
+// withSshConfig returns a copy of the configuration merged with the
+// OpenSSH config values of its server. The explicit values win: the
+// config identity files are tried after the explicit ones, the config
+// known hosts file, jump hosts and proxy command are used if not set and
+// StrictHostKeyChecking=no (or off) disables the host key verification.
+// It returns the configuration itself if the OpenSSH config doesn't apply
+func (c *SshClientConf) withSshConfig() (*SshClientConf, error) {
+	path, ok := c.usesSshConfig()
+	if !ok {
+		return c, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		if c.UseSshConfig && c.SshConfigFile != "" {
+			return nil, err
+		}
+		return c, nil
+	}
+	merged := *c
+	uri, values, err := resolveSshURI(path, c.ServerURI)
+	if err != nil {
+		return nil, err
+	}
+	merged.ServerURI = uri
+	merged.Identity = appendMissing(append(Identities{}, c.Identity...), values.IdentityFiles)
+	if merged.KnownHosts == "" {
+		merged.KnownHosts = values.UserKnownHostsFile
+	}
+	if values.StrictHostKeyChecking == "no" || values.StrictHostKeyChecking == "off" {
+		merged.Insecure = true
+	}
+	if merged.ProxyCommand == "" && merged.Proxy == "" && len(c.JumpHosts) == 0 {
+		merged.ProxyCommand = values.ProxyCommand
+	}
+	// the jump hosts values are looked up too, their own ProxyJump aside
+	if len(c.JumpHosts) == 0 {
+		merged.JumpHosts = nil
+		for _, jump := range values.ProxyJump {
+			jumpURI, jumpValues, err := resolveSshURI(path, strings.TrimPrefix(jump, "ssh://"))
+			if err != nil {
+				return nil, err
+			}
+			jh := &JumpHostConf{
+				URI:         jumpURI,
+				Identity:    appendMissing(append(Identities{}, c.Identity...), jumpValues.IdentityFiles),
+				AskPassword: c.AskPassword,
+				KnownHosts:  jumpValues.UserKnownHostsFile,
+			}
+			if jumpValues.StrictHostKeyChecking == "no" || jumpValues.StrictHostKeyChecking == "off" {
+				insecure := true
+				jh.Insecure = &insecure
+			}
+			merged.JumpHosts = append(merged.JumpHosts, jh)
+		}
+	}
+	return &merged, nil
+}
+
+// appendMissing appends the values not in list yet
+func appendMissing(list Identities, values []string) Identities {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -1,25 +1,34 @@
 package sshc
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/metrics"
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
-	"golang.org/x/term"
 )
 
-var log = logger.NewLogger("[SSHC] ", logger.Green)
-
 // The ssh connection available statuses
 const (
 	STATUS_CONNECTING = "Connecting..."
@@ -27,39 +36,196 @@ const (
 	STATUS_CLOSED     = "Closed"
 )
 
+// ConnState is the ssh connection loop state
+type ConnState string
+
+// The ssh connection states
+const (
+	// Start was not called yet
+	ConnStateIdle ConnState = "idle"
+	// the first connection attempt is in progress
+	ConnStateConnecting ConnState = "connecting"
+	// the connection is established
+	ConnStateConnected ConnState = "connected"
+	// the connection failed and it is being established again
+	ConnStateReconnecting ConnState = "reconnecting"
+	// the connection loop is over
+	ConnStateStopped ConnState = "stopped"
+)
+
+// DefaultConnectTimeout is the connect timeout used if the configuration
+// doesn't set one
+const DefaultConnectTimeout = 15 * time.Second
+
+// The keep alive defaults, used if the configuration doesn't set them
+const (
+	DefaultKeepAliveInterval  = 30 * time.Second
+	DefaultKeepAliveMaxMisses = 3
+)
+
+// DefaultCompressionLevel is the compression level used if the
+// configuration doesn't set one. It is the OpenSSH one
+const DefaultCompressionLevel = 6
+
+// ErrUntrustedHost is returned when the host key is not in the known_hosts
+// file and it can't be added automatically
+var ErrUntrustedHost = errors.New("host not trusted")
+
+// ErrMaxReconnectAttempts is returned by Start when the connection fails
+// MaxReconnectAttempts consecutive times
+var ErrMaxReconnectAttempts = errors.New("max reconnect attempts reached")
+
+// ErrConnectionStopped is returned by ReadyWait when the connection is
+// stopped before it is established
+var ErrConnectionStopped = errors.New("connection stopped")
+
+// IsAuthError reports if err is a failed authentication with the server.
+// The ssh package doesn't export a type for it
+func IsAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// HopError is a failure connecting to a jump host. Hop is its position
+// in the jump hosts chain, starting from 1
+type HopError struct {
+	Hop  int
+	Addr string
+	Err  error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("jump host %d (%s): %s", e.Hop, e.Addr, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
 // SshConnection implements an ssh client
 type SshConnection struct {
 	username   string
-	identity   string
-	password   string
+	auth       authConf
 	knownHosts string
 
+	// reads the password interactively. nil if not available
+	passwordPrompt func() (string, error)
+	// asks the passphrase of the protected identities
+	passphrasePrompt func(keyPath string) ([]byte, error)
+	// reads the keyboard interactive answers. nil if not available
+	kbdInteractivePrompt func(question string, echo bool) (string, error)
+
+	agentSocket string
+	agentConn   io.ReadWriteCloser
+	agentMU     sync.Mutex
+	// if true the sessions request the agent forwarding. The servers
+	// whose host key is not verified get it only if forwardAgentInsecure
+	// is true too
+	forwardAgentEnabled  bool
+	forwardAgentInsecure bool
+	// the sessions forwarding the agent and the open agent channels
+	agentForwards int
+	agentChannels map[ssh.Channel]struct{}
+
+	decryptedIdentities map[string]ssh.Signer
+	identitiesMU        sync.Mutex
+
 	serverEndpoint *utils.Endpoint
 
 	insecure  bool
 	quiet     bool
 	jumpHosts []*JumpHostConf
+	// the configured host key algorithms. Empty for the defaults
+	hostKeyAlgorithms []string
+	// the configured ciphers, key exchanges and MACs
+	algorithms ssh.Config
+	// the command the first hop is reached through. Empty to dial it
+	proxyCommand string
+	// the proxy the first hop is dialed through. nil to dial it directly
+	proxyURL *url.URL
+	// the local address the first hop, or the proxy, is dialed from.
+	// Any if empty
+	bindAddress string
+	// the NO_PROXY hosts, if the proxy comes from the environment
+	noProxy string
+	// the pinned host certificate authority. nil if not set
+	pinnedCA         ssh.PublicKey
+	pinnedPrincipals []string
 
-	reconnectionInterval time.Duration
-	keepAliveInterval    time.Duration
+	backoff              *backoff
+	reconnectResetAfter  time.Duration
+	maxReconnectAttempts int
+	// 0 if the keep alive is disabled
+	keepAliveInterval  time.Duration
+	keepAliveMaxMisses int
+	// the max duration of the dial and of the handshake with each hop
+	connectTimeout time.Duration
 
 	Client *ssh.Client
-	// used to inform the tunnels if this sshClient
-	// is connected. Tunnels will wait on this waitGroup to
-	// know if the ssh client is connected or not
-	connected sync.WaitGroup
+	// used to inform the tunnels if this sshClient is connected.
+	// ready is closed when the connection is established and replaced
+	// when it is lost. stopped is closed when the connection loop is
+	// over and replaced when it is started again. Guarded by
+	// connectionStatusMU
+	ready   chan struct{}
+	stopped chan struct{}
+	// cancels the running connection loop, and counts the Start calls.
+	// Guarded by connectionStatusMU
+	cancelLoop context.CancelFunc
+	loopID     uint64
+
+	connectionStatus string
+	// the connection loop state, its last failure and when the connection
+	// was established. Guarded by connectionStatusMU
+	state          ConnState
+	lastError      error
+	connectedSince time.Time
 
-	connectionStatus   string
 	connectionStatusMU sync.Mutex
 	clientMU           sync.Mutex
 	// indicates the connection status request
 	isStopped atomic.Bool
+
+	recorder metrics.Recorder
+
+	tracer         trace.Tracer
+	tracingEnabled bool
+	// true if the server accepts the trace context in the direct-tcpip
+	// channels. Guarded by clientMU
+	traceContextSupported bool
+
+	// the configured compression level. 0 if the compression is disabled
+	compressionLevel int
+	// the tunnels copy loops buffer size
+	bufferSize int
+	// true if the server accepted the compression. Guarded by clientMU
+	compressed bool
+
+	subscribers subscribers
+
+	log *slog.Logger
 }
 
-// NewSshConnection creates a new SshConnection instance
-func NewSshConnection(conf *SshClientConf) *SshConnection {
+// NewSshConnection creates a new SshConnection instance. It returns an
+// error if conf is not valid
+func NewSshConnection(conf *SshClientConf, opts ...Option) (*SshConnection, error) {
+	o := options.Build(opts)
+	log := o.Logger
+	if conf.Quiet {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	resolved, err := conf.withSshConfig()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the ssh config: %w", err)
+	}
+	if resolved != conf {
+		log.Debug("using the ssh config", "server", conf.ServerURI, "resolved", resolved.ServerURI)
+		conf = resolved
+	}
 
-	parsed := utils.ParseSSHUrl(conf.ServerURI)
+	parsed, err := utils.ParseSSHUrl(conf.ServerURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server uri: %w", err)
+	}
 	var knownHostsPath string
 	if conf.KnownHosts == "" {
 		usr := utils.CurrentUser()
@@ -69,40 +235,172 @@ func NewSshConnection(conf *SshClientConf) *SshConnection {
 	}
 
 	c := &SshConnection{
-		username:       parsed.Username,
-		identity:       conf.Identity,
-		password:       conf.Password,
-		knownHosts:     knownHostsPath,
-		serverEndpoint: conf.GetServerEndpoint(),
-		insecure:       conf.Insecure,
-		quiet:          conf.Quiet,
-		jumpHosts:      conf.JumpHosts,
-
-		keepAliveInterval:    5 * time.Second,
-		reconnectionInterval: 5 * time.Second,
+		username: parsed.Username,
+		auth: authConf{
+			identities:            conf.Identity,
+			password:              conf.Password,
+			askPassword:           conf.AskPassword,
+			passphrase:            conf.Passphrase,
+			certificate:           conf.CertificateFile,
+			kbdInteractiveAnswers: conf.KbdInteractiveAnswers,
+			disableKbdInteractive: conf.DisableKbdInteractive,
+		},
+		passwordPrompt:       terminalPasswordPrompt(),
+		passphrasePrompt:     conf.PassphrasePrompt,
+		kbdInteractivePrompt: terminalKbdInteractivePrompt(),
+		knownHosts:           knownHostsPath,
+		agentSocket:          agentSocketPath(conf.AgentSocket),
+		forwardAgentEnabled:  conf.ForwardAgent,
+		forwardAgentInsecure: conf.ForwardAgentInsecure,
+		agentChannels:        make(map[ssh.Channel]struct{}),
+		serverEndpoint:       conf.GetServerEndpoint(),
+		insecure:             conf.Insecure,
+		quiet:                conf.Quiet,
+		jumpHosts:            conf.JumpHosts,
+		hostKeyAlgorithms:    conf.HostKeyAlgorithms,
+		algorithms:           algorithmsConfig(conf.Ciphers, conf.KeyExchanges, conf.MACs),
+		proxyCommand:         conf.ProxyCommand,
+		bindAddress:          conf.BindAddress,
+		pinnedPrincipals:     conf.PinnedCertPrincipals,
+
+		keepAliveInterval:    DefaultKeepAliveInterval,
+		keepAliveMaxMisses:   conf.KeepAliveMaxMisses,
+		backoff:              newBackoff(conf.ReconnectInitialDelay, conf.ReconnectMultiplier, conf.ReconnectMaxDelay),
+		reconnectResetAfter:  conf.ReconnectResetAfter,
+		maxReconnectAttempts: conf.MaxReconnectAttempts,
+		connectTimeout:       conf.ConnectTimeout,
 		connectionStatus:     STATUS_CONNECTING,
+		state:                ConnStateIdle,
 		isStopped:            atomic.Bool{},
+
+		decryptedIdentities: make(map[string]ssh.Signer),
+		recorder:            metrics.Nop,
+		tracer:              o.GetTracer(),
+		tracingEnabled:      o.Tracer != nil,
+		log:                 log.With("subsystem", "sshc"),
 	}
 
-	c.isStopped.Store(true)
-	// client is not connected on startup, so add 1 here
-	c.connected.Add(1)
-	if c.quiet {
-		log.SetOutput(io.Discard)
+	if c.passphrasePrompt == nil {
+		c.passphrasePrompt = utils.TerminalPassphrasePrompt
+	}
+	if c.connectTimeout <= 0 {
+		c.connectTimeout = DefaultConnectTimeout
+	}
+	if conf.KeepAliveInterval != nil {
+		c.keepAliveInterval = max(*conf.KeepAliveInterval, 0)
+	}
+	if c.keepAliveMaxMisses <= 0 {
+		c.keepAliveMaxMisses = DefaultKeepAliveMaxMisses
+	}
+	if c.reconnectResetAfter <= 0 {
+		c.reconnectResetAfter = DefaultReconnectResetAfter
+	}
+	if err := rio.ValidateCompressionLevel(conf.CompressionLevel); err != nil {
+		return nil, fmt.Errorf("invalid compression_level %d: %w", conf.CompressionLevel, err)
+	}
+	if conf.Compression {
+		c.compressionLevel = conf.CompressionLevel
+		if c.compressionLevel == 0 {
+			c.compressionLevel = DefaultCompressionLevel
+		}
+	}
+	if err := rio.ValidateBufferSize(conf.BufferSize); err != nil {
+		return nil, fmt.Errorf("invalid buffer_size: %w", err)
+	}
+	c.bufferSize = conf.BufferSize
+	if c.bufferSize == 0 {
+		c.bufferSize = rio.DefaultBufferSize
+	}
+	if err := ValidateHostKeyAlgorithms(conf.HostKeyAlgorithms); err != nil {
+		return nil, fmt.Errorf("invalid host_key_algorithms: %w", err)
+	}
+	if err := ValidateAlgorithms(conf.Ciphers, conf.KeyExchanges, conf.MACs); err != nil {
+		return nil, fmt.Errorf("invalid sshclient algorithms: %w", err)
+	}
+	for _, jh := range conf.JumpHosts {
+		if err := utils.ValidateSSHUrl(jh.URI); err != nil {
+			return nil, fmt.Errorf("invalid jump host uri: %w", err)
+		}
+		if err := ValidateAlgorithms(jh.Ciphers, jh.KeyExchanges, jh.MACs); err != nil {
+			return nil, fmt.Errorf("invalid jump host %s algorithms: %w", jh.URI, err)
+		}
+	}
+	if conf.Proxy != "" && conf.ProxyCommand != "" {
+		return nil, errors.New("proxy and proxy_command can't be both set")
+	}
+	if conf.BindAddress != "" && net.ParseIP(conf.BindAddress) == nil {
+		return nil, fmt.Errorf("invalid bind_address %q: it is not an ip address", conf.BindAddress)
+	}
+	if conf.Proxy != "" {
+		proxyURL, err := ParseProxyURL(conf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		c.proxyURL = proxyURL
+	} else if allProxy, noProxy := environmentProxy(); allProxy != "" && conf.ProxyCommand == "" {
+		proxyURL, err := ParseProxyURL(allProxy)
+		if err != nil {
+			c.log.Warn("ignoring the ALL_PROXY environment variable", "error", err)
+		} else {
+			c.proxyURL = proxyURL
+			c.noProxy = noProxy
+		}
+	}
+	if conf.PinnedCertCA != "" {
+		ca, err := loadPinnedCA(conf.PinnedCertCA)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned_cert_ca: %w", err)
+		}
+		c.pinnedCA = ca
+		if len(pinnedHostKeyAlgorithms(conf.HostKeyAlgorithms)) == 0 {
+			return nil, errors.New("host_key_algorithms doesn't contain any certificate algorithm, required by pinned_cert_ca")
+		}
 	}
 
-	return c
+	c.isStopped.Store(true)
+	// client is not connected on startup
+	c.ready = make(chan struct{})
+	c.stopped = make(chan struct{})
+
+	return c, nil
 }
 
-// Waits until the connection is estabilished with the server
-func (s *SshConnection) ReadyWait() {
-	s.connected.Wait()
+// SetMetricsRecorder sets the recorder that collects the reconnection
+// events. It needs to be called before Start
+func (s *SshConnection) SetMetricsRecorder(recorder metrics.Recorder) {
+	s.recorder = recorder
 }
 
-// Stop closes the ssh conn instance client connection
+// ReadyWait waits until the connection is estabilished with the server.
+// It returns ErrConnectionStopped if the connection loop is stopped, or
+// gives up reconnecting, in the meantime
+func (s *SshConnection) ReadyWait() error {
+	s.connectionStatusMU.Lock()
+	ready, stopped := s.ready, s.stopped
+	s.connectionStatusMU.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-stopped:
+		return ErrConnectionStopped
+	}
+}
+
+// Stop cancels the connection loop and closes the ssh conn instance
+// client connection, with all its channels. The ReadyWait callers get
+// ErrConnectionStopped. Calling it more than once is safe, and Start can
+// be called again after it to connect again
 func (s *SshConnection) Stop() {
 	s.isStopped.Store(true)
+	s.connectionStatusMU.Lock()
+	cancel := s.cancelLoop
+	s.connectionStatusMU.Unlock()
+	if cancel != nil {
+		cancel()
+	}
 	s.resetConn()
+	s.closeAgent()
+	s.setState(ConnStateStopped, nil)
 }
 
 // resets the connection after a stop request or if it fails
@@ -120,38 +418,191 @@ func (s *SshConnection) resetConn() {
 
 // Start connects the ssh client to the remote server
 // and keeps it connected sending keep alive packet
-// and reconnecting in the event of network failures
-func (s *SshConnection) Start() {
+// and reconnecting in the event of network failures.
+// It returns nil when ctx is canceled or Stop is called. If
+// MaxReconnectAttempts is set, it returns an error wrapping
+// ErrMaxReconnectAttempts when they are all failed. A host key that
+// can't be trusted, ErrUntrustedHost or a *knownhosts.RevokedError, is
+// returned at once without reconnecting.
+// After it returns, it can be called again to connect again
+func (s *SshConnection) Start(ctx context.Context) error {
+	return s.run(ctx, s.beginLoop())
+}
+
+// beginLoop prepares a connection loop run, leaving the stopped state so
+// that ReadyWait waits for the new connection. It returns the run id
+func (s *SshConnection) beginLoop() uint64 {
 	s.isStopped.Store(false)
+	s.setState(ConnStateConnecting, nil)
+	s.connectionStatusMU.Lock()
+	defer s.connectionStatusMU.Unlock()
+	s.loopID++
+	return s.loopID
+}
+
+// run is the connection loop started by beginLoop
+func (s *SshConnection) run(ctx context.Context, loopID uint64) (err error) {
+	stop := context.AfterFunc(ctx, s.Stop)
+	defer stop()
+	// Stop cancels the pending dial and the reconnect delay
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.connectionStatusMU.Lock()
+	if s.loopID == loopID {
+		s.cancelLoop = cancel
+	}
+	s.connectionStatusMU.Unlock()
+	defer func() {
+		s.connectionStatusMU.Lock()
+		current := s.loopID == loopID
+		s.connectionStatusMU.Unlock()
+		// a Start called again after Stop owns the state
+		if current {
+			s.setState(ConnStateStopped, err)
+		}
+		s.emit(ConnectionEvent{Type: EventStopped, Err: err})
+	}()
+
+	everConnected := false
+	// the attempts since the last established connection and the last
+	// failure, for the reconnecting events
+	first := true
+	attempt := 0
+	var lastErr error
 	for {
 		// this becomes true if Stop() was called in the meantime
-		if s.isStopped.Load() {
-			break
+		if s.isStopped.Load() || ctx.Err() != nil {
+			return nil
 		}
+		if first {
+			s.setState(ConnStateConnecting, nil)
+		} else {
+			attempt++
+			s.setState(ConnStateReconnecting, nil)
+			s.emit(ConnectionEvent{Type: EventReconnecting, Attempt: attempt, Err: lastErr})
+		}
+		first = false
 		s.connectionStatusMU.Lock()
 		s.connectionStatus = STATUS_CONNECTING
 		s.connectionStatusMU.Unlock()
 
-		if err := s.connect(); err != nil {
-			log.Printf("error while connecting %s", err)
-			time.Sleep(s.reconnectionInterval)
+		// the span covers the dial, the handshake and the first keep alive
+		connectCtx, span := s.tracer.Start(ctx, "ssh.connect", trace.WithAttributes(
+			attribute.String("server.addr", s.serverEndpoint.String()),
+		))
+		if err := s.connect(connectCtx); err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			span.End()
+			if ctx.Err() != nil {
+				return nil
+			}
+			var revokedErr *knownhosts.RevokedError
+			if errors.Is(err, ErrUntrustedHost) || errors.As(err, &revokedErr) {
+				s.log.Error("error while connecting", "error", err)
+				return err
+			}
+			s.setState(ConnStateReconnecting, err)
+			if err := s.waitReconnect(ctx, err); err != nil {
+				return err
+			}
+			lastErr = err
 			continue
 		}
-		// client connected. Free the wait group
-		s.connected.Done()
+		// Stop was called while the handshake was completing
+		if s.isStopped.Load() || ctx.Err() != nil {
+			s.resetConn()
+			return nil
+		}
+		if everConnected {
+			s.recorder.SshReconnect()
+		}
+		everConnected = true
+		connectedAt := time.Now()
 
 		s.connectionStatusMU.Lock()
 		s.connectionStatus = STATUS_CONNECTED
 		s.connectionStatusMU.Unlock()
+		// client connected. Frees the ReadyWait callers
+		s.setState(ConnStateConnected, nil)
+		attempt = 0
+		s.emit(ConnectionEvent{Type: EventConnected})
 
 		// this call will block until the connection fails
-		s.keepAlive()
+		lastErr = s.keepAlive(ctx, span)
 
 		s.resetConn()
-		s.connected.Add(1)
+		if !s.isStopped.Load() && ctx.Err() == nil {
+			s.setState(ConnStateReconnecting, lastErr)
+		}
+		s.emit(ConnectionEvent{Type: EventDisconnected, Err: lastErr})
+
+		// a stable connection starts the backoff again. A connection that
+		// fails soon counts as a failed attempt
+		if time.Since(connectedAt) >= s.reconnectResetAfter {
+			s.backoff.reset()
+		} else if !s.isStopped.Load() && ctx.Err() == nil {
+			err := fmt.Errorf("connection closed after %s", time.Since(connectedAt).Round(time.Millisecond))
+			if err := s.waitReconnect(ctx, err); err != nil {
+				return err
+			}
+		}
 	}
 }
 
+// ConnectWithContext starts the connection in the background and waits
+// until it is established. Like with Start, the connection is kept and
+// reconnected on failures until ctx is canceled or Stop is called.
+// It returns ctx.Err() if ctx is canceled before the connection is
+// established, or the Start error if it gives up reconnecting
+func (s *SshConnection) ConnectWithContext(ctx context.Context) error {
+	// the stopped state is left before ReadyWait is called
+	loopID := s.beginLoop()
+	failed := make(chan error, 1)
+	go func() {
+		err := s.run(ctx, loopID)
+		if err == nil {
+			err = errors.New("connection stopped")
+		}
+		failed <- err
+	}()
+	ready := make(chan struct{})
+	go func() {
+		if s.ReadyWait() == nil {
+			close(ready)
+		}
+	}()
+	select {
+	case <-ready:
+		return nil
+	case err := <-failed:
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitReconnect waits the backoff delay after the failed attempt. It
+// returns an error if the max reconnect attempts are reached
+func (s *SshConnection) waitReconnect(ctx context.Context, err error) error {
+	if s.maxReconnectAttempts > 0 && s.backoff.attempt+1 >= s.maxReconnectAttempts {
+		s.log.Error("error while connecting, giving up", "error", err, "attempt", s.backoff.attempt+1)
+		s.isStopped.Store(true)
+		s.resetConn()
+		return fmt.Errorf("%s: %w after %d attempts: %w", s.serverEndpoint, ErrMaxReconnectAttempts, s.backoff.attempt+1, err)
+	}
+	delay := s.backoff.next()
+	s.log.Error("error while connecting", "error", err, "attempt", s.backoff.attempt, "next_delay", delay.Round(time.Millisecond).String())
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+	return nil
+}
+
 // GetConnectionStatus returns the current connection status as a string
 func (s *SshConnection) GetConnectionStatus() string {
 	s.connectionStatusMU.Lock()
@@ -159,34 +610,363 @@ func (s *SshConnection) GetConnectionStatus() string {
 	return s.connectionStatus
 }
 
-// GrabPubKey is an helper function that gets server pubkey
-func (s *SshConnection) GrabPubKey() {
+// setState moves the connection to state. A not nil err is recorded as the
+// last failure
+func (s *SshConnection) setState(state ConnState, err error) {
+	s.connectionStatusMU.Lock()
+	defer s.connectionStatusMU.Unlock()
+	if err != nil {
+		s.lastError = err
+	}
+	if state == s.state {
+		return
+	}
+	prev := s.state
+	s.state = state
+	if state == ConnStateConnected {
+		close(s.ready)
+	} else if prev == ConnStateConnected {
+		s.ready = make(chan struct{})
+	}
+	if state == ConnStateStopped {
+		close(s.stopped)
+	} else if prev == ConnStateStopped {
+		s.stopped = make(chan struct{})
+	}
+	if state == ConnStateConnected {
+		s.connectedSince = time.Now()
+	} else {
+		s.connectedSince = time.Time{}
+	}
+	s.log.Debug("connection state changed", "state", string(state))
+}
+
+// State returns the connection loop state, without waiting for the
+// connection
+func (s *SshConnection) State() ConnState {
+	s.connectionStatusMU.Lock()
+	defer s.connectionStatusMU.Unlock()
+	return s.state
+}
+
+// LastError returns the last connection failure: the failed attempt or
+// the reason the established connection was lost. It is kept after the
+// reconnection, nil if the connection never failed
+func (s *SshConnection) LastError() error {
+	s.connectionStatusMU.Lock()
+	defer s.connectionStatusMU.Unlock()
+	return s.lastError
+}
+
+// ConnectedSince returns when the current connection was established.
+// It is the zero time if the connection is not established
+func (s *SshConnection) ConnectedSince() time.Time {
+	s.connectionStatusMU.Lock()
+	defer s.connectionStatusMU.Unlock()
+	return s.connectedSince
+}
+
+// GetServerEndpoint returns the ssh server endpoint
+func (s *SshConnection) GetServerEndpoint() utils.Endpoint {
+	return *s.serverEndpoint
+}
+
+// IsConnected returns true if the client is connected to the server
+func (s *SshConnection) IsConnected() bool {
+	return s.GetConnectionStatus() == STATUS_CONNECTED
+}
+
+// grabHostKeyAlgorithms are the host key algorithms GrabPubKey asks
+// the server for, one handshake each
+var grabHostKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA,
+}
+
+// errHostKeyGrabbed aborts the GrabPubKey handshakes once the host
+// key is received
+var errHostKeyGrabbed = errors.New("host key grabbed")
+
+// HostKey is a host key grabbed from the server
+type HostKey struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// the key type, like ssh-ed25519
+	Type string `json:"type"`
+	// the base64 encoded key
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+	// true if the key is in the known_hosts file already
+	Known bool `json:"known"`
+
+	PublicKey ssh.PublicKey `json:"-"`
+}
+
+// GrabPubKey gets the server host keys, doing a handshake for each host key
+// algorithm like ssh-keyscan does, and checks them against the known_hosts
+// file. The file is not modified: use AddHostKeys to add the unknown keys.
+// The returned error is not nil if a key can't be trusted or if the server
+// doesn't answer within the connect timeout
+func (s *SshConnection) GrabPubKey() ([]HostKey, error) {
+	addr := s.serverEndpoint.String()
+
+	keys := []HostKey{}
+	var verifyErr error
+	for _, algorithm := range grabHostKeyAlgorithms {
+		// the proxy command runs until ctx is canceled
+		ctx, cancel := context.WithCancel(context.Background())
+		conn, err := s.dial(ctx, addr, s.username)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		// the handshake isn't covered by the config timeout, that only
+		// applies to the dial
+		conn.SetDeadline(time.Now().Add(s.connectTimeout))
+		sshConfig := &ssh.ClientConfig{
+			Config:            s.algorithms,
+			HostKeyAlgorithms: []string{algorithm},
+			HostKeyCallback: func(host string, remote net.Addr, key ssh.PublicKey) error {
+				for _, k := range keys {
+					if keyEqual(k.PublicKey, key) {
+						return errHostKeyGrabbed
+					}
+				}
+				known, err := s.isKnownHostKey(host, remote, key)
+				if err != nil {
+					verifyErr = err
+				}
+				keys = append(keys, HostKey{
+					Host:        s.serverEndpoint.Hostname(),
+					Port:        s.serverEndpoint.Port,
+					Type:        key.Type(),
+					Key:         base64.StdEncoding.EncodeToString(key.Marshal()),
+					Fingerprint: ssh.FingerprintSHA256(key),
+					Known:       known,
+					PublicKey:   key,
+				})
+				return errHostKeyGrabbed
+			},
+			Timeout: s.connectTimeout,
+		}
+		_, _, _, err = ssh.NewClientConn(conn, addr, sshConfig)
+		conn.Close()
+		cancel()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, s.timeoutError(addr)
+		}
+		if !errors.Is(err, errHostKeyGrabbed) {
+			s.log.Debug("host key algorithm not available", "algorithm", algorithm, "error", err)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("cannot get the %s host keys", addr)
+	}
+	return keys, verifyErr
+}
+
+// isKnownHostKey reports if the host key is in the known_hosts file. A key
+// of a type not known for the host yet is reported as unknown, the revoked
+// keys and the ones mismatching the known key of the same type as errors
+func (s *SshConnection) isKnownHostKey(host string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	clb, err := knownhosts.New(s.knownHosts)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var keyErr *knownhosts.KeyError
+	err = checkHostKey(clb, s.knownHosts, host, remote, key)
+	if errors.As(err, &keyErr) && hasKeyType(keyErr.Want, key.Type()) {
+		return false, fmt.Errorf("%s: the host %s key doesn't match the known one: %w", host, key.Type(), err)
+	} else if errors.As(err, &keyErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// HostKeyLines returns the known_hosts lines of the keys not known yet.
+// The hostnames are hashed if hash is true or if the known_hosts file
+// already contains hashed hostnames
+func (s *SshConnection) HostKeyLines(keys []HostKey, hash bool) []string {
+	hash = hash || utils.KnownHostsUsesHashing(s.knownHosts)
+	lines := []string{}
+	for _, k := range keys {
+		if k.Known {
+			continue
+		}
+		lines = append(lines, utils.KnownHostLine(s.serverEndpoint.String(), k.PublicKey, hash))
+	}
+	return lines
+}
+
+// AddHostKeys writes the keys not known yet to the known_hosts file,
+// creating it if needed. The keys already in the file are skipped and the
+// known keys of the same type are replaced, like after a key rotation.
+// See HostKeyLines for the hashing rules
+func (s *SshConnection) AddHostKeys(keys []HostKey, hash bool) error {
+	hash = hash || utils.KnownHostsUsesHashing(s.knownHosts)
+	for _, k := range keys {
+		if k.Known {
+			continue
+		}
+		changed, err := utils.WriteKnownHostKey(s.knownHosts, s.serverEndpoint.String(), k.PublicKey, hash)
+		if err != nil {
+			return err
+		}
+		if changed {
+			s.log.Info("host key written to known_hosts file", "remote_addr", s.serverEndpoint.String(),
+				"type", k.Type, "path", s.knownHosts)
+		} else {
+			s.log.Debug("host key already in known_hosts file", "remote_addr", s.serverEndpoint.String(), "type", k.Type)
+		}
+	}
+	return nil
+}
+
+// VerifyHostKey connects to the server and checks its pubkey against the
+// known_hosts file ones. It returns the server key and a nil error if the key
+// is trusted, a *knownhosts.KeyError if the key is unknown or mismatches
+func (s *SshConnection) VerifyHostKey() (ssh.PublicKey, error) {
+	var (
+		serverKey ssh.PublicKey
+		verifyErr error
+	)
 	sshConfig := &ssh.ClientConfig{
-		HostKeyCallback: s.verifyHostCallback(false),
+		Config:            s.algorithms,
+		Timeout:           s.connectTimeout,
+		HostKeyAlgorithms: s.getHostKeyAlgorithms(s.hostKeyAlgorithms, s.knownHosts, false, s.serverEndpoint.String()),
+		HostKeyCallback: func(host string, remote net.Addr, key ssh.PublicKey) error {
+			serverKey = key
+			clb, err := knownhosts.New(s.knownHosts)
+			if err != nil {
+				verifyErr = err
+				return err
+			}
+			verifyErr = checkHostKey(clb, s.knownHosts, host, remote, key)
+			return verifyErr
+		},
 	}
-	// ignore return values here. I'm using it just to trigger the
-	// verifyHostCallback
-	ssh.Dial("tcp", s.serverEndpoint.String(), sshConfig)
+	addr := s.serverEndpoint.String()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := s.dial(ctx, addr, s.username)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.connectTimeout))
+	_, _, _, err = ssh.NewClientConn(conn, addr, sshConfig)
+	if serverKey == nil {
+		return nil, err
+	}
+	return serverKey, verifyErr
 }
 
-func (s *SshConnection) keepAlive() {
-	log.Println("starting client keep alive")
+// keepAlive sends the keep alive requests until the connection fails. The
+// connection is closed after keepAliveMaxMisses consecutive requests fail
+// or are not replied within the interval, so that a silently dead network
+// path triggers the reconnect. The connect span is ended after the first
+// request. It returns why the connection failed
+func (s *SshConnection) keepAlive(ctx context.Context, connectSpan trace.Span) error {
+	s.log.Debug("starting client keep alive")
+	s.clientMU.Lock()
+	client := s.Client
+	s.clientMU.Unlock()
+
+	// detect the connection close without waiting for the
+	// next keep alive
+	closed := make(chan struct{})
+	var closedErr error
+	go func() {
+		closedErr = client.Wait()
+		close(closed)
+	}()
+	// the connection close reason
+	closeReason := func() error {
+		if closedErr == nil || errors.Is(closedErr, io.EOF) {
+			return errors.New("connection closed")
+		}
+		return closedErr
+	}
+
+	if s.keepAliveInterval == 0 {
+		if connectSpan != nil {
+			connectSpan.End()
+		}
+		select {
+		case <-closed:
+			s.log.Info("connection closed")
+			return closeReason()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	misses := 0
 	for {
-		// log.Println("keep alive")
-		_, _, err := s.Client.SendRequest("keepalive@rospo", true, nil)
+		err := s.sendKeepAlive(client)
+		if connectSpan != nil {
+			if err != nil {
+				connectSpan.RecordError(err)
+				connectSpan.SetStatus(codes.Error, err.Error())
+			}
+			connectSpan.End()
+			connectSpan = nil
+		}
 		if err != nil {
-			log.Printf("error while sending keep alive %s", err)
-			return
+			misses++
+			s.log.Warn("keep alive missed", "error", err, "misses", misses, "max_misses", s.keepAliveMaxMisses)
+			if misses >= s.keepAliveMaxMisses {
+				s.log.Error("connection dead, closing it", "misses", misses)
+				client.Close()
+				return fmt.Errorf("%d keep alive missed: %w", misses, err)
+			}
+		} else {
+			misses = 0
+		}
+		select {
+		case <-closed:
+			s.log.Info("connection closed")
+			return closeReason()
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.keepAliveInterval):
 		}
-		time.Sleep(s.keepAliveInterval)
 	}
 }
-func (s *SshConnection) connect() error {
+
+// sendKeepAlive sends a keep alive request, failing if it isn't replied
+// within the keep alive interval
+func (s *SshConnection) sendKeepAlive(client *ssh.Client) error {
+	res := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@rospo", true, nil)
+		res <- err
+	}()
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(s.keepAliveInterval):
+		return fmt.Errorf("no reply within %s", s.keepAliveInterval)
+	}
+}
+
+func (s *SshConnection) connect(ctx context.Context) error {
 	sshConfig := &ssh.ClientConfig{
+		Config: s.algorithms,
 		// SSH connection username
-		User:            s.username,
-		Auth:            s.getAuthMethods(s.identity, s.password),
-		HostKeyCallback: s.verifyHostCallback(true),
+		User:              s.username,
+		Auth:              s.getAuthMethods(s.auth),
+		Timeout:           s.connectTimeout,
+		HostKeyCallback:   s.verifyHostCallback(s.knownHosts, s.insecure),
+		HostKeyAlgorithms: s.getHostKeyAlgorithms(s.hostKeyAlgorithms, s.knownHosts, s.insecure, s.serverEndpoint.String()),
 		BannerCallback: func(message string) error {
 			if !s.quiet {
 				fmt.Print(message)
@@ -194,41 +974,96 @@ func (s *SshConnection) connect() error {
 			return nil
 		},
 	}
-	log.Println("trying to connect to remote server...")
-
-	identityPath := s.identity
-	if s.identity == "" {
-		usr := utils.CurrentUser()
-		identityPath = filepath.Join(usr.HomeDir, ".ssh", "id_rsa")
+	if s.pinnedCA != nil {
+		sshConfig.HostKeyCallback = s.pinnedCertCallback()
+		sshConfig.HostKeyAlgorithms = pinnedHostKeyAlgorithms(s.hostKeyAlgorithms)
 	}
-
-	log.Printf("using identity at %s", identityPath)
+	s.log.Info("trying to connect to remote server...")
 
 	if len(s.jumpHosts) != 0 {
-		client, err := s.jumpHostConnect(s.serverEndpoint, sshConfig)
+		client, err := s.jumpHostConnect(ctx, s.serverEndpoint, sshConfig)
 		if err != nil {
 			return err
 		}
-		s.clientMU.Lock()
-		s.Client = client
-		s.clientMU.Unlock()
+		s.setClient(client)
 
 	} else {
-		client, err := s.directConnect(s.serverEndpoint, sshConfig)
+		client, err := s.directConnect(ctx, s.serverEndpoint, sshConfig)
 		if err != nil {
 			return err
 		}
-		s.clientMU.Lock()
-		s.Client = client
-		s.clientMU.Unlock()
+		s.setClient(client)
 	}
 
 	return nil
 }
 
-func (s *SshConnection) verifyHostCallback(fail bool) ssh.HostKeyCallback {
+// getHostKeyAlgorithms returns the host key algorithms to negotiate with
+// host. The known_hosts file is not looked up if insecure is true
+func (s *SshConnection) getHostKeyAlgorithms(configured []string, knownHostsPath string, insecure bool, host string) []string {
+	if insecure {
+		return configured
+	}
+	algorithms := preferredHostKeyAlgorithms(configured, knownHostsPath, host)
+	s.log.Debug("host key algorithms", "remote_addr", host, "algorithms", algorithms)
+	return algorithms
+}
+
+// setClient sets the connected client. If tracing is enabled, it checks
+// if the server accepts the trace context in the direct-tcpip channels.
+// If the compression is enabled, it asks the server for it
+func (s *SshConnection) setClient(client *ssh.Client) {
+	supported := false
+	if s.tracingEnabled {
+		supported, _, _ = client.SendRequest(utils.TraceContextRequest, true, nil)
+	}
+	compressed := false
+	if s.compressionLevel > 0 {
+		payload := ssh.Marshal(&utils.CompressionPayload{Level: uint32(s.compressionLevel)})
+		compressed, _, _ = client.SendRequest(utils.CompressionRequest, true, payload)
+		if !compressed {
+			s.log.Warn("the server doesn't support the compression, the data is sent uncompressed")
+		}
+	}
+	if s.forwardAgentEnabled {
+		go s.serveAgentChannels(client.HandleChannelOpen(agentChannelType))
+	}
+	s.clientMU.Lock()
+	s.Client = client
+	s.traceContextSupported = supported
+	s.compressed = compressed
+	s.clientMU.Unlock()
+}
+
+// BufferSize returns the tunnels copy loops buffer size
+func (s *SshConnection) BufferSize() int {
+	return s.bufferSize
+}
+
+// IsCompressed returns true if the tunnels data is compressed on the
+// current connection
+func (s *SshConnection) IsCompressed() bool {
+	s.clientMU.Lock()
+	defer s.clientMU.Unlock()
+	return s.Client != nil && s.compressed
+}
+
+// pinnedCertCallback accepts only the host certificates signed by the
+// pinned authority
+func (s *SshConnection) pinnedCertCallback() ssh.HostKeyCallback {
+	return func(host string, remote net.Addr, key ssh.PublicKey) error {
+		err := checkPinnedCertificate(s.pinnedCA, s.pinnedPrincipals, host, key)
+		if err != nil {
+			s.log.Error("the host certificate doesn't match the pinned one", "remote_addr", host, "error", err)
+		}
+		return err
+	}
+}
 
-	if s.insecure {
+// verifyHostCallback checks the host keys against the knownHostsPath file
+func (s *SshConnection) verifyHostCallback(knownHostsPath string, insecure bool) ssh.HostKeyCallback {
+
+	if insecure {
 		return func(host string, remote net.Addr, key ssh.PublicKey) error {
 			return nil
 		}
@@ -236,133 +1071,409 @@ func (s *SshConnection) verifyHostCallback(fail bool) ssh.HostKeyCallback {
 	return func(host string, remote net.Addr, key ssh.PublicKey) error {
 		var err error
 
-		log.Printf("using known_hosts file at %s", s.knownHosts)
+		s.log.Debug("using known_hosts file", "path", knownHostsPath)
 
-		clb, err := knownhosts.New(s.knownHosts)
+		clb, err := knownhosts.New(knownHostsPath)
 		if err != nil {
-			log.Printf("error while parsing 'known_hosts' file: %s: %v", s.knownHosts, err)
-			f, fErr := os.OpenFile(s.knownHosts, os.O_CREATE, 0600)
+			s.log.Error("error while parsing 'known_hosts' file", "path", knownHostsPath, "error", err)
+			f, fErr := os.OpenFile(knownHostsPath, os.O_CREATE, 0600)
 			if fErr != nil {
-				log.Fatalf("%s", fErr)
+				return fmt.Errorf("%w: cannot create the known_hosts file %s: %v", ErrUntrustedHost, knownHostsPath, fErr)
 			}
 			f.Close()
-			clb, err = knownhosts.New(s.knownHosts)
+			clb, err = knownhosts.New(knownHostsPath)
 			if err != nil {
-				log.Fatalf("%s", err)
+				return fmt.Errorf("%w: cannot parse the known_hosts file %s: %v", ErrUntrustedHost, knownHostsPath, err)
 			}
 		}
+		// hashed hostnames and @revoked markers are handled by the
+		// knownhosts package, host certificates by checkHostKey
 		var keyErr *knownhosts.KeyError
-		e := clb(host, remote, key)
-		if errors.As(e, &keyErr) && len(keyErr.Want) > 0 {
-			log.Printf("ERROR: %s is not a key of %s, either a man in the middle attack or %s host pub key was changed.", ssh.FingerprintSHA256(key), host, host)
-			return e
-		} else if errors.As(e, &keyErr) && len(keyErr.Want) == 0 {
-			if fail {
-				log.Fatalf(`ERROR: the host '%s' is not trusted. If it is trusted instead, 
-				  please grab its pub key using the 'rospo grabpubkey' command`, host)
-				return errors.New("")
-			}
-			log.Printf("WARNING: %s is not trusted, adding this key: \n\n%s\n\nto known_hosts file.", host, utils.SerializePublicKey(key))
-			return utils.AddHostKeyToKnownHosts(host, key, s.knownHosts)
+		var revokedErr *knownhosts.RevokedError
+		e := checkHostKey(clb, knownHostsPath, host, remote, key)
+		if cert, ok := key.(*ssh.Certificate); ok {
+			// the certificate is not trusted by any authority. Its key
+			// is the one looked up
+			key = cert.Key
+		}
+		// the errors carry the host and the offending fingerprint, so that
+		// the failing one can be told apart in a jump hosts chain
+		fingerprint := ssh.FingerprintSHA256(key)
+		if errors.As(e, &revokedErr) {
+			s.log.Error("the host key is marked as revoked",
+				"remote_addr", host, "fingerprint", ssh.FingerprintSHA256(revokedErr.Revoked.Key),
+				"path", knownHostsPath, "line", revokedErr.Revoked.Line, "error", e)
+			return fmt.Errorf("%s: the host key %s is revoked: %w", host, ssh.FingerprintSHA256(revokedErr.Revoked.Key), e)
+		} else if errors.As(e, &keyErr) && len(keyErr.Want) > 0 {
+			s.log.Error("the key is not a key of the host, either a man in the middle attack or the host pub key was changed",
+				"remote_addr", host, "fingerprint", fingerprint, "path", knownHostsPath)
+			return fmt.Errorf("%s: the host key %s doesn't match the %s one: %w", host, fingerprint, knownHostsPath, e)
+		} else if errors.As(e, &keyErr) {
+			s.log.Error("the host is not trusted. If it is trusted instead, please grab its pub key using the 'rospo grabpubkey' command",
+				"remote_addr", host, "fingerprint", fingerprint, "path", knownHostsPath)
+			return fmt.Errorf("%s: %w: the key %s is not in %s", host, ErrUntrustedHost, fingerprint, knownHostsPath)
 		}
 		return e
 	}
 }
 
-func (s *SshConnection) getAuthMethods(identity string, password string) []ssh.AuthMethod {
+// authConf holds the auth settings of the server or of a jump host
+type authConf struct {
+	identities            []string
+	password              string
+	askPassword           bool
+	passphrase            string
+	certificate           string
+	kbdInteractiveAnswers []string
+	disableKbdInteractive bool
+}
+
+func (s *SshConnection) getAuthMethods(auth authConf) []ssh.AuthMethod {
 	authMethods := []ssh.AuthMethod{}
 
-	keysAuth, err := utils.LoadIdentityFile(identity)
-	if err == nil {
-		authMethods = append(authMethods, keysAuth)
+	// the client tries each auth method type once only, so all the keys
+	// need to be offered by the same publickey method
+	identities := auth.identities
+	if len(identities) == 0 {
+		usr := utils.CurrentUser()
+		identities = []string{filepath.Join(usr.HomeDir, ".ssh", "id_rsa")}
+	}
+	identitySigners := []ssh.Signer{}
+	loaded := []string{}
+	for _, identity := range identities {
+		signer, err := s.loadIdentity(identity, auth.passphrase)
+		if err != nil {
+			s.log.Warn("cannot load identity", "path", utils.KeySourceName(identity), "error", err)
+			continue
+		}
+		s.log.Debug("using identity", "path", utils.KeySourceName(identity))
+		identitySigners = append(identitySigners, signer)
+		loaded = append(loaded, identity)
 	}
-	if password != "" {
-		authMethods = append(authMethods, ssh.Password(password))
+	certs, certErr := s.loadIdentityCerts(loaded, identitySigners, auth.certificate)
+	if certErr != nil {
+		s.log.Error("cannot use the certificate", "path", auth.certificate, "error", certErr)
+	}
+	if s.agentSocket != "" || len(identitySigners) > 0 || certErr != nil {
+		authMethods = append(authMethods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			if certErr != nil {
+				return nil, certErr
+			}
+			// the certificates are tried first, then the agent keys
+			signers, err := s.certSigners(certs, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			if s.agentSocket != "" {
+				agentSigners, _ := s.agentSigners()
+				signers = append(signers, agentSigners...)
+			}
+			return append(signers, identitySigners...), nil
+		}))
+	}
+	// password auth is tried after the public key one
+	if method := s.passwordAuthMethod(auth.password, auth.askPassword); method != nil {
+		authMethods = append(authMethods, method)
+	}
+	if !auth.disableKbdInteractive {
+		if method := s.kbdInteractiveAuthMethod(auth.kbdInteractiveAnswers); method != nil {
+			authMethods = append(authMethods, method)
+		}
 	}
-
-	authMethods = append(authMethods, ssh.PasswordCallback(func() (secret string, err error) {
-		fmt.Println("\nThe server asks for a password")
-		fmt.Println("Password: ")
-		p, err := term.ReadPassword(0)
-		return string(p), err
-	}))
 
 	return authMethods
 }
 
+// jumpHostConnect connects to the server through the jump hosts chain.
+// Each hop is reached through a direct-tcpip channel of the previous one
+// and it has its own identity and host key verification. The hops
+// clients are closed when the server one is
 func (s *SshConnection) jumpHostConnect(
+	ctx context.Context,
 	server *utils.Endpoint,
 	sshConfig *ssh.ClientConfig,
 ) (*ssh.Client, error) {
 
-	var (
-		jhClient *ssh.Client
-		jhConn   net.Conn
-		err      error
-	)
+	hops := make([]*ssh.Client, 0, len(s.jumpHosts))
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
 
 	// traverse all the hops
 	for idx, jh := range s.jumpHosts {
-		parsed := utils.ParseSSHUrl(jh.URI)
+		parsed, err := utils.ParseSSHUrl(jh.URI)
+		if err != nil {
+			closeHops()
+			return nil, &HopError{Hop: idx + 1, Addr: jh.URI, Err: err}
+		}
 		hop := &utils.Endpoint{
 			Host: parsed.Host,
 			Port: parsed.Port,
 		}
+		user := parsed.Username
+		if jh.User != "" {
+			user = jh.User
+		}
 
 		config := &ssh.ClientConfig{
-			User:            parsed.Username,
-			Auth:            s.getAuthMethods(jh.Identity, jh.Password),
-			HostKeyCallback: s.verifyHostCallback(true),
+			Config: algorithmsConfig(jh.Ciphers, jh.KeyExchanges, jh.MACs),
+			User:   user,
+			Auth: s.getAuthMethods(authConf{
+				identities:            jh.Identity,
+				password:              jh.Password,
+				askPassword:           jh.AskPassword,
+				passphrase:            jh.Passphrase,
+				certificate:           jh.CertificateFile,
+				kbdInteractiveAnswers: jh.KbdInteractiveAnswers,
+				disableKbdInteractive: jh.DisableKbdInteractive,
+			}),
+			Timeout:         s.connectTimeout,
+			HostKeyCallback: s.verifyHostCallback(jh.getKnownHosts(s.knownHosts), jh.isInsecure(s.insecure)),
+			HostKeyAlgorithms: s.getHostKeyAlgorithms(nil, jh.getKnownHosts(s.knownHosts),
+				jh.isInsecure(s.insecure), hop.String()),
 		}
-		log.Printf("connecting to hop %s@%s", parsed.Username, hop.String())
+		s.log.Info("connecting to hop", "hop", idx+1, "user", user, "remote_addr", hop.String())
 
+		var jhClient *ssh.Client
 		// if it is the first hop, use ssh Dial to create the first client
 		if idx == 0 {
-			jhClient, err = ssh.Dial("tcp", hop.String(), config)
-			if err != nil {
-				log.Printf("dial INTO remote server error. %s", err)
-				return nil, err
-			}
+			jhClient, err = s.dialContext(ctx, hop.String(), config)
 		} else {
-			jhConn, err = jhClient.Dial("tcp", hop.String())
-			if err != nil {
-				return nil, err
-			}
-			ncc, chans, reqs, err := ssh.NewClientConn(jhConn, hop.String(), config)
-			if err != nil {
-				return nil, err
-			}
-			jhClient = ssh.NewClient(ncc, chans, reqs)
+			jhClient, err = s.hopDialContext(ctx, hops[idx-1], hop.String(), config)
+		}
+		if err != nil {
+			closeHops()
+			err = &HopError{Hop: idx + 1, Addr: hop.String(), Err: err}
+			s.log.Error("dial INTO jump host error", "hop", idx+1, "remote_addr", hop.String(), "error", err)
+			return nil, err
 		}
-		log.Printf("reached the jump host %s@%s", parsed.Username, hop.String())
+		hops = append(hops, jhClient)
+		s.log.Info("reached the jump host", "hop", idx+1, "user", user, "remote_addr", hop.String())
 	}
 
 	// now I'm ready to reach the final hop, the server
-	log.Printf("connecting to %s@%s", sshConfig.User, server.String())
-	jhConn, err = jhClient.Dial("tcp", server.String())
-	if err != nil {
-		return nil, err
-	}
-	ncc, chans, reqs, err := ssh.NewClientConn(jhConn, server.String(), sshConfig)
+	s.log.Info("connecting", "user", sshConfig.User, "remote_addr", server.String())
+	client, err := s.hopDialContext(ctx, hops[len(hops)-1], server.String(), sshConfig)
 	if err != nil {
+		closeHops()
+		s.log.Error("dial INTO remote server error", "remote_addr", server.String(), "error", err)
 		return nil, err
 	}
-	client := ssh.NewClient(ncc, chans, reqs)
-
+	go func() {
+		client.Wait()
+		closeHops()
+	}()
 	return client, nil
 }
 
 func (s *SshConnection) directConnect(
+	ctx context.Context,
 	server *utils.Endpoint,
 	sshConfig *ssh.ClientConfig,
 ) (*ssh.Client, error) {
 
-	log.Printf("connecting to %s", server.String())
-	client, err := ssh.Dial("tcp", server.String(), sshConfig)
+	s.log.Info("connecting", "remote_addr", server.String())
+	client, err := s.dialContext(ctx, server.String(), sshConfig)
 	if err != nil {
-		log.Printf("dial INTO remote server error. %s", err)
+		s.log.Error("dial INTO remote server error", "remote_addr", server.String(), "error", err)
 		return nil, err
 	}
-	log.Printf("connected to remote server at %s\n", server.String())
+	s.log.Info("connected to remote server", "remote_addr", server.String())
 	return client, nil
 }
+
+// dialContext works like ssh.Dial, but the dial and the handshake are
+// aborted if ctx is done or if they take longer than the connect timeout
+func (s *SshConnection) dialContext(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	_, dialSpan := s.tracer.Start(ctx, "ssh.dial", trace.WithAttributes(
+		attribute.String("server.addr", addr),
+	))
+	conn, err := s.dial(ctx, addr, config.User)
+	if err != nil {
+		dialSpan.RecordError(err)
+		dialSpan.SetStatus(codes.Error, err.Error())
+		dialSpan.End()
+		return nil, err
+	}
+	dialSpan.End()
+
+	_, handshakeSpan := s.tracer.Start(ctx, "ssh.handshake")
+	defer handshakeSpan.End()
+	client, err := s.handshake(ctx, conn, addr, config)
+	if err != nil {
+		handshakeSpan.RecordError(err)
+		handshakeSpan.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return client, nil
+}
+
+// dial opens the transport to the first hop addr: a tcp connection,
+// direct or through the proxy, or the proxy command one if configured.
+// user is the hop user, for the proxy command %r token. The tcp dial is
+// aborted if ctx is done or once the connect timeout passes. The proxy
+// command is killed once ctx is done: it must last as the connection
+func (s *SshConnection) dial(ctx context.Context, addr string, user string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.proxyCommand == "" {
+		dialer, err := BindDialer(s.bindAddress)
+		if err != nil {
+			return nil, err
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, s.connectTimeout)
+		defer cancel()
+		var conn net.Conn
+		if s.proxyURL != nil && !bypassProxy(s.noProxy, host) {
+			s.log.Info("connecting through the proxy", "remote_addr", addr, "proxy", s.proxyURL.Redacted())
+			conn, err = proxyDial(dialCtx, dialer, s.proxyURL, addr)
+			if err != nil {
+				s.log.Error("proxy error", "remote_addr", addr, "proxy", s.proxyURL.Redacted(), "error", err)
+			}
+		} else {
+			conn, err = dialer.DialContext(dialCtx, "tcp", addr)
+		}
+		if err != nil && ctx.Err() == nil && errors.Is(dialCtx.Err(), context.DeadlineExceeded) {
+			err = s.timeoutError(addr)
+		}
+		return conn, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	command := expandProxyCommand(s.proxyCommand, host, port, user)
+	s.log.Info("connecting through the proxy command", "remote_addr", addr, "proxy_command", command)
+	return startProxyCommand(ctx, command, s.log)
+}
+
+// hopDialContext connects to addr through the jump host client. Like
+// dialContext, it is aborted if ctx is done or on connect timeout
+func (s *SshConnection) hopDialContext(ctx context.Context, jhClient *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, s.connectTimeout)
+	defer cancel()
+
+	conn, err := jhClient.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(dialCtx.Err(), context.DeadlineExceeded) {
+			err = s.timeoutError(addr)
+		}
+		return nil, err
+	}
+	return s.handshake(ctx, conn, addr, config)
+}
+
+// handshake runs the ssh handshake on conn. The connection is closed if
+// ctx is done or if the server key isn't received within the connect
+// timeout. The authentication is not subject to the timeout, as it can
+// wait for the user input
+func (s *SshConnection) handshake(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(s.connectTimeout, func() {
+		timedOut.Store(true)
+		conn.Close()
+	})
+	defer timer.Stop()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	handshakeConfig := *config
+	handshakeConfig.HostKeyCallback = func(host string, remote net.Addr, key ssh.PublicKey) error {
+		timer.Stop()
+		return config.HostKeyCallback(host, remote, key)
+	}
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, &handshakeConfig)
+	if err != nil {
+		conn.Close()
+		if timedOut.Load() {
+			return nil, s.timeoutError(addr)
+		}
+		return nil, err
+	}
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
+// timeoutError is returned if the connection to addr can't be established
+// within the connect timeout
+func (s *SshConnection) timeoutError(addr string) error {
+	return fmt.Errorf("%s: connection timed out after %s: %w", addr, s.connectTimeout, os.ErrDeadlineExceeded)
+}
+
+// DialContext opens a connection to addr through the ssh server, like
+// Client.Dial does. If ctx carries a span and the server is a rospo one,
+// the span context is sent along, so that the server spans are part of
+// the same trace. If the compression was negotiated, the connection data
+// is compressed
+func (s *SshConnection) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	s.clientMU.Lock()
+	client := s.Client
+	supported := s.traceContextSupported
+	compressed := s.compressed
+	s.clientMU.Unlock()
+	if client == nil {
+		return nil, errors.New("the ssh client is not connected")
+	}
+	extra := utils.DirectTCPIPExtra{}
+	if supported && trace.SpanContextFromContext(ctx).IsValid() {
+		carrier := propagation.MapCarrier{}
+		propagation.TraceContext{}.Inject(ctx, carrier)
+		extra.TraceParent = carrier.Get("traceparent")
+	}
+	if compressed {
+		extra.CompressionLevel = s.compressionLevel
+	}
+	if extra == (utils.DirectTCPIPExtra{}) {
+		return client.Dial("tcp", addr)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	payload := utils.MarshalDirectTCPIP(utils.DirectTCPIPPayload{
+		Addr:       host,
+		Port:       uint32(port),
+		OriginAddr: net.IPv4zero.String(),
+	}, extra)
+
+	channel, reqs, err := client.OpenChannel("direct-tcpip", payload)
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	var conn net.Conn = &channelConn{
+		Channel: channel,
+		laddr:   &net.TCPAddr{IP: net.IPv4zero},
+		raddr:   &net.TCPAddr{IP: net.IPv4zero},
+	}
+	if compressed {
+		conn = rio.NewCompressedConn(conn, s.compressionLevel)
+	}
+	return conn, nil
+}
+
+// Listen asks the ssh server to listen on addr, like Client.Listen does.
+// If the compression was negotiated, the accepted connections data is
+// compressed: the server compresses all the forwarded connections
+func (s *SshConnection) Listen(addr string) (net.Listener, error) {
+	s.clientMU.Lock()
+	client := s.Client
+	compressed := s.compressed
+	s.clientMU.Unlock()
+	if client == nil {
+		return nil, errors.New("the ssh client is not connected")
+	}
+	listener, err := client.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return listener, nil
+	}
+	return &compressedListener{Listener: listener, level: s.compressionLevel}, nil
+}
@@ -1,17 +1,36 @@
 package sshc
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/ferama/go-socks"
 	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"golang.org/x/net/proxy"
 )
 
@@ -35,8 +54,11 @@ func startD(withPass bool, disableShell bool, usekeys2 bool) string {
 	} else {
 		serverConf.AuthorizedPassword = "password"
 	}
-	sd := sshd.NewSshServer(serverConf)
-	go sd.Start()
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		panic(err)
+	}
+	go sd.Start(context.Background())
 	var addr net.Addr
 	for {
 		addr = sd.GetListenerAddr()
@@ -52,13 +74,16 @@ func startD(withPass bool, disableShell bool, usekeys2 bool) string {
 func TestErrors(t *testing.T) {
 	// create an ssh client
 	clientConf := &SshClientConf{
-		Identity:  "../../testdata/client",
+		Identity:  Identities{"../../testdata/client"},
 		Insecure:  true,
 		JumpHosts: make([]*JumpHostConf, 0),
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", "48738"), // some random not existing port
 	}
-	client := NewSshConnection(clientConf)
-	go client.Start()
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 	time.Sleep(2 * time.Second)
 	if client.GetConnectionStatus() != STATUS_CONNECTING {
 		t.Fail()
@@ -67,18 +92,21 @@ func TestErrors(t *testing.T) {
 	// invalid tunnel hop
 	sshd1Port := startD(false, false, false)
 	clientConf = &SshClientConf{
-		Identity: "testdata/client",
+		Identity: Identities{"testdata/client"},
 		Insecure: true, // disables known_hosts check
 		JumpHosts: []*JumpHostConf{
 			{
 				URI:      fmt.Sprintf("127.0.0.1:%s", "48739"),
-				Identity: "../../testdata/client",
+				Identity: Identities{"../../testdata/client"},
 			},
 		},
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshd1Port),
 	}
-	client = NewSshConnection(clientConf)
-	go client.Start()
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 	time.Sleep(2 * time.Second)
 	if client.GetConnectionStatus() != STATUS_CONNECTING {
 		t.Fail()
@@ -90,26 +118,218 @@ func TestSshC(t *testing.T) {
 
 	file, err := os.CreateTemp("", "rospo_known_hosts")
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 	defer os.Remove(file.Name())
 
 	// create an ssh client
 	clientConf := &SshClientConf{
-		Identity:   "../../testdata/client",
+		Identity:   Identities{"../../testdata/client"},
 		KnownHosts: file.Name(),
 		Insecure:   false,
 		JumpHosts:  make([]*JumpHostConf, 0),
 		ServerURI:  fmt.Sprintf("127.0.0.1:%s", sshdPort),
 	}
 
-	client := NewSshConnection(clientConf)
-	client.GrabPubKey()
-	go client.Start()
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grabPubKey(t, client)
+	go client.Start(context.Background())
 
 	client.ReadyWait()
 }
 
+func TestVerifyHostKey(t *testing.T) {
+	sshdPort := startD(false, false, false)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(knownHosts, nil, 0600)
+	client, err := NewSshConnection(&SshClientConf{
+		KnownHosts: knownHosts,
+		ServerURI:  fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := client.VerifyHostKey()
+	var keyErr *knownhosts.KeyError
+	if key == nil || !errors.As(err, &keyErr) || len(keyErr.Want) != 0 {
+		t.Fatalf("expected an unknown key error, got %v", err)
+	}
+
+	grabPubKey(t, client)
+	if _, err := client.VerifyHostKey(); err != nil {
+		t.Fatalf("expected the key to match, got %v", err)
+	}
+}
+
+func TestGrabPubKeyTimeout(t *testing.T) {
+	// accepts the connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client, err := NewSshConnection(&SshClientConf{
+		KnownHosts:     filepath.Join(t.TempDir(), "known_hosts"),
+		ServerURI:      listener.Addr().String(),
+		ConnectTimeout: 200 * time.Millisecond,
+		Quiet:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = client.GrabPubKey()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("GrabPubKey took %s", elapsed)
+	}
+}
+
+func TestGrabPubKeyAlgorithms(t *testing.T) {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	hostKeys := []ssh.PublicKey{}
+	for _, algorithm := range []string{utils.KeyAlgorithmEd25519, utils.KeyAlgorithmECDSA, utils.KeyAlgorithmRSA} {
+		key, _ := utils.GeneratePrivateKey(algorithm, 0)
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.AddHostKey(signer)
+		hostKeys = append(hostKeys, signer.PublicKey())
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ssh.NewServerConn(conn, config)
+				conn.Close()
+			}()
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	// one of the keys is already known
+	os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{listener.Addr().String()}, hostKeys[0])+"\n"), 0600)
+	client, err := NewSshConnection(&SshClientConf{
+		KnownHosts: knownHosts,
+		ServerURI:  listener.Addr().String(),
+		Quiet:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := client.GrabPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(hostKeys) {
+		t.Fatalf("expected %d keys, got %d", len(hostKeys), len(keys))
+	}
+	for _, k := range keys {
+		if k.Known != keyEqual(k.PublicKey, hostKeys[0]) {
+			t.Fatalf("%s: unexpected known %t", k.Type, k.Known)
+		}
+		if k.Fingerprint != ssh.FingerprintSHA256(k.PublicKey) || k.Port != listener.Addr().(*net.TCPAddr).Port {
+			t.Fatalf("%s: unexpected key %+v", k.Type, k)
+		}
+	}
+	// grabbing doesn't touch the known_hosts file
+	if entries, _ := utils.ListKnownHostEntries(knownHosts); len(entries) != 1 {
+		t.Fatalf("expected 1 known_hosts entry, got %d", len(entries))
+	}
+	if err := client.AddHostKeys(keys, false); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := utils.ListKnownHostEntries(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(hostKeys) {
+		t.Fatalf("expected %d known_hosts entries, got %d", len(hostKeys), len(entries))
+	}
+
+	// all the key types are trusted now
+	clb, _ := knownhosts.New(knownHosts)
+	for _, key := range hostKeys {
+		if err := clb(listener.Addr().String(), listener.Addr(), key); err != nil {
+			t.Fatalf("%s: %s", key.Type(), err)
+		}
+	}
+
+	// grabbing again doesn't add duplicates
+	grabPubKey(t, client)
+	entries, _ = utils.ListKnownHostEntries(knownHosts)
+	if len(entries) != len(hostKeys) {
+		t.Fatalf("expected %d known_hosts entries, got %d", len(hostKeys), len(entries))
+	}
+	// neither the keys grabbed before the file was updated do
+	if err := client.AddHostKeys(keys, false); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = utils.ListKnownHostEntries(knownHosts)
+	if len(entries) != len(hostKeys) {
+		t.Fatalf("expected %d known_hosts entries, got %d", len(hostKeys), len(entries))
+	}
+
+	// hashed lines for a new file
+	client, err = NewSshConnection(&SshClientConf{
+		KnownHosts: filepath.Join(t.TempDir(), "known_hosts"),
+		ServerURI:  listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = client.GrabPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := client.HostKeyLines(keys, true)
+	if len(lines) != len(hostKeys) {
+		t.Fatalf("expected %d lines, got %d", len(hostKeys), len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "|1|") {
+			t.Fatalf("expected a hashed line, got '%s'", line)
+		}
+	}
+}
+
+// grabPubKey grabs the server keys adding them to the known_hosts file
+func grabPubKey(t *testing.T, client *SshConnection) {
+	keys, err := client.GrabPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AddHostKeys(keys, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestJumpHosts(t *testing.T) {
 	sshd1Port := startD(false, false, false)
 	sshd2Port := startD(false, false, false)
@@ -117,26 +337,83 @@ func TestJumpHosts(t *testing.T) {
 
 	// create an ssh client
 	clientConf := &SshClientConf{
-		Identity: "../../testdata/client",
+		Identity: Identities{"../../testdata/client"},
 		Insecure: true, // disables known_hosts check
 		JumpHosts: []*JumpHostConf{
 			{
 				URI:      fmt.Sprintf("127.0.0.1:%s", sshd2Port),
-				Identity: "../../testdata/client",
+				Identity: Identities{"../../testdata/client"},
 			},
 			{
 				URI:      fmt.Sprintf("127.0.0.1:%s", sshd3Port),
-				Identity: "../../testdata/client2",
+				Identity: Identities{"../../testdata/client2"},
 			},
 		},
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshd1Port),
 	}
-	client := NewSshConnection(clientConf)
-	go client.Start()
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 	client.ReadyWait()
 	client.Stop()
 }
 
+func TestJumpHostChain(t *testing.T) {
+	serverPort := startD(false, false, false)
+	hop1Port := startD(false, false, false)
+	// the second hop authorizes the client2 key only
+	hop2Port := startD(false, false, true)
+
+	conf := func(hop2Identity string) *SshClientConf {
+		return &SshClientConf{
+			Identity: Identities{"../../testdata/client"},
+			Insecure: true,
+			JumpHosts: []*JumpHostConf{
+				{
+					URI:      fmt.Sprintf("hop1@127.0.0.1:%s", hop1Port),
+					Identity: Identities{"../../testdata/client"},
+				},
+				{
+					URI:      fmt.Sprintf("127.0.0.1:%s", hop2Port),
+					User:     "hop2",
+					Identity: Identities{hop2Identity},
+				},
+			},
+			ServerURI: fmt.Sprintf("127.0.0.1:%s", serverPort),
+		}
+	}
+
+	client, err := NewSshConnection(conf("../../testdata/client2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	session, err := client.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+	client.Client.Close()
+
+	// the failing hop is reported
+	client, err = NewSshConnection(conf("../../testdata/client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.connect(context.Background())
+	var hopErr *HopError
+	if !errors.As(err, &hopErr) {
+		t.Fatalf("expected a hop error, got %v", err)
+	}
+	if hopErr.Hop != 2 || hopErr.Addr != fmt.Sprintf("127.0.0.1:%s", hop2Port) {
+		t.Fatalf("unexpected hop error %s", hopErr)
+	}
+}
+
 func TestWithPassword(t *testing.T) {
 	sshdPort := startD(true, false, false)
 	clientConf := &SshClientConf{
@@ -145,22 +422,399 @@ func TestWithPassword(t *testing.T) {
 		Insecure:  true,
 		Password:  "password",
 	}
-	client := NewSshConnection(clientConf)
-	go client.Start()
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 	client.ReadyWait()
 	client.Stop()
 }
 
+func TestMultipleIdentities(t *testing.T) {
+	// the server authorizes the client2 key only
+	sshdPort := startD(false, false, true)
+	clientConf := &SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity: Identities{
+			"../../testdata/not_existent",
+			"../../testdata/client",
+			"../../testdata/client2",
+		},
+		JumpHosts: make([]*JumpHostConf, 0),
+		Insecure:  true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Close()
+
+	clientConf.Identity = Identities{"../../testdata/not_existent"}
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.connect(context.Background()); err == nil {
+		t.Fatal("expected the auth to fail without valid identities")
+	}
+}
+
+func TestJumpHostVerification(t *testing.T) {
+	jumpPort := startD(false, false, false)
+	serverPort := startD(false, false, false)
+	jumpAddr := fmt.Sprintf("127.0.0.1:%s", jumpPort)
+	serverAddr := fmt.Sprintf("127.0.0.1:%s", serverPort)
+
+	keyBytes, _ := os.ReadFile("../../testdata/server.pub")
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// knows the final server only
+	clientKnownHosts := filepath.Join(dir, "client_known_hosts")
+	os.WriteFile(clientKnownHosts, nil, 0600)
+	utils.AddHostKeyToKnownHosts(serverAddr, hostKey, clientKnownHosts)
+	// knows the jump host only
+	jumpKnownHosts := filepath.Join(dir, "jump_known_hosts")
+	os.WriteFile(jumpKnownHosts, nil, 0600)
+	utils.AddHostKeyToKnownHosts(jumpAddr, hostKey, jumpKnownHosts)
+	emptyKnownHosts := filepath.Join(dir, "empty_known_hosts")
+	os.WriteFile(emptyKnownHosts, nil, 0600)
+
+	insecure := true
+	secure := false
+	cases := []struct {
+		name    string
+		jump    JumpHostConf
+		trusted bool
+	}{
+		// the jump host inherits the client known_hosts
+		{"inherited", JumpHostConf{}, false},
+		{"own known_hosts", JumpHostConf{KnownHosts: jumpKnownHosts}, true},
+		{"unknown key", JumpHostConf{KnownHosts: emptyKnownHosts}, false},
+		{"insecure", JumpHostConf{KnownHosts: emptyKnownHosts, Insecure: &insecure}, true},
+		{"explicitly secure", JumpHostConf{KnownHosts: emptyKnownHosts, Insecure: &secure}, false},
+	}
+	for _, c := range cases {
+		jump := c.jump
+		jump.URI = jumpAddr
+		jump.Identity = Identities{"../../testdata/client"}
+		client, err := NewSshConnection(&SshClientConf{
+			Identity:   Identities{"../../testdata/client"},
+			KnownHosts: clientKnownHosts,
+			JumpHosts:  []*JumpHostConf{&jump},
+			ServerURI:  serverAddr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.connect(context.Background())
+		if c.trusted && err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if !c.trusted && !errors.Is(err, ErrUntrustedHost) {
+			t.Fatalf("%s: expected an untrusted host error, got %v", c.name, err)
+		}
+		if err == nil {
+			client.Client.Close()
+		}
+	}
+
+	// the unknown jump host key is not added to the known_hosts file
+	content, _ := os.ReadFile(emptyKnownHosts)
+	if len(content) != 0 {
+		t.Fatalf("unexpected known_hosts content '%s'", content)
+	}
+
+	// a changed jump host key: the error tells the hop and the fingerprint
+	otherBytes, _ := os.ReadFile("../../testdata/client.pub")
+	otherKey, _, _, _, _ := ssh.ParseAuthorizedKey(otherBytes)
+	changedKnownHosts := filepath.Join(dir, "changed_known_hosts")
+	os.WriteFile(changedKnownHosts, nil, 0600)
+	utils.AddHostKeyToKnownHosts(jumpAddr, otherKey, changedKnownHosts)
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:   Identities{"../../testdata/client"},
+		KnownHosts: clientKnownHosts,
+		JumpHosts: []*JumpHostConf{{
+			URI:        jumpAddr,
+			Identity:   Identities{"../../testdata/client"},
+			KnownHosts: changedKnownHosts,
+		}},
+		ServerURI: serverAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.connect(context.Background())
+	var hopErr *HopError
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &hopErr) || hopErr.Hop != 1 || !errors.As(err, &keyErr) {
+		t.Fatalf("expected a hop 1 key mismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), ssh.FingerprintSHA256(hostKey)) {
+		t.Fatalf("the error doesn't tell the fingerprint: %s", err)
+	}
+}
+
+func TestHashedKnownHosts(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	serverAddr := fmt.Sprintf("127.0.0.1:%s", sshdPort)
+
+	keyBytes, _ := os.ReadFile("../../testdata/server.pub")
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := utils.SerializePublicKey(hostKey)
+	hashedHost := knownhosts.HashHostname(knownhosts.Normalize(serverAddr))
+
+	connect := func(content string) error {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+		os.WriteFile(knownHosts, []byte(content), 0600)
+		client, err := NewSshConnection(&SshClientConf{
+			Identity:   Identities{"../../testdata/client"},
+			KnownHosts: knownHosts,
+			ServerURI:  serverAddr,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.connect(context.Background())
+		if err == nil {
+			client.Client.Close()
+		}
+		return err
+	}
+
+	if err := connect(hashedHost + " " + serialized + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	var revokedErr *knownhosts.RevokedError
+	err = connect(hashedHost + " " + serialized + "\n@revoked * " + serialized + "\n")
+	if !errors.As(err, &revokedErr) {
+		t.Fatalf("expected a revoked key error, got %v", err)
+	}
+
+	// the grabbed keys follow the file hashing convention
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(knownHosts, []byte(knownhosts.HashHostname("otherhost")+" "+serialized+"\n"), 0600)
+	client, err := NewSshConnection(&SshClientConf{
+		KnownHosts: knownHosts,
+		ServerURI:  serverAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grabPubKey(t, client)
+	if _, err := client.VerifyHostKey(); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(knownHosts)
+	if strings.Contains(string(content), "127.0.0.1") {
+		t.Fatalf("expected hashed entries only, got '%s'", content)
+	}
+}
+
+func TestInvalidConf(t *testing.T) {
+	for _, conf := range []*SshClientConf{
+		{ServerURI: "127.0.0.1:65536"},
+		{ServerURI: "127.0.0.1:22", CompressionLevel: 10},
+		{ServerURI: "127.0.0.1:22", JumpHosts: []*JumpHostConf{{URI: "[::1"}}},
+		{ServerURI: "127.0.0.1:22", BindAddress: "localhost"},
+	} {
+		if _, err := NewSshConnection(conf); err == nil {
+			t.Fatalf("expected an error for %+v", conf)
+		}
+	}
+}
+
+func TestStartUntrustedHost(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	// the server key is not in known_hosts
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(knownHosts, nil, 0600)
+
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:   Identities{"../../testdata/client"},
+		KnownHosts: knownHosts,
+		ServerURI:  "127.0.0.1:" + sshdPort,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Start gives up at once, without exiting
+	if err := client.Start(context.Background()); !errors.Is(err, ErrUntrustedHost) {
+		t.Fatalf("expected an untrusted host error, got %v", err)
+	}
+	if err := client.ReadyWait(); !errors.Is(err, ErrConnectionStopped) {
+		t.Fatalf("expected the stopped connection error, got %v", err)
+	}
+}
+
+func TestHostCertificates(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		key, _ := utils.GeneratePrivateKey(utils.KeyAlgorithmEd25519, 0)
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	ca := newSigner()
+	otherCA := newSigner()
+	hostSigner := newSigner()
+	newCert := func(signer ssh.Signer, principal string, validBefore time.Time) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             hostSigner.PublicKey(),
+			CertType:        ssh.HostCert,
+			ValidPrincipals: []string{principal},
+			ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+		}
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	valid := time.Now().Add(time.Hour)
+	caLine := "@cert-authority *.corp.example.com,!bad.corp.example.com " + utils.SerializePublicKey(ca.PublicKey()) + "\n"
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+
+	client, err := NewSshConnection(&SshClientConf{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(content string, host string, key ssh.PublicKey) error {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+		os.WriteFile(knownHosts, []byte(content), 0600)
+		return client.verifyHostCallback(knownHosts, false)(host, remote, key)
+	}
+
+	if err := check(caLine, "srv.corp.example.com:22", newCert(ca, "srv.corp.example.com", valid)); err != nil {
+		t.Fatal(err)
+	}
+	// negated pattern
+	err = check(caLine, "bad.corp.example.com:22", newCert(ca, "bad.corp.example.com", valid))
+	if !errors.Is(err, ErrUntrustedHost) {
+		t.Fatalf("expected an untrusted host error, got %v", err)
+	}
+	// the pattern doesn't match a non standard port
+	err = check(caLine, "srv.corp.example.com:2222", newCert(ca, "srv.corp.example.com", valid))
+	if !errors.Is(err, ErrUntrustedHost) {
+		t.Fatalf("expected an untrusted host error, got %v", err)
+	}
+	// unknown authority
+	err = check(caLine, "srv.corp.example.com:22", newCert(otherCA, "srv.corp.example.com", valid))
+	if !errors.Is(err, ErrUntrustedHost) {
+		t.Fatalf("expected an untrusted host error, got %v", err)
+	}
+	// expired
+	if err := check(caLine, "srv.corp.example.com:22", newCert(ca, "srv.corp.example.com", time.Now().Add(-time.Minute))); err == nil {
+		t.Fatal("expected an error for an expired certificate")
+	}
+	// wrong principal
+	if err := check(caLine, "srv.corp.example.com:22", newCert(ca, "other.corp.example.com", valid)); err == nil {
+		t.Fatal("expected an error for a wrong principal")
+	}
+
+	// fall back to the plain key
+	plainLine := "srv.corp.example.com " + utils.SerializePublicKey(hostSigner.PublicKey()) + "\n"
+	if err := check(plainLine, "srv.corp.example.com:22", newCert(otherCA, "srv.corp.example.com", valid)); err != nil {
+		t.Fatal(err)
+	}
+
+	var revokedErr *knownhosts.RevokedError
+	revokedCA := caLine + "@revoked * " + utils.SerializePublicKey(ca.PublicKey()) + "\n"
+	err = check(revokedCA, "srv.corp.example.com:22", newCert(ca, "srv.corp.example.com", valid))
+	if !errors.As(err, &revokedErr) || !strings.Contains(err.Error(), "certificate authority") {
+		t.Fatalf("expected a revoked authority error, got %v", err)
+	}
+	revokedKey := caLine + "@revoked * " + utils.SerializePublicKey(hostSigner.PublicKey()) + "\n"
+	err = check(revokedKey, "srv.corp.example.com:22", newCert(ca, "srv.corp.example.com", valid))
+	if !errors.As(err, &revokedErr) || !strings.Contains(err.Error(), "certificate key") {
+		t.Fatalf("expected a revoked key error, got %v", err)
+	}
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	sshdPort := startD(true, false, false)
+	clientConf := &SshClientConf{
+		ServerURI:   fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:    Identities{"../../testdata/not_existent"},
+		JumpHosts:   make([]*JumpHostConf, 0),
+		Insecure:    true,
+		Password:    "wrong",
+		AskPassword: true,
+	}
+
+	// the configured password is tried first, then the prompt is used
+	prompts := 0
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.passwordPrompt = func() (string, error) {
+		prompts++
+		return "password", nil
+	}
+	if err := client.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Close()
+	if prompts != 1 {
+		t.Fatalf("expected 1 prompt, got %d", prompts)
+	}
+
+	// retries are bounded
+	prompts = 0
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.passwordPrompt = func() (string, error) {
+		prompts++
+		return "wrong", nil
+	}
+	if err := client.connect(context.Background()); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+	if prompts != maxPasswordAttempts-1 {
+		t.Fatalf("expected %d prompts, got %d", maxPasswordAttempts-1, prompts)
+	}
+
+	// without a terminal only the configured password is used
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.passwordPrompt = nil
+	if err := client.connect(context.Background()); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+
+	if strings.Contains(fmt.Sprintf("%v", clientConf), "wrong") {
+		t.Fatal("the password must not be printed")
+	}
+}
+
 func TestRemoteShell(t *testing.T) {
 	sshdPort := startD(false, false, false)
 	clientConf := &SshClientConf{
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
-		Identity:  "../../testdata/client",
+		Identity:  Identities{"../../testdata/client"},
 		JumpHosts: make([]*JumpHostConf, 0),
 		Insecure:  true,
 	}
-	client := NewSshConnection(clientConf)
-	go client.Start()
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 	remoteShell := NewRemoteShell(client)
 	go remoteShell.Start("", true)
 	time.Sleep(1 * time.Second)
@@ -172,12 +826,15 @@ func TestRemoteShellCmd(t *testing.T) {
 	sshdPort := startD(false, false, false)
 	clientConf := &SshClientConf{
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
-		Identity:  "../../testdata/client",
+		Identity:  Identities{"../../testdata/client"},
 		JumpHosts: make([]*JumpHostConf, 0),
 		Insecure:  true,
 	}
-	client := NewSshConnection(clientConf)
-	go client.Start()
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 	remoteShell := NewRemoteShell(client)
 	go remoteShell.Start("ls", false)
 	time.Sleep(1 * time.Second)
@@ -185,21 +842,63 @@ func TestRemoteShellCmd(t *testing.T) {
 	client.Stop()
 }
 
-func TestShellDisabled(t *testing.T) {
-	sshdPort := startD(false, true, false)
+func TestRemoteShellExitCode(t *testing.T) {
+	sshdPort := startD(false, false, false)
 	clientConf := &SshClientConf{
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
-		Identity:  "../../testdata/client",
+		Identity:  Identities{"../../testdata/client"},
 		JumpHosts: make([]*JumpHostConf, 0),
 		Insecure:  true,
 	}
-	client := NewSshConnection(clientConf)
-	go client.Start()
-	client.ReadyWait()
-	remoteShell := NewRemoteShell(client)
-	err := remoteShell.Start("ls", false)
-	if err == nil {
-		t.Fatalf("shell/exec disabled. test should fail")
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+
+	remoteShell := NewRemoteShell(client)
+	code, err := ExitCode(remoteShell.Start("exit 3", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("exit code is %d, want 3", code)
+	}
+
+	// Stop ends the interactive shell
+	done := make(chan struct{})
+	go func() {
+		remoteShell.Start("", false)
+		close(done)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	remoteShell.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shell didn't stop")
+	}
+}
+
+func TestShellDisabled(t *testing.T) {
+	sshdPort := startD(false, true, false)
+	clientConf := &SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:  Identities{"../../testdata/client"},
+		JumpHosts: make([]*JumpHostConf, 0),
+		Insecure:  true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	client.ReadyWait()
+	remoteShell := NewRemoteShell(client)
+	err = remoteShell.Start("ls", false)
+	if err == nil {
+		t.Fatalf("shell/exec disabled. test should fail")
 	}
 	remoteShell.Stop()
 	client.Stop()
@@ -209,12 +908,15 @@ func TestSocksProxy(t *testing.T) {
 	sshdPort := startD(false, false, false)
 	clientConf := &SshClientConf{
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
-		Identity:  "../../testdata/client",
+		Identity:  Identities{"../../testdata/client"},
 		JumpHosts: make([]*JumpHostConf, 0),
 		Insecure:  true,
 	}
-	client := NewSshConnection(clientConf)
-	go client.Start()
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 	defer client.Stop()
 
 	sockProxy := NewSocksProxy(client)
@@ -254,3 +956,2581 @@ func TestSocksProxy(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRunCommand(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	clientConf := &SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:  Identities{"../../testdata/client"},
+		JumpHosts: make([]*JumpHostConf, 0),
+		Insecure:  true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+
+	var stdout, stderr bytes.Buffer
+	code, err := client.RunCommand(context.Background(), "echo hello", nil, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	if strings.TrimSpace(stdout.String()) != "hello" {
+		t.Fatalf("expected 'hello', got '%s'", stdout.String())
+	}
+
+	for _, expected := range []int{0, 1} {
+		code, err = client.RunCommand(context.Background(), fmt.Sprintf("exit %d", expected), nil, &stdout, &stderr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Fatalf("expected exit code %d, got %d", expected, code)
+		}
+	}
+
+	stdout.Reset()
+	code, err = client.RunCommand(context.Background(), "cat", strings.NewReader("from stdin"), &stdout, &stderr)
+	if err != nil || code != 0 {
+		t.Fatalf("unexpected result: %d, %v", code, err)
+	}
+	if stdout.String() != "from stdin" {
+		t.Fatalf("expected 'from stdin', got '%s'", stdout.String())
+	}
+
+	// each call uses its own session
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			code, err := client.RunCommand(context.Background(), fmt.Sprintf("exit %d", i), nil, io.Discard, io.Discard)
+			if err == nil && code != i {
+				err = fmt.Errorf("expected exit code %d, got %d", i, code)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the cancellation terminates the remote command
+	marker := filepath.Join(t.TempDir(), "marker")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = client.RunCommand(ctx, fmt.Sprintf("sleep 1; touch %s", marker), nil, &stdout, &stderr)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	time.Sleep(time.Second)
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("the remote command kept running after the cancellation")
+	}
+}
+
+func TestRun(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	clientConf := &SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:  Identities{"../../testdata/client"},
+		JumpHosts: make([]*JumpHostConf, 0),
+		Insecure:  true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+
+	stdout, stderr, code, err := client.Run(context.Background(), "echo out; echo err >&2; exit 3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("expected exit code 3, got %d", code)
+	}
+	if strings.TrimSpace(string(stdout)) != "out" {
+		t.Fatalf("expected 'out', got '%s'", string(stdout))
+	}
+	if strings.TrimSpace(string(stderr)) != "err" {
+		t.Fatalf("expected 'err', got '%s'", string(stderr))
+	}
+
+	stdout, _, _, err = client.Run(context.Background(), "cat", strings.NewReader("from stdin"))
+	if err != nil || string(stdout) != "from stdin" {
+		t.Fatalf("unexpected output %q, error %v", stdout, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, _, _, err = client.Run(ctx, "sleep 10", nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if code, err := ExitCode(nil); code != 0 || err != nil {
+		t.Fatalf("unexpected result %d, %v", code, err)
+	}
+	if code, err := ExitCode(&ssh.ExitMissingError{}); code != -1 || !errors.Is(err, ErrExitStatusMissing) {
+		t.Fatalf("unexpected result %d, %v", code, err)
+	}
+	other := errors.New("other")
+	if code, err := ExitCode(other); code != -1 || err != other {
+		t.Fatalf("unexpected result %d, %v", code, err)
+	}
+}
+
+func startAgent(t *testing.T, keyPath string) string {
+	keyring := agent.NewKeyring()
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.ParseRawPrivateKey(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+	return socket
+}
+
+func TestAgentAuth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test agent listens on a unix socket")
+	}
+	sshdPort := startD(false, false, false)
+	socket := startAgent(t, "../../testdata/client")
+
+	// no identity file: the agent is the only key source
+	clientConf := &SshClientConf{
+		ServerURI:   fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:    Identities{"not-existent-identity"},
+		AgentSocket: socket,
+		JumpHosts:   make([]*JumpHostConf, 0),
+		Insecure:    true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	client.ReadyWait()
+	client.Stop()
+
+	// a broken agent falls back to the identity file
+	clientConf = &SshClientConf{
+		ServerURI:   fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:    Identities{"../../testdata/client"},
+		AgentSocket: filepath.Join(t.TempDir(), "not-existent.sock"),
+		JumpHosts:   make([]*JumpHostConf, 0),
+		Insecure:    true,
+	}
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	client.ReadyWait()
+	client.Stop()
+}
+
+func TestSftpShellBatch(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	client, err := NewSshConnection(&SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:  Identities{"../../testdata/client"},
+		JumpHosts: make([]*JumpHostConf, 0),
+		Insecure:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+
+	transfer, err := NewSftpTransfer(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transfer.Close()
+
+	// the test server shares the local filesystem
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	downloadDir := t.TempDir()
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(localDir, "data.bin"), data, 0644)
+	os.WriteFile(filepath.Join(localDir, "a.log"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(localDir, "b.log"), []byte("b"), 0644)
+
+	out := &bytes.Buffer{}
+	shell, err := NewSftpShell(transfer, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf(`# uploads and downloads back
+lcd %q
+cd %q
+mkdir up
+cd up
+put data.bin
+put *.log
+ls
+-rm missing.txt
+lcd %q
+get data.bin
+get *.log
+rm *.log
+exit
+get never.txt
+`, localDir, remoteDir, downloadDir)
+	if err := shell.RunBatch(strings.NewReader(script)); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+
+	got, err := os.ReadFile(filepath.Join(downloadDir, "data.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("the downloaded data differs: %v", err)
+	}
+	for _, name := range []string{"a.log", "b.log"} {
+		if _, err := os.Stat(filepath.Join(downloadDir, name)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(remoteDir, "up", name)); !os.IsNotExist(err) {
+			t.Fatalf("expected the remote %s to be removed", name)
+		}
+	}
+	if !strings.Contains(out.String(), "data.bin") || !strings.Contains(out.String(), "b.log") {
+		t.Fatalf("unexpected ls output:\n%s", out)
+	}
+	if shell.Prompt() != "sftp "+filepath.ToSlash(filepath.Join(remoteDir, "up"))+"> " {
+		t.Fatalf("unexpected prompt %s", shell.Prompt())
+	}
+
+	// a failed command stops the batch
+	err = shell.RunBatch(strings.NewReader("get missing.txt\npwd\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 1:") {
+		t.Fatalf("expected a line 1 error, got %v", err)
+	}
+	if err := shell.Exec("nope"); err == nil {
+		t.Fatal("expected an invalid command error")
+	}
+}
+
+func TestSftpTransfer(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	clientConf := &SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:  Identities{"../../testdata/client"},
+		JumpHosts: make([]*JumpHostConf, 0),
+		Insecure:  true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+
+	transfer, err := NewSftpTransfer(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transfer.Close()
+
+	srcDir := t.TempDir()
+	os.MkdirAll(filepath.Join(srcDir, "tree", "nested"), 0755)
+	srcFile := filepath.Join(srcDir, "tree", "nested", "file.txt")
+	os.WriteFile(srcFile, []byte("sftp transfer test"), 0640)
+	mtime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	os.Chtimes(srcFile, mtime, mtime)
+
+	// the test server shares the local filesystem
+	remoteDir := t.TempDir()
+	if err := transfer.Upload(filepath.Join(srcDir, "tree"), remoteDir, true); err != nil {
+		t.Fatal(err)
+	}
+	dstDir := t.TempDir()
+	if err := transfer.Download(remoteDir+"/tree", dstDir, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		filepath.Join(remoteDir, "tree", "nested", "file.txt"),
+		filepath.Join(dstDir, "tree", "nested", "file.txt"),
+	} {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "sftp transfer test" {
+			t.Fatalf("unexpected content in %s: %s", path, content)
+		}
+		info, _ := os.Stat(path)
+		if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+			t.Fatalf("expected mode 0640 for %s, got %#o", path, info.Mode().Perm())
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Fatalf("expected mtime %s for %s, got %s", mtime, path, info.ModTime())
+		}
+	}
+
+	if err := transfer.Upload(srcDir, remoteDir, false); err == nil {
+		t.Fatal("expected directory upload to fail if not recursive")
+	}
+}
+
+func TestSftpTransferResume(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	clientConf := &SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:  Identities{"../../testdata/client"},
+		JumpHosts: make([]*JumpHostConf, 0),
+		Insecure:  true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+
+	var (
+		progress   []int64
+		progressMU sync.Mutex
+	)
+	transfer, err := NewSftpTransfer(client, func(name string, size int64) chan int64 {
+		ch := make(chan int64, 16)
+		progressMU.Lock()
+		progress = append(progress, 0)
+		i := len(progress) - 1
+		progressMU.Unlock()
+		go func() {
+			for n := range ch {
+				progressMU.Lock()
+				progress[i] += n
+				progressMU.Unlock()
+			}
+		}()
+		return ch
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transfer.Close()
+	transfer.SetPreserve(false)
+	transfer.SetResume(true)
+
+	content := "the partially transferred file content"
+	srcDir := t.TempDir()
+	srcFile := filepath.Join(srcDir, "file.txt")
+	os.WriteFile(srcFile, []byte(content), 0600)
+	mtime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	os.Chtimes(srcFile, mtime, mtime)
+
+	// the test server shares the local filesystem
+	remoteDir := t.TempDir()
+	remoteFile := filepath.Join(remoteDir, "file.txt")
+	// the first part was copied: the rest is appended
+	os.WriteFile(remoteFile, []byte(content[:10]), 0600)
+	if err := transfer.Upload(srcFile, remoteDir, false); err != nil {
+		t.Fatal(err)
+	}
+	// a bigger destination is copied again
+	dstDir := t.TempDir()
+	dstFile := filepath.Join(dstDir, "file.txt")
+	os.WriteFile(dstFile, []byte(content+" and more"), 0600)
+	if err := transfer.Download(remoteFile, dstDir, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{remoteFile, dstFile} {
+		got, _ := os.ReadFile(path)
+		if string(got) != content {
+			t.Fatalf("unexpected content in %s: %s", path, got)
+		}
+		// not preserved
+		if info, _ := os.Stat(path); info.ModTime().Equal(mtime) {
+			t.Fatalf("unexpected preserved mtime for %s", path)
+		}
+	}
+
+	// a corrupted destination with the source size is taken as complete
+	os.WriteFile(dstFile, []byte(strings.Repeat("x", len(content))), 0600)
+	if err := transfer.Download(remoteFile, dstDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dstFile); string(got) == content {
+		t.Fatal("the complete destination was copied again")
+	}
+
+	transfer.SetResume(false)
+	if err := transfer.Download(remoteFile, dstDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dstFile); string(got) != content {
+		t.Fatalf("unexpected content %s", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	progressMU.Lock()
+	defer progressMU.Unlock()
+	// the resumed transfers progress starts from the copied part
+	for i, n := range progress {
+		if n != int64(len(content)) {
+			t.Fatalf("transfer %d progress is %d, want %d", i, n, len(content))
+		}
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	client, err := NewSshConnection(&SshClientConf{
+		ServerURI:            fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:             Identities{"../../testdata/client2"},
+		JumpHosts:            make([]*JumpHostConf, 0),
+		Insecure:             true,
+		MaxReconnectAttempts: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.ConnectWithContext(context.Background())
+	if !IsAuthError(err) {
+		t.Fatalf("expected an auth error, got %v", err)
+	}
+	if IsAuthError(nil) || IsAuthError(ErrMaxReconnectAttempts) {
+		t.Fatal("unexpected auth error")
+	}
+}
+
+func TestPassphraseProtectedIdentity(t *testing.T) {
+	sshdPort := startD(false, false, false)
+
+	// protected key without any passphrase source
+	t.Setenv("ROSPO_KEY_PASSPHRASE", "")
+	conn, err := NewSshConnection(&SshClientConf{
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:  Identities{"../../testdata/client_protected"},
+		Insecure:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.loadIdentity("../../testdata/client_protected", ""); err == nil ||
+		!strings.Contains(err.Error(), "ROSPO_KEY_PASSPHRASE") {
+		t.Fatalf("expected a passphrase required error, got %v", err)
+	}
+	if _, err := conn.loadIdentity("../../testdata/client_protected", "wrong"); err == nil {
+		t.Fatal("expected wrong passphrase to fail")
+	}
+
+	// passphrase from config
+	clientConf := &SshClientConf{
+		ServerURI:  fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Identity:   Identities{"../../testdata/client_protected"},
+		Passphrase: "rospo",
+		JumpHosts:  make([]*JumpHostConf, 0),
+		Insecure:   true,
+	}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	client.ReadyWait()
+	client.Stop()
+
+	// passphrase from env
+	t.Setenv("ROSPO_KEY_PASSPHRASE", "rospo")
+	clientConf.Passphrase = ""
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	client.ReadyWait()
+	client.Stop()
+
+	// passphrase from the prompt
+	t.Setenv("ROSPO_KEY_PASSPHRASE", "")
+	answer := "wrong"
+	prompted := []string{}
+	clientConf.PassphrasePrompt = func(keyPath string) ([]byte, error) {
+		prompted = append(prompted, keyPath)
+		return []byte(answer), nil
+	}
+	conn, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.loadIdentity("../../testdata/client_protected", ""); err == nil {
+		t.Fatal("expected wrong passphrase to fail")
+	}
+	answer = "rospo"
+	if _, err := conn.loadIdentity("../../testdata/client_protected", ""); err != nil {
+		t.Fatal(err)
+	}
+	// the decrypted key is kept in memory
+	if _, err := conn.loadIdentity("../../testdata/client_protected", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(prompted) != 2 || prompted[0] != "../../testdata/client_protected" {
+		t.Fatalf("unexpected prompts %v", prompted)
+	}
+}
+
+// startKbdInteractiveD starts a minimal ssh server that asks for a
+// password and an otp code in two keyboard interactive rounds
+func startKbdInteractiveD(t *testing.T) string {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, _ := ssh.NewSignerFromKey(hostKey)
+	config := &ssh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"Password: "}, []bool{false})
+			if err != nil || len(answers) != 1 || answers[0] != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			answers, err = client("2FA", "enter the otp code", []string{"OTP: "}, []bool{true})
+			if err != nil || len(answers) != 1 || answers[0] != "123456" {
+				return nil, errors.New("wrong otp")
+			}
+			return &ssh.Permissions{}, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestKbdInteractive(t *testing.T) {
+	addr := startKbdInteractiveD(t)
+	clientConf := &SshClientConf{
+		ServerURI: addr,
+		Identity:  Identities{"../../testdata/not_existent"},
+		Insecure:  true,
+	}
+
+	// pre seeded answers are used across the rounds
+	clientConf.KbdInteractiveAnswers = []string{"secret", "123456"}
+	client, err := NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.kbdInteractivePrompt = nil
+	if err := client.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Close()
+
+	// the prompt completes the missing answers
+	clientConf.KbdInteractiveAnswers = []string{"secret"}
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asked := []string{}
+	client.kbdInteractivePrompt = func(question string, echo bool) (string, error) {
+		if !echo {
+			t.Errorf("unexpected no echo for %s", question)
+		}
+		asked = append(asked, question)
+		return "123456", nil
+	}
+	if err := client.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	client.Client.Close()
+	if len(asked) != 1 || asked[0] != "OTP: " {
+		t.Fatalf("unexpected prompts %v", asked)
+	}
+
+	// wrong answers
+	clientConf.KbdInteractiveAnswers = []string{"secret", "000000"}
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.kbdInteractivePrompt = nil
+	if err := client.connect(context.Background()); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+
+	// disabled method
+	clientConf.KbdInteractiveAnswers = []string{"secret", "123456"}
+	clientConf.DisableKbdInteractive = true
+	client, err = NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.connect(context.Background()); err == nil {
+		t.Fatal("expected authentication to fail with the method disabled")
+	}
+}
+
+// syncBuffer is a goroutine safe log destination
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Lines() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n"))
+}
+
+func TestStructuredLogging(t *testing.T) {
+	sshdPort := startD(false, false, false)
+
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:  Identities{"../../testdata/client"},
+		Insecure:  true,
+		JumpHosts: make([]*JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	client.ReadyWait()
+	defer client.Stop()
+
+	serverAddr := fmt.Sprintf("127.0.0.1:%s", sshdPort)
+	found := false
+	for _, line := range out.Lines() {
+		record := map[string]any{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["level"] == "DEBUG" {
+			t.Fatalf("unexpected debug record with the default level: %s", line)
+		}
+		if record["msg"] != "connected to remote server" {
+			continue
+		}
+		found = true
+		if record["level"] != "INFO" {
+			t.Fatalf("unexpected level %v", record["level"])
+		}
+		if record["subsystem"] != "sshc" {
+			t.Fatalf("unexpected subsystem %v", record["subsystem"])
+		}
+		if record["remote_addr"] != serverAddr {
+			t.Fatalf("unexpected remote_addr %v", record["remote_addr"])
+		}
+	}
+	if !found {
+		t.Fatal("connected record not found")
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	if err := ValidateHostKeyAlgorithms([]string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSA}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateHostKeyAlgorithms([]string{"ssh-foo"}); err == nil {
+		t.Fatal("expected an invalid algorithm error")
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	hostKeys := map[string]ssh.PublicKey{}
+	for _, algorithm := range []string{utils.KeyAlgorithmEd25519, utils.KeyAlgorithmECDSAP256} {
+		key, _ := utils.GeneratePrivateKey(algorithm, 0)
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.AddHostKey(signer)
+		hostKeys[signer.PublicKey().Type()] = signer.PublicKey()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ssh.NewServerConn(conn, config)
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	// only the ed25519 key is known. The ecdsa one would be negotiated
+	// by default
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostKeys[ssh.KeyAlgoED25519])+"\n"), 0600)
+	preferred := preferredHostKeyAlgorithms(nil, knownHosts, addr)
+	if preferred[0] != ssh.KeyAlgoED25519 || len(preferred) != len(defaultHostKeyAlgorithms) {
+		t.Fatalf("unexpected algorithms %v", preferred)
+	}
+
+	client, err := NewSshConnection(&SshClientConf{KnownHosts: knownHosts, ServerURI: addr, Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := client.VerifyHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Type() != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected the known key type, got %s", key.Type())
+	}
+
+	// pinned algorithms
+	client, err = NewSshConnection(&SshClientConf{
+		KnownHosts:        knownHosts,
+		ServerURI:         addr,
+		Quiet:             true,
+		HostKeyAlgorithms: []string{ssh.KeyAlgoECDSA256},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = client.VerifyHostKey()
+	if key == nil || key.Type() != ssh.KeyAlgoECDSA256 {
+		t.Fatalf("expected the pinned key type, got %v", key)
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("expected a key error, got %v", err)
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	if err := ValidateAlgorithms([]string{"aes128-cbc"}, []string{"diffie-hellman-group1-sha1"}, []string{"hmac-sha1"}); err != nil {
+		t.Fatal(err)
+	}
+	err := ValidateAlgorithms(nil, []string{"diffie-hellman-foo"}, nil)
+	if err == nil || !strings.Contains(err.Error(), `"diffie-hellman-foo"`) || !strings.Contains(err.Error(), "curve25519-sha256") {
+		t.Fatalf("expected an error listing the supported key exchanges, got %v", err)
+	}
+	if err := ValidateAlgorithms([]string{"aes"}, nil, nil); err == nil {
+		t.Fatal("expected an invalid cipher error")
+	}
+
+	// a legacy server, supporting only algorithms that are not enabled
+	// by default
+	config := &ssh.ServerConfig{
+		NoClientAuth: true,
+		Config: ssh.Config{
+			Ciphers:      []string{"aes128-cbc"},
+			KeyExchanges: []string{"diffie-hellman-group1-sha1"},
+		},
+	}
+	key, _ := utils.GeneratePrivateKey(utils.KeyAlgorithmEd25519, 0)
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ssh.NewServerConn(conn, config)
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, signer.PublicKey())+"\n"), 0600)
+
+	client, err := NewSshConnection(&SshClientConf{KnownHosts: knownHosts, ServerURI: addr, Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.VerifyHostKey(); err == nil {
+		t.Fatal("expected the default algorithms to fail the handshake")
+	}
+
+	// the empty lists, as the unset flags ones, keep the defaults
+	defaults := algorithmsConfig([]string{}, []string{}, []string{})
+	if defaults.Ciphers != nil || defaults.KeyExchanges != nil || defaults.MACs != nil {
+		t.Fatalf("expected the default algorithms, got %+v", defaults)
+	}
+
+	client, err = NewSshConnection(&SshClientConf{
+		KnownHosts:   knownHosts,
+		ServerURI:    addr,
+		Quiet:        true,
+		Ciphers:      []string{"aes128-ctr", "aes128-cbc"},
+		KeyExchanges: []string{"diffie-hellman-group1-sha1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.VerifyHostKey(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPinnedCertificate(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		key, _ := utils.GeneratePrivateKey(utils.KeyAlgorithmEd25519, 0)
+		signer, err := ssh.NewSignerFromSigner(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	ca := newSigner()
+	otherCA := newSigner()
+	hostSigner := newSigner()
+
+	// starts a server presenting a host certificate signed by the
+	// authority and returns its address
+	startServer := func(authority ssh.Signer) string {
+		cert := &ssh.Certificate{
+			Key:             hostSigner.PublicKey(),
+			CertType:        ssh.HostCert,
+			ValidPrincipals: []string{"srv.example.com"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, authority); err != nil {
+			t.Fatal(err)
+		}
+		certSigner, err := ssh.NewCertSigner(cert, hostSigner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &ssh.ServerConfig{NoClientAuth: true}
+		config.AddHostKey(hostSigner)
+		config.AddHostKey(certSigner)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					go ssh.DiscardRequests(reqs)
+					for ch := range chans {
+						ch.Reject(ssh.Prohibited, "")
+					}
+					sconn.Close()
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pub")
+	os.WriteFile(caFile, []byte(utils.SerializePublicKey(ca.PublicKey())+"\n"), 0600)
+	// the plain host key is known: it must not be enough
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	connect := func(addr string, principals []string) error {
+		os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostSigner.PublicKey())+"\n"), 0600)
+		client, err := NewSshConnection(&SshClientConf{
+			KnownHosts:           knownHosts,
+			ServerURI:            addr,
+			Quiet:                true,
+			PinnedCertCA:         caFile,
+			PinnedCertPrincipals: principals,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.connect(context.Background())
+		if err == nil {
+			client.Client.Close()
+		}
+		return err
+	}
+
+	addr := startServer(ca)
+	if err := connect(addr, []string{"other.example.com", "srv.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(addr, []string{"other.example.com"}); !errors.Is(err, ErrUntrustedHost) {
+		t.Fatalf("expected a principal mismatch, got %v", err)
+	}
+	if err := connect(startServer(otherCA), []string{"srv.example.com"}); !errors.Is(err, ErrUntrustedHost) {
+		t.Fatalf("expected an authority mismatch, got %v", err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// accepts the connections but never talks
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conns := []net.Conn{}
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	client, err := NewSshConnection(&SshClientConf{
+		ServerURI:      listener.Addr().String(),
+		Insecure:       true,
+		Quiet:          true,
+		ConnectTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = client.connect(context.Background())
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "connection timed out after 200ms") {
+		t.Fatalf("unexpected error message %s", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("the timeout was not honored")
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	b := newBackoff(100*time.Millisecond, 2, time.Second)
+	expected := []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second,
+	}
+	for i, max := range expected {
+		delay := b.next()
+		if delay < max/2 || delay > max {
+			t.Fatalf("attempt %d: delay %s not in [%s, %s]", i+1, delay, max/2, max)
+		}
+		if b.attempt != i+1 {
+			t.Fatalf("unexpected attempt %d", b.attempt)
+		}
+	}
+	b.reset()
+	if delay := b.next(); delay > 100*time.Millisecond {
+		t.Fatalf("expected the initial delay after reset, got %s", delay)
+	}
+}
+
+func TestMaxReconnectAttempts(t *testing.T) {
+	// nobody listens on a closed listener port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	out := &syncBuffer{}
+	client, err := NewSshConnection(&SshClientConf{
+		ServerURI:             addr,
+		Insecure:              true,
+		ReconnectInitialDelay: 10 * time.Millisecond,
+		ReconnectMaxDelay:     50 * time.Millisecond,
+		MaxReconnectAttempts:  3,
+	}, WithLogger(slog.New(slog.NewJSONHandler(out, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- client.Start(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrMaxReconnectAttempts) {
+			t.Fatalf("expected ErrMaxReconnectAttempts, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start didn't give up")
+	}
+
+	attempts := []float64{}
+	for _, line := range out.Lines() {
+		record := map[string]any{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "error while connecting" {
+			if _, ok := record["next_delay"]; !ok {
+				t.Fatalf("missing next_delay: %s", line)
+			}
+		}
+		if attempt, ok := record["attempt"].(float64); ok {
+			attempts = append(attempts, attempt)
+		}
+	}
+	if fmt.Sprint(attempts) != "[1 2 3]" {
+		t.Fatalf("unexpected attempts %v", attempts)
+	}
+}
+
+// freezableProxy forwards the connections to target until it is frozen.
+// Then it stops forwarding without closing them, like a dead network path
+type freezableProxy struct {
+	listener net.Listener
+	frozen   atomic.Bool
+}
+
+func newFreezableProxy(t *testing.T, target string) *freezableProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &freezableProxy{listener: listener}
+	pipe := func(dst, src net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			// the frozen path drops the data
+			if p.frozen.Load() {
+				continue
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go pipe(upstream, conn)
+			go pipe(conn, upstream)
+		}
+	}()
+	return p
+}
+
+func TestKeepAliveDeadConnection(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	proxy := newFreezableProxy(t, fmt.Sprintf("127.0.0.1:%s", sshdPort))
+	defer proxy.listener.Close()
+
+	interval := 100 * time.Millisecond
+	out := &syncBuffer{}
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:           Identities{"../../testdata/client"},
+		Insecure:           true,
+		ServerURI:          proxy.listener.Addr().String(),
+		KeepAliveInterval:  &interval,
+		KeepAliveMaxMisses: 2,
+	}, WithLogger(slog.New(slog.NewJSONHandler(out, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+
+	proxy.frozen.Store(true)
+	for i := 0; i < 50 && client.IsConnected(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if client.IsConnected() {
+		t.Fatal("the dead connection was not detected")
+	}
+	misses := 0
+	for _, line := range out.Lines() {
+		record := map[string]any{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "keep alive missed" {
+			misses++
+		}
+	}
+	if misses != 2 {
+		t.Fatalf("expected 2 missed keep alive, got %d", misses)
+	}
+
+	// the client reconnects once the path is back
+	proxy.frozen.Store(false)
+	client.ReadyWait()
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	disabled := time.Duration(0)
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:          Identities{"../../testdata/client"},
+		Insecure:          true,
+		ServerURI:         fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		KeepAliveInterval: &disabled,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.keepAliveInterval != 0 {
+		t.Fatalf("expected the keep alive disabled, got %s", client.keepAliveInterval)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+	if _, _, _, err := client.Run(context.Background(), "echo ok", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, _ := NewSshConnection(&SshClientConf{ServerURI: "127.0.0.1:22"}); c.keepAliveInterval != DefaultKeepAliveInterval || c.keepAliveMaxMisses != DefaultKeepAliveMaxMisses {
+		t.Fatal("expected the keep alive defaults")
+	}
+}
+
+func TestExpandProxyCommand(t *testing.T) {
+	got := expandProxyCommand("connect-proxy -S proxy:%p %h %p %r 100%% %x%", "example.com", 22, "rospo")
+	if got != "connect-proxy -S proxy:22 example.com 22 rospo 100% %x%" {
+		t.Fatalf("unexpected command %q", got)
+	}
+	if got := expandProxyCommand("ssh -l %u bastion", "example.com", 22, "rospo"); got != "ssh -l "+utils.CurrentUser().Username+" bastion" {
+		t.Fatalf("unexpected command %q", got)
+	}
+}
+
+// TestProxyCommandHelper is the proxy command run by TestProxyCommand. It
+// connects its stdio to the host and port args
+func TestProxyCommandHelper(t *testing.T) {
+	spawnsFile := os.Getenv("ROSPO_TEST_PROXY_SPAWNS")
+	if spawnsFile == "" {
+		return
+	}
+	args := flag.Args()
+	f, _ := os.OpenFile(spawnsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	f.WriteString("spawn\n")
+	f.Close()
+	fmt.Fprintf(os.Stderr, "proxying to %s:%s\n", args[0], args[1])
+	conn, err := net.Dial("tcp", net.JoinHostPort(args[0], args[1]))
+	if err != nil {
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		os.Exit(0)
+	}()
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestProxyCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the proxy command is run by /bin/sh")
+	}
+	sshdPort := startD(false, false, false)
+	spawnsFile := filepath.Join(t.TempDir(), "spawns")
+	t.Setenv("ROSPO_TEST_PROXY_SPAWNS", spawnsFile)
+	spawns := func() int {
+		data, _ := os.ReadFile(spawnsFile)
+		return strings.Count(string(data), "spawn\n")
+	}
+
+	out := &syncBuffer{}
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:     Identities{"../../testdata/client"},
+		Insecure:     true,
+		ServerURI:    "127.0.0.1:" + sshdPort,
+		ProxyCommand: os.Args[0] + " -test.run=TestProxyCommandHelper -- %h %p",
+	}, WithLogger(slog.New(slog.NewJSONHandler(out, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+
+	stdout, _, _, err := client.Run(context.Background(), "echo through the proxy", nil)
+	if err != nil || strings.TrimSpace(string(stdout)) != "through the proxy" {
+		t.Fatalf("unexpected output %q %v", stdout, err)
+	}
+	if spawns() != 1 {
+		t.Fatalf("expected 1 proxy command, got %d", spawns())
+	}
+	found := false
+	for _, line := range out.Lines() {
+		if bytes.Contains(line, []byte("proxying to 127.0.0.1:"+sshdPort)) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("the proxy command stderr was not logged")
+	}
+
+	// the command is run again on reconnect
+	client.clientMU.Lock()
+	client.Client.Close()
+	client.clientMU.Unlock()
+	for i := 0; spawns() < 2 || !client.IsConnected(); i++ {
+		if i == 100 {
+			t.Fatalf("not reconnected, %d proxy commands", spawns())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProxyCommandNotSsh(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the proxy command is run by /bin/sh")
+	}
+	marker := filepath.Join(t.TempDir(), "started")
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:             Identities{"../../testdata/client"},
+		Insecure:             true,
+		ServerURI:            "rospo@example.com:2222",
+		MaxReconnectAttempts: 1,
+		// the output reaches the handshake, that fails on it. The command
+		// is exec'ed: the list needs its own shell
+		ProxyCommand: "sh -c 'echo %r@%h:%p %u > " + marker + "; echo not an ssh server | cat'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+	err = client.ConnectWithContext(context.Background())
+	if err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+	if !strings.Contains(err.Error(), "handshake") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	data, _ := os.ReadFile(marker)
+	if want := "rospo@example.com:2222 " + utils.CurrentUser().Username; strings.TrimSpace(string(data)) != want {
+		t.Fatalf("the proxy command got %q, want %q", data, want)
+	}
+}
+
+func TestProxyCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the proxy command is run by /bin/sh")
+	}
+	// the command never talks
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	client, err := NewSshConnection(&SshClientConf{
+		ServerURI:      "example.com:2222",
+		Insecure:       true,
+		Quiet:          true,
+		ConnectTimeout: 200 * time.Millisecond,
+		ProxyCommand:   "sh -c 'echo $$ > " + pidFile + "; exec sleep 30'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = client.connect(context.Background())
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("the timeout was not honored")
+	}
+
+	// the command is killed
+	data, _ := os.ReadFile(pidFile)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("unexpected pid %q", data)
+	}
+	proc, _ := os.FindProcess(pid)
+	for i := 0; proc.Signal(syscall.Signal(0)) == nil; i++ {
+		if i == 50 {
+			t.Fatal("the proxy command is still running")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// canceling ctx kills the command
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := startProxyCommand(ctx, "cat", client.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cancel()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the command stdout to be closed, got %v", err)
+	}
+	if _, err := startProxyCommand(ctx, "sleep 30", client.log); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the command not to start, got %v", err)
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	remotes := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			remotes <- conn.RemoteAddr().String()
+			conn.Close()
+		}
+	}()
+
+	connect := func(bindAddress string) error {
+		client, err := NewSshConnection(&SshClientConf{
+			Identity:             Identities{"../../testdata/client"},
+			Insecure:             true,
+			ServerURI:            listener.Addr().String(),
+			MaxReconnectAttempts: 1,
+			BindAddress:          bindAddress,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Stop()
+		return client.ConnectWithContext(context.Background())
+	}
+
+	// the server closes the connection, after the dial from the address
+	if err := connect("127.0.0.1"); err == nil || strings.Contains(err.Error(), "bind address") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if host, _, _ := net.SplitHostPort(<-remotes); host != "127.0.0.1" {
+		t.Fatalf("the connection came from %s", host)
+	}
+
+	// 192.0.2.0/24 is reserved for the documentation
+	err = connect("192.0.2.1")
+	if err == nil || !strings.Contains(err.Error(), "not assigned to any local interface") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	select {
+	case remote := <-remotes:
+		t.Fatalf("unexpected connection from %s", remote)
+	default:
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := "localhost, .internal.example.com,10.0.0.0/8,[::1]:22,192.168.1.1"
+	cases := map[string]bool{
+		"localhost":               true,
+		"LOCALHOST":               true,
+		"internal.example.com":    true,
+		"db.internal.example.com": true,
+		"example.com":             false,
+		"10.1.2.3":                true,
+		"11.1.2.3":                false,
+		"[::1]":                   true,
+		"192.168.1.1":             true,
+		"192.168.1.2":             false,
+	}
+	for host, expected := range cases {
+		if bypassProxy(noProxy, host) != expected {
+			t.Fatalf("unexpected bypass for %s", host)
+		}
+	}
+	if !bypassProxy("*", "example.com") || bypassProxy("", "example.com") {
+		t.Fatal("unexpected bypass")
+	}
+}
+
+// startSocks5 starts a SOCKS5 server requiring the user:pass credentials.
+// It returns its address and the number of proxied connections
+func startSocks5(t *testing.T) (string, *atomic.Int32) {
+	dials := &atomic.Int32{}
+	server, _ := socks.New(&socks.Config{
+		Credentials: socks.StaticCredentials{"user": "pass"},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+	return listener.Addr().String(), dials
+}
+
+func TestSocks5Proxy(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	proxyAddr, dials := startSocks5(t)
+
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:  Identities{"../../testdata/client"},
+		Insecure:  true,
+		ServerURI: "127.0.0.1:" + sshdPort,
+		Proxy:     "socks5://user:pass@" + proxyAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+
+	stdout, _, _, err := client.Run(context.Background(), "echo through the proxy", nil)
+	if err != nil || strings.TrimSpace(string(stdout)) != "through the proxy" {
+		t.Fatalf("unexpected output %q %v", stdout, err)
+	}
+	if dials.Load() != 1 {
+		t.Fatalf("expected 1 proxied connection, got %d", dials.Load())
+	}
+
+	// the proxy failures are told apart
+	badAuth, err := NewSshConnection(&SshClientConf{
+		Identity:  Identities{"../../testdata/client"},
+		Insecure:  true,
+		ServerURI: "127.0.0.1:" + sshdPort,
+		Proxy:     "socks5://user:wrong@" + proxyAddr,
+	}, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = badAuth.dial(context.Background(), "127.0.0.1:"+sshdPort, "")
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) {
+		t.Fatalf("expected a proxy error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("the proxy password was not redacted: %s", err)
+	}
+}
+
+func TestEnvironmentProxy(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	proxyAddr, dials := startSocks5(t)
+	t.Setenv("ALL_PROXY", "socks5://user:pass@"+proxyAddr)
+	t.Setenv("NO_PROXY", "")
+
+	newClient := func() *SshConnection {
+		client, err := NewSshConnection(&SshClientConf{
+			Identity:  Identities{"../../testdata/client"},
+			Insecure:  true,
+			ServerURI: "127.0.0.1:" + sshdPort,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	conn, err := newClient().dial(context.Background(), "127.0.0.1:"+sshdPort, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if dials.Load() != 1 {
+		t.Fatalf("ALL_PROXY was not used")
+	}
+
+	t.Setenv("NO_PROXY", "127.0.0.0/8")
+	conn, err = newClient().dial(context.Background(), "127.0.0.1:"+sshdPort, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if dials.Load() != 1 {
+		t.Fatalf("NO_PROXY was not honored")
+	}
+}
+
+// startHTTPProxy starts an HTTP CONNECT proxy requiring the user:pass
+// basic auth. It returns its address and the CONNECT targets
+func startHTTPProxy(t *testing.T) (string, func() []string) {
+	var mu sync.Mutex
+	targets := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		mu.Lock()
+		targets = append(targets, r.Host)
+		mu.Unlock()
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		buf.Flush()
+		go func() {
+			io.Copy(target, buf)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, targets...)
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	serverAddr := "127.0.0.1:" + sshdPort
+	proxyAddr, targets := startHTTPProxy(t)
+
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:  Identities{"../../testdata/client"},
+		Insecure:  true,
+		ServerURI: serverAddr,
+		Proxy:     "http://user:pass@" + proxyAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+
+	stdout, _, _, err := client.Run(context.Background(), "echo through the proxy", nil)
+	if err != nil || strings.TrimSpace(string(stdout)) != "through the proxy" {
+		t.Fatalf("unexpected output %q %v", stdout, err)
+	}
+	if got := targets(); len(got) != 1 || got[0] != serverAddr {
+		t.Fatalf("unexpected CONNECT targets %v", got)
+	}
+
+	// the CONNECT is made again on reconnect
+	client.clientMU.Lock()
+	client.Client.Close()
+	client.clientMU.Unlock()
+	for i := 0; len(targets()) < 2 || !client.IsConnected(); i++ {
+		if i == 100 {
+			t.Fatalf("not reconnected, CONNECT targets %v", targets())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the refused CONNECT error has the proxy status line
+	badAuth, err := NewSshConnection(&SshClientConf{
+		Identity:  Identities{"../../testdata/client"},
+		Insecure:  true,
+		ServerURI: serverAddr,
+		Proxy:     "http://user:wrong@" + proxyAddr,
+	}, WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = badAuth.dial(context.Background(), serverAddr, "")
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) || !strings.Contains(err.Error(), "HTTP/1.1 407 Proxy Authentication Required") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestHTTPProxyJumpHost(t *testing.T) {
+	jumpPort := startD(false, false, false)
+	sshdPort := startD(false, false, false)
+	proxyAddr, targets := startHTTPProxy(t)
+
+	client, err := NewSshConnection(&SshClientConf{
+		Identity: Identities{"../../testdata/client"},
+		Insecure: true,
+		JumpHosts: []*JumpHostConf{{
+			URI:      "127.0.0.1:" + jumpPort,
+			Identity: Identities{"../../testdata/client"},
+		}},
+		ServerURI: "127.0.0.1:" + sshdPort,
+		Proxy:     "http://user:pass@" + proxyAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+
+	// only the first hop is proxied, the server is reached through it
+	if got := targets(); len(got) != 1 || got[0] != "127.0.0.1:"+jumpPort {
+		t.Fatalf("unexpected CONNECT targets %v", got)
+	}
+	stdout, _, _, err := client.Run(context.Background(), "echo through the jump host", nil)
+	if err != nil || strings.TrimSpace(string(stdout)) != "through the jump host" {
+		t.Fatalf("unexpected output %q %v", stdout, err)
+	}
+}
+
+func TestLookupSshConfig(t *testing.T) {
+	path := "../../testdata/ssh_config/config"
+	tests := []struct {
+		host string
+		user string
+		want SshConfigHost
+	}{
+		{
+			host: "web",
+			want: SshConfigHost{
+				HostName:      "127.0.0.1",
+				Port:          2201,
+				User:          "deploy",
+				IdentityFiles: []string{"~/.ssh/web_key", "~/.ssh/id_default"},
+			},
+		},
+		{
+			// Match host is checked against the HostName
+			host: "db",
+			want: SshConfigHost{
+				HostName:           "db.internal.example.com",
+				Port:               2022,
+				User:               "dbadmin",
+				IdentityFiles:      []string{"~/.ssh/id_default"},
+				ProxyJump:          []string{"bastion"},
+				UserKnownHostsFile: "~/.ssh/internal_known_hosts",
+			},
+		},
+		{
+			host: "tunneled",
+			want: SshConfigHost{
+				HostName:      "tunneled.example.com",
+				User:          "everybody",
+				IdentityFiles: []string{"~/.ssh/id_default"},
+				ProxyCommand:  `nc -X connect -x "proxy:3128" %h %p`,
+			},
+		},
+		{
+			host: "app.corp",
+			want: SshConfigHost{
+				User:                  "corp",
+				StrictHostKeyChecking: "no",
+				IdentityFiles:         []string{"~/.ssh/id_default"},
+			},
+		},
+		{
+			// negated by the Host line, matched by Match originalhost and user
+			host: "legacy.corp",
+			user: "admin",
+			want: SshConfigHost{
+				Port:          2323,
+				User:          "everybody",
+				IdentityFiles: []string{"~/.ssh/id_default"},
+			},
+		},
+		{
+			host: "legacy.corp",
+			want: SshConfigHost{
+				User:          "everybody",
+				IdentityFiles: []string{"~/.ssh/id_default"},
+			},
+		},
+		{
+			host: "included",
+			want: SshConfigHost{
+				HostName:      "included.example.com",
+				Port:          2200,
+				User:          "everybody",
+				IdentityFiles: []string{"~/.ssh/id_default"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := LookupSshConfig(path, tt.host, tt.user)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.host, err)
+		}
+		if fmt.Sprintf("%+v", *got) != fmt.Sprintf("%+v", tt.want) {
+			t.Errorf("%s@%s:\n got %+v\nwant %+v", tt.user, tt.host, *got, tt.want)
+		}
+	}
+
+	if _, err := LookupSshConfig("../../testdata/ssh_config/missing", "web", ""); err == nil {
+		t.Error("expected an error for a missing config")
+	}
+}
+
+func TestWithSshConfig(t *testing.T) {
+	path := "../../testdata/ssh_config/config"
+	home := utils.CurrentUser().HomeDir
+	username := utils.CurrentUser().Username
+
+	tests := []struct {
+		name string
+		conf SshClientConf
+		want SshClientConf
+	}{
+		{
+			name: "alias",
+			conf: SshClientConf{ServerURI: "web", SshConfigFile: path},
+			want: SshClientConf{
+				ServerURI: "deploy@127.0.0.1:2201",
+				Identity:  Identities{home + "/.ssh/web_key", home + "/.ssh/id_default"},
+			},
+		},
+		{
+			name: "explicit values win",
+			conf: SshClientConf{
+				ServerURI:     "root@web:2000",
+				Identity:      Identities{"~/.ssh/mine"},
+				KnownHosts:    "~/.ssh/known_hosts",
+				SshConfigFile: path,
+			},
+			want: SshClientConf{
+				ServerURI:  "root@127.0.0.1:2000",
+				Identity:   Identities{"~/.ssh/mine", home + "/.ssh/web_key", home + "/.ssh/id_default"},
+				KnownHosts: "~/.ssh/known_hosts",
+			},
+		},
+		{
+			name: "proxy jump",
+			conf: SshClientConf{ServerURI: "db", SshConfigFile: path},
+			want: SshClientConf{
+				ServerURI:  "dbadmin@db.internal.example.com:2022",
+				Identity:   Identities{home + "/.ssh/id_default"},
+				KnownHosts: home + "/.ssh/internal_known_hosts",
+				JumpHosts: []*JumpHostConf{
+					{
+						URI:      "jump@bastion.example.com:2222",
+						Identity: Identities{home + "/.ssh/bastion_jump", home + "/.ssh/id_default"},
+					},
+				},
+			},
+		},
+		{
+			name: "proxy command",
+			conf: SshClientConf{ServerURI: "tunneled", SshConfigFile: path},
+			want: SshClientConf{
+				ServerURI:    "everybody@tunneled.example.com:22",
+				Identity:     Identities{home + "/.ssh/id_default"},
+				ProxyCommand: `nc -X connect -x "proxy:3128" %h %p`,
+			},
+		},
+		{
+			name: "explicit proxy wins",
+			conf: SshClientConf{ServerURI: "tunneled", SshConfigFile: path, Proxy: "socks5://localhost:1080"},
+			want: SshClientConf{
+				ServerURI: "everybody@tunneled.example.com:22",
+				Identity:  Identities{home + "/.ssh/id_default"},
+				Proxy:     "socks5://localhost:1080",
+			},
+		},
+		{
+			name: "dotted host not looked up",
+			conf: SshClientConf{ServerURI: "app.corp", SshConfigFile: path},
+			want: SshClientConf{ServerURI: "app.corp"},
+		},
+		{
+			name: "dotted host enabled explicitly",
+			conf: SshClientConf{ServerURI: "app.corp", SshConfigFile: path, UseSshConfig: true},
+			want: SshClientConf{
+				ServerURI: "corp@app.corp:22",
+				Identity:  Identities{home + "/.ssh/id_default"},
+				Insecure:  true,
+			},
+		},
+		{
+			name: "host not named by the config",
+			conf: SshClientConf{ServerURI: "other", SshConfigFile: path},
+			want: SshClientConf{ServerURI: "other"},
+		},
+		{
+			name: "wildcards only",
+			conf: SshClientConf{ServerURI: "other", SshConfigFile: path, UseSshConfig: true},
+			want: SshClientConf{
+				ServerURI: "everybody@other:22",
+				Identity:  Identities{home + "/.ssh/id_default"},
+			},
+		},
+		{
+			name: "missing default config",
+			conf: SshClientConf{ServerURI: "web", SshConfigFile: "../../testdata/ssh_config/missing"},
+			want: SshClientConf{ServerURI: "web"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.conf.withSshConfig()
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		tt.want.SshConfigFile = tt.conf.SshConfigFile
+		tt.want.UseSshConfig = tt.conf.UseSshConfig
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(tt.want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, gotJSON, wantJSON)
+		}
+	}
+
+	// the current user is the default one
+	conf := SshClientConf{ServerURI: "included", SshConfigFile: "../../testdata/ssh_config/conf.d/extra.conf"}
+	got, err := conf.withSshConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ServerURI != username+"@included.example.com:2200" {
+		t.Errorf("unexpected server uri %s", got.ServerURI)
+	}
+}
+
+func TestSshConfigConnect(t *testing.T) {
+	sshdPort := startD(false, false, false)
+
+	path := filepath.Join(t.TempDir(), "config")
+	config := fmt.Sprintf(`Host rospo-test
+    HostName 127.0.0.1
+    Port %s
+    IdentityFile ../../testdata/client
+    StrictHostKeyChecking no
+`, sshdPort)
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewSshConnection(&SshClientConf{
+		ServerURI:     "rospo-test",
+		SshConfigFile: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+
+	stdout, _, _, err := client.Run(context.Background(), "echo through the alias", nil)
+	if err != nil || strings.TrimSpace(string(stdout)) != "through the alias" {
+		t.Fatalf("unexpected output %q %v", stdout, err)
+	}
+}
+
+func TestConnectionEvents(t *testing.T) {
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sshdAddr := sd.GetListenerAddr().String()
+
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:              Identities{"../../testdata/client"},
+		Insecure:              true,
+		ServerURI:             sshdAddr,
+		ReconnectInitialDelay: 50 * time.Millisecond,
+		ReconnectMaxDelay:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := client.Subscribe()
+	other := client.Subscribe()
+
+	next := func(events <-chan ConnectionEvent, want ConnectionEventType) ConnectionEvent {
+		t.Helper()
+		for {
+			select {
+			case e := <-events:
+				// the reconnecting events repeat until the server is back
+				if e.Type == EventReconnecting && want != EventReconnecting {
+					continue
+				}
+				if e.Type != want {
+					t.Fatalf("expected a %s event, got %s (%v)", want, e.Type, e.Err)
+				}
+				return e
+			case <-time.After(10 * time.Second):
+				t.Fatalf("no %s event", want)
+			}
+		}
+	}
+
+	go client.Start(context.Background())
+	next(events, EventConnected)
+	next(other, EventConnected)
+	client.Unsubscribe(other)
+	if _, ok := <-other; ok {
+		t.Fatal("expected the unsubscribed channel to be closed")
+	}
+
+	sd.Stop()
+	if e := next(events, EventDisconnected); e.Err == nil {
+		t.Fatal("expected the disconnect error")
+	}
+	e := next(events, EventReconnecting)
+	if e.Attempt != 1 {
+		t.Fatalf("unexpected attempt %d", e.Attempt)
+	}
+	e = next(events, EventReconnecting)
+	if e.Attempt != 2 || e.Err == nil {
+		t.Fatalf("unexpected reconnecting event %+v", e)
+	}
+
+	serverConf.ListenAddress = sshdAddr
+	sd, err = sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+	next(events, EventConnected)
+
+	client.Stop()
+	next(events, EventDisconnected)
+	next(events, EventStopped)
+}
+
+func TestConnectionEventsSlowSubscriber(t *testing.T) {
+	client, err := NewSshConnection(&SshClientConf{ServerURI: "127.0.0.1:22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := client.Subscribe()
+
+	for i := 0; i < connectionEventsBuffer+5; i++ {
+		client.emit(ConnectionEvent{Type: EventReconnecting, Attempt: i + 1})
+	}
+	for i := 0; i < connectionEventsBuffer; i++ {
+		e := <-events
+		if e.Attempt != i+1 || e.Dropped != 0 {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+	client.emit(ConnectionEvent{Type: EventConnected})
+	if e := <-events; e.Type != EventConnected || e.Dropped != 5 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	client.emit(ConnectionEvent{Type: EventDisconnected})
+	if e := <-events; e.Dropped != 0 {
+		t.Fatalf("unexpected dropped count %d", e.Dropped)
+	}
+}
+
+func TestConnState(t *testing.T) {
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sshdAddr := sd.GetListenerAddr().String()
+
+	out := &syncBuffer{}
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:              Identities{"../../testdata/client"},
+		Insecure:              true,
+		ServerURI:             sshdAddr,
+		ReconnectInitialDelay: 50 * time.Millisecond,
+		ReconnectMaxDelay:     100 * time.Millisecond,
+	}, WithLogger(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.State() != ConnStateIdle || client.LastError() != nil || !client.ConnectedSince().IsZero() {
+		t.Fatalf("unexpected initial state %s", client.State())
+	}
+
+	waitState := func(want ConnState) {
+		t.Helper()
+		for i := 0; i < 100 && client.State() != want; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if state := client.State(); state != want {
+			t.Fatalf("expected the %s state, got %s", want, state)
+		}
+	}
+
+	before := time.Now()
+	go client.Start(context.Background())
+	waitState(ConnStateConnected)
+	if client.ConnectedSince().Before(before) {
+		t.Fatalf("unexpected connected since %s", client.ConnectedSince())
+	}
+
+	sd.Stop()
+	waitState(ConnStateReconnecting)
+	if client.LastError() == nil || !client.ConnectedSince().IsZero() {
+		t.Fatalf("unexpected reconnecting state, error %v since %s", client.LastError(), client.ConnectedSince())
+	}
+
+	serverConf.ListenAddress = sshdAddr
+	sd, err = sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+	waitState(ConnStateConnected)
+	if client.LastError() == nil {
+		t.Fatal("expected the last error to be kept")
+	}
+
+	client.Stop()
+	waitState(ConnStateStopped)
+
+	states := []string{}
+	for _, line := range out.Lines() {
+		record := map[string]any{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == "connection state changed" {
+			states = append(states, record["state"].(string))
+		}
+	}
+	expected := []string{"connecting", "connected", "reconnecting", "connected", "stopped"}
+	if strings.Join(states, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected states sequence %v", states)
+	}
+}
+
+func TestStopWhileReconnecting(t *testing.T) {
+	// nobody listens on a closed listener port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	client, err := NewSshConnection(&SshClientConf{
+		ServerURI: addr,
+		Insecure:  true,
+		// the loop would sleep long before the next attempt
+		ReconnectInitialDelay: time.Hour,
+		ReconnectMaxDelay:     time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Start(context.Background())
+	}()
+	ready := make(chan error, 1)
+	go func() {
+		ready <- client.ReadyWait()
+	}()
+	for client.LastError() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected Start error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Stop")
+	}
+	select {
+	case err := <-ready:
+		if !errors.Is(err, ErrConnectionStopped) {
+			t.Fatalf("expected ErrConnectionStopped, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadyWait didn't return after Stop")
+	}
+	// a second call is a noop
+	client.Stop()
+	if err := client.ReadyWait(); !errors.Is(err, ErrConnectionStopped) {
+		t.Fatalf("expected ErrConnectionStopped, got %v", err)
+	}
+}
+
+func TestStopRestart(t *testing.T) {
+	sshdPort := startD(false, false, false)
+	client, err := NewSshConnection(&SshClientConf{
+		Identity:  Identities{"../../testdata/client"},
+		Insecure:  true,
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := client.ConnectWithContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		stdout, _, _, err := client.Run(context.Background(), "echo hello", nil)
+		if err != nil || strings.TrimSpace(string(stdout)) != "hello" {
+			t.Fatalf("unexpected output %q, error %v", stdout, err)
+		}
+		sshClient := client.Client
+
+		client.Stop()
+		if client.State() != ConnStateStopped {
+			t.Fatalf("expected the stopped state, got %s", client.State())
+		}
+		// the closed client doesn't open channels
+		if _, err := sshClient.NewSession(); err == nil {
+			t.Fatal("expected the client to be closed")
+		}
+		if err := client.ReadyWait(); !errors.Is(err, ErrConnectionStopped) {
+			t.Fatalf("expected ErrConnectionStopped, got %v", err)
+		}
+	}
+}
+
+func TestSftpTransferCopyTo(t *testing.T) {
+	transfers := make([]*SftpTransfer, 2)
+	for i := range transfers {
+		sshdPort := startD(false, false, false)
+		client, err := NewSshConnection(&SshClientConf{
+			ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+			Identity:  Identities{"../../testdata/client"},
+			JumpHosts: make([]*JumpHostConf, 0),
+			Insecure:  true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Start(context.Background())
+		defer client.Stop()
+		transfer, err := NewSftpTransfer(client, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer transfer.Close()
+		transfers[i] = transfer
+	}
+	src, dst := transfers[0], transfers[1]
+
+	// the test servers share the local filesystem
+	srcDir := filepath.Join(t.TempDir(), "data")
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0700)
+	os.MkdirAll(filepath.Join(srcDir, "other"), 0700)
+	os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("a content"), 0600)
+	os.WriteFile(filepath.Join(srcDir, "sub", "b.txt"), []byte("b content"), 0600)
+	os.WriteFile(filepath.Join(srcDir, "other", "c.txt"), []byte("c content"), 0600)
+	mtime := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	os.Chtimes(filepath.Join(srcDir, "a.txt"), mtime, mtime)
+
+	dstDir := t.TempDir()
+	if err := src.CopyTo(dst, srcDir, dstDir, false); err == nil {
+		t.Fatal("expected the directory to be refused without recursive")
+	}
+	// a file in the way of the sub directory fails its copy only
+	os.MkdirAll(filepath.Join(dstDir, "data"), 0700)
+	os.WriteFile(filepath.Join(dstDir, "data", "sub"), nil, 0600)
+
+	src.SetBandwidthLimit(1000 * 1000)
+	err := src.CopyTo(dst, srcDir, dstDir, true)
+	var failed TransferErrors
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected the failed files, got %v", err)
+	}
+	if len(failed) != 1 || failed[0].Path != filepath.Join(srcDir, "sub") {
+		t.Fatalf("unexpected failed files %v", failed)
+	}
+	for _, name := range []string{"a.txt", filepath.Join("other", "c.txt")} {
+		got, err := os.ReadFile(filepath.Join(dstDir, "data", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(got), " content") {
+			t.Fatalf("unexpected content of %s: %s", name, got)
+		}
+	}
+	if info, _ := os.Stat(filepath.Join(dstDir, "data", "a.txt")); !info.ModTime().Equal(mtime) {
+		t.Fatalf("the modification time was not preserved")
+	}
+
+	// a single file into an existing directory
+	if err := src.CopyTo(dst, filepath.Join(srcDir, "sub", "b.txt"), dstDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dstDir, "b.txt")); string(got) != "b content" {
+		t.Fatalf("unexpected content %s", got)
+	}
+}
+
+// startAgentForwardServer starts a server answering each exec request with
+// the number of keys of the forwarded agent. It returns its address, its
+// host key and the server connections
+func startAgentForwardServer(t *testing.T) (string, ssh.PublicKey, chan *ssh.ServerConn) {
+	key, _ := utils.GeneratePrivateKey(utils.KeyAlgorithmEd25519, 0)
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	conns := make(chan *ssh.ServerConn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			conns <- sshConn
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				for newChannel := range chans {
+					channel, reqs, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						forwarding := false
+						for req := range reqs {
+							switch req.Type {
+							case "auth-agent-req@openssh.com":
+								forwarding = true
+								req.Reply(true, nil)
+							case "exec":
+								req.Reply(true, nil)
+								result := "no agent"
+								if forwarding {
+									agentChannel, agentReqs, err := sshConn.OpenChannel(agentChannelType, nil)
+									if err != nil {
+										result = err.Error()
+									} else {
+										go ssh.DiscardRequests(agentReqs)
+										keys, err := agent.NewClient(agentChannel).List()
+										result = fmt.Sprintf("%d keys %v", len(keys), err)
+										agentChannel.Close()
+									}
+								}
+								fmt.Fprint(channel, result)
+								channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+								channel.Close()
+							default:
+								req.Reply(false, nil)
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), signer.PublicKey(), conns
+}
+
+func TestForwardAgent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test agent listens on a unix socket")
+	}
+	socket := startAgent(t, "../../testdata/client")
+	addr, hostKey, conns := startAgentForwardServer(t)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostKey)+"\n"), 0600)
+
+	run := func(conf *SshClientConf) (string, *ssh.ServerConn) {
+		conf.ServerURI = addr
+		conf.AgentSocket = socket
+		conf.JumpHosts = make([]*JumpHostConf, 0)
+		conf.Quiet = true
+		client, err := NewSshConnection(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Start(context.Background())
+		t.Cleanup(client.Stop)
+		stdout, _, _, err := client.Run(context.Background(), "keys", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(stdout), <-conns
+	}
+
+	// off by default
+	if out, _ := run(&SshClientConf{KnownHosts: knownHosts}); out != "no agent" {
+		t.Fatalf("unexpected result %q", out)
+	}
+	// refused to the servers whose key is not verified
+	if out, _ := run(&SshClientConf{Insecure: true, ForwardAgent: true}); out != "no agent" {
+		t.Fatalf("unexpected result %q", out)
+	}
+	if out, _ := run(&SshClientConf{Insecure: true, ForwardAgent: true, ForwardAgentInsecure: true}); out != "1 keys <nil>" {
+		t.Fatalf("unexpected result %q", out)
+	}
+
+	out, serverConn := run(&SshClientConf{KnownHosts: knownHosts, ForwardAgent: true})
+	if out != "1 keys <nil>" {
+		t.Fatalf("unexpected result %q", out)
+	}
+	// the agent is not reachable once the session is closed
+	if _, _, err := serverConn.OpenChannel(agentChannelType, nil); err == nil {
+		t.Fatal("expected the agent channel to be rejected")
+	}
+}
+
+// startCertServer starts a server accepting the user certificates signed
+// by ca only. The types of the keys offered by the clients are sent to
+// the returned channel
+func startCertServer(t *testing.T, ca ssh.PublicKey) (string, chan string) {
+	key, _ := utils.GeneratePrivateKey(utils.KeyAlgorithmEd25519, 0)
+	signer, err := ssh.NewSignerFromSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offered := make(chan string, 16)
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool { return keyEqual(auth, ca) },
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			offered <- key.Type()
+			return checker.Authenticate(conn, key)
+		},
+	}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				defer sshConn.Close()
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					newChannel.Reject(ssh.Prohibited, "no channels")
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), offered
+}
+
+// writeUserCert writes the identityPath public key certificate, signed by
+// ca, to path
+func writeUserCert(t *testing.T, ca ssh.Signer, identityPath string, path string, validBefore time.Time) {
+	signer, err := utils.LoadIdentitySigner(identityPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "tester",
+		ValidPrincipals: []string{"tester"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserCertificate(t *testing.T) {
+	caKey, _ := utils.GeneratePrivateKey(utils.KeyAlgorithmEd25519, 0)
+	ca, err := ssh.NewSignerFromSigner(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, offered := startCertServer(t, ca.PublicKey())
+
+	dir := t.TempDir()
+	identity := filepath.Join(dir, "id_ed25519")
+	key, _ := utils.GeneratePrivateKey(utils.KeyAlgorithmEd25519, 0)
+	encoded, err := utils.EncodePrivateKeyToPEM(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.WriteKeyToFile(encoded, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := func(conf *SshClientConf) error {
+		conf.ServerURI = "tester@" + addr
+		conf.Insecure = true
+		conf.Quiet = true
+		conf.JumpHosts = make([]*JumpHostConf, 0)
+		conf.MaxReconnectAttempts = 1
+		client, err := NewSshConnection(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Stop()
+		return client.ConnectWithContext(context.Background())
+	}
+	drain := func() []string {
+		types := []string{}
+		for {
+			select {
+			case k := <-offered:
+				types = append(types, k)
+			default:
+				return types
+			}
+		}
+	}
+
+	// the plain key alone is rejected
+	if err := connect(&SshClientConf{Identity: Identities{identity}}); err == nil {
+		t.Fatal("expected the plain key to be rejected")
+	}
+	drain()
+
+	// the <identity>-cert.pub certificate is found and offered first
+	writeUserCert(t, ca, identity, identity+certSuffix, time.Now().Add(time.Hour))
+	if err := connect(&SshClientConf{Identity: Identities{identity}}); err != nil {
+		t.Fatal(err)
+	}
+	if types := drain(); len(types) == 0 || types[0] != ssh.CertAlgoED25519v01 {
+		t.Fatalf("unexpected offered keys %v", types)
+	}
+	os.Remove(identity + certSuffix)
+
+	// an explicit certificate file
+	certFile := filepath.Join(dir, "tester.cert")
+	writeUserCert(t, ca, identity, certFile, time.Now().Add(time.Hour))
+	if err := connect(&SshClientConf{Identity: Identities{identity}, CertificateFile: certFile}); err != nil {
+		t.Fatal(err)
+	}
+	drain()
+
+	// the expired certificate fails before being offered
+	writeUserCert(t, ca, identity, certFile, time.Now().Add(-time.Minute))
+	err = connect(&SshClientConf{Identity: Identities{identity}, CertificateFile: certFile})
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expected an expired certificate error, got %v", err)
+	}
+	if types := drain(); len(types) != 0 {
+		t.Fatalf("the keys %v were offered", types)
+	}
+
+	// the certificate must be of one of the identities
+	other := filepath.Join(dir, "other.cert")
+	writeUserCert(t, ca, "../../testdata/client", other, time.Now().Add(time.Hour))
+	err = connect(&SshClientConf{Identity: Identities{identity}, CertificateFile: other})
+	if err == nil || !strings.Contains(err.Error(), "doesn't certify") {
+		t.Fatalf("expected a certificate mismatch error, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package sshd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// the exit status sent to the client when its command is not allowed
+const deniedCommandExitStatus = 126
+
+// ValidateAllowedCommands returns an error if any of the patterns is not
+// a valid path.Match glob
+func ValidateAllowedCommands(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// isAllowedCommand reports if the executable matches one of the patterns
+func isAllowedCommand(patterns []string, executable string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, executable); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCommand splits the command line into its arguments like a posix
+// shell does with the quotes and the backslashes. Nothing else is
+// interpreted: the other shell metacharacters are plain chars
+func splitCommand(command string) ([]string, error) {
+	args := []string{}
+	var (
+		arg     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\\':
+			// inside the double quotes the backslash only escapes some
+			// chars, it is enough for the command arguments
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
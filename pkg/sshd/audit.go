@@ -0,0 +1,286 @@
+package sshd
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The audit events
+const (
+	AuditAuthSuccess        = "auth_success"
+	AuditAuthFailure        = "auth_failure"
+	AuditForwardStarted     = "forward_started"
+	AuditForwardStopped     = "forward_stopped"
+	AuditExecRequest        = "exec_request"
+	AuditShellOpened        = "shell_opened"
+	AuditClientDisconnected = "client_disconnected"
+)
+
+// the audit entries queued before the writes become synchronous
+const auditQueueSize = 1024
+
+// the journald native protocol socket
+const journaldSocket = "/run/systemd/journal/socket"
+
+// AuditEntry is an audit log line. Each entry is linked to the previous
+// one by its HMAC, computed over the entry json without the hmac field
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Seq        uint64    `json:"seq"`
+	Event      string    `json:"event"`
+	User       string    `json:"user,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	// the client public key fingerprint
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// the auth method, for the auth events
+	Method string `json:"method,omitempty"`
+	// the failure or the denial reason
+	Reason string `json:"reason,omitempty"`
+	// the forward kind: tcpip-forward or direct-tcpip
+	Forward string `json:"forward,omitempty"`
+	// the forward addresses: the server listener and the client one for
+	// tcpip-forward, the originator and the destination for direct-tcpip
+	Local  string `json:"local,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	// the exec request command
+	Command string `json:"command,omitempty"`
+	// the previous entry hmac. Empty for the first one
+	Prev string `json:"prev"`
+	HMAC string `json:"hmac,omitempty"`
+}
+
+// computeHMAC returns the entry hmac, hex encoded
+func (e AuditEntry) computeHMAC(key []byte) string {
+	e.HMAC = ""
+	data, _ := json.Marshal(e)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAuditLog checks the hmac chain of the audit log file lines read
+// from r. An error is returned on the first entry that was changed,
+// removed or added
+func VerifyAuditLog(r io.Reader, key []byte) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	prev := ""
+	var seq uint64
+	for line := 1; scanner.Scan(); line++ {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if line > 1 && (entry.Prev != prev || entry.Seq != seq+1) {
+			return fmt.Errorf("line %d: the entry doesn't follow the previous one", line)
+		}
+		if !hmac.Equal([]byte(entry.HMAC), []byte(entry.computeHMAC(key))) {
+			return fmt.Errorf("line %d: hmac mismatch", line)
+		}
+		prev = entry.HMAC
+		seq = entry.Seq
+	}
+	return scanner.Err()
+}
+
+// auditLog writes the audit entries to its sink. The entries are queued
+// and written in background. If the queue is full they are written
+// synchronously, so that none is dropped. All its methods can be called
+// on a nil auditLog, doing nothing
+type auditLog struct {
+	key []byte
+
+	entries  chan *AuditEntry
+	done     chan struct{}
+	closed   bool
+	closedMU sync.RWMutex
+
+	// guards the sink writes and the chain state
+	mu   sync.Mutex
+	sink io.WriteCloser
+	seq  uint64
+	prev string
+
+	log *slog.Logger
+}
+
+// newAuditLog opens the audit log target: a file path, "syslog" or
+// "journald". A file chain is resumed from its last entry
+func newAuditLog(target string, key []byte, log *slog.Logger) (*auditLog, error) {
+	a := &auditLog{
+		key:     key,
+		entries: make(chan *AuditEntry, auditQueueSize),
+		done:    make(chan struct{}),
+		log:     log,
+	}
+	switch target {
+	case "syslog":
+		sink, err := newSyslogSink()
+		if err != nil {
+			return nil, err
+		}
+		a.sink = sink
+	case "journald":
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		a.sink = &journaldSink{conn: conn}
+	default:
+		last, err := lastAuditEntry(target)
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			a.seq = last.Seq
+			a.prev = last.HMAC
+		}
+		f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.sink = &fileSink{f: f}
+	}
+	go a.writeLoop()
+	return a, nil
+}
+
+// lastAuditEntry returns the last entry of the audit log file. nil if
+// the file doesn't exist or it is empty
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var last []byte
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(last) == 0 {
+		return nil, nil
+	}
+	entry := &AuditEntry{}
+	if err := json.Unmarshal(last, entry); err != nil {
+		return nil, fmt.Errorf("invalid audit log last entry: %w", err)
+	}
+	return entry, nil
+}
+
+// Log records the entry. Its time is set if zero
+func (a *auditLog) Log(e AuditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	a.closedMU.RLock()
+	defer a.closedMU.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.entries <- &e:
+	default:
+		a.write(&e)
+	}
+}
+
+func (a *auditLog) writeLoop() {
+	defer close(a.done)
+	for e := range a.entries {
+		a.write(e)
+	}
+}
+
+// write links the entry to the chain and writes it. The chain follows the
+// writes order
+func (a *auditLog) write(e *AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Seq = a.seq + 1
+	e.Prev = a.prev
+	e.HMAC = e.computeHMAC(a.key)
+	data, _ := json.Marshal(e)
+	if _, err := a.sink.Write(data); err != nil {
+		a.log.Error("cannot write the audit entry", "event", e.Event, "error", err)
+		return
+	}
+	a.seq = e.Seq
+	a.prev = e.HMAC
+}
+
+// Close writes the queued entries and closes the sink. The entries
+// logged after are discarded
+func (a *auditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.closedMU.Lock()
+	if a.closed {
+		a.closedMU.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.entries)
+	a.closedMU.Unlock()
+	<-a.done
+	return a.sink.Close()
+}
+
+// fileSink writes an entry per line
+type fileSink struct {
+	f *os.File
+}
+
+func (s *fileSink) Write(entry []byte) (int, error) {
+	return s.f.Write(append(entry, '\n'))
+}
+
+// Close syncs the file, so that the entries survive a crash after the
+// server stop
+func (s *fileSink) Close() error {
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// journaldSink sends an entry per journal message, with the journald
+// native protocol
+type journaldSink struct {
+	conn *net.UnixConn
+}
+
+func (s *journaldSink) Write(entry []byte) (int, error) {
+	msg := fmt.Sprintf("SYSLOG_IDENTIFIER=rospo-audit\nPRIORITY=6\nMESSAGE=%s\n", entry)
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		return 0, err
+	}
+	return len(entry), nil
+}
+
+func (s *journaldSink) Close() error {
+	return s.conn.Close()
+}
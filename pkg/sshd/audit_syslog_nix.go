@@ -0,0 +1,13 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogSink returns the local syslog sink of the audit entries
+func newSyslogSink() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "rospo-audit")
+}
@@ -0,0 +1,10 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogSink() (io.WriteCloser, error) {
+	return nil, errors.New("the syslog audit log is not supported on windows")
+}
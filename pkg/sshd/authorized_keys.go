@@ -0,0 +1,382 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// the default authorized_keys http sources refresh interval
+const defaultAuthorizedKeysRefreshInterval = 5 * time.Minute
+
+// the default max age of the http sources keys before they are fetched
+// again on login
+const defaultAuthorizedKeysCacheTTL = time.Minute
+
+// the default max duration of an http source fetch
+const defaultAuthorizedKeysFetchTimeout = 30 * time.Second
+
+// authorizedKeysSource is a single authorized_keys uri. The http sources
+// keep the keys of the last successful load, so that a failing server
+// doesn't lose them. The file ones don't: a missing or unreadable file
+// revokes its keys
+type authorizedKeysSource struct {
+	uri string
+	// the file path or the http url
+	location string
+	isHTTP   bool
+
+	// the authorized keys, marshaled, with their options
+	keys   map[string]*keyOptions
+	loaded bool
+	// the last successful load time
+	fetchedAt time.Time
+	// the last load attempt time. Failing sources are retried at most
+	// once per cache ttl on login
+	attemptedAt time.Time
+}
+
+// authorizedKeys merges the keys of all the authorized_keys sources. The
+// file sources are read on every load, the http ones are cached: they are
+// fetched on refresh and on load if older than the cache ttl
+type authorizedKeys struct {
+	sources         []*authorizedKeysSource
+	refreshInterval time.Duration
+	cacheTTL        time.Duration
+	client          *http.Client
+	mu              sync.Mutex
+
+	log *slog.Logger
+}
+
+func newAuthorizedKeys(log *slog.Logger, uris []string, refreshInterval, cacheTTL, fetchTimeout time.Duration) *authorizedKeys {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultAuthorizedKeysRefreshInterval
+	}
+	if cacheTTL <= 0 {
+		cacheTTL = defaultAuthorizedKeysCacheTTL
+	}
+	if fetchTimeout <= 0 {
+		fetchTimeout = defaultAuthorizedKeysFetchTimeout
+	}
+	a := &authorizedKeys{
+		refreshInterval: refreshInterval,
+		cacheTTL:        cacheTTL,
+		client:          &http.Client{Timeout: fetchTimeout},
+		log:             log,
+	}
+	for _, uri := range uris {
+		src := &authorizedKeysSource{uri: uri, keys: map[string]*keyOptions{}}
+		u, err := url.ParseRequestURI(uri)
+		switch {
+		case err != nil || u.Scheme == "":
+			src.location = uri
+		case u.Scheme == "file":
+			// file://~/keys and file:///etc/keys
+			src.location = u.Host + u.Path
+		case u.Scheme == "http" || u.Scheme == "https":
+			src.location = u.String()
+			src.isHTTP = true
+		default:
+			log.Error("unsupported authorized_keys uri scheme", "uri", uri)
+			continue
+		}
+		a.sources = append(a.sources, src)
+	}
+	return a
+}
+
+// refresh loads again the sources, the http ones too if withHTTP is true
+func (a *authorizedKeys) refresh(withHTTP bool) {
+	a.refreshSources(func(src *authorizedKeysSource) bool {
+		return !src.isHTTP || withHTTP
+	})
+}
+
+// refreshSources loads again the sources selected by the filter. The
+// failing http sources keep the keys of their last successful load, the
+// failing file sources lose them
+func (a *authorizedKeys) refreshSources(filter func(src *authorizedKeysSource) bool) {
+	for _, src := range a.sources {
+		a.mu.Lock()
+		selected := filter(src)
+		if selected {
+			src.attemptedAt = time.Now()
+		}
+		a.mu.Unlock()
+		if !selected {
+			continue
+		}
+
+		keys, err := a.fetch(src)
+		a.mu.Lock()
+		if err != nil && !src.isHTTP {
+			a.log.Error("failed to load authorized_keys, its keys are revoked", "uri", src.uri, "error", err)
+			src.keys = map[string]*keyOptions{}
+			src.loaded = false
+		} else if err != nil {
+			if src.loaded {
+				a.log.Warn("failed to load authorized_keys, serving the last known good keys",
+					"uri", src.uri, "age", time.Since(src.fetchedAt).Round(time.Second).String(), "error", err)
+			} else {
+				a.log.Error("failed to load authorized_keys", "uri", src.uri, "error", err)
+			}
+		} else {
+			src.keys = keys
+			src.loaded = true
+			src.fetchedAt = time.Now()
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *authorizedKeys) fetch(src *authorizedKeysSource) (map[string]*keyOptions, error) {
+	if !src.isHTTP {
+		a.log.Debug("loading keys from file", "uri", src.uri)
+		path, err := utils.ExpandUserHome(src.location)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return a.parse(src, data), nil
+	}
+
+	a.log.Debug("loading keys from http", "uri", src.uri)
+	res, err := a.client.Get(src.location)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected http status %s", res.Status)
+	}
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return a.parse(src, data), nil
+}
+
+// load reads again the file sources and the http ones older than the
+// cache ttl, then returns the keys of all of them
+func (a *authorizedKeys) load() map[string]*keyOptions {
+	now := time.Now()
+	a.refreshSources(func(src *authorizedKeysSource) bool {
+		if !src.isHTTP {
+			return true
+		}
+		return now.Sub(src.fetchedAt) >= a.cacheTTL && now.Sub(src.attemptedAt) >= a.cacheTTL
+	})
+	return a.merged()
+}
+
+// merged returns the keys of all the sources. The options of a key
+// listed by more sources are merged by mergeKeyOptions. The conflicting
+// ones are logged and the key is refused
+func (a *authorizedKeys) merged() map[string]*keyOptions {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res := map[string]*keyOptions{}
+	conflicts := map[string]bool{}
+	for _, src := range a.sources {
+		for k, v := range src.keys {
+			prev, ok := res[k]
+			if conflicts[k] {
+				continue
+			} else if !ok {
+				res[k] = v
+				continue
+			}
+			opts, err := mergeKeyOptions(prev, v)
+			if err != nil {
+				fp := ""
+				if pubKey, err := ssh.ParsePublicKey([]byte(k)); err == nil {
+					fp = ssh.FingerprintSHA256(pubKey)
+				}
+				a.log.Warn("conflicting authorized_keys options, the key is refused",
+					"uri", src.uri, "fingerprint", fp, "error", err)
+				delete(res, k)
+				conflicts[k] = true
+				continue
+			}
+			res[k] = opts
+		}
+	}
+	return res
+}
+
+// mergeKeyOptions merges the options of a key listed by more sources,
+// keeping the restrictions of both: an unrestricted line never lifts
+// the restrictions of another. The different commands and the permitopen
+// lists with no common destination are an error
+func mergeKeyOptions(a, b *keyOptions) (*keyOptions, error) {
+	res := &keyOptions{noPortForwarding: a.noPortForwarding || b.noPortForwarding}
+	switch {
+	case a.command == "":
+		res.command = b.command
+	case b.command == "" || b.command == a.command:
+		res.command = a.command
+	default:
+		return nil, errors.New("different commands")
+	}
+	switch {
+	case len(a.permitOpen) == 0:
+		res.permitOpen = b.permitOpen
+	case len(b.permitOpen) == 0:
+		res.permitOpen = a.permitOpen
+	default:
+		for _, permitted := range a.permitOpen {
+			if slices.Contains(b.permitOpen, permitted) {
+				res.permitOpen = append(res.permitOpen, permitted)
+			}
+		}
+		if len(res.permitOpen) == 0 {
+			return nil, errors.New("no common permitopen destination")
+		}
+	}
+	return res, nil
+}
+
+// hasHTTPSources reports if any of the sources needs a periodic refresh
+func (a *authorizedKeys) hasHTTPSources() bool {
+	for _, src := range a.sources {
+		if src.isHTTP {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshLoop fetches the http sources at the refresh interval, and on
+// SIGHUP, until ctx is done
+func (a *authorizedKeys) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(a.refreshInterval)
+	defer ticker.Stop()
+	reload, stop := reloadSignal()
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.refresh(true)
+		case <-reload:
+			a.log.Info("reloading the authorized_keys")
+			a.refresh(true)
+		}
+	}
+}
+
+// keyOptions are the options of an authorized_keys line
+type keyOptions struct {
+	// the command="..." option: the command run in place of the one
+	// requested by the client
+	command string
+	// the no-port-forwarding option: the forward and the reverse
+	// tunnels are rejected
+	noPortForwarding bool
+	// the permitopen="host:port" options: the only destinations of the
+	// forward tunnels. The host and the port can be *. Empty allows all
+	permitOpen []string
+}
+
+// parseKeyOptions parses the authorized_keys line options. The unknown
+// ones are ignored
+func parseKeyOptions(options []string) *keyOptions {
+	opts := &keyOptions{}
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		switch strings.ToLower(name) {
+		case "command":
+			opts.command = unquoteOption(value)
+		case "no-port-forwarding":
+			opts.noPortForwarding = true
+		case "permitopen":
+			opts.permitOpen = append(opts.permitOpen, unquoteOption(value))
+		}
+	}
+	return opts
+}
+
+// unquoteOption returns the option value without the double quotes. The
+// escaped quotes are unescaped
+func unquoteOption(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	return strings.ReplaceAll(value, `\"`, `"`)
+}
+
+// parse parses the authorized_keys content of src. The lines that are
+// not valid keys are logged and skipped
+func (a *authorizedKeys) parse(src *authorizedKeysSource, data []byte) map[string]*keyOptions {
+	keys := map[string]*keyOptions{}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		pubKey, _, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			a.log.Warn("skipping invalid authorized_keys line", "uri", src.uri, "line", i+1, "error", err)
+			continue
+		}
+		keys[string(pubKey.Marshal())] = parseKeyOptions(options)
+	}
+	return keys
+}
+
+// the ssh.Permissions extensions carrying the key options
+const (
+	noPortForwardingExtension = "no-port-forwarding"
+	permitOpenExtension       = "permitopen"
+)
+
+// portForwardingAllowed reports if the client permissions allow the
+// tunnels. The clients without permissions, if the auth is disabled, are
+// allowed
+func portForwardingAllowed(perms *ssh.Permissions) bool {
+	if perms == nil {
+		return true
+	}
+	_, denied := perms.Extensions[noPortForwardingExtension]
+	return !denied
+}
+
+// openPermitted reports if the client permissions allow a forward tunnel
+// to host:port. The host is compared as requested by the client, without
+// resolving it, like OpenSSH does
+func openPermitted(perms *ssh.Permissions, host string, port uint32) bool {
+	if perms == nil || perms.Extensions[permitOpenExtension] == "" {
+		return true
+	}
+	for _, permitted := range strings.Split(perms.Extensions[permitOpenExtension], ",") {
+		permittedHost, permittedPort, err := net.SplitHostPort(permitted)
+		if err != nil {
+			continue
+		}
+		if (permittedHost == "*" || strings.EqualFold(permittedHost, host)) &&
+			(permittedPort == "*" || permittedPort == strconv.FormatUint(uint64(port), 10)) {
+			return true
+		}
+	}
+	return false
+}
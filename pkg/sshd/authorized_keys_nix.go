@@ -0,0 +1,17 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadSignal returns the channel receiving the SIGHUP signals, that
+// reload the authorized_keys http sources, and the func stopping it
+func reloadSignal() (<-chan os.Signal, func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	return c, func() { signal.Stop(c) }
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizedKeysReloadSignal(t *testing.T) {
+	key1, _ := os.ReadFile("../../testdata/client.pub")
+	key2, _ := os.ReadFile("../../testdata/client2.pub")
+	pub2, _, _, _, _ := ssh.ParseAuthorizedKey(key2)
+
+	var updated atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if updated.Load() {
+			w.Write(key2)
+			return
+		}
+		w.Write(key1)
+	}))
+	defer srv.Close()
+
+	// the signals don't terminate the test if the loop is not
+	// listening yet
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	keys := newAuthorizedKeys(slog.Default(), []string{srv.URL}, time.Hour, time.Hour, 0)
+	keys.refresh(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go keys.refreshLoop(ctx)
+
+	updated.Store(true)
+	for i := 0; i < 50; i++ {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(100 * time.Millisecond)
+		if res := keys.merged(); len(res) == 1 && res[string(pub2.Marshal())] != nil {
+			return
+		}
+	}
+	t.Fatal("the keys were not reloaded on SIGHUP")
+}
@@ -1,13 +1,16 @@
 package sshd
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -15,6 +18,10 @@ import (
 	"github.com/ferama/rospo/pkg/rpty"
 	"github.com/ferama/rospo/pkg/utils"
 	"github.com/pkg/sftp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -30,63 +37,179 @@ type channelHandler struct {
 	sshConn *ssh.ServerConn
 
 	chans <-chan ssh.NewChannel
+	log   *slog.Logger
 }
 
 func newChannelHandler(
 	server *sshServer,
 	sshConn *ssh.ServerConn,
 	chans <-chan ssh.NewChannel,
+	log *slog.Logger,
 ) *channelHandler {
 
 	return &channelHandler{
 		server:  server,
 		sshConn: sshConn,
 		chans:   chans,
+		log:     log,
 	}
 
 }
 
+// handleShellExecRequest starts the requested shell or command. It replies
+// to the request by itself: the reply must be sent before the command
+// output and exit status
 func (s *channelHandler) handleShellExecRequest(
 	pty rpty.Pty,
+	term *ptyTerm,
+	proc *sessionProcess,
 	env map[string]string,
 	channel ssh.Channel,
 	req *ssh.Request) bool {
 
-	var shell string
+	shell := s.server.getShell()
 
-	if s.server.shellExecutable == "" {
-		usr := utils.CurrentUser()
-		shell = utils.GetUserDefaultShell(usr.Username)
-	} else {
-		shell = s.server.shellExecutable
+	var command string
+	if req.Type == "exec" {
+		var payload = struct{ Value string }{}
+		ssh.Unmarshal(req.Payload, &payload)
+		command = payload.Value
 	}
 
 	if s.server.disableShell {
-		log.Printf("declining %s request... ", req.Type)
+		s.log.Debug("declining request", "type", req.Type)
+		if req.Type == "shell" {
+			fmt.Fprint(channel.Stderr(), "shell access is disabled on this server\r\n")
+		} else {
+			fmt.Fprint(channel.Stderr(), "command execution is disabled on this server\r\n")
+			s.audit(AuditEntry{Event: AuditExecRequest, Command: command, Reason: "command execution is disabled"})
+		}
 		req.Reply(false, nil)
 		return false
 	}
 	var cmd *exec.Cmd
 
-	if req.Type == "shell" {
+	forcedCommand := s.forcedCommand()
+	switch {
+	case forcedCommand != "":
+		// the client command is ignored, like OpenSSH does
+		s.log.Info("running the forced command", "command", forcedCommand, "original_command", command)
+		cmd = shellCommand(shell, forcedCommand)
+	case len(s.server.allowedCommands) > 0:
+		args, err := splitCommand(command)
+		if err != nil || len(args) == 0 || !isAllowedCommand(s.server.allowedCommands, args[0]) {
+			return s.denyCommand(channel, req, command)
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+	case req.Type == "shell":
 		if s.server.shellExecutable != "" {
 			parts := strings.Split(s.server.shellExecutable, " ")
 			cmd = exec.Command(parts[0], parts[1:]...)
 		} else {
 			cmd = exec.Command(shell)
 		}
+	default:
+		cmd = shellCommand(shell, command)
+	}
+
+	if req.Type == "exec" {
+		s.audit(AuditEntry{Event: AuditExecRequest, Command: command})
 	} else {
-		var payload = struct{ Value string }{}
-		ssh.Unmarshal(req.Payload, &payload)
-		command := payload.Value
-		cmd = exec.Command(shell, []string{"-c", command}...)
-		if runtime.GOOS == "windows" {
-			command = strings.Replace(command, "powershell.exe", "", 1)
-			command = strings.Replace(command, "powershell", "", 1)
-			cmd = exec.Command(shell, command)
+		s.audit(AuditEntry{Event: AuditShellOpened})
+	}
+
+	cmd.Env = s.buildEnv(env)
+	cmd.Dir = s.server.shellWorkingDir
+	if forcedCommand != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s", command))
+	}
+
+	if pty != nil {
+		if err := pty.Run(cmd); err != nil {
+			s.log.Error("cannot start command", "error", err)
+			req.Reply(false, nil)
+			return false
+		}
+		req.Reply(true, nil)
+		term.recorder = s.startRecording(term, shell, command)
+		s.ptySessionClientServe(channel, pty, term.recorder)
+
+		s.sendStatus(channel, 0)
+		s.sendSignal(channel, "TERM")
+		return true
+	}
+	return s.runCommand(cmd, proc, channel, req)
+}
+
+// getShell returns the shell that runs the commands: the shell_executable
+// or the first that exists of the SHELL environment variable and the user
+// login shell. Minimal containers often have neither, so /bin/sh is the
+// last resort
+func (s *sshServer) getShell() string {
+	if s.shellExecutable != "" {
+		return s.shellExecutable
+	}
+	usr := utils.CurrentUser()
+	if runtime.GOOS == "windows" {
+		return utils.GetUserDefaultShell(usr.Username)
+	}
+	for _, shell := range []string{os.Getenv("SHELL"), utils.GetUserDefaultShell(usr.Username)} {
+		if shell == "" {
+			continue
+		}
+		if _, err := exec.LookPath(shell); err == nil {
+			return shell
 		}
 	}
+	return "/bin/sh"
+}
+
+// shellCommand builds the command that runs the command line with shell
+func shellCommand(shell string, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		command = strings.Replace(command, "powershell.exe", "", 1)
+		command = strings.Replace(command, "powershell", "", 1)
+		return exec.Command(shell, command)
+	}
+	return exec.Command(shell, []string{"-c", command}...)
+}
+
+// forcedCommand returns the authorized_keys command= option of the
+// client key. Empty if not set
+func (s *channelHandler) forcedCommand() string {
+	if s.sshConn.Permissions == nil {
+		return ""
+	}
+	return s.sshConn.Permissions.CriticalOptions["force-command"]
+}
 
+// denyCommand rejects a command that is not in the allowed ones. The
+// request is accepted, so that the client gets the reason and the exit
+// status
+func (s *channelHandler) denyCommand(channel ssh.Channel, req *ssh.Request, command string) bool {
+	fp := ""
+	if s.sshConn.Permissions != nil {
+		fp = s.sshConn.Permissions.Extensions["pubkey-fp"]
+	}
+	s.log.Warn("command not allowed", "type", req.Type, "command", command,
+		"user", s.sshConn.User(), "fingerprint", fp)
+	if req.Type == "exec" {
+		s.audit(AuditEntry{Event: AuditExecRequest, Command: command, Reason: "command not allowed"})
+	}
+	req.Reply(true, nil)
+	if req.Type == "shell" {
+		fmt.Fprint(channel.Stderr(), "shell access is not allowed on this server\r\n")
+	} else {
+		fmt.Fprint(channel.Stderr(), "command not allowed on this server\r\n")
+	}
+	s.sendStatus(channel, deniedCommandExitStatus)
+	channel.Close()
+	return false
+}
+
+// buildEnv returns the command environment merging the client provided
+// vars with the user ones
+func (s *channelHandler) buildEnv(env map[string]string) []string {
 	envVal := make([]string, 0, len(env))
 	for k, v := range env {
 		envVal = append(envVal, fmt.Sprintf("%s=%s", k, v))
@@ -108,48 +231,189 @@ func (s *channelHandler) handleShellExecRequest(
 	envVal = append(envVal, fmt.Sprintf("USER=%s", usr.Username))
 	envVal = append(envVal, fmt.Sprintf("LOGNAME=%s", usr.Username))
 
-	cmd.Env = envVal
+	return envVal
+}
 
-	if pty != nil {
-		if err := pty.Run(cmd); err != nil {
-			log.Fatalf("%s", err)
-		}
-		s.ptySessionClientServe(channel, pty)
+// sessionProcess is the command of a session without a pty. It gets the
+// client "signal" requests and it is killed if the client closes the
+// session before the command exits
+type sessionProcess struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	exited bool
+}
 
-		s.sendStatus(channel, 0)
-		s.sendSignal(channel, "TERM")
+func (p *sessionProcess) started(cmd *exec.Cmd) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cmd = cmd
+}
 
-	} else {
-		cmd.Stdout = channel
-		cmd.Stderr = channel
-		cmd.Stdin = channel
-		err := cmd.Start()
-		if err != nil {
-			log.Printf("%s", err)
-		}
+func (p *sessionProcess) exit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exited = true
+}
 
-		go func() {
-			status, err := cmd.Process.Wait()
-			if err != nil {
-				log.Printf("failed to exit (%s)", err)
-				cmd.Process.Kill()
-			} else {
-				log.Printf("command executed with exit status %s", status)
-			}
-			s.sendStatus(channel, uint32(status.ExitCode()))
-			channel.Close()
-			log.Printf("session closed")
-		}()
+// signal delivers the signal named as in the "signal" requests. It
+// returns false if the signal is unknown or the command is not running
+func (p *sessionProcess) signal(name string) bool {
+	sig, ok := sshSignals[name]
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !ok || p.cmd == nil || p.exited {
+		return false
 	}
+	return p.cmd.Process.Signal(sig) == nil
+}
 
+// kill ends the command if it is still running
+func (p *sessionProcess) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd != nil && !p.exited {
+		p.cmd.Process.Kill()
+	}
+}
+
+// runCommand starts cmd using the channel as its stdio, replies to req and
+// sends the exit status to the client when the command terminates
+func (s *channelHandler) runCommand(cmd *exec.Cmd, proc *sessionProcess, channel ssh.Channel, req *ssh.Request) bool {
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	stdin, _ := cmd.StdinPipe()
+	err := cmd.Start()
+	if err != nil {
+		s.log.Error("cannot start command", "error", err)
+		req.Reply(false, nil)
+		return false
+	}
+	proc.started(cmd)
 	req.Reply(true, nil)
+
+	// the stdin copy is not waited for: the client could never
+	// close its side of the channel
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	go func() {
+		// all the output needs to be sent before the exit status
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			io.Copy(channel, stdout)
+			wg.Done()
+		}()
+		go func() {
+			io.Copy(channel.Stderr(), stderr)
+			wg.Done()
+		}()
+		wg.Wait()
+
+		err := cmd.Wait()
+		proc.exit()
+		if err != nil {
+			s.log.Info("command exited with error", "error", err)
+		} else {
+			s.log.Info("command executed", "status", cmd.ProcessState.String())
+		}
+		s.sendStatus(channel, uint32(cmd.ProcessState.ExitCode()))
+		channel.Close()
+		s.log.Info("session closed")
+	}()
 	return true
 }
 
-func (s *channelHandler) handlePtyRequest(req *ssh.Request) (rpty.Pty, error) {
-	if s.server.disableShell {
-		log.Printf("declining %s request... ", req.Type)
+// handleSubsystemRequest serves the subsystem requested by the client.
+// Configured subsystems take precedence over the builtin sftp one
+func (s *channelHandler) handleSubsystemRequest(
+	proc *sessionProcess,
+	env map[string]string,
+	channel ssh.Channel,
+	req *ssh.Request) bool {
+
+	var payload = struct{ Name string }{}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		s.log.Error("invalid subsystem payload", "payload", string(req.Payload))
+		req.Reply(false, nil)
+		return false
+	}
+	if payload.Name == "sftp" && s.server.disableSftpSubsystem {
 		req.Reply(false, nil)
+		return false
+	}
+
+	// the forced command replaces the subsystems too
+	if forcedCommand := s.forcedCommand(); forcedCommand != "" {
+		s.log.Info("running the forced command", "command", forcedCommand, "subsystem", payload.Name)
+		cmd := shellCommand(s.server.getShell(), forcedCommand)
+		cmd.Env = append(s.buildEnv(env), fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s", payload.Name))
+		cmd.Dir = s.server.shellWorkingDir
+		return s.runCommand(cmd, proc, channel, req)
+	}
+
+	if executable, ok := s.server.subsystems[payload.Name]; ok {
+		s.log.Info("starting subsystem", "name", payload.Name, "executable", executable)
+		parts := strings.Fields(executable)
+		if len(parts) == 0 {
+			req.Reply(false, nil)
+			return false
+		}
+		cmd := exec.Command(parts[0], parts[1:]...)
+		cmd.Env = s.buildEnv(env)
+		cmd.Dir = s.server.shellWorkingDir
+		return s.runCommand(cmd, proc, channel, req)
+	}
+
+	if payload.Name == "sftp" {
+		go s.handleSftpRequest(channel)
+		req.Reply(true, nil)
+		return true
+	}
+	req.Reply(false, nil)
+	return false
+}
+
+// ptyTerm is the terminal requested by the client
+type ptyTerm struct {
+	name       string
+	cols, rows uint32
+	// the session recording. nil if not recorded
+	recorder *sessionRecorder
+}
+
+// startRecording starts the session recording, if enabled. A recording
+// failure doesn't affect the session
+func (s *channelHandler) startRecording(term *ptyTerm, shell string, command string) *sessionRecorder {
+	if !s.server.recordSessions {
+		return nil
+	}
+	fp := ""
+	if s.sshConn.Permissions != nil {
+		fp = s.sshConn.Permissions.Extensions["pubkey-fp"]
+	}
+	recorder, err := newSessionRecorder(s.server.recordingDir, fp, CastHeader{
+		Width:   int(term.cols),
+		Height:  int(term.rows),
+		Command: command,
+		Title:   fmt.Sprintf("%s@%s", s.sshConn.User(), s.sshConn.RemoteAddr()),
+		Env:     map[string]string{"TERM": term.name, "SHELL": shell},
+	}, s.log)
+	if err != nil {
+		s.log.Error("cannot record the session", "error", err)
+		return nil
+	}
+	return recorder
+}
+
+func (s *channelHandler) handlePtyRequest(req *ssh.Request, term *ptyTerm) (rpty.Pty, error) {
+	if s.server.disableShell {
+		return nil, nil
+	}
+	if !s.server.permitTTY {
+		s.log.Info("pty request rejected: permit_tty is false")
 		return nil, nil
 	}
 
@@ -161,74 +425,92 @@ func (s *channelHandler) handlePtyRequest(req *ssh.Request) (rpty.Pty, error) {
 		return nil, err
 	}
 
-	// Responding 'ok' here will let the client
-	// know we have a pty ready for input
-	req.Reply(true, nil)
 	// Parse body...
 	termLen := req.Payload[3]
 	termEnv := string(req.Payload[4 : termLen+4])
 	w, h := parseDims(req.Payload[termLen+4:])
 	pty.Resize(uint16(w), uint16(h))
+	term.name, term.cols, term.rows = termEnv, w, h
 
-	log.Printf("pty-req '%s'", termEnv)
+	s.log.Debug("pty-req", "term", termEnv)
 	return pty, nil
 }
 
 func (s *channelHandler) serveChannelSession(c ssh.NewChannel) {
 	channel, requests, err := c.Accept()
 	if err != nil {
-		log.Printf("could not accept channel (%s)", err)
+		s.log.Error("could not accept channel", "error", err)
 		return
 	}
 
 	var pty rpty.Pty
+	term := &ptyTerm{}
+	proc := &sessionProcess{}
 	env := map[string]string{}
+	// the requests end when the client closes the session
+	defer proc.kill()
 
 	for req := range requests {
 		ok := false
 		switch req.Type {
 		case "shell", "exec":
-			ok = s.handleShellExecRequest(pty, env, channel, req)
+			// the handler sends the reply by itself
+			s.handleShellExecRequest(pty, term, proc, env, channel, req)
+			continue
+
+		case "signal":
+			var payload = struct{ Signal string }{}
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				s.log.Error("invalid signal payload", "payload", string(req.Payload))
+				break
+			}
+			s.log.Debug("signal", "signal", payload.Signal)
+			ok = proc.signal(payload.Signal)
 
 		case "pty-req":
-			pty, err = s.handlePtyRequest(req)
+			pty, err = s.handlePtyRequest(req, term)
 			if err != nil {
-				log.Printf("could not start pty (%s)", err)
-				return
+				s.log.Error("could not start pty", "error", err)
 			}
 			if pty != nil {
 				ok = true
 			}
 
 		case "window-change":
-			w, h := parseDims(req.Payload)
-			pty.Resize(uint16(w), uint16(h))
-			ok = true
+			if pty != nil {
+				w, h := parseDims(req.Payload)
+				pty.Resize(uint16(w), uint16(h))
+				term.cols, term.rows = w, h
+				term.recorder.resize(w, h)
+				ok = true
+			}
 
 		case "env":
 			var payload = struct{ Name, Value string }{}
 
 			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-				log.Printf("invalid env payload: %s", req.Payload)
+				s.log.Error("invalid env payload", "payload", string(req.Payload))
+				break
 			}
-			log.Printf("setenv: %s=%s", payload.Name, payload.Value)
+			if !s.server.acceptsEnv(payload.Name) {
+				s.log.Debug("setenv rejected", "name", payload.Name)
+				break
+			}
+			s.log.Debug("setenv", "name", payload.Name, "value", payload.Value)
 
 			env[payload.Name] = payload.Value
 			ok = true
 
 		case "subsystem":
-			var payload = struct{ Name string }{}
-			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-				log.Printf("invalid payload: %s", req.Payload)
-			}
-			if payload.Name == "sftp" && !s.server.disableSftpSubsystem {
-				go s.handleSftpRequest(channel)
-				ok = true
+			// the handler sends the reply by itself
+			if !s.handleSubsystemRequest(proc, env, channel, req) {
+				s.log.Debug("declining request", "type", req.Type)
 			}
+			continue
 		}
 
 		if !ok {
-			log.Printf("declining %s request... ", req.Type)
+			s.log.Debug("declining request", "type", req.Type)
 		}
 
 		req.Reply(ok, nil)
@@ -242,21 +524,28 @@ func (s *channelHandler) sendStatus(channel ssh.Channel, status uint32) {
 		Status: status,
 	}
 	if _, err := channel.SendRequest("exit-status", false, ssh.Marshal(&msg)); err != nil {
-		log.Printf("failed to send exit-status: %s", err)
+		s.log.Error("failed to send exit-status", "error", err)
 	}
 }
 
-func (s *channelHandler) ptySessionClientServe(channel ssh.Channel, pty rpty.Pty) {
+// ptySessionClientServe pipes the channel to the pty and vice-versa. The
+// pty output is teed to the recorder, if not nil
+func (s *channelHandler) ptySessionClientServe(channel ssh.Channel, pty rpty.Pty, recorder *sessionRecorder) {
 	// Teardown session
 	var once sync.Once
 	close := func() {
 		channel.Close()
 		pty.Close()
+		recorder.Close()
 	}
 
+	var out io.Writer = channel
+	if recorder != nil {
+		out = io.MultiWriter(channel, recorder)
+	}
 	// Pipe session to shell and vice-versa
 	go func() {
-		pty.WriteTo(channel)
+		pty.WriteTo(out)
 		once.Do(close)
 	}()
 
@@ -267,6 +556,10 @@ func (s *channelHandler) ptySessionClientServe(channel ssh.Channel, pty rpty.Pty
 }
 
 func (s *channelHandler) handleSftpRequest(channel ssh.Channel) {
+	if s.server.sftpLimits.enabled() {
+		s.handleLimitedSftpRequest(channel)
+		return
+	}
 	debugStream := os.Stderr
 	serverOptions := []sftp.ServerOption{
 		sftp.WithDebug(debugStream),
@@ -276,15 +569,32 @@ func (s *channelHandler) handleSftpRequest(channel ssh.Channel) {
 		serverOptions...,
 	)
 	if err != nil {
-		log.Fatal(err)
+		s.log.Error("cannot start sftp server", "error", err)
+		return
 	}
 	if err := server.Serve(); err != nil {
 		if err != io.EOF {
-			log.Fatal("sftp server completed with error:", err)
+			s.log.Error("sftp server completed with error", "error", err)
 		}
 	}
 	server.Close()
-	log.Print("sftp client exited session.")
+	s.log.Info("sftp client exited session")
+}
+
+// handleLimitedSftpRequest serves the sftp session through a request server
+// that enforces the configured concurrency and file size limits
+func (s *channelHandler) handleLimitedSftpRequest(channel ssh.Channel) {
+	cwd, _ := os.Getwd()
+	server := sftp.NewRequestServer(
+		channel,
+		newSftpHandlers(s.server.sftpLimits),
+		sftp.WithStartDirectory(cwd),
+	)
+	if err := server.Serve(); err != nil && err != io.EOF {
+		s.log.Error("sftp server completed with error", "error", err)
+	}
+	server.Close()
+	s.log.Info("sftp client exited session")
 }
 
 func (s *channelHandler) sendSignal(channel ssh.Channel, signal string) {
@@ -300,46 +610,91 @@ func (s *channelHandler) sendSignal(channel ssh.Channel, signal string) {
 		Lang:       "en-GB",
 	}
 	if _, err := channel.SendRequest("exit-signal", false, ssh.Marshal(&sig)); err != nil {
-		log.Printf("unable to send signal: %v", err)
+		s.log.Error("unable to send signal", "error", err)
 	}
 }
 
 func (s *channelHandler) handleChannelDirect(c ssh.NewChannel) {
-	var payload = struct {
-		Addr       string
-		Port       uint32
-		OriginAddr string
-		OriginPort uint32
-	}{}
-
-	if err := ssh.Unmarshal(c.ExtraData(), &payload); err != nil {
-		log.Printf("Could not unmarshal extra data: %s\n", err)
+	payload, extra, err := utils.ParseDirectTCPIP(c.ExtraData())
+	if err != nil {
+		s.log.Error("could not unmarshal extra data", "error", err)
 
 		c.Reject(ssh.Prohibited, "Bad payload")
 		return
 	}
-	connection, requests, err := c.Accept()
-	if err != nil {
-		log.Printf("Could not accept channel (%s)\n", err)
+	if err := rio.ValidateCompressionLevel(extra.CompressionLevel); err != nil {
+		s.log.Error("invalid compression level", "level", extra.CompressionLevel)
+		c.Reject(ssh.Prohibited, "Bad payload")
 		return
 	}
-	go ssh.DiscardRequests(requests)
 	addr := fmt.Sprintf("[%s]:%d", payload.Addr, payload.Port)
+	if !openPermitted(s.sshConn.Permissions, payload.Addr, payload.Port) {
+		s.log.Warn("destination not permitted for the key", "target_addr", addr,
+			"fingerprint", s.sshConn.Permissions.Extensions["pubkey-fp"])
+		c.Reject(ssh.Prohibited, "destination not permitted")
+		return
+	}
 
+	// rospo clients send the span context of the tunnel connection
+	ctx := context.Background()
+	if extra.TraceParent != "" {
+		ctx = propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": extra.TraceParent})
+	}
+	_, span := s.server.tracer.Start(ctx, "sshd.direct-tcpip", trace.WithAttributes(
+		attribute.String("remote.addr", s.sshConn.RemoteAddr().String()),
+		attribute.String("target.addr", addr),
+	))
+
+	// the destination is dialed first, so that the client knows if it
+	// is unreachable, like with OpenSSH
 	rconn, err := net.Dial("tcp", addr)
 	if err != nil {
-		log.Printf("Could not dial remote (%s)", err)
-		connection.Close()
+		s.log.Error("could not dial remote", "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		c.Reject(ssh.ConnectionFailed, err.Error())
 		return
 	}
 
-	rio.CopyConn(connection, rconn)
+	connection, requests, err := c.Accept()
+	if err != nil {
+		s.log.Error("could not accept channel", "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		rconn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	var channel io.ReadWriteCloser = connection
+	if extra.CompressionLevel > 0 {
+		channel = rio.NewCompressed(connection, extra.CompressionLevel)
+	}
+	origin := net.JoinHostPort(payload.OriginAddr, strconv.Itoa(int(payload.OriginPort)))
+	s.audit(AuditEntry{Event: AuditForwardStarted, Forward: "direct-tcpip", Local: origin, Remote: addr})
+	rio.CopyConnWithOnClose(channel, rconn, false, s.server.bufferSize, func() {
+		span.End()
+		s.audit(AuditEntry{Event: AuditForwardStopped, Forward: "direct-tcpip", Local: origin, Remote: addr})
+	})
+}
+
+// audit records the entry, adding the client details
+func (s *channelHandler) audit(e AuditEntry) {
+	e.User = s.sshConn.User()
+	e.RemoteAddr = s.sshConn.RemoteAddr().String()
+	if s.sshConn.Permissions != nil {
+		e.Fingerprint = s.sshConn.Permissions.Extensions["pubkey-fp"]
+	}
+	s.server.audit.Log(e)
 }
 
 func (s *channelHandler) handleChannels() {
 	// Service the incoming Channel channel.
 	for newChannel := range s.chans {
 		t := newChannel.ChannelType()
+		s.log.Debug("channel open", "type", t)
 		switch t {
 		case "session":
 			// shell, exec and sft subsystem
@@ -349,6 +704,11 @@ func (s *channelHandler) handleChannels() {
 				newChannel.Reject(ssh.Prohibited, "tunnelling is disabled")
 				continue
 			}
+			if !portForwardingAllowed(s.sshConn.Permissions) {
+				s.log.Warn("port forwarding not allowed for the key", "fingerprint", s.sshConn.Permissions.Extensions["pubkey-fp"])
+				newChannel.Reject(ssh.Prohibited, "port forwarding is not allowed for the key")
+				continue
+			}
 			// used by forward requests
 			go s.handleChannelDirect(newChannel)
 		default:
@@ -1,15 +1,107 @@
 package sshd
 
+import "time"
+
+// DefaultLoginGraceTime is the login grace time used if the configuration
+// doesn't set one
+const DefaultLoginGraceTime = 30 * time.Second
+
+// DefaultClientAliveCountMax is the unanswered client alive requests limit
+// used if the configuration doesn't set one
+const DefaultClientAliveCountMax = 3
+
 // SshDConf holds the sshd configuration
 type SshDConf struct {
-	Key               string   `yaml:"server_key"`
+	// the server key path. It can be an inline PEM key, env:VAR for a key
+	// in the VAR environment variable or - for a key read from stdin too:
+	// these keys are never written to the disk
+	Key string `yaml:"server_key"`
+	// more server keys, of different algorithms, offered together with
+	// the server_key. The missing ones are generated, with the type in
+	// their file name, as ssh_host_rsa_key, or the first of ed25519 and
+	// rsa that no other key has
+	Keys              []string `yaml:"server_keys"`
 	AuthorizedKeysURI []string `yaml:"authorized_keys"`
+	// how often the http authorized_keys sources are fetched again.
+	// Defaults to 5 minutes
+	AuthorizedKeysRefreshInterval time.Duration `yaml:"authorized_keys_refresh_interval"`
+	// the max age of the http authorized_keys sources keys. Older keys
+	// are fetched again on login. If the source is unreachable, the last
+	// known good keys are used. Defaults to 1 minute. A SIGHUP fetches
+	// them again immediately
+	AuthorizedKeysCacheTTL time.Duration `yaml:"authorized_keys_cache_ttl"`
+	// the max duration of an http authorized_keys source fetch.
+	// Defaults to 30 seconds
+	AuthorizedKeysFetchTimeout time.Duration `yaml:"authorized_keys_fetch_timeout"`
+	// if true the server will refuse to start if the server key
+	// is readable by group or others. If false a warning is logged
+	StrictKeyPermissions bool `yaml:"strict_key_permissions"`
+	// the server key passphrase, if the key is protected. The key
+	// generated on first run is encrypted with it too
+	KeyPassphrase string `yaml:"server_key_passphrase"`
+	// the type of the server key generated on first run: ed25519 (the
+	// default), ecdsa or rsa. The bits are the key size, 0 is the type
+	// default. ed25519 keys have a fixed size
+	KeyType string `yaml:"server_key_type"`
+	KeyBits int    `yaml:"server_key_bits"`
+	// optional OpenSSH host certificate path. The certificate must be
+	// signed for the server_key public key. Clients that don't accept
+	// certificates will keep using the plain key
+	HostCertificate string `yaml:"host_certificate"`
 
 	AuthorizedPassword string `yaml:"authorized_password"`
+	// if true the public key logins need a TOTP code too, asked with
+	// a keyboard interactive exchange. It can't be set with
+	// AuthorizedPassword, as the password logins have no TOTP secret
+	RequireTOTP bool `yaml:"require_totp"`
+	// the file mapping the public key fingerprints to their TOTP secrets.
+	// One "SHA256:<fingerprint> <base32 secret>" pair per line
+	TOTPSecretsFile string `yaml:"totp_secrets_file"`
 	// The address the sshd server will listen too
 	ListenAddress string `yaml:"listen_address"`
+	// the clients that don't complete the handshake and the
+	// authentication within this time are disconnected. Defaults to
+	// DefaultLoginGraceTime
+	LoginGraceTime time.Duration `yaml:"login_grace_time"`
+	// if set, a keepalive@openssh.com request is sent to the clients at
+	// this interval, as the OpenSSH ClientAliveInterval. The clients
+	// leaving ClientAliveCountMax (default DefaultClientAliveCountMax)
+	// consecutive requests unanswered are disconnected, and their forwards
+	// closed
+	ClientAliveInterval time.Duration `yaml:"client_alive_interval"`
+	ClientAliveCountMax int           `yaml:"client_alive_count_max"`
+	// if greater than 0, at most MaxConnRate new connections per second
+	// are accepted on average, MaxConnBurst (default MaxConnRate rounded
+	// up) at once. The exceeding ones are closed before the handshake
+	MaxConnRate  float64 `yaml:"max_conn_rate"`
+	MaxConnBurst int     `yaml:"max_conn_burst"`
+	// if true the server uses the socket passed by the systemd socket
+	// activation (ListenStream) instead of listening on ListenAddress,
+	// and notifies systemd (Type=notify) when it is ready
+	SystemdSocket bool `yaml:"systemd_socket"`
+	// if set, the auth events, the forwards and the shell and exec
+	// requests are recorded as json lines to this file path, to the local
+	// syslog with "syslog" or to the journal with "journald"
+	AuditLog string `yaml:"audit_log"`
+	// the key of the HMAC chaining each audit entry to the previous one.
+	// Without it the chain can be recomputed by whoever changes the log
+	AuditLogKey string `yaml:"audit_log_key"`
+	// if true the pty sessions output is recorded in RecordingDir as
+	// asciicast v2 files, one per session. The input is not recorded, so
+	// that the typed passwords are not saved
+	RecordSessions bool   `yaml:"record_sessions"`
+	RecordingDir   string `yaml:"recording_dir"`
 	// if true the exec,shell requests will be ignored
 	DisableShell bool `yaml:"disable_shell"`
+	// if false the pty requests are rejected, as the OpenSSH PermitTTY.
+	// Defaults to true
+	PermitTTY *bool `yaml:"permit_tty"`
+	// if true the env requests of the clients set the commands environment
+	// variables, as the OpenSSH PermitUserEnvironment. Only the variables
+	// matching one of the AcceptEnv path.Match globs are set, if any.
+	// Example: [LANG, LC_*]
+	PermitUserEnvironment bool     `yaml:"permit_user_environment"`
+	AcceptEnv             []string `yaml:"accept_env"`
 	// if true no banner will be displayed while interacting
 	// with the sshd server
 	DisableBanner bool `yaml:"disable_banner"`
@@ -19,9 +111,46 @@ type SshDConf struct {
 	// If true the sftp subsystem will be disabled and no file transfer
 	// will be allowed
 	DisableSftpSubsystem bool `yaml:"disable_sftp_subsystem"`
+	// the max number of sftp requests served concurrently across all
+	// the sessions. Excess requests wait for a free slot. 0 means no limit
+	SftpMaxConcurrentRequests int `yaml:"sftp_max_concurrent_requests"`
+	// the max size in bytes of the files written through sftp.
+	// 0 means no limit
+	SftpMaxFileSize int64 `yaml:"sftp_max_file_size"`
+	// the forwards copy loops buffer size, in bytes. The bigger buffers
+	// help on the high bandwidth-delay links, at the cost of more memory
+	// per connection. Defaults to rio.DefaultBufferSize
+	BufferSize int `yaml:"buffer_size"`
 	// if disabled, forward and reverse tunnelling will be not allowed
 	// on this server
 	DisableTunnelling bool `yaml:"disable_tunnelling"`
-	// shell executable. Leave empty for default behaviour
+	// if greater than 0, a summary of every active reverse forward
+	// (connections and transferred bytes) is logged at this interval.
+	// Example: "1m"
+	ForwardStatsInterval time.Duration `yaml:"forward_stats_interval"`
+	// if set, only the exec requests whose executable matches one of
+	// these names or path.Match globs are run. Example: [rsync, git-*].
+	// The commands are run directly, not through the shell, and the
+	// shell requests are rejected. The authorized_keys command= options
+	// are always run
+	AllowedCommands []string `yaml:"allowed_commands"`
+	// shell executable. Leave empty to use the SHELL environment
+	// variable, the user login shell or /bin/sh, the first that exists
 	ShellExecutable string `yaml:"shell_executable"`
+	// the working directory of the shells, commands and subsystems. Leave
+	// empty to use the rospo one
+	ShellWorkingDir string `yaml:"shell_working_dir"`
+	// additional subsystems. Maps the subsystem name to the executable
+	// that will serve it using the channel as stdio. An "sftp" entry
+	// replaces the builtin sftp server
+	Subsystems map[string]string `yaml:"subsystems"`
+	// if set, the /healthz and /readyz probes are served on this
+	// address. Example: ":8080"
+	HealthAddr string `yaml:"health_addr"`
+	// if set, the rest management api is served on this address.
+	// Example: ":8081"
+	APIAddr string `yaml:"api_addr"`
+	// the bearer token required by the api. If empty the ROSPO_API_TOKEN
+	// env var is used
+	APIToken string `yaml:"api_token"`
 }
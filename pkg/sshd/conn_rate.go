@@ -0,0 +1,51 @@
+package sshd
+
+import (
+	"math"
+	"time"
+)
+
+// connRateLimiter is a token bucket limiting the accepted connections.
+// It is used by the accept loop only
+type connRateLimiter struct {
+	// the tokens added per second and the bucket size
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// newConnRateLimiter builds a limiter accepting rate connections per
+// second on average and burst at once. If burst is not positive the
+// rate rounded up is used. It returns nil, no limit, if rate is not
+// positive
+func newConnRateLimiter(rate float64, burst int) *connRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &connRateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// allow takes a token, if any. A nil limiter allows everything
+func (l *connRateLimiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
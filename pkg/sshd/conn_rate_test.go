@@ -0,0 +1,42 @@
+package sshd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnRateLimiter(t *testing.T) {
+	if l := newConnRateLimiter(0, 5); l != nil || !l.allow(time.Now()) {
+		t.Fatal("a zero rate must not limit")
+	}
+
+	l := newConnRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow(now) {
+			t.Fatalf("connection %d of the burst denied", i)
+		}
+	}
+	if l.allow(now) {
+		t.Fatal("the connection over the burst was allowed")
+	}
+	// two tokens per second
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow(now) || l.allow(now) {
+		t.Fatal("expected a single token after 500ms")
+	}
+	// the bucket doesn't grow over the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allow(now) {
+			t.Fatalf("connection %d of the refilled burst denied", i)
+		}
+	}
+	if l.allow(now) {
+		t.Fatal("the bucket grew over the burst")
+	}
+
+	if l := newConnRateLimiter(2.5, 0); l.burst != 3 {
+		t.Fatalf("unexpected default burst %v", l.burst)
+	}
+}
@@ -0,0 +1,35 @@
+package sshd
+
+import (
+	"fmt"
+	"path"
+)
+
+// ValidateAcceptEnv returns an error if any of the accept_env patterns is
+// not a valid path.Match glob
+func ValidateAcceptEnv(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// acceptsEnv reports if the clients can set the name environment
+// variable: the user environment must be permitted and, if acceptEnv is
+// set, the name must match one of its patterns
+func (s *sshServer) acceptsEnv(name string) bool {
+	if !s.permitUserEnvironment {
+		return false
+	}
+	if len(s.acceptEnv) == 0 {
+		return true
+	}
+	for _, pattern := range s.acceptEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
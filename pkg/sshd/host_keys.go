@@ -0,0 +1,187 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyPaths returns the server_key, if set, followed by the server_keys:
+// file paths or the other utils.ReadKeySource sources. The server_key comes
+// first so that the known_hosts entries pinned to it keep working when more
+// keys are added. Without server_keys the companion key follows, if it
+// exists or the server_key file is missing and both are generated
+func hostKeyPaths(conf *SshDConf) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, p := range append([]string{conf.Key}, conf.Keys...) {
+		p, _ = utils.ExpandUserHome(p)
+		if p == "" || seen[p] {
+			continue
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	if companion, _ := companionKey(conf); companion != "" {
+		key, _ := utils.ExpandUserHome(conf.Key)
+		if _, err := os.Stat(key); err != nil {
+			paths = append(paths, companion)
+		} else if _, err := os.Stat(companion); err == nil {
+			paths = append(paths, companion)
+		}
+	}
+	return paths
+}
+
+// companionKey returns the path and the type of the key generated along
+// with a missing server_key file when server_keys is not set, so that the
+// clients can negotiate both an ed25519 and an rsa key. The type is rsa,
+// or ed25519 for an rsa server_key, and the path is the server_key one
+// followed by the type, as server_key_rsa
+func companionKey(conf *SshDConf) (string, string) {
+	if len(conf.Keys) != 0 || conf.Key == "" || !utils.IsKeyFile(conf.Key) {
+		return "", ""
+	}
+	keyType := utils.KeyAlgorithmRSA
+	if conf.KeyType == utils.KeyAlgorithmRSA || conf.KeyType == utils.KeyAlgorithmRSA4096 {
+		keyType = utils.KeyAlgorithmEd25519
+	}
+	key, _ := utils.ExpandUserHome(conf.Key)
+	return key + "_" + keyType, keyType
+}
+
+// keyTypeOf maps an ssh public key type to the GeneratePrivateKey algorithm
+func keyTypeOf(pub ssh.PublicKey) string {
+	switch t := pub.Type(); {
+	case t == ssh.KeyAlgoRSA:
+		return utils.KeyAlgorithmRSA
+	case strings.HasPrefix(t, "ecdsa-"):
+		return utils.KeyAlgorithmECDSA
+	}
+	return utils.KeyAlgorithmEd25519
+}
+
+// generatedKeyType returns the type of the missing key generated at path.
+// The server_key uses server_key_type and the companion key its own type.
+// The other keys use the type in their file name, as ssh_host_rsa_key, or
+// the first of ed25519, rsa and ecdsa that no other key has
+func generatedKeyType(conf *SshDConf, path string, used map[string]bool) (string, int) {
+	if key, _ := utils.ExpandUserHome(conf.Key); key == path {
+		return conf.KeyType, conf.KeyBits
+	}
+	if companion, keyType := companionKey(conf); companion == path {
+		return keyType, 0
+	}
+	name := strings.ToLower(filepath.Base(path))
+	for _, t := range []string{utils.KeyAlgorithmEd25519, utils.KeyAlgorithmECDSA, utils.KeyAlgorithmRSA} {
+		if strings.Contains(name, t) {
+			return t, 0
+		}
+	}
+	for _, t := range []string{utils.KeyAlgorithmEd25519, utils.KeyAlgorithmRSA, utils.KeyAlgorithmECDSA} {
+		if !used[t] {
+			return t, 0
+		}
+	}
+	return utils.KeyAlgorithmEd25519, 0
+}
+
+// generateHostKey writes a new server key of keyType to path, and its
+// public key to path.pub, the one to use in the known_hosts file
+func generateHostKey(path string, keyType string, bits int, passphrase string) ([]byte, error) {
+	key, err := utils.GeneratePrivateKey(keyType, bits)
+	if err != nil {
+		return nil, err
+	}
+	var pass []byte
+	if passphrase != "" {
+		pass = []byte(passphrase)
+	}
+	encoded, err := utils.EncodePrivateKeyToPEM(key, pass)
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WriteKeyToFile(encoded, path); err != nil {
+		return nil, err
+	}
+	publicKey, err := utils.GeneratePublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if err := utils.WritePublicKeyToFile(publicKey, path+".pub"); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// loadHostKeys loads the server keys, generating the missing ones. Each
+// key must have its own algorithm: the clients negotiate the strongest
+// one they support
+func loadHostKeys(log *slog.Logger, conf *SshDConf) ([]ssh.Signer, error) {
+	paths := hostKeyPaths(conf)
+	if len(paths) == 0 {
+		return nil, errors.New("server_key is not set")
+	}
+
+	signers := make([]ssh.Signer, len(paths))
+	used := make(map[string]bool)
+	var missing []int
+	for i, path := range paths {
+		name := utils.KeySourceName(path)
+		log.Info("loading server key", "path", name)
+		var (
+			data []byte
+			err  error
+		)
+		if utils.IsKeyFile(path) {
+			data, err = os.ReadFile(path)
+			if err != nil {
+				missing = append(missing, i)
+				continue
+			}
+			if err := checkHostKeyPermissions(log, path, conf.StrictKeyPermissions); err != nil {
+				return nil, err
+			}
+		} else if data, err = utils.ReadKeySource(path); err != nil {
+			// the keys that are not files are never generated
+			return nil, fmt.Errorf("cannot read server key %s: %w", name, err)
+		}
+		signer, err := parseHostKey(data, conf.KeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse server key %s: %w", name, err)
+		}
+		signers[i] = signer
+		used[keyTypeOf(signer.PublicKey())] = true
+	}
+	for _, i := range missing {
+		path := paths[i]
+		keyType, bits := generatedKeyType(conf, path, used)
+		log.Info("server identity do not exists. Generating one...", "path", path, "type", keyType, "bits", bits)
+		data, err := generateHostKey(path, keyType, bits, conf.KeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate server key %s: %w", path, err)
+		}
+		signer, err := parseHostKey(data, conf.KeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse server key %s: %w", path, err)
+		}
+		signers[i] = signer
+		used[keyTypeOf(signer.PublicKey())] = true
+	}
+
+	algorithms := make(map[string]string)
+	for i, signer := range signers {
+		t := signer.PublicKey().Type()
+		if other, ok := algorithms[t]; ok {
+			return nil, fmt.Errorf("the server keys %s and %s are both %s keys", utils.KeySourceName(other), utils.KeySourceName(paths[i]), t)
+		}
+		algorithms[t] = paths[i]
+	}
+	return signers, nil
+}
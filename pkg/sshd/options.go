@@ -0,0 +1,22 @@
+package sshd
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures the ssh server
+type Option = options.Option
+
+// WithLogger sets the server logger
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
+
+// WithTracer enables the tracing of the direct-tcpip channels served by the server. Rospo clients send
+// their span context, so that the server spans join the client traces
+func WithTracer(t trace.Tracer) Option {
+	return options.WithTracer(t)
+}
@@ -0,0 +1,187 @@
+package sshd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CastHeader is the asciicast v2 recording header, the first line of the
+// file
+type CastHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// CastEvent is an asciicast v2 event line: [time, type, data]. The time
+// is in seconds from the recording start. The types written are "o", the
+// terminal output, and "r", the resizes with a "COLSxROWS" data
+type CastEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+func (e CastEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{e.Time, e.Type, e.Data})
+}
+
+func (e *CastEvent) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("invalid event: %d fields, expected 3", len(fields))
+	}
+	if err := json.Unmarshal(fields[0], &e.Time); err != nil {
+		return fmt.Errorf("invalid event time: %w", err)
+	}
+	if err := json.Unmarshal(fields[1], &e.Type); err != nil {
+		return fmt.Errorf("invalid event type: %w", err)
+	}
+	if err := json.Unmarshal(fields[2], &e.Data); err != nil {
+		return fmt.Errorf("invalid event data: %w", err)
+	}
+	return nil
+}
+
+// recordingFileName returns the recording file name of a session started
+// at t by the client with the fingerprint key. The fingerprint is made
+// file name safe
+func recordingFileName(t time.Time, fingerprint string) string {
+	if fingerprint == "" {
+		fingerprint = "nokey"
+	}
+	fingerprint = strings.TrimPrefix(fingerprint, "SHA256:")
+	fingerprint = strings.NewReplacer("/", "_", "+", "-", ":", "").Replace(fingerprint)
+	return fmt.Sprintf("%s-%s", t.Format("2006-01-02-15-04-05"), fingerprint)
+}
+
+// sessionRecorder writes the pty output of a session as an asciicast v2
+// file. Its writes never fail, so that it can be teed with the client
+// channel: the recording errors are logged and the recording stopped. All
+// its methods can be called on a nil sessionRecorder, doing nothing
+type sessionRecorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	enc   *json.Encoder
+	start time.Time
+	// the trailing bytes of an utf8 sequence split between writes
+	pending []byte
+
+	log *slog.Logger
+}
+
+// newSessionRecorder creates the recording file in dir and writes the
+// header. A numeric suffix is added if a recording with the same name
+// exists
+func newSessionRecorder(dir string, fingerprint string, header CastHeader, log *slog.Logger) (*sessionRecorder, error) {
+	start := time.Now()
+	name := recordingFileName(start.UTC(), fingerprint)
+	var f *os.File
+	var err error
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, name+".cast")
+		if i > 0 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d.cast", name, i))
+		}
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if !errors.Is(err, os.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	header.Version = 2
+	header.Timestamp = start.Unix()
+	r := &sessionRecorder{
+		f:     f,
+		enc:   json.NewEncoder(f),
+		start: start,
+		log:   log.With("recording", f.Name()),
+	}
+	if err := r.enc.Encode(header); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	r.log.Info("recording the session")
+	return r, nil
+}
+
+// Write records p as an output event
+func (r *sessionRecorder) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.pending, p...)
+	// keep an incomplete utf8 sequence for the next write, json would
+	// replace it with the replacement char
+	cut := len(data)
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				cut = len(data) - i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte{}, data[cut:]...)
+	if cut > 0 {
+		r.event("o", string(data[:cut]))
+	}
+	return len(p), nil
+}
+
+// resize records a terminal resize event
+func (r *sessionRecorder) resize(cols, rows uint32) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// event writes the event. It must be called holding mu
+func (r *sessionRecorder) event(kind string, data string) {
+	if r.enc == nil {
+		return
+	}
+	e := CastEvent{Time: time.Since(r.start).Seconds(), Type: kind, Data: data}
+	if err := r.enc.Encode(e); err != nil {
+		r.log.Error("cannot write the session recording, stopping it", "error", err)
+		r.enc = nil
+	}
+}
+
+// Close writes the pending output and closes the recording file
+func (r *sessionRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+	r.enc = nil
+	return r.f.Close()
+}
@@ -2,12 +2,14 @@ package sshd
 
 import (
 	"fmt"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
+	"github.com/ferama/rospo/pkg/rio"
+	"github.com/ferama/rospo/pkg/utils"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -20,16 +22,20 @@ type requestHandler struct {
 	forwards   map[string]net.Listener
 	forwardsMu sync.Mutex
 
-	forwardsKeepAliveInterval time.Duration
+	// the level the forwarded connections data is compressed with. 0 if
+	// the client didn't ask for the compression
+	compressionLevel int
+
+	log *slog.Logger
 }
 
-func newRequestHandler(server *sshServer, sshConn *ssh.ServerConn, reqs <-chan *ssh.Request) *requestHandler {
+func newRequestHandler(server *sshServer, sshConn *ssh.ServerConn, reqs <-chan *ssh.Request, log *slog.Logger) *requestHandler {
 	return &requestHandler{
-		server:                    server,
-		sshConn:                   sshConn,
-		reqs:                      reqs,
-		forwards:                  make(map[string]net.Listener),
-		forwardsKeepAliveInterval: 5 * time.Second,
+		server:   server,
+		sshConn:  sshConn,
+		reqs:     reqs,
+		forwards: make(map[string]net.Listener),
+		log:      log,
 	}
 }
 
@@ -39,7 +45,7 @@ func (r *requestHandler) tcpipForwardHandler(req *ssh.Request) {
 		Port uint32
 	}{}
 	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-		log.Printf("Unable to unmarshal payload")
+		r.log.Error("unable to unmarshal tcpip-forward payload", "error", err)
 		req.Reply(false, []byte{})
 		return
 	}
@@ -49,7 +55,7 @@ func (r *requestHandler) tcpipForwardHandler(req *ssh.Request) {
 
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Printf("listen failed for %s %s", addr, err)
+		r.log.Error("listen failed", "addr", addr, "error", err)
 		req.Reply(false, []byte{})
 		return
 	}
@@ -70,31 +76,49 @@ func (r *requestHandler) tcpipForwardHandler(req *ssh.Request) {
 		// fix the addr value too
 		addr = fmt.Sprintf("[%s]:%d", laddr, lport)
 	}
-	log.Printf("tcpip-forward listening for %s", addr)
+	r.log.Info("tcpip-forward listening", "addr", addr)
 	var replyPayload = struct{ Port uint32 }{lport}
 
 	// Tell client everything is OK
 	req.Reply(true, ssh.Marshal(replyPayload))
 
 	// handle session
-	forwardSessionHandler := newSessionHandler(r.sshConn, listener, laddr, lport)
-	go forwardSessionHandler.handleSession()
-
-	// run checkAlive
-	go r.checkAlive(r.sshConn, listener, addr)
+	forwardSessionHandler := newSessionHandler(r.log, r.sshConn, listener, laddr, lport, r.server.forwardStatsInterval)
+	forwardSessionHandler.compressionLevel = r.compressionLevel
+	forwardSessionHandler.bufferSize = r.server.bufferSize
+	r.audit(AuditForwardStarted, listener.Addr().String())
+	go func() {
+		forwardSessionHandler.handleSession()
+		r.audit(AuditForwardStopped, listener.Addr().String())
+	}()
 
 	r.forwardsMu.Lock()
 	r.forwards[addr] = listener
 	r.forwardsMu.Unlock()
 }
 
+// audit records the tcpip-forward event of the listener at addr
+func (r *requestHandler) audit(event string, addr string) {
+	e := AuditEntry{
+		Event:      event,
+		User:       r.sshConn.User(),
+		RemoteAddr: r.sshConn.RemoteAddr().String(),
+		Forward:    "tcpip-forward",
+		Local:      addr,
+	}
+	if r.sshConn.Permissions != nil {
+		e.Fingerprint = r.sshConn.Permissions.Extensions["pubkey-fp"]
+	}
+	r.server.audit.Log(e)
+}
+
 func (r *requestHandler) cancelTcpIpForwardHandler(req *ssh.Request) {
 	var payload = struct {
 		Addr string
 		Port uint32
 	}{}
 	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
-		log.Printf("Unable to unmarshal payload")
+		r.log.Error("unable to unmarshal cancel-tcpip-forward payload", "error", err)
 		req.Reply(false, []byte{})
 		return
 	}
@@ -104,6 +128,7 @@ func (r *requestHandler) cancelTcpIpForwardHandler(req *ssh.Request) {
 	addr := fmt.Sprintf("[%s]:%d", laddr, lport)
 	r.forwardsMu.Lock()
 	ln, ok := r.forwards[addr]
+	delete(r.forwards, addr)
 	r.forwardsMu.Unlock()
 	if ok {
 		ln.Close()
@@ -111,7 +136,10 @@ func (r *requestHandler) cancelTcpIpForwardHandler(req *ssh.Request) {
 	req.Reply(true, nil)
 }
 
+// handleRequests serves the global requests. When the connection is
+// closed its forwards are closed too
 func (r *requestHandler) handleRequests() {
+	defer r.closeForwards()
 	for req := range r.reqs {
 		switch req.Type {
 		case "tcpip-forward":
@@ -119,6 +147,11 @@ func (r *requestHandler) handleRequests() {
 				req.Reply(false, nil)
 				continue
 			}
+			if !portForwardingAllowed(r.sshConn.Permissions) {
+				r.log.Warn("port forwarding not allowed for the key", "fingerprint", r.sshConn.Permissions.Extensions["pubkey-fp"])
+				req.Reply(false, nil)
+				continue
+			}
 			r.tcpipForwardHandler(req)
 
 		case "cancel-tcpip-forward":
@@ -127,33 +160,43 @@ func (r *requestHandler) handleRequests() {
 				continue
 			}
 			r.cancelTcpIpForwardHandler(req)
+		case utils.TraceContextRequest:
+			// the direct-tcpip channels can carry the client span context
+			req.Reply(true, nil)
+		case utils.CompressionRequest:
+			var payload utils.CompressionPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				r.log.Error("unable to unmarshal compression payload", "error", err)
+				req.Reply(false, nil)
+				continue
+			}
+			if payload.Level == 0 || rio.ValidateCompressionLevel(int(payload.Level)) != nil {
+				r.log.Error("invalid compression level", "level", payload.Level)
+				req.Reply(false, nil)
+				continue
+			}
+			// the request is handled before the tcpip-forward ones, as
+			// the requests are served in order
+			r.compressionLevel = int(payload.Level)
+			r.log.Debug("compression enabled", "level", r.compressionLevel)
+			req.Reply(true, nil)
 		default:
 			if strings.Contains(req.Type, "keepalive") {
 				req.Reply(true, nil)
 				continue
 			}
-			log.Printf("received out-of-band request: %+v", req)
+			r.log.Debug("received out-of-band request", "type", req.Type)
 		}
 	}
 }
 
-func (r *requestHandler) checkAlive(sshConn *ssh.ServerConn, ln net.Listener, addr string) {
-	ticker := time.NewTicker(r.forwardsKeepAliveInterval)
-
-	defer func() {
+// closeForwards closes all the tcpip-forward listeners
+func (r *requestHandler) closeForwards() {
+	r.forwardsMu.Lock()
+	defer r.forwardsMu.Unlock()
+	for addr, ln := range r.forwards {
+		r.log.Info("closing the forward of the terminated connection", "addr", addr)
 		ln.Close()
-		r.forwardsMu.Lock()
 		delete(r.forwards, addr)
-		r.forwardsMu.Unlock()
-	}()
-
-	log.Println("starting check for forward availability")
-	for {
-		<-ticker.C
-		_, _, err := sshConn.SendRequest("checkalive@rospo", true, nil)
-		if err != nil {
-			log.Printf("forward endpoint not available anymore. Closing socket %s", ln.Addr())
-			break
-		}
 	}
 }
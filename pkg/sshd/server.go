@@ -1,29 +1,58 @@
 package sshd
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/metrics"
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/utils"
 
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
-var log = logger.NewLogger("[SSHD] ", logger.Blue)
+// ConnectedClient is a client logged in the server
+type ConnectedClient struct {
+	RemoteAddr string `json:"remote_addr"`
+	User       string `json:"user"`
+	// the public key fingerprint. Empty if the client didn't log in
+	// with a key
+	Fingerprint string    `json:"fingerprint"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// the id in the session_id field of the client log lines
+	SessionID string `json:"session_id"`
+}
 
 // sshServer instance
 type sshServer struct {
-	hostPrivateKey    ssh.Signer
-	authorizedKeysURI []string
-	password          string
-	listenAddress     *string
+	// one key per algorithm
+	hostKeys       []ssh.Signer
+	hostCertSigner ssh.Signer
+	authorizedKeys *authorizedKeys
+	password       string
+	listenAddress  *string
+	systemdSocket  bool
+	loginGraceTime time.Duration
+	// the client alive requests interval. Disabled if 0
+	clientAliveInterval time.Duration
+	clientAliveCountMax int
+	// nil if the audit log is not enabled
+	audit *auditLog
 
 	disableShell         bool
 	disableAuth          bool
@@ -31,144 +60,257 @@ type sshServer struct {
 	disableSftpSubsystem bool
 	disableTunnelling    bool
 
+	permitTTY bool
+	// the env requests are honored only if permitUserEnvironment is set,
+	// for the variables matching acceptEnv
+	permitUserEnvironment bool
+	acceptEnv             []string
+
+	forwardStatsInterval time.Duration
+	// the forwards copy loops buffer size
+	bufferSize int
+
+	recordSessions bool
+	recordingDir   string
+
+	requireTOTP     bool
+	totpSecretsFile string
+
 	shellExecutable string
+	shellWorkingDir string
+	allowedCommands []string
+	subsystems      map[string]string
+	sftpLimits      *sftpLimits
 
 	listener   net.Listener
 	listenerMU sync.RWMutex
 
 	activeSessions  int
 	activeSessionMu sync.Mutex
+	// the active client connections. Closed on Stop. The value is nil
+	// until the client logs in
+	connections map[net.Conn]*ConnectedClient
+	stopped     atomic.Bool
+	// the running serveConnection calls. Stop waits for them, so that
+	// their audit entries are written before the audit log is closed
+	serving sync.WaitGroup
+	// the new connections rate limit. nil if unlimited
+	connRate *connRateLimiter
+
+	recorder metrics.Recorder
+	tracer   trace.Tracer
+	log      *slog.Logger
 }
 
-// NewSshServer builds an SshServer object
-func NewSshServer(conf *SshDConf) *sshServer {
-	keyPath, _ := utils.ExpandUserHome(conf.Key)
-	if keyPath == "" {
-		log.Fatalln("server_key is not set")
+// NewSshServer builds an SshServer object. It returns an error if conf
+// is not valid
+func NewSshServer(conf *SshDConf, opts ...Option) (*sshServer, error) {
+	o := options.Build(opts)
+	log := o.Logger.With("subsystem", "sshd")
+
+	if err := utils.ValidateKeyAlgorithm(conf.KeyType, conf.KeyBits); err != nil {
+		return nil, fmt.Errorf("invalid server_key_type: %w", err)
 	}
-	log.Printf("loading server key at: '%s'", keyPath)
-	hostPrivateKey, err := os.ReadFile(keyPath)
-	log.Printf("authorized_keys: %s", conf.AuthorizedKeysURI)
+	log.Info("authorized_keys", "uri", conf.AuthorizedKeysURI)
+	hostKeys, err := loadHostKeys(log, conf)
 	if err != nil {
-		log.Println("server identity do not exists. Generating one...")
-		key, err := utils.GeneratePrivateKey()
+		return nil, fmt.Errorf("invalid server key: %w", err)
+	}
+
+	var hostCertSigner ssh.Signer
+	if conf.HostCertificate != "" {
+		certPath, _ := utils.ExpandUserHome(conf.HostCertificate)
+		log.Info("loading host certificate", "path", certPath)
+		hostCertSigner, err = loadHostCertSigner(certPath, hostKeys)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("invalid host certificate: %w", err)
+		}
+	}
+
+	if err := ValidateAllowedCommands(conf.AllowedCommands); err != nil {
+		return nil, fmt.Errorf("invalid allowed_commands: %w", err)
+	}
+	if err := ValidateAcceptEnv(conf.AcceptEnv); err != nil {
+		return nil, fmt.Errorf("invalid accept_env: %w", err)
+	}
+	if conf.RecordSessions {
+		if conf.RecordingDir == "" {
+			return nil, errors.New("invalid config: record_sessions requires recording_dir")
 		}
-		encoded := utils.EncodePrivateKeyToPEM(key)
-		if err := utils.WriteKeyToFile(encoded, keyPath); err != nil {
-			panic(err)
+		if err := os.MkdirAll(conf.RecordingDir, 0700); err != nil {
+			return nil, fmt.Errorf("cannot create the recording dir: %w", err)
 		}
-		hostPrivateKey = encoded
+	}
+	if err := rio.ValidateBufferSize(conf.BufferSize); err != nil {
+		return nil, fmt.Errorf("invalid buffer_size: %w", err)
+	}
 
-		// this is the one to use in the known_hosts file
-		publicKey, err := utils.GeneratePublicKey(&key.PublicKey)
-		if err != nil {
-			panic(err)
+	if conf.RequireTOTP {
+		if conf.TOTPSecretsFile == "" {
+			return nil, errors.New("require_totp is set but totp_secrets_file is empty")
+		}
+		// the secrets are enrolled per public key: the password logins
+		// would skip the second factor
+		if conf.AuthorizedPassword != "" {
+			return nil, errors.New("require_totp can't be set with authorized_password")
+		}
+		if _, err := loadTOTPSecrets(conf.TOTPSecretsFile); err != nil {
+			return nil, fmt.Errorf("cannot load the totp secrets: %w", err)
 		}
-		utils.WriteKeyToFile(publicKey, keyPath+".pub")
 	}
 
-	hostPrivateKeySigner, err := ssh.ParsePrivateKey(hostPrivateKey)
-	if err != nil {
-		log.Fatalln(err)
+	shellWorkingDir, _ := utils.ExpandUserHome(conf.ShellWorkingDir)
+	if shellWorkingDir != "" {
+		if info, err := os.Stat(shellWorkingDir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("shell_working_dir %s is not a directory", shellWorkingDir)
+		}
+	}
+
+	if conf.MaxConnRate < 0 || conf.MaxConnBurst < 0 {
+		return nil, fmt.Errorf("invalid max_conn_rate %v or max_conn_burst %d: they must not be negative",
+			conf.MaxConnRate, conf.MaxConnBurst)
+	}
+	if conf.LoginGraceTime < 0 {
+		return nil, fmt.Errorf("invalid login_grace_time %s: it must not be negative", conf.LoginGraceTime)
+	}
+	if conf.ClientAliveInterval < 0 || conf.ClientAliveCountMax < 0 {
+		return nil, fmt.Errorf("invalid client_alive_interval %s or client_alive_count_max %d: they must not be negative",
+			conf.ClientAliveInterval, conf.ClientAliveCountMax)
+	}
+
+	var audit *auditLog
+	if conf.AuditLog != "" {
+		if conf.AuditLogKey == "" {
+			log.Warn("audit_log_key is not set: the audit log changes can't be detected reliably")
+		}
+		audit, err = newAuditLog(conf.AuditLog, []byte(conf.AuditLogKey), log)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open the audit log %s: %w", conf.AuditLog, err)
+		}
 	}
 
 	ss := &sshServer{
-		authorizedKeysURI:    conf.AuthorizedKeysURI,
+		hostCertSigner: hostCertSigner,
+		authorizedKeys: newAuthorizedKeys(log, conf.AuthorizedKeysURI,
+			conf.AuthorizedKeysRefreshInterval, conf.AuthorizedKeysCacheTTL, conf.AuthorizedKeysFetchTimeout),
 		password:             conf.AuthorizedPassword,
-		hostPrivateKey:       hostPrivateKeySigner,
+		hostKeys:             hostKeys,
 		shellExecutable:      conf.ShellExecutable,
+		shellWorkingDir:      shellWorkingDir,
+		allowedCommands:      conf.AllowedCommands,
+		subsystems:           conf.Subsystems,
+		sftpLimits:           newSftpLimits(conf.SftpMaxConcurrentRequests, conf.SftpMaxFileSize),
 		disableShell:         conf.DisableShell,
 		disableBanner:        conf.DisableBanner,
 		disableSftpSubsystem: conf.DisableSftpSubsystem,
 		disableAuth:          conf.DisableAuth,
 		disableTunnelling:    conf.DisableTunnelling,
+		forwardStatsInterval: conf.ForwardStatsInterval,
+		bufferSize:           conf.BufferSize,
+		recordSessions:       conf.RecordSessions,
+		recordingDir:         conf.RecordingDir,
+		requireTOTP:          conf.RequireTOTP,
+		totpSecretsFile:      conf.TOTPSecretsFile,
 
 		listenAddress:  &conf.ListenAddress,
+		systemdSocket:  conf.SystemdSocket,
+		loginGraceTime: conf.LoginGraceTime,
+
+		clientAliveInterval: conf.ClientAliveInterval,
+		clientAliveCountMax: conf.ClientAliveCountMax,
+
+		permitTTY:             conf.PermitTTY == nil || *conf.PermitTTY,
+		permitUserEnvironment: conf.PermitUserEnvironment,
+		acceptEnv:             conf.AcceptEnv,
+
+		connRate: newConnRateLimiter(conf.MaxConnRate, conf.MaxConnBurst),
+
+		audit:          audit,
 		activeSessions: 0,
+		connections:    make(map[net.Conn]*ConnectedClient),
+		recorder:       metrics.Nop,
+		tracer:         o.GetTracer(),
+		log:            log,
+	}
+	if ss.loginGraceTime == 0 {
+		ss.loginGraceTime = DefaultLoginGraceTime
+	}
+	if ss.clientAliveCountMax == 0 {
+		ss.clientAliveCountMax = DefaultClientAliveCountMax
 	}
 	// run here, to make sure I have a valid authorized keys
 	// file on start
 	if !conf.DisableAuth {
-		res := ss.loadAuthorizedKeys()
+		ss.authorizedKeys.refresh(true)
+		res := ss.authorizedKeys.merged()
 		if len(res) == 0 && conf.AuthorizedPassword == "" {
-			log.Fatalf(`failed to load authorized_keys, err: %v
-	
-	You need an authorized_keys source. You can create and 
-	use an ./authorized_keys file and fill in with 
+			audit.Close()
+			return nil, errors.New(`failed to load authorized_keys.
+
+	You need an authorized_keys source. You can create and
+	use an ./authorized_keys file and fill in with
 	your authorized users public keys. You can optionally use
 	an http endpoint that serves your authorized_keys.
-	Run "rospo sshd --help" for more info
-
-`, err)
+	Run "rospo sshd --help" for more info`)
 		}
 	}
 
-	return ss
+	return ss, nil
 }
 
-func (s *sshServer) parseAuthorizedKeysBytes(bytes []byte) (map[string]bool, error) {
-	authorizedKeysMap := map[string]bool{}
-	authorizedKeysBytes := bytes
-	for len(authorizedKeysBytes) > 0 {
-		pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
-		if err != nil {
-			return authorizedKeysMap, err
-		}
-
-		authorizedKeysMap[string(pubKey.Marshal())] = true
-		authorizedKeysBytes = rest
+// checkHostKeyPermissions verifies that the host key at keyPath is not
+// accessible by others. It returns an error only in strict mode, logging
+// a warning otherwise
+func checkHostKeyPermissions(log *slog.Logger, keyPath string, strict bool) error {
+	err := utils.CheckKeyFilePermissions(keyPath)
+	if err == nil {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("refusing to use server key: %s", err)
 	}
-	return authorizedKeysMap, nil
+	log.Warn("insecure server key permissions", "error", err)
+	return nil
 }
 
-func (s *sshServer) loadAuthorizedKeys() map[string]bool {
-	res := map[string]bool{}
-	mergeMap := func(m map[string]bool) {
-		for k, v := range m {
-			res[k] = v
-		}
+// loadHostCertSigner loads the host certificate at certPath and pairs it
+// with the host key it is signed for. It fails if the certificate is not a
+// host certificate for one of the signers public keys or if it is not
+// valid now
+func loadHostCertSigner(certPath string, signers []ssh.Signer) (ssh.Signer, error) {
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read host certificate %s: %s", certPath, err)
 	}
-
-	for _, keyURI := range s.authorizedKeysURI {
-		u, err := url.ParseRequestURI(keyURI)
-		if err != nil || u.Scheme == "" {
-			log.Println("loading keys from file", keyURI)
-			path, err := utils.ExpandUserHome(keyURI)
-			if err != nil {
-				continue
-			}
-			authorizedKeysBytes, err := os.ReadFile(path)
-			if err != nil {
-				continue
-			}
-			result, err := s.parseAuthorizedKeysBytes(authorizedKeysBytes)
-			if err == nil {
-				mergeMap(result)
-			}
-		} else {
-			if u.Scheme == "http" || u.Scheme == "https" {
-				log.Println("loading keys from http", keyURI)
-				res, err := http.Get(u.String())
-				if err != nil {
-					log.Println("failed to load keys from http", err)
-					continue
-				}
-
-				bytes, err := io.ReadAll(res.Body)
-				if err != nil {
-					log.Println("failed to read http body", err)
-					continue
-				}
-				result, err := s.parseAuthorizedKeysBytes(bytes)
-				if err == nil {
-					mergeMap(result)
-				}
-			}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse host certificate %s: %s", certPath, err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ssh certificate", certPath)
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s is not a host certificate", certPath)
+	}
+	var signer ssh.Signer
+	for _, s := range signers {
+		if bytes.Equal(cert.Key.Marshal(), s.PublicKey().Marshal()) {
+			signer = s
+			break
 		}
 	}
-	return res
+	if signer == nil {
+		return nil, fmt.Errorf("host certificate %s doesn't match the server key", certPath)
+	}
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter {
+		return nil, fmt.Errorf("host certificate %s is not valid yet", certPath)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore {
+		return nil, fmt.Errorf("host certificate %s is expired", certPath)
+	}
+	return ssh.NewCertSigner(cert, signer)
 }
 
 func (s *sshServer) passwordAuth(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
@@ -179,19 +321,75 @@ func (s *sshServer) passwordAuth(conn ssh.ConnMetadata, password []byte) (*ssh.P
 }
 
 func (s *sshServer) keyAuth(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-	log.Println(conn.RemoteAddr(), "authenticate with", pubKey.Type())
+	s.log.Info("public key authentication", "remote_addr", conn.RemoteAddr().String(), "key_type", pubKey.Type())
+
+	authorizedKeysMap := s.authorizedKeys.load()
+
+	if opts, ok := authorizedKeysMap[string(pubKey.Marshal())]; ok {
+		perms := keyPermissions(ssh.FingerprintSHA256(pubKey), opts)
+		if s.requireTOTP {
+			// the TOTP code is asked as a second factor
+			return nil, &ssh.PartialSuccessError{
+				Next: ssh.ServerAuthCallbacks{
+					KeyboardInteractiveCallback: s.totpCallback(perms),
+				},
+			}
+		}
+		return perms, nil
+	}
+	return nil, fmt.Errorf("unknown public key for %q", conn.User())
+}
+
+// keyPermissions returns the permissions of a client logged in with the
+// key fingerprint fp and the authorized_keys options opts
+func keyPermissions(fp string, opts *keyOptions) *ssh.Permissions {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		// Record the public key used for authentication.
+		Extensions: map[string]string{
+			"pubkey-fp": fp,
+		},
+	}
+	if opts.command != "" {
+		perms.CriticalOptions["force-command"] = opts.command
+	}
+	if opts.noPortForwarding {
+		perms.Extensions[noPortForwardingExtension] = ""
+	}
+	if len(opts.permitOpen) > 0 {
+		perms.Extensions[permitOpenExtension] = strings.Join(opts.permitOpen, ",")
+	}
+	return perms
+}
 
-	authorizedKeysMap := s.loadAuthorizedKeys()
+// SetMetricsRecorder sets the recorder that collects the server auth and
+// connection events. It needs to be called before Start
+func (s *sshServer) SetMetricsRecorder(recorder metrics.Recorder) {
+	s.recorder = recorder
+}
 
-	if authorizedKeysMap[string(pubKey.Marshal())] {
-		return &ssh.Permissions{
-			// Record the public key used for authentication.
-			Extensions: map[string]string{
-				"pubkey-fp": ssh.FingerprintSHA256(pubKey),
-			},
-		}, nil
+func (s *sshServer) authLog(conn ssh.ConnMetadata, method string, err error) {
+	// the none method is tried by clients to get the supported ones
+	if method == "none" {
+		return
+	}
+	// the second factor outcome is the one recorded
+	var partialErr *ssh.PartialSuccessError
+	if errors.As(err, &partialErr) {
+		return
+	}
+	if err != nil {
+		s.recorder.SshdAuthAttempt(metrics.AuthFailure)
+		s.audit.Log(AuditEntry{
+			Event:      AuditAuthFailure,
+			User:       conn.User(),
+			RemoteAddr: conn.RemoteAddr().String(),
+			Method:     method,
+			Reason:     err.Error(),
+		})
+	} else {
+		s.recorder.SshdAuthAttempt(metrics.AuthSuccess)
 	}
-	return nil, fmt.Errorf("unknown public key for %q", conn.User())
 }
 
 func (s *sshServer) GetActiveSessionsCount() int {
@@ -201,41 +399,119 @@ func (s *sshServer) GetActiveSessionsCount() int {
 	return s.activeSessions
 }
 
+// GetConnectedClients returns the clients logged in the server
+func (s *sshServer) GetConnectedClients() []ConnectedClient {
+	s.activeSessionMu.Lock()
+	defer s.activeSessionMu.Unlock()
+
+	clients := []ConnectedClient{}
+	for _, client := range s.connections {
+		if client != nil {
+			clients = append(clients, *client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+	return clients
+}
+
+// DisconnectClient closes the connections of the clients logged in with
+// the public key fingerprint. It returns how many were closed
+func (s *sshServer) DisconnectClient(fingerprint string) int {
+	s.activeSessionMu.Lock()
+	defer s.activeSessionMu.Unlock()
+
+	n := 0
+	for conn, client := range s.connections {
+		if client != nil && client.Fingerprint != "" && client.Fingerprint == fingerprint {
+			s.log.Info("disconnecting client", "remote_addr", client.RemoteAddr, "fingerprint", fingerprint)
+			conn.Close()
+			n++
+		}
+	}
+	return n
+}
+
 // serve sshd client connection
 func (s *sshServer) serveConnection(conn net.Conn, config ssh.ServerConfig) {
-	log.Printf("connection from %s", conn.RemoteAddr())
+	log := s.log.With("remote_addr", conn.RemoteAddr().String())
+	log.Info("connection accepted")
 	s.activeSessionMu.Lock()
 	s.activeSessions++
-	log.Printf("active sessions: %d", s.activeSessions)
+	s.connections[conn] = nil
+	log.Info("session started", "active_sessions", s.activeSessions)
 	s.activeSessionMu.Unlock()
 
 	defer func() {
-		log.Println("client session terminated")
 		s.activeSessionMu.Lock()
 		s.activeSessions--
-		log.Printf("active sessions: %d", s.activeSessions)
+		delete(s.connections, conn)
+		log.Info("client session terminated", "active_sessions", s.activeSessions)
 		s.activeSessionMu.Unlock()
 	}()
 
-	// From a standard TCP connection to an encrypted SSH connection
+	// From a standard TCP connection to an encrypted SSH connection.
+	// The clients stalling before the login are disconnected
+	conn.SetDeadline(time.Now().Add(s.loginGraceTime))
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, &config)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		log.Warn("login grace time exceeded, disconnecting", "login_grace_time", s.loginGraceTime.String())
+		return
+	}
 	if err != nil {
-		log.Printf("client connection error %s", err)
+		log.Error("client connection error", "error", err)
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	// the session id correlates the lines logged from now on, down to the
+	// session termination one
+	sessionID := newSessionID()
+	log = log.With("session_id", sessionID)
+	client := &ConnectedClient{
+		RemoteAddr:  conn.RemoteAddr().String(),
+		User:        sshConn.User(),
+		ConnectedAt: time.Now(),
+		SessionID:   sessionID,
+	}
 	if !s.disableAuth {
-		log.Printf("logged in %s", sshConn.Permissions.Extensions["pubkey-fp"])
+		client.Fingerprint = sshConn.Permissions.Extensions["pubkey-fp"]
+		log.Info("logged in", "fingerprint", client.Fingerprint)
 	} else {
-		log.Println("logged in WITHOUT authentication")
+		log.Warn("logged in WITHOUT authentication")
+	}
+	s.audit.Log(AuditEntry{
+		Event:       AuditAuthSuccess,
+		User:        client.User,
+		RemoteAddr:  client.RemoteAddr,
+		Fingerprint: client.Fingerprint,
+	})
+	defer s.audit.Log(AuditEntry{
+		Event:       AuditClientDisconnected,
+		User:        client.User,
+		RemoteAddr:  client.RemoteAddr,
+		Fingerprint: client.Fingerprint,
+	})
+	s.activeSessionMu.Lock()
+	if _, ok := s.connections[conn]; ok {
+		s.connections[conn] = client
 	}
+	s.activeSessionMu.Unlock()
+	s.recorder.SshdClientConnected()
+	defer s.recorder.SshdClientDisconnected()
 
-	requestHandler := newRequestHandler(s, sshConn, reqs)
+	requestHandler := newRequestHandler(s, sshConn, reqs, log)
 	go requestHandler.handleRequests()
 
+	if s.clientAliveInterval > 0 {
+		go s.clientAlive(log, sshConn)
+	}
+
 	channelHandler := newChannelHandler(
 		s,
 		sshConn,
 		chans,
+		log,
 	)
 
 	// blocks until chans is closed (session terminates)
@@ -243,9 +519,77 @@ func (s *sshServer) serveConnection(conn net.Conn, config ssh.ServerConfig) {
 
 }
 
+// newSessionID returns a random id for the client connection log lines
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clientAlive sends the client alive requests until the connection is
+// closed. The connection is closed if clientAliveCountMax consecutive
+// requests are not answered within the interval
+func (s *sshServer) clientAlive(log *slog.Logger, sshConn *ssh.ServerConn) {
+	closed := make(chan struct{})
+	go func() {
+		sshConn.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(s.clientAliveInterval)
+	defer ticker.Stop()
+
+	// a request is sent only when the previous one was answered
+	replies := make(chan error, 1)
+	pending := false
+	misses := 0
+	for {
+		select {
+		case <-closed:
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			misses = 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					// any reply, even a failure one, means the client is alive
+					_, _, err := sshConn.SendRequest("keepalive@openssh.com", true, nil)
+					replies <- err
+				}()
+				continue
+			}
+			misses++
+			if misses >= s.clientAliveCountMax {
+				log.Warn("client alive timeout, disconnecting", "misses", misses, "client_alive_interval", s.clientAliveInterval.String())
+				sshConn.Close()
+				return
+			}
+		}
+	}
+}
+
+// parseHostKey parses the server key, decrypting it with passphrase
+// if it is not empty
+func parseHostKey(key []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		return nil, fmt.Errorf("the server key is passphrase protected, set the server_key_passphrase option: %w", err)
+	}
+	return signer, err
+}
+
 // Start the sshServer actually listening for incoming connections
-// and handling requests and ssh channels
-func (s *sshServer) Start() {
+// and handling requests and ssh channels. It returns nil when ctx is
+// canceled or Stop is called, an error if it can't listen
+func (s *sshServer) Start(ctx context.Context) error {
 	bannerCb := func(conn ssh.ConnMetadata) string {
 		return `
  .---------------.
@@ -261,9 +605,16 @@ func (s *sshServer) Start() {
 	config := ssh.ServerConfig{
 		BannerCallback: bannerCb,
 	}
-	config.AddHostKey(s.hostPrivateKey)
-	if *s.listenAddress == "" {
-		log.Fatalf("listen port can't be empty")
+	for _, signer := range s.hostKeys {
+		config.AddHostKey(signer)
+	}
+	if s.hostCertSigner != nil {
+		// the cert signer has its own key format so it doesn't
+		// replace the plain key
+		config.AddHostKey(s.hostCertSigner)
+	}
+	if *s.listenAddress == "" && !s.systemdSocket {
+		return errors.New("listen port can't be empty")
 	}
 
 	if !s.disableAuth {
@@ -272,31 +623,93 @@ func (s *sshServer) Start() {
 			config.PasswordCallback = s.passwordAuth
 			config.MaxAuthTries = 3
 		} else {
-			// one try only. I'm supporting public key auth.
-			// If it fails, there is nothing more to try
-			config.MaxAuthTries = 1
+			// public key auth only. Clients can offer several keys,
+			// allow as many tries as the OpenSSH default
+			config.MaxAuthTries = 6
 		}
 		config.PublicKeyCallback = s.keyAuth
+		config.AuthLogCallback = s.authLog
 	} else {
 		config.NoClientAuth = true
 	}
 
-	listener, err := net.Listen("tcp", *s.listenAddress)
+	var listener net.Listener
+	var err error
+	if s.systemdSocket {
+		listener, err = systemdListener()
+	} else {
+		listener, err = net.Listen("tcp", *s.listenAddress)
+	}
 
 	s.listenerMU.Lock()
 	s.listener = listener
 	s.listenerMU.Unlock()
 
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("cannot listen: %w", err)
+	}
+	s.log.Info("listening", "addr", listener.Addr().String(), "systemd_socket", s.systemdSocket)
+	if s.systemdSocket {
+		if err := sdNotify("READY=1"); err != nil {
+			s.log.Warn("cannot notify systemd", "error", err)
+		}
+	}
+	stop := context.AfterFunc(ctx, s.Stop)
+	defer stop()
+	if !s.disableAuth && s.authorizedKeys.hasHTTPSources() {
+		refreshCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go s.authorizedKeys.refreshLoop(refreshCtx)
 	}
-	log.Printf("listening on %s\n", listener.Addr())
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			panic(err)
+			if s.stopped.Load() || ctx.Err() != nil {
+				s.log.Info("server stopped")
+				return nil
+			}
+			return err
+		}
+		if !s.connRate.allow(time.Now()) {
+			s.log.Debug("connection rate exceeded, closing", "remote_addr", conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+		s.activeSessionMu.Lock()
+		if s.stopped.Load() {
+			s.activeSessionMu.Unlock()
+			conn.Close()
+			continue
 		}
-		go s.serveConnection(conn, config)
+		s.serving.Add(1)
+		s.activeSessionMu.Unlock()
+		go func() {
+			defer s.serving.Done()
+			s.serveConnection(conn, config)
+		}()
+	}
+}
+
+// Stop closes the server listener and all the active client connections,
+// then flushes and closes the audit log
+func (s *sshServer) Stop() {
+	s.stopped.Store(true)
+
+	s.listenerMU.RLock()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.listenerMU.RUnlock()
+
+	s.activeSessionMu.Lock()
+	for conn := range s.connections {
+		conn.Close()
+	}
+	s.activeSessionMu.Unlock()
+
+	s.serving.Wait()
+	if err := s.audit.Close(); err != nil {
+		s.log.Error("cannot close the audit log", "error", err)
 	}
 }
 
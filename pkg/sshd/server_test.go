@@ -1,13 +1,33 @@
 package sshd
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ferama/rospo/pkg/sshc"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/pkg/sftp"
+	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -18,13 +38,24 @@ func getPort(addr net.Addr) string {
 
 func startD(disableSftp bool) (*sshServer, string) {
 	serverConf := &SshDConf{
-		Key:                  "../../testdata/server",
-		ListenAddress:        "127.0.0.1:0",
 		DisableSftpSubsystem: disableSftp,
 	}
-	serverConf.AuthorizedKeysURI = []string{"../../testdata/authorized_keys"}
-	sd := NewSshServer(serverConf)
-	go sd.Start()
+	return startDWithConf(serverConf)
+}
+
+// startDWithConf starts a server using the test key and authorized_keys
+// on a random port
+func startDWithConf(serverConf *SshDConf, opts ...Option) (*sshServer, string) {
+	serverConf.Key = "../../testdata/server"
+	serverConf.ListenAddress = "127.0.0.1:0"
+	if len(serverConf.AuthorizedKeysURI) == 0 {
+		serverConf.AuthorizedKeysURI = []string{"../../testdata/authorized_keys"}
+	}
+	sd, err := NewSshServer(serverConf, opts...)
+	if err != nil {
+		panic(err)
+	}
+	go sd.Start(context.Background())
 	var addr net.Addr
 	for {
 		addr = sd.GetListenerAddr()
@@ -40,14 +71,17 @@ func startD(disableSftp bool) (*sshServer, string) {
 func getSSHConn(sshdPort string) *sshc.SshConnection {
 	// create an ssh client
 	clientConf := &sshc.SshClientConf{
-		Identity:  "../../testdata/client",
+		Identity:  sshc.Identities{"../../testdata/client"},
 		Insecure:  true, // disable known_hosts check
 		JumpHosts: make([]*sshc.JumpHostConf, 0),
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
 	}
 
-	client := sshc.NewSshConnection(clientConf)
-	go client.Start()
+	client, err := sshc.NewSshConnection(clientConf)
+	if err != nil {
+		panic(err)
+	}
+	go client.Start(context.Background())
 	client.ReadyWait()
 
 	return client
@@ -112,3 +146,1859 @@ func TestSftpDisabled(t *testing.T) {
 		t.Fatal("expected sftp subsystem to be disabled")
 	}
 }
+
+func TestShellDisabled(t *testing.T) {
+	_, sshdPort := startDWithConf(&SshDConf{DisableShell: true})
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, _ := sess.StderrPipe()
+	if err := sess.Shell(); err == nil {
+		t.Fatal("expected shell request to be rejected")
+	}
+	// the message is sent before the request reply
+	buf := make([]byte, 256)
+	n, _ := stderr.Read(buf)
+	sess.Close()
+	if !strings.Contains(string(buf[:n]), "shell access is disabled") {
+		t.Fatalf("expected an explanatory message, got '%s'", string(buf[:n]))
+	}
+
+	sftpClient, err := sftp.NewClient(conn.Client)
+	if err != nil {
+		t.Fatalf("expected sftp to work with shell disabled: %s", err)
+	}
+	defer sftpClient.Close()
+	if _, err := sftpClient.Getwd(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubsystems(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test subsystem uses cat")
+	}
+	_, sshdPort := startDWithConf(&SshDConf{
+		Subsystems: map[string]string{"echo": "cat"},
+	})
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, _ := sess.StdinPipe()
+	stdout, _ := sess.StdoutPipe()
+	if err := sess.RequestSubsystem("echo"); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Write([]byte("subsystem test"))
+	stdin.Close()
+	out, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "subsystem test" {
+		t.Fatalf("expected 'subsystem test', got '%s'", string(out))
+	}
+
+	sess, _ = conn.Client.NewSession()
+	if err := sess.RequestSubsystem("unknown"); err == nil {
+		t.Fatal("expected unknown subsystem to be rejected")
+	}
+
+	// the builtin sftp is still available
+	sftpClient, err := sftp.NewClient(conn.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sftpClient.Close()
+}
+
+func TestInvalidConf(t *testing.T) {
+	newConf := func() *SshDConf {
+		return &SshDConf{
+			Key:               "../../testdata/server",
+			ListenAddress:     "127.0.0.1:0",
+			AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		}
+	}
+	for _, change := range []func(c *SshDConf){
+		func(c *SshDConf) { c.AuthorizedKeysURI = []string{"missing_authorized_keys"} },
+		func(c *SshDConf) { c.LoginGraceTime = -time.Second },
+		func(c *SshDConf) { c.RecordSessions = true },
+		func(c *SshDConf) { c.ShellWorkingDir = "../../testdata/server" },
+	} {
+		conf := newConf()
+		change(conf)
+		if _, err := NewSshServer(conf); err == nil {
+			t.Fatalf("expected an error for %+v", conf)
+		}
+	}
+
+	// the listen errors are returned by Start
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conf := newConf()
+	conf.ListenAddress = l.Addr().String()
+	sd, err := NewSshServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.Start(context.Background()); err == nil {
+		t.Fatal("expected the address in use error")
+	}
+}
+
+func TestHostKeyPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permission bits are not used on windows")
+	}
+	keyPath := filepath.Join(t.TempDir(), "server_key")
+	if _, err := NewSshServer(&SshDConf{
+		Key:                  keyPath,
+		ListenAddress:        "127.0.0.1:0",
+		AuthorizedKeysURI:    []string{"../../testdata/authorized_keys"},
+		StrictKeyPermissions: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// generated keys must have a safe mode
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected private key mode 0600, got %#o", info.Mode().Perm())
+	}
+	info, err = os.Stat(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("expected public key mode 0644, got %#o", info.Mode().Perm())
+	}
+
+	if err := checkHostKeyPermissions(slog.Default(), keyPath, true); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Chmod(keyPath, 0644)
+	if err := checkHostKeyPermissions(slog.Default(), keyPath, false); err != nil {
+		t.Fatalf("expected a warning only, got %s", err)
+	}
+	if err := checkHostKeyPermissions(slog.Default(), keyPath, true); err == nil {
+		t.Fatal("expected world readable key to be refused in strict mode")
+	}
+}
+
+func TestHostKeyType(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "server_key")
+	conf := &SshDConf{
+		Key:               keyPath,
+		KeyType:           utils.KeyAlgorithmECDSA,
+		KeyBits:           384,
+		ListenAddress:     "127.0.0.1:0",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+	}
+	if _, err := NewSshServer(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := parseHostKey(encoded, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoECDSA384 {
+		t.Fatalf("unexpected key type %s", signer.PublicKey().Type())
+	}
+	pubBytes, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub.Marshal(), signer.PublicKey().Marshal()) {
+		t.Fatal("the public key doesn't match the generated one")
+	}
+
+	// the existing key is kept whatever the type
+	conf.KeyType, conf.KeyBits = utils.KeyAlgorithmRSA, 2048
+	if _, err := NewSshServer(conf); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(keyPath); !bytes.Equal(again, encoded) {
+		t.Fatal("the existing key was replaced")
+	}
+}
+
+// hostKeyOffered returns the host key the server negotiates with a client
+// supporting only the algorithms
+func hostKeyOffered(t *testing.T, sshdPort string, algorithms []string) ssh.PublicKey {
+	clientBytes, _ := os.ReadFile("../../testdata/client")
+	clientSigner, _ := ssh.ParsePrivateKey(clientBytes)
+	var offered ssh.PublicKey
+	conn, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+		User:              "test",
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+		HostKeyAlgorithms: algorithms,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			offered = key
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	return offered
+}
+
+func TestHostKeys(t *testing.T) {
+	extraPath := filepath.Join(t.TempDir(), "extra_key")
+	sd, sshdPort := startDWithConf(&SshDConf{Keys: []string{extraPath}})
+	defer sd.Stop()
+
+	// the missing key is generated with the algorithm the server_key
+	// doesn't have
+	extraBytes, err := os.ReadFile(extraPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra, err := parseHostKey(extraBytes, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Fatalf("unexpected generated key type %s", extra.PublicKey().Type())
+	}
+
+	key := hostKeyOffered(t, sshdPort, []string{ssh.KeyAlgoED25519})
+	if !bytes.Equal(key.Marshal(), extra.PublicKey().Marshal()) {
+		t.Fatalf("expected the ed25519 key, got %s", key.Type())
+	}
+	// the clients knowing the server_key keep getting it
+	serverBytes, _ := os.ReadFile("../../testdata/server.pub")
+	serverKey, _, _, _, _ := ssh.ParseAuthorizedKey(serverBytes)
+	key = hostKeyOffered(t, sshdPort, []string{ssh.KeyAlgoRSASHA256})
+	if !bytes.Equal(key.Marshal(), serverKey.Marshal()) {
+		t.Fatalf("expected the server_key, got %s", key.Type())
+	}
+}
+
+func TestHostKeysGenerated(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	conf := &SshDConf{Keys: []string{filepath.Join(dir, "first"), filepath.Join(dir, "second")}}
+	signers, err := loadHostKeys(log, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 ||
+		signers[0].PublicKey().Type() != ssh.KeyAlgoED25519 ||
+		signers[1].PublicKey().Type() != ssh.KeyAlgoRSA {
+		t.Fatalf("expected an ed25519 and an rsa key, got %d keys", len(signers))
+	}
+
+	// the type in the file name wins
+	named := filepath.Join(dir, "ssh_host_ecdsa_key")
+	conf.Keys = append(conf.Keys, named)
+	signers, err = loadHostKeys(log, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signers[2].PublicKey().Type() != ssh.KeyAlgoECDSA256 {
+		t.Fatalf("unexpected key type %s", signers[2].PublicKey().Type())
+	}
+
+	// two keys of the same algorithm
+	dup := filepath.Join(dir, "ssh_host_ed25519_key")
+	conf.Keys = []string{filepath.Join(dir, "first"), dup}
+	if _, err := loadHostKeys(log, conf); err == nil {
+		t.Fatal("expected the duplicated algorithm to be refused")
+	}
+}
+
+func TestHostKeysCompanion(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "server_key")
+	conf := &SshDConf{
+		Key:               keyPath,
+		ListenAddress:     "127.0.0.1:0",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+	}
+	start := func() (*sshServer, string) {
+		sd, err := NewSshServer(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sd.Start(context.Background())
+		for sd.GetListenerAddr() == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return sd, getPort(sd.GetListenerAddr())
+	}
+	sd, sshdPort := start()
+	defer func() { sd.Stop() }()
+
+	// both an ed25519 and an rsa key are generated and offered
+	for path, algorithm := range map[string]string{
+		keyPath:          ssh.KeyAlgoED25519,
+		keyPath + "_rsa": ssh.KeyAlgoRSASHA256,
+	} {
+		pubBytes, err := os.ReadFile(path + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := hostKeyOffered(t, sshdPort, []string{algorithm})
+		if !bytes.Equal(key.Marshal(), pub.Marshal()) {
+			t.Fatalf("%s: expected the %s key, got %s", algorithm, path, key.Type())
+		}
+	}
+
+	// the existing companion key is loaded again
+	rsaBytes, _ := os.ReadFile(keyPath + "_rsa")
+	sd.Stop()
+	sd, sshdPort = start()
+	if again, _ := os.ReadFile(keyPath + "_rsa"); !bytes.Equal(again, rsaBytes) {
+		t.Fatal("the existing companion key was replaced")
+	}
+	if key := hostKeyOffered(t, sshdPort, []string{ssh.KeyAlgoRSASHA256}); key.Type() != ssh.KeyAlgoRSA {
+		t.Fatalf("expected the rsa key, got %s", key.Type())
+	}
+}
+
+func TestHostKeySources(t *testing.T) {
+	serverPEM, _ := os.ReadFile("../../testdata/server")
+	clientPEM, _ := os.ReadFile("../../testdata/client")
+	t.Setenv("ROSPO_TEST_SERVER_KEY", string(serverPEM))
+	conf := &SshDConf{
+		Key:               "env:ROSPO_TEST_SERVER_KEY",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd, err := NewSshServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	client, err := sshc.NewSshConnection(&sshc.SshClientConf{
+		Identity:  sshc.Identities{string(clientPEM)},
+		Insecure:  true,
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: sd.GetListenerAddr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	if err := client.ReadyWait(); err != nil {
+		t.Fatal(err)
+	}
+	// the keys that are not files are never generated
+	if _, err := os.Stat(conf.Key + ".pub"); err == nil {
+		t.Fatal("unexpected public key file written")
+	}
+
+	t.Setenv("ROSPO_TEST_SERVER_KEY", "")
+	if _, err := loadHostKeys(slog.New(slog.NewTextHandler(io.Discard, nil)), conf); err == nil {
+		t.Fatal("expected an error for the unset env var")
+	}
+}
+
+func TestHostKeyPassphrase(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "server_key")
+	conf := &SshDConf{
+		Key:               keyPath,
+		KeyPassphrase:     "rospo",
+		ListenAddress:     "127.0.0.1:0",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+	}
+	// the generated key is encrypted
+	if _, err := NewSshServer(conf); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseHostKey(encoded, ""); err == nil ||
+		!strings.Contains(err.Error(), "server_key_passphrase") {
+		t.Fatalf("expected a passphrase required error, got %v", err)
+	}
+	if _, err := parseHostKey(encoded, "wrong"); err == nil {
+		t.Fatal("expected wrong passphrase to fail")
+	}
+
+	// the existing protected key is loaded
+	sd, err := NewSshServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	client := getSSHConn(getPort(sd.GetListenerAddr()))
+	client.Stop()
+}
+
+func writeHostCert(t *testing.T, key ssh.PublicKey, validBefore uint64) (string, ssh.PublicKey) {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSigner, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		KeyId:           "rospo-test",
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     validBefore,
+	}
+	if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "server-cert.pub")
+	if err := os.WriteFile(path, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, caSigner.PublicKey()
+}
+
+func TestHostCertificate(t *testing.T) {
+	keyBytes, err := os.ReadFile("../../testdata/server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expired certificate
+	expiredPath, _ := writeHostCert(t, signer.PublicKey(), uint64(time.Now().Add(-time.Hour).Unix()))
+	if _, err := loadHostCertSigner(expiredPath, []ssh.Signer{signer}); err == nil {
+		t.Fatal("expected expired certificate to be refused")
+	}
+
+	// certificate for another key
+	clientBytes, _ := os.ReadFile("../../testdata/client")
+	clientSigner, _ := ssh.ParsePrivateKey(clientBytes)
+	otherPath, _ := writeHostCert(t, clientSigner.PublicKey(), ssh.CertTimeInfinity)
+	if _, err := loadHostCertSigner(otherPath, []ssh.Signer{signer}); err == nil {
+		t.Fatal("expected certificate for another key to be refused")
+	}
+
+	certPath, caKey := writeHostCert(t, signer.PublicKey(), ssh.CertTimeInfinity)
+	sd, err := NewSshServer(&SshDConf{
+		Key:               "../../testdata/server",
+		HostCertificate:   certPath,
+		ListenAddress:     "127.0.0.1:0",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return string(auth.Marshal()) == string(caKey.Marshal())
+		},
+	}
+	client, err := ssh.Dial("tcp", sd.GetListenerAddr().String(), &ssh.ClientConfig{
+		User:              "rospo",
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+		HostKeyCallback:   checker.CheckHostKey,
+		HostKeyAlgorithms: []string{ssh.CertAlgoRSASHA256v01},
+	})
+	if err != nil {
+		t.Fatalf("expected the host certificate to be accepted: %s", err)
+	}
+	client.Close()
+
+	// clients that don't accept certificates still get the plain key
+	client, err = ssh.Dial("tcp", sd.GetListenerAddr().String(), &ssh.ClientConfig{
+		User:              "rospo",
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(clientSigner)},
+		HostKeyCallback:   ssh.FixedHostKey(signer.PublicKey()),
+		HostKeyAlgorithms: []string{ssh.KeyAlgoRSASHA256},
+	})
+	if err != nil {
+		t.Fatalf("expected the plain host key to be accepted: %s", err)
+	}
+	client.Close()
+}
+
+func TestSftpLimits(t *testing.T) {
+	_, sshdPort := startDWithConf(&SshDConf{
+		SftpMaxConcurrentRequests: 2,
+		SftpMaxFileSize:           1024,
+	})
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	sftpClient, err := sftp.NewClient(conn.Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sftpClient.Close()
+
+	dir := t.TempDir()
+	write := func(name string, size int) error {
+		f, err := sftpClient.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(make([]byte, size))
+		return err
+	}
+	if err := write("small", 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("big", 2048); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected a permission denied error, got %v", err)
+	}
+	if err := sftpClient.Truncate(filepath.Join(dir, "small"), 4096); err == nil {
+		t.Fatal("expected the truncate over the limit to fail")
+	}
+
+	// requests over the concurrency limit wait for a free slot
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := sftpClient.Stat(filepath.Join(dir, "small"))
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := sftpClient.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+}
+
+func TestSftpLimitsSemaphore(t *testing.T) {
+	limits := newSftpLimits(1, 0)
+	release := limits.acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		limits.acquire()()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("expected acquire to block")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("expected acquire to succeed after release")
+	}
+}
+
+// syncBuffer is a goroutine safe log destination
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	records := []map[string]any{}
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		record := map[string]any{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestStructuredLogging(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	sd, sshdPort := startDWithConf(&SshDConf{}, WithLogger(logger))
+	defer sd.Stop()
+
+	conn := getSSHConn(sshdPort)
+	conn.Stop()
+
+	var found map[string]any
+	for i := 0; i < 20 && found == nil; i++ {
+		for _, r := range out.records(t) {
+			if r["msg"] == "logged in" {
+				found = r
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if found == nil {
+		t.Fatal("logged in record not found")
+	}
+	if found["level"] != "INFO" {
+		t.Fatalf("unexpected level %v", found["level"])
+	}
+	if found["subsystem"] != "sshd" {
+		t.Fatalf("unexpected subsystem %v", found["subsystem"])
+	}
+	if addr, _ := found["remote_addr"].(string); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("unexpected remote_addr %v", found["remote_addr"])
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	sd, sshdPort := startDWithConf(&SshDConf{}, WithLogger(logger))
+	defer sd.Stop()
+
+	conn := getSSHConn(sshdPort)
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+	clients := sd.GetConnectedClients()
+	if len(clients) != 1 || clients[0].SessionID == "" {
+		t.Fatalf("unexpected clients %+v", clients)
+	}
+	conn.Stop()
+
+	// the session lines carry the connected client session id
+	want := []string{"logged in", "channel open", "client session terminated"}
+	var found map[string]map[string]any
+	for i := 0; i < 20 && len(found) < len(want); i++ {
+		found = map[string]map[string]any{}
+		for _, r := range out.records(t) {
+			for _, msg := range want {
+				if r["msg"] == msg {
+					found[msg] = r
+				}
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, msg := range want {
+		if found[msg] == nil {
+			t.Fatalf("%s record not found", msg)
+		}
+		if found[msg]["session_id"] != clients[0].SessionID {
+			t.Fatalf("unexpected %s session_id %v, want %s", msg, found[msg]["session_id"], clients[0].SessionID)
+		}
+	}
+}
+
+func TestForwardStats(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	sd, sshdPort := startDWithConf(&SshDConf{
+		ForwardStatsInterval: 100 * time.Millisecond,
+	}, WithLogger(logger))
+	defer sd.Stop()
+
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	listener, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("0123456789"))
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var found map[string]any
+	for i := 0; i < 20 && found == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+		for _, r := range out.records(t) {
+			if r["msg"] == "forward summary" && r["bytes_out"] == float64(10) {
+				found = r
+			}
+		}
+	}
+	client.Close()
+	if found == nil {
+		t.Fatal("forward summary record not found")
+	}
+	if found["addr"] != "[127.0.0.1]:"+getPort(listener.Addr()) {
+		t.Fatalf("unexpected addr %v", found["addr"])
+	}
+	if found["connections"] != float64(1) || found["active_connections"] != float64(1) {
+		t.Fatalf("unexpected connections %v %v", found["connections"], found["active_connections"])
+	}
+	if found["bytes_in"] != float64(10) {
+		t.Fatalf("unexpected bytes_in %v", found["bytes_in"])
+	}
+}
+
+func TestAuthorizedKeysSources(t *testing.T) {
+	key1, _ := os.ReadFile("../../testdata/client.pub")
+	key2, _ := os.ReadFile("../../testdata/client2.pub")
+	pub1, _, _, _, _ := ssh.ParseAuthorizedKey(key1)
+	pub2, _, _, _, _ := ssh.ParseAuthorizedKey(key2)
+
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(key2)
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "authorized_keys")
+	os.WriteFile(file, append(key1, []byte("# trailing comment\n")...), 0600)
+
+	keys := newAuthorizedKeys(slog.Default(), []string{"file://" + file, srv.URL, "missing_authorized_keys"}, time.Hour, time.Hour, 0)
+	keys.refresh(true)
+	res := keys.load()
+	if len(res) != 2 || res[string(pub1.Marshal())] == nil || res[string(pub2.Marshal())] == nil {
+		t.Fatalf("expected the keys of both sources, got %d keys", len(res))
+	}
+
+	// the failing http sources keep their keys, the invalid file ones are
+	// revoked
+	failing.Store(true)
+	os.WriteFile(file, []byte("invalid"), 0600)
+	keys.refresh(true)
+	res = keys.load()
+	if len(res) != 1 || res[string(pub2.Marshal())] == nil {
+		t.Fatalf("expected the previous http keys only, got %d keys", len(res))
+	}
+
+	os.WriteFile(file, key1, 0600)
+	res = keys.load()
+	if len(res) != 2 || res[string(pub1.Marshal())] == nil {
+		t.Fatalf("expected the updated file keys, got %d keys", len(res))
+	}
+
+	// the removed file revokes its keys
+	os.Remove(file)
+	res = keys.load()
+	if len(res) != 1 || res[string(pub1.Marshal())] != nil {
+		t.Fatalf("expected the file keys to be revoked, got %d keys", len(res))
+	}
+}
+
+func TestAuthorizedKeysMergedOptions(t *testing.T) {
+	key1, _ := os.ReadFile("../../testdata/client.pub")
+	key2, _ := os.ReadFile("../../testdata/client2.pub")
+	pub1, _, _, _, _ := ssh.ParseAuthorizedKey(key1)
+	pub2, _, _, _, _ := ssh.ParseAuthorizedKey(key2)
+
+	dir := t.TempDir()
+	restricted := filepath.Join(dir, "restricted")
+	os.WriteFile(restricted, []byte(
+		`command="uptime",no-port-forwarding `+string(key1)+
+			`permitopen="localhost:80",permitopen="localhost:443" `+string(key2)), 0600)
+	unrestricted := filepath.Join(dir, "unrestricted")
+	os.WriteFile(unrestricted, append(append([]byte{}, key1...), key2...), 0600)
+
+	// the unrestricted lines don't lift the restrictions, in any order
+	for _, uris := range [][]string{{restricted, unrestricted}, {unrestricted, restricted}} {
+		res := newAuthorizedKeys(slog.Default(), uris, time.Hour, time.Hour, 0).load()
+		opts1, opts2 := res[string(pub1.Marshal())], res[string(pub2.Marshal())]
+		if opts1 == nil || opts1.command != "uptime" || !opts1.noPortForwarding {
+			t.Fatalf("%v: unexpected options %+v", uris, opts1)
+		}
+		if opts2 == nil || fmt.Sprint(opts2.permitOpen) != "[localhost:80 localhost:443]" {
+			t.Fatalf("%v: unexpected options %+v", uris, opts2)
+		}
+	}
+
+	// the permitopen lists are intersected, the conflicting options
+	// refuse the key
+	other := filepath.Join(dir, "other")
+	os.WriteFile(other, []byte(
+		`command="id" `+string(key1)+
+			`permitopen="localhost:443",permitopen="localhost:8080" `+string(key2)), 0600)
+	res := newAuthorizedKeys(slog.Default(), []string{restricted, other}, time.Hour, time.Hour, 0).load()
+	if res[string(pub1.Marshal())] != nil {
+		t.Fatal("expected the key with different commands to be refused")
+	}
+	if opts2 := res[string(pub2.Marshal())]; opts2 == nil || fmt.Sprint(opts2.permitOpen) != "[localhost:443]" {
+		t.Fatalf("unexpected options %+v", opts2)
+	}
+}
+
+func TestAuthorizedKeysInvalidLine(t *testing.T) {
+	key1, _ := os.ReadFile("../../testdata/client.pub")
+	key2, _ := os.ReadFile("../../testdata/client2.pub")
+	pub1, _, _, _, _ := ssh.ParseAuthorizedKey(key1)
+	pub2, _, _, _, _ := ssh.ParseAuthorizedKey(key2)
+
+	file := filepath.Join(t.TempDir(), "authorized_keys")
+	data := append([]byte{}, key1...)
+	data = append(data, []byte("\nssh-ed25519 not-a-key\n")...)
+	data = append(data, key2...)
+	os.WriteFile(file, data, 0600)
+
+	keys := newAuthorizedKeys(slog.Default(), []string{file}, time.Hour, time.Hour, 0)
+	res := keys.load()
+	if len(res) != 2 || res[string(pub1.Marshal())] == nil || res[string(pub2.Marshal())] == nil {
+		t.Fatalf("expected the keys around the invalid line, got %d keys", len(res))
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	keyBytes, _ := os.ReadFile("../../testdata/client")
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otpKey, err := totp.Generate(totp.GenerateOpts{Issuer: "rospo", AccountName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretsFile := filepath.Join(t.TempDir(), "totp_secrets")
+	os.WriteFile(secretsFile, []byte("# enrolled keys\n"+ssh.FingerprintSHA256(signer.PublicKey())+" "+otpKey.Secret()+"\n"), 0600)
+
+	sd, sshdPort := startDWithConf(&SshDConf{
+		RequireTOTP:     true,
+		TOTPSecretsFile: secretsFile,
+	})
+	defer sd.Stop()
+
+	// the password logins would skip the second factor
+	_, err = NewSshServer(&SshDConf{
+		Key:                "../../testdata/server",
+		RequireTOTP:        true,
+		TOTPSecretsFile:    secretsFile,
+		AuthorizedPassword: "secret",
+	})
+	if err == nil || !strings.Contains(err.Error(), "authorized_password") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	connect := func(code string) error {
+		client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+			User: "test",
+			Auth: []ssh.AuthMethod{
+				ssh.PublicKeys(signer),
+				ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+					return []string{code}, nil
+				}),
+			},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	code, err := totp.GenerateCode(otpKey.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(code); err != nil {
+		t.Fatalf("expected the login to succeed, got %s", err)
+	}
+	if err := connect("000000"); err == nil && code != "000000" {
+		t.Fatal("expected a wrong code to fail")
+	}
+
+	// the public key alone is not enough
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+		t.Fatal("expected the login without totp code to fail")
+	}
+}
+
+func TestAuthorizedKeysCache(t *testing.T) {
+	key, _ := os.ReadFile("../../testdata/client.pub")
+	var requests atomic.Int32
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(key)
+	}))
+	defer srv.Close()
+
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	ttl := 200 * time.Millisecond
+	keys := newAuthorizedKeys(logger, []string{srv.URL}, time.Hour, ttl, 0)
+
+	// the first load fetches the source, the next ones use the cache
+	for i := 0; i < 3; i++ {
+		if len(keys.load()) != 1 {
+			t.Fatal("expected the http source key")
+		}
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("expected 1 request, got %d", requests.Load())
+	}
+
+	// expired cache with an unreachable source
+	failing.Store(true)
+	time.Sleep(ttl)
+	for i := 0; i < 3; i++ {
+		if len(keys.load()) != 1 {
+			t.Fatal("expected the last known good key")
+		}
+	}
+	if requests.Load() != 2 {
+		t.Fatalf("expected 2 requests, got %d", requests.Load())
+	}
+	found := false
+	for _, r := range out.records(t) {
+		if r["msg"] == "failed to load authorized_keys, serving the last known good keys" && r["age"] != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected a staleness log record")
+	}
+}
+
+func TestDisconnectClient(t *testing.T) {
+	sd, sshdPort := startD(false)
+	defer sd.Stop()
+	client := getSSHConn(sshdPort)
+	defer client.Stop()
+
+	clients := sd.GetConnectedClients()
+	if len(clients) != 1 || clients[0].Fingerprint == "" {
+		t.Fatalf("unexpected connected clients %v", clients)
+	}
+	if n := sd.DisconnectClient("SHA256:unknown"); n != 0 {
+		t.Fatalf("disconnected %d clients with an unknown fingerprint", n)
+	}
+	if n := sd.DisconnectClient(clients[0].Fingerprint); n != 1 {
+		t.Fatalf("expected 1 disconnected client, got %d", n)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	cases := map[string][]string{
+		"rsync --server -e.Lsf . /backup": {"rsync", "--server", "-e.Lsf", ".", "/backup"},
+		`git-upload-pack 'my repo.git'`:   {"git-upload-pack", "my repo.git"},
+		`echo "a \"b\"" c\ d ''`:          {"echo", `a "b"`, "c d", ""},
+		"echo a; rm -rf /":                {"echo", "a;", "rm", "-rf", "/"},
+		"  ":                              {},
+	}
+	for command, expected := range cases {
+		args, err := splitCommand(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(args) != fmt.Sprint(expected) || len(args) != len(expected) {
+			t.Fatalf("%s: expected %q, got %q", command, expected, args)
+		}
+	}
+	if _, err := splitCommand(`echo "a`); err == nil {
+		t.Fatal("expected an unterminated quote error")
+	}
+}
+
+func TestAllowedCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need a posix system")
+	}
+	if err := ValidateAllowedCommands([]string{"git-["}); err == nil {
+		t.Fatal("expected an invalid pattern error")
+	}
+
+	sd, sshdPort := startDWithConf(&SshDConf{AllowedCommands: []string{"echo", "git-*"}})
+	defer sd.Stop()
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	// the shell doesn't interpret the command
+	stdout, _, code, err := conn.Run(context.Background(), "echo 'a b'; ls", nil)
+	if err != nil || code != 0 || string(stdout) != "a b; ls\n" {
+		t.Fatalf("unexpected result %q %d %v", stdout, code, err)
+	}
+
+	for _, command := range []string{"ls", "/tmp/echo", "sh -c 'echo a'", "echo 'a"} {
+		_, stderr, code, err := conn.Run(context.Background(), command, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != deniedCommandExitStatus || !strings.Contains(string(stderr), "command not allowed") {
+			t.Fatalf("%s: expected the command to be denied, got %d %q", command, code, stderr)
+		}
+	}
+
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := sshc.ExitCode(sess.Wait()); code != deniedCommandExitStatus {
+		t.Fatalf("expected the shell to be denied, got %d", code)
+	}
+}
+
+func TestExecSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need a posix system")
+	}
+	sd, sshdPort := startDWithConf(&SshDConf{})
+	defer sd.Stop()
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start(`trap 'echo terminated; exit 3' TERM; echo started; sleep 10 & wait`); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(stdout)
+	if line, err := reader.ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("unexpected output %q %v", line, err)
+	}
+	if err := sess.Signal(ssh.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := reader.ReadString('\n'); line != "terminated\n" {
+		t.Fatalf("expected the command to be terminated, got %q", line)
+	}
+	if code, _ := sshc.ExitCode(sess.Wait()); code != 3 {
+		t.Fatalf("unexpected exit code %d", code)
+	}
+
+	// closing the session kills the command
+	marker := filepath.Join(t.TempDir(), "marker")
+	sess, err = conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start(fmt.Sprintf("sleep 1; touch %s", marker)); err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+	time.Sleep(2 * time.Second)
+	if _, err := os.Stat(marker); err == nil {
+		t.Fatal("the command kept running after the session was closed")
+	}
+}
+
+func TestPermitTTY(t *testing.T) {
+	permit := false
+	sd, sshdPort := startDWithConf(&SshDConf{PermitTTY: &permit})
+	defer sd.Stop()
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	sess, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err == nil {
+		t.Fatal("expected the pty request to be rejected")
+	}
+}
+
+func TestPermitUserEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need a posix system")
+	}
+	if err := ValidateAcceptEnv([]string{"LC_["}); err == nil {
+		t.Fatal("expected an invalid pattern error")
+	}
+
+	// setenv runs the command with the accepted vars
+	setenv := func(conn *sshc.SshConnection, vars map[string]string) (string, []string) {
+		sess, err := conn.Client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		var rejected []string
+		for name, value := range vars {
+			if err := sess.Setenv(name, value); err != nil {
+				rejected = append(rejected, name)
+			}
+		}
+		out, err := sess.Output("echo $LC_TEST-$FOO")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out)), rejected
+	}
+	vars := map[string]string{"LC_TEST": "lc", "FOO": "foo"}
+
+	// rejected by default
+	sd, sshdPort := startD(false)
+	conn := getSSHConn(sshdPort)
+	out, rejected := setenv(conn, vars)
+	conn.Stop()
+	sd.Stop()
+	if out != "-" || len(rejected) != 2 {
+		t.Fatalf("unexpected environment %q, rejected %v", out, rejected)
+	}
+
+	sd, sshdPort = startDWithConf(&SshDConf{PermitUserEnvironment: true, AcceptEnv: []string{"LC_*"}})
+	defer sd.Stop()
+	conn = getSSHConn(sshdPort)
+	defer conn.Stop()
+	out, rejected = setenv(conn, vars)
+	if out != "lc-" || len(rejected) != 1 || rejected[0] != "FOO" {
+		t.Fatalf("unexpected environment %q, rejected %v", out, rejected)
+	}
+}
+
+func TestForcedCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need a posix system")
+	}
+	key, _ := os.ReadFile("../../testdata/client.pub")
+	file := filepath.Join(t.TempDir(), "authorized_keys")
+	os.WriteFile(file, append([]byte(`command="echo \"forced:$SSH_ORIGINAL_COMMAND\"" `), key...), 0600)
+
+	// the forced command is run even if it is not allowed
+	sd, sshdPort := startDWithConf(&SshDConf{
+		AuthorizedKeysURI: []string{file},
+		AllowedCommands:   []string{"git-*"},
+	})
+	defer sd.Stop()
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	stdout, _, code, err := conn.Run(context.Background(), "ls -l", nil)
+	if err != nil || code != 0 || string(stdout) != "forced:ls -l\n" {
+		t.Fatalf("unexpected result %q %d %v", stdout, code, err)
+	}
+}
+
+func TestKeyOptions(t *testing.T) {
+	opts := parseKeyOptions([]string{`command="echo \"a\""`, "No-Port-Forwarding", `permitopen="localhost:80"`, `permitopen="*:8080"`, "no-pty"})
+	if opts.command != `echo "a"` || !opts.noPortForwarding || fmt.Sprint(opts.permitOpen) != "[localhost:80 *:8080]" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+
+	perms := keyPermissions("SHA256:test", opts)
+	if portForwardingAllowed(perms) || !portForwardingAllowed(keyPermissions("SHA256:test", &keyOptions{})) {
+		t.Fatal("unexpected port forwarding permission")
+	}
+	for _, c := range []struct {
+		host    string
+		port    uint32
+		allowed bool
+	}{
+		{"localhost", 80, true},
+		{"LOCALHOST", 80, true},
+		{"127.0.0.1", 80, false},
+		{"localhost", 81, false},
+		{"example.com", 8080, true},
+	} {
+		if openPermitted(perms, c.host, c.port) != c.allowed {
+			t.Fatalf("%s:%d: expected allowed %v", c.host, c.port, c.allowed)
+		}
+	}
+	if !openPermitted(nil, "example.com", 1) {
+		t.Fatal("expected all the destinations allowed without permissions")
+	}
+}
+
+func TestKeyOptionsEnforced(t *testing.T) {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	echoAddr := echoListener.Addr().String()
+
+	key, _ := os.ReadFile("../../testdata/client.pub")
+	startWithOptions := func(options string) *sshc.SshConnection {
+		file := filepath.Join(t.TempDir(), "authorized_keys")
+		os.WriteFile(file, append([]byte(options+" "), key...), 0600)
+		sd, sshdPort := startDWithConf(&SshDConf{AuthorizedKeysURI: []string{file}})
+		t.Cleanup(sd.Stop)
+		conn := getSSHConn(sshdPort)
+		t.Cleanup(conn.Stop)
+		return conn
+	}
+
+	conn := startWithOptions("no-port-forwarding")
+	if _, err := conn.Client.Dial("tcp", echoAddr); err == nil {
+		t.Fatal("expected the forward tunnel to be rejected")
+	}
+	if _, err := conn.Client.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Fatal("expected the reverse tunnel to be rejected")
+	}
+
+	conn = startWithOptions(fmt.Sprintf(`permitopen="%s"`, echoAddr))
+	c, err := conn.Client.Dial("tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("expected the permitted destination to be allowed: %s", err)
+	}
+	c.Close()
+	if _, err := conn.Client.Dial("tcp", "localhost:"+getPort(echoListener.Addr())); err == nil {
+		t.Fatal("expected a not permitted destination to be rejected")
+	}
+	listener, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected the reverse tunnels to be allowed: %s", err)
+	}
+	listener.Close()
+}
+
+func TestAuditLogChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key := []byte("secret")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	audit, err := newAuditLog(path, key, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more entries than the queue size, so that some are written
+	// synchronously
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < auditQueueSize/2; j++ {
+				audit.Log(AuditEntry{Event: AuditExecRequest, Command: fmt.Sprintf("cmd %d", j)})
+			}
+		}()
+	}
+	wg.Wait()
+	audit.Close()
+
+	verify := func(key []byte) error {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		return VerifyAuditLog(f, key)
+	}
+	if err := verify(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify([]byte("wrong")); err == nil {
+		t.Fatal("the chain was verified with a wrong key")
+	}
+
+	// the chain is resumed on reopen
+	audit, err = newAuditLog(path, key, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Log(AuditEntry{Event: AuditShellOpened})
+	audit.Close()
+	if err := verify(key); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4*auditQueueSize+1 {
+		t.Fatalf("expected %d entries, got %d", 4*auditQueueSize+1, len(lines))
+	}
+
+	// a changed entry
+	tampered := strings.Replace(string(data), `"cmd 1"`, `"cmd 2"`, 1)
+	os.WriteFile(path, []byte(tampered), 0600)
+	if err := verify(key); err == nil {
+		t.Fatal("the changed entry was not detected")
+	}
+	// a removed entry
+	lines = append(lines[:10], lines[11:]...)
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if err := verify(key); err == nil || !strings.Contains(err.Error(), "line 11") {
+		t.Fatalf("the removed entry was not detected: %v", err)
+	}
+}
+
+func TestAuditLogEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		AuditLog:    path,
+		AuditLogKey: "secret",
+	})
+	defer sd.Stop()
+
+	// a key not in authorized_keys
+	key, _ := os.ReadFile("../../testdata/client2")
+	signer, _ := ssh.ParsePrivateKey(key)
+	_, err := ssh.Dial("tcp", "127.0.0.1:"+sshdPort, &ssh.ClientConfig{
+		User:            "audited",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		t.Fatal("expected an auth failure")
+	}
+
+	conn := getSSHConn(sshdPort)
+	if _, _, _, err := conn.Run(context.Background(), "echo audited", nil); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := conn.Client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	conn.Stop()
+
+	expected := []string{
+		AuditAuthFailure, AuditAuthSuccess, AuditExecRequest, AuditForwardStarted,
+		AuditForwardStopped, AuditClientDisconnected,
+	}
+	var entries []AuditEntry
+	for i := 0; ; i++ {
+		entries = nil
+		data, _ := os.ReadFile(path)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			entry := AuditEntry{}
+			if json.Unmarshal([]byte(line), &entry) == nil {
+				entries = append(entries, entry)
+			}
+		}
+		if len(entries) >= len(expected) {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("missing audit entries %+v", entries)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	events := map[string]AuditEntry{}
+	for _, e := range entries {
+		events[e.Event] = e
+	}
+	for _, event := range expected {
+		if _, ok := events[event]; !ok {
+			t.Fatalf("missing %s entry in %+v", event, entries)
+		}
+	}
+	if events[AuditAuthFailure].User != "audited" || events[AuditAuthFailure].Reason == "" {
+		t.Fatalf("unexpected auth failure entry %+v", events[AuditAuthFailure])
+	}
+	if !strings.HasPrefix(events[AuditAuthSuccess].Fingerprint, "SHA256:") || events[AuditAuthSuccess].RemoteAddr == "" {
+		t.Fatalf("unexpected auth success entry %+v", events[AuditAuthSuccess])
+	}
+	if events[AuditExecRequest].Command != "echo audited" {
+		t.Fatalf("unexpected exec entry %+v", events[AuditExecRequest])
+	}
+	if events[AuditForwardStarted].Local == "" || events[AuditForwardStarted].Forward != "tcpip-forward" {
+		t.Fatalf("unexpected forward entry %+v", events[AuditForwardStarted])
+	}
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	if err := VerifyAuditLog(f, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLogStop(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		AuditLog:    path,
+		AuditLogKey: "secret",
+	})
+
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+	if _, _, _, err := conn.Run(context.Background(), "echo audited", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client is still connected: its disconnection is the last entry,
+	// written before Stop returns
+	sd.Stop()
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	last := AuditEntry{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Event != AuditClientDisconnected {
+		t.Fatalf("expected the %s last entry, got %+v", AuditClientDisconnected, last)
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	if err := VerifyAuditLog(f, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readCast parses an asciicast v2 file
+func readCast(t *testing.T, path string) (CastHeader, []CastEvent) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	header := CastHeader{}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("invalid header %s: %s", lines[0], err)
+	}
+	events := []CastEvent{}
+	for _, line := range lines[1:] {
+		event := CastEvent{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid event %s: %s", line, err)
+		}
+		events = append(events, event)
+	}
+	return header, events
+}
+
+func TestSessionRecorder(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := newSessionRecorder(dir, "SHA256:ab/c+d", CastHeader{
+		Width:  80,
+		Height: 24,
+		Env:    map[string]string{"TERM": "xterm"},
+	}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Write([]byte("hello\r\n"))
+	// an utf8 sequence split between the writes
+	euro := []byte("€")
+	recorder.Write(euro[:1])
+	recorder.Write(euro[1:])
+	recorder.resize(100, 30)
+	recorder.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*-ab_c-d.cast"))
+	if len(files) != 1 {
+		t.Fatalf("unexpected recordings %v", files)
+	}
+	header, events := readCast(t, files[0])
+	if header.Version != 2 || header.Width != 80 || header.Height != 24 ||
+		header.Timestamp == 0 || header.Env["TERM"] != "xterm" {
+		t.Fatalf("unexpected header %+v", header)
+	}
+	expected := []CastEvent{{Type: "o", Data: "hello\r\n"}, {Type: "o", Data: "€"}, {Type: "r", Data: "100x30"}}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i].Type || e.Data != expected[i].Data || e.Time < 0 {
+			t.Fatalf("unexpected event %+v, expected %+v", e, expected[i])
+		}
+	}
+
+	// a second recording in the same second doesn't overwrite the first
+	name := recordingFileName(time.Now().UTC(), "SHA256:ab/c+d")
+	os.WriteFile(filepath.Join(dir, name+".cast"), nil, 0600)
+	recorder, err = newSessionRecorder(dir, "SHA256:ab/c+d", CastHeader{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+	if filepath.Base(recorder.f.Name()) == name+".cast" {
+		t.Fatal("the existing recording was overwritten")
+	}
+}
+
+func TestRecordSessions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test uses a unix shell")
+	}
+	dir := filepath.Join(t.TempDir(), "sessions")
+	sd, sshdPort := startDWithConf(&SshDConf{
+		ShellExecutable: "/bin/sh",
+		RecordSessions:  true,
+		RecordingDir:    dir,
+	})
+	defer sd.Stop()
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	output, _ := session.Output("echo recorded-output")
+	session.Close()
+	if !strings.Contains(string(output), "recorded-output") {
+		t.Fatalf("unexpected session output %q", output)
+	}
+
+	var files []string
+	for i := 0; i < 50 && len(files) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		files, _ = filepath.Glob(filepath.Join(dir, "*.cast"))
+	}
+	if len(files) != 1 {
+		t.Fatalf("unexpected recordings %v", files)
+	}
+	for i := 0; ; i++ {
+		header, events := readCast(t, files[0])
+		if header.Version != 2 || header.Width != 80 || header.Height != 24 {
+			t.Fatalf("unexpected header %+v", header)
+		}
+		recorded := ""
+		for _, e := range events {
+			if e.Type == "o" {
+				recorded += e.Data
+			}
+		}
+		if strings.Contains(recorded, "recorded-output") {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("the output was not recorded: %+v", events)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestLoginGraceTime(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	grace := 300 * time.Millisecond
+	sd, sshdPort := startDWithConf(&SshDConf{LoginGraceTime: grace}, WithLogger(logger))
+	defer sd.Stop()
+
+	// a client that never sends its identification string
+	start := time.Now()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, conn); err != nil {
+		t.Fatalf("the connection was not closed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < grace || elapsed > grace+2*time.Second {
+		t.Fatalf("closed after %s", elapsed)
+	}
+	var found map[string]any
+	for i := 0; i < 20 && found == nil; i++ {
+		for _, r := range out.records(t) {
+			if r["msg"] == "login grace time exceeded, disconnecting" {
+				found = r
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if found == nil || found["login_grace_time"] != grace.String() {
+		t.Fatalf("unexpected record %v", found)
+	}
+
+	// the logged in sessions are not time limited
+	client := getSSHConn(sshdPort)
+	defer client.Stop()
+	time.Sleep(2 * grace)
+	if _, _, _, err := client.Run(context.Background(), "true", nil); err != nil {
+		t.Fatalf("the session was closed: %s", err)
+	}
+}
+
+func TestAuthorizedKeysHTTP(t *testing.T) {
+	key, _ := os.ReadFile("../../testdata/client.pub")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(key)
+	}))
+	defer srv.Close()
+
+	sd, sshdPort := startDWithConf(&SshDConf{
+		AuthorizedKeysURI:          []string{srv.URL},
+		AuthorizedKeysFetchTimeout: 5 * time.Second,
+	})
+	defer sd.Stop()
+
+	client := getSSHConn(sshdPort)
+	defer client.Stop()
+	stdout, _, _, err := client.Run(context.Background(), "echo logged in", nil)
+	if err != nil || strings.TrimSpace(string(stdout)) != "logged in" {
+		t.Fatalf("unexpected output %q, error %v", stdout, err)
+	}
+}
+
+func TestClientAlive(t *testing.T) {
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	interval := 100 * time.Millisecond
+	sd, sshdPort := startDWithConf(&SshDConf{
+		ClientAliveInterval: interval,
+		ClientAliveCountMax: 3,
+	}, WithLogger(logger))
+	defer sd.Stop()
+
+	key, _ := os.ReadFile("../../testdata/client")
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshConn.Close()
+	go func() {
+		for ch := range chans {
+			ch.Reject(ssh.Prohibited, "")
+		}
+	}()
+	// the keep alive requests are never answered
+	keepAlives := atomic.Int32{}
+	go func() {
+		for req := range reqs {
+			if req.Type == "keepalive@openssh.com" {
+				keepAlives.Add(1)
+			}
+		}
+	}()
+	ok, reply, err := sshConn.SendRequest("tcpip-forward", true, ssh.Marshal(&struct {
+		Addr string
+		Port uint32
+	}{"127.0.0.1", 0}))
+	if err != nil || !ok {
+		t.Fatalf("tcpip-forward failed: %v", err)
+	}
+	var forward struct{ Port uint32 }
+	if err := ssh.Unmarshal(reply, &forward); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	closed := make(chan struct{})
+	go func() {
+		sshConn.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+	if elapsed := time.Since(start); elapsed < 3*interval {
+		t.Fatalf("closed after %s", elapsed)
+	}
+	if n := keepAlives.Load(); n != 1 {
+		t.Fatalf("got %d keep alive requests, want 1 pending", n)
+	}
+	var found map[string]any
+	for i := 0; i < 20 && found == nil; i++ {
+		for _, r := range out.records(t) {
+			if r["msg"] == "client alive timeout, disconnecting" {
+				found = r
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if found == nil || found["misses"] != float64(3) {
+		t.Fatalf("unexpected record %v", found)
+	}
+	// the forward is closed with the connection
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", forward.Port))
+		if err != nil {
+			break
+		}
+		c.Close()
+		if i == 20 {
+			t.Fatal("the forward listener was not closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the clients answering are kept
+	client := getSSHConn(sshdPort)
+	defer client.Stop()
+	time.Sleep(10 * interval)
+	if _, _, _, err := client.Run(context.Background(), "true", nil); err != nil {
+		t.Fatalf("the answering client was disconnected: %s", err)
+	}
+}
+
+func TestShellWorkingDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test uses pwd")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, sshdPort := startDWithConf(&SshDConf{
+		ShellExecutable: "/bin/sh",
+		ShellWorkingDir: dir,
+	})
+	defer sd.Stop()
+	conn := getSSHConn(sshdPort)
+	defer conn.Stop()
+
+	session, err := conn.Client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	output, err := session.Output("pwd -P")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(output)); got != dir {
+		t.Fatalf("the command ran in %q, want %q", got, dir)
+	}
+}
+
+func TestGetShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the shells are unix ones")
+	}
+	s := &sshServer{}
+	t.Setenv("SHELL", "/bin/sh")
+	if shell := s.getShell(); shell != "/bin/sh" {
+		t.Fatalf("got %q, want the SHELL one", shell)
+	}
+	// a missing SHELL falls back to the login shell or /bin/sh
+	t.Setenv("SHELL", filepath.Join(t.TempDir(), "missing"))
+	if _, err := exec.LookPath(s.getShell()); err != nil {
+		t.Fatalf("the shell %q does not exist", s.getShell())
+	}
+	s.shellExecutable = "/usr/bin/python3"
+	if shell := s.getShell(); shell != "/usr/bin/python3" {
+		t.Fatalf("got %q, want the shell_executable", shell)
+	}
+}
+
+func TestMaxConnRate(t *testing.T) {
+	sd, sshdPort := startDWithConf(&SshDConf{
+		MaxConnRate:  0.01,
+		MaxConnBurst: 2,
+	})
+	defer sd.Stop()
+
+	// the server sends its version first, unless the connection is
+	// closed before the handshake
+	banner := func() error {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+sshdPort)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if string(buf) != "SSH-" {
+			return fmt.Errorf("unexpected banner %q", buf)
+		}
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := banner(); err != nil {
+			t.Fatalf("connection %d of the burst: %s", i, err)
+		}
+	}
+	if err := banner(); err == nil {
+		t.Fatal("the connection over the burst was served")
+	}
+}
@@ -1,29 +1,76 @@
 package sshd
 
 import (
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/ferama/rospo/pkg/rio"
 	"golang.org/x/crypto/ssh"
 )
 
+// forwardStats accumulates the traffic of a reverse forward
+type forwardStats struct {
+	activeConns atomic.Int64
+	totalConns  atomic.Int64
+	// bytes received from the forward clients
+	bytesIn atomic.Int64
+	// bytes sent to the forward clients
+	bytesOut atomic.Int64
+}
+
+// statsConn counts the bytes read from and written to the wrapped conn
+type statsConn struct {
+	net.Conn
+	stats *forwardStats
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.bytesOut.Add(int64(n))
+	return n, err
+}
+
 type sessionHandler struct {
 	sshConn      *ssh.ServerConn
 	listener     net.Listener
 	listenerAddr string
 	listenerPort uint32
+
+	stats         forwardStats
+	statsInterval time.Duration
+	// the level the forwarded connections data is compressed with. 0 if
+	// it is not compressed
+	compressionLevel int
+	// the copy loops buffer size. The default one if 0
+	bufferSize int
+
+	log *slog.Logger
 }
 
-func newSessionHandler(sshConn *ssh.ServerConn,
+func newSessionHandler(log *slog.Logger,
+	sshConn *ssh.ServerConn,
 	ln net.Listener,
 	laddr string,
-	lport uint32) *sessionHandler {
+	lport uint32,
+	statsInterval time.Duration) *sessionHandler {
 
 	return &sessionHandler{
-		sshConn:      sshConn,
-		listener:     ln,
-		listenerAddr: laddr,
-		listenerPort: lport,
+		sshConn:       sshConn,
+		listener:      ln,
+		listenerAddr:  laddr,
+		listenerPort:  lport,
+		statsInterval: statsInterval,
+		log:           log,
 	}
 }
 
@@ -45,27 +92,63 @@ func (s *sessionHandler) handleClient(client net.Conn) {
 
 	c, requests, err := s.sshConn.OpenChannel("forwarded-tcpip", mpayload)
 	if err != nil {
-		log.Printf("Unable to get channel: %s. Hanging up requesting party!", err)
+		s.log.Error("unable to get channel. Hanging up requesting party!", "error", err)
 		client.Close()
 		return
 	}
 	go ssh.DiscardRequests(requests)
-	rio.CopyConn(c, client)
-	log.Printf("ended forward session: %s", client.LocalAddr())
+	var channel io.ReadWriteCloser = c
+	if s.compressionLevel > 0 {
+		channel = rio.NewCompressed(c, s.compressionLevel)
+	}
+	s.stats.totalConns.Add(1)
+	s.stats.activeConns.Add(1)
+	rio.CopyConnWithOnClose(channel, &statsConn{Conn: client, stats: &s.stats}, false, s.bufferSize, func() {
+		s.stats.activeConns.Add(-1)
+	})
+	s.log.Debug("ended forward session", "addr", client.LocalAddr().String())
+}
+
+// logStats periodically logs the forward summary until done is closed
+func (s *sessionHandler) logStats(done <-chan struct{}) {
+	ticker := time.NewTicker(s.statsInterval)
+	defer ticker.Stop()
+
+	addr := fmt.Sprintf("[%s]:%d", s.listenerAddr, s.listenerPort)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.log.Info("forward summary",
+				"addr", addr,
+				"active_connections", s.stats.activeConns.Load(),
+				"connections", s.stats.totalConns.Load(),
+				"bytes_in", s.stats.bytesIn.Load(),
+				"bytes_out", s.stats.bytesOut.Load(),
+			)
+		}
+	}
 }
 
 func (s *sessionHandler) handleSession() {
+	if s.statsInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go s.logStats(done)
+	}
+
 	for {
 		client, err := s.listener.Accept()
 		if err != nil {
 			neterr := err.(net.Error)
 			if neterr.Timeout() {
-				log.Printf("Accept failed with timeout: %s", err)
+				s.log.Error("accept failed with timeout", "error", err)
 				continue
 			}
 			break
 		}
-		log.Printf("started forward session: %s", client.LocalAddr())
+		s.log.Debug("started forward session", "addr", client.LocalAddr().String())
 
 		go s.handleClient(client)
 	}
@@ -0,0 +1,261 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpLimits holds the sftp server wide limits. The concurrent requests
+// semaphore is shared by all the sftp sessions
+type sftpLimits struct {
+	// nil if the concurrency is not limited
+	sem chan struct{}
+	// 0 if the file size is not limited
+	maxFileSize int64
+}
+
+func newSftpLimits(maxConcurrentRequests int, maxFileSize int64) *sftpLimits {
+	l := &sftpLimits{
+		maxFileSize: maxFileSize,
+	}
+	if maxConcurrentRequests > 0 {
+		l.sem = make(chan struct{}, maxConcurrentRequests)
+	}
+	return l
+}
+
+func (l *sftpLimits) enabled() bool {
+	return l.sem != nil || l.maxFileSize > 0
+}
+
+// acquire blocks until a request slot is available. The returned
+// function releases it
+func (l *sftpLimits) acquire() func() {
+	if l.sem == nil {
+		return func() {}
+	}
+	l.sem <- struct{}{}
+	return func() { <-l.sem }
+}
+
+func (l *sftpLimits) checkSize(path string, size int64) error {
+	if l.maxFileSize > 0 && size > l.maxFileSize {
+		return fmt.Errorf("%s: file size limit of %d bytes exceeded: %w",
+			path, l.maxFileSize, sftp.ErrSSHFxPermissionDenied)
+	}
+	return nil
+}
+
+// sftpFS serves the local file system through the sftp request server
+// enforcing the configured limits
+type sftpFS struct {
+	limits *sftpLimits
+}
+
+func newSftpHandlers(limits *sftpLimits) sftp.Handlers {
+	fs := &sftpFS{limits: limits}
+	return sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}
+}
+
+func localPath(p string) string {
+	return filepath.FromSlash(p)
+}
+
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	release := fs.limits.acquire()
+	defer release()
+
+	f, err := os.Open(localPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{File: f, limits: fs.limits, path: r.Filepath}, nil
+}
+
+func (fs *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.OpenFile(r)
+}
+
+func (fs *sftpFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	release := fs.limits.acquire()
+	defer release()
+
+	pflags := r.Pflags()
+	flags := 0
+	switch {
+	case pflags.Read && pflags.Write:
+		flags |= os.O_RDWR
+	case pflags.Write:
+		flags |= os.O_WRONLY
+	default:
+		flags |= os.O_RDONLY
+	}
+	// O_APPEND is not set: WriteAt can't be used on append mode files
+	// and the clients send the write offsets anyway
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(localPath(r.Filepath), flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{File: f, limits: fs.limits, path: r.Filepath}, nil
+}
+
+func (fs *sftpFS) Filecmd(r *sftp.Request) error {
+	release := fs.limits.acquire()
+	defer release()
+
+	path := localPath(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return fs.setstat(r)
+	case "Rename", "PosixRename":
+		return os.Rename(path, localPath(r.Target))
+	case "Rmdir", "Remove":
+		return os.Remove(path)
+	case "Mkdir":
+		return os.Mkdir(path, 0755)
+	case "Link":
+		return os.Link(path, localPath(r.Target))
+	case "Symlink":
+		// r.Filepath is the target, and r.Target is the link path
+		return os.Symlink(path, localPath(r.Target))
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) PosixRename(r *sftp.Request) error {
+	return fs.Filecmd(r)
+}
+
+func (fs *sftpFS) setstat(r *sftp.Request) error {
+	path := localPath(r.Filepath)
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := fs.limits.checkSize(r.Filepath, int64(attrs.Size)); err != nil {
+			return err
+		}
+		if err := os.Truncate(path, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(path, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		mtime := time.Unix(int64(attrs.Mtime), 0)
+		if err := os.Chtimes(path, atime, mtime); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(path, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	release := fs.limits.acquire()
+	defer release()
+
+	path := localPath(r.Filepath)
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	release := fs.limits.acquire()
+	defer release()
+
+	info, err := os.Lstat(localPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+func (fs *sftpFS) Readlink(path string) (string, error) {
+	release := fs.limits.acquire()
+	defer release()
+
+	return os.Readlink(localPath(path))
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpFile enforces the limits on the file reads and writes
+type sftpFile struct {
+	*os.File
+	limits *sftpLimits
+	path   string
+}
+
+func (f *sftpFile) ReadAt(p []byte, off int64) (int, error) {
+	release := f.limits.acquire()
+	defer release()
+	return f.File.ReadAt(p, off)
+}
+
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.limits.checkSize(f.path, off+int64(len(p))); err != nil {
+		return 0, err
+	}
+	release := f.limits.acquire()
+	defer release()
+	return f.File.WriteAt(p, off)
+}
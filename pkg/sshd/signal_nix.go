@@ -0,0 +1,26 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"os"
+	"syscall"
+)
+
+// sshSignals maps the "signal" request names, without the SIG prefix, to
+// the signals delivered to the session commands
+var sshSignals = map[string]os.Signal{
+	"ABRT": syscall.SIGABRT,
+	"ALRM": syscall.SIGALRM,
+	"FPE":  syscall.SIGFPE,
+	"HUP":  syscall.SIGHUP,
+	"ILL":  syscall.SIGILL,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"PIPE": syscall.SIGPIPE,
+	"QUIT": syscall.SIGQUIT,
+	"SEGV": syscall.SIGSEGV,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
@@ -0,0 +1,9 @@
+package sshd
+
+import "os"
+
+// the windows processes can only be killed: the other "signal" requests
+// are declined
+var sshSignals = map[string]os.Signal{
+	"KILL": os.Kill,
+}
@@ -0,0 +1,64 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, the
+// SD_LISTEN_FDS_START value
+const listenFdsStart = 3
+
+// systemdListener returns the listener of the first socket passed by the
+// systemd socket activation. LISTEN_PID must match the process pid and
+// LISTEN_FDS must be at least 1. The env vars are unset, so that the
+// child processes don't inherit them. LISTEN_FDS_START, if set,
+// overrides the first file descriptor
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no socket passed by systemd: LISTEN_PID is not the process pid")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("no socket passed by systemd: LISTEN_FDS is not set")
+	}
+	fd := listenFdsStart
+	if start := os.Getenv("LISTEN_FDS_START"); start != "" {
+		if fd, err = strconv.Atoi(start); err != nil {
+			return nil, fmt.Errorf("invalid LISTEN_FDS_START: %w", err)
+		}
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_FDS_START")
+
+	f := os.NewFile(uintptr(fd), "systemd-socket")
+	// FileListener duplicates the descriptor
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket passed by systemd: %w", err)
+	}
+	return listener, nil
+}
+
+// sdNotify sends the state, like "READY=1", to the systemd notify
+// socket. It does nothing if NOTIFY_SOCKET is not set
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
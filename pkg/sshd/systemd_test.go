@@ -0,0 +1,68 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSystemdSocket(t *testing.T) {
+	// the socket systemd would pass: a listener descriptor, as a net.Pipe
+	// has none. It is a dup, as the server takes its ownership
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer passed.Close()
+	f, err := passed.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDS_START", strconv.Itoa(fd))
+	t.Setenv("NOTIFY_SOCKET", notify.LocalAddr().String())
+
+	sd, sshdPort := startDWithConf(&SshDConf{SystemdSocket: true})
+	defer sd.Stop()
+	if sshdPort != getPort(passed.Addr()) {
+		t.Fatalf("the passed socket was not used: %s, expected %s", sshdPort, getPort(passed.Addr()))
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("the systemd env vars were not unset")
+	}
+
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := notify.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("unexpected notification %q %v", buf[:n], err)
+	}
+
+	client := getSSHConn(sshdPort)
+	defer client.Stop()
+	stdout, _, _, err := client.Run(context.Background(), "echo activated", nil)
+	if err != nil || strings.TrimSpace(string(stdout)) != "activated" {
+		t.Fatalf("unexpected output %q %v", stdout, err)
+	}
+}
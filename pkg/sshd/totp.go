@@ -0,0 +1,85 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/ssh"
+)
+
+// loadTOTPSecrets parses the TOTP secrets file. Each line maps a public
+// key fingerprint to its base32 TOTP secret:
+//
+//	SHA256:3c5s...Yf8 JBSWY3DPEHPK3PXP
+//
+// Empty lines and lines starting with # are ignored
+func loadTOTPSecrets(file string) (map[string]string, error) {
+	path, _ := utils.ExpandUserHome(file)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secrets := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a fingerprint and a secret", path, lineNum)
+		}
+		secrets[fields[0]] = fields[1]
+	}
+	return secrets, scanner.Err()
+}
+
+// validateTOTP checks the code against the secret, accepting the codes of
+// the previous and of the next 30 seconds period too, to allow for clock skew
+func validateTOTP(code string, secret string) bool {
+	valid, err := totp.ValidateCustom(code, secret, time.Now(), totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	return err == nil && valid
+}
+
+// totpCallback returns the keyboard interactive callback that asks the TOTP
+// code of the key logged in with perms, as the public key auth second
+// factor. The key permissions are granted if the code is valid
+func (s *sshServer) totpCallback(perms *ssh.Permissions) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	fp := perms.Extensions["pubkey-fp"]
+	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		secrets, err := loadTOTPSecrets(s.totpSecretsFile)
+		if err != nil {
+			s.log.Error("cannot load the totp secrets", "path", s.totpSecretsFile, "error", err)
+			return nil, fmt.Errorf("totp not available")
+		}
+		secret, ok := secrets[fp]
+		if !ok {
+			s.log.Warn("no totp secret for the key", "remote_addr", conn.RemoteAddr().String(), "fingerprint", fp)
+			return nil, fmt.Errorf("totp not enrolled for %s", fp)
+		}
+		answers, err := client(conn.User(), "", []string{"TOTP code: "}, []bool{false})
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != 1 || !validateTOTP(strings.TrimSpace(answers[0]), secret) {
+			s.log.Warn("invalid totp code", "remote_addr", conn.RemoteAddr().String(), "fingerprint", fp)
+			return nil, fmt.Errorf("invalid totp code")
+		}
+		return perms, nil
+	}
+}
@@ -0,0 +1,106 @@
+package tun
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// DefaultHealthCheckFailures is the default number of consecutive failed
+// health checks that marks a backend as unhealthy
+const DefaultHealthCheckFailures = 3
+
+// BackendStats is a reverse tunnel local endpoint health
+type BackendStats struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	// the consecutive failed health checks
+	Failures int64 `json:"failures"`
+}
+
+// backend is a reverse tunnel local endpoint
+type backend struct {
+	endpoint *utils.Endpoint
+	// set if the health checks failed. The backends start healthy
+	unhealthy atomic.Bool
+	failures  atomic.Int64
+}
+
+func (b *backend) stats() BackendStats {
+	return BackendStats{
+		Address:  b.endpoint.String(),
+		Healthy:  !b.unhealthy.Load(),
+		Failures: b.failures.Load(),
+	}
+}
+
+// healthCheckLoop dials the backends every interval until the tunnel is
+// terminated. A backend is removed from the rotation after the threshold
+// consecutive failed dials and added back on the first successful one
+func (t *Tunnel) healthCheckLoop(interval time.Duration, threshold int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.terminate:
+			return
+		case <-ticker.C:
+		}
+		for _, b := range t.backends {
+			t.healthCheck(b, interval, threshold)
+		}
+	}
+}
+
+// healthCheck dials the backend once, updating its health
+func (t *Tunnel) healthCheck(b *backend, timeout time.Duration, threshold int) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	dialer, err := t.localDialer()
+	if err != nil {
+		t.log.Error("invalid local_bind_address", "local_bind_address", t.localBindAddress, "error", err)
+		return
+	}
+	conn, err := t.dialBackend(ctx, dialer, b)
+	if err == nil {
+		conn.Close()
+		b.failures.Store(0)
+		if b.unhealthy.Swap(false) {
+			t.log.Info("backend healthy again", "local", b.endpoint.String())
+		}
+		return
+	}
+	if failures := b.failures.Add(1); failures >= int64(threshold) && !b.unhealthy.Swap(true) {
+		t.log.Warn("backend unhealthy, removed from the rotation", "local", b.endpoint.String(),
+			"failures", failures, "error", err)
+	}
+}
+
+// dialBackend connects to the backend. With dns_cache_ttl its host is
+// resolved through utils.DefaultEndpointCache and the addresses are
+// tried in order. If none answers the cache entry is expired: the
+// backend could have moved. Its addresses are kept for the DNS failures
+func (t *Tunnel) dialBackend(ctx context.Context, dialer *net.Dialer, b *backend) (net.Conn, error) {
+	if t.dnsCacheTTL <= 0 {
+		return dialer.DialContext(ctx, "tcp", b.endpoint.String())
+	}
+	addrs, err := b.endpoint.Addresses(t.dnsCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	utils.DefaultEndpointCache.Expire(b.endpoint.Hostname())
+	return nil, err
+}
@@ -0,0 +1,61 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// errForwardLocalBind is returned for the forward tunnels with a
+// local_bind_address: the ssh server dials their targets
+var errForwardLocalBind = errors.New("can only be set on reverse tunnels, " +
+	"the sshclient bind_address sets the address of the connection to the server")
+
+// ResolveBindAddress resolves a local_bind_address: an ip address or the
+// name of a network interface. The interfaces bind to their first IPv4
+// address, or to the first one if they have none
+func ResolveBindAddress(address string) (*net.TCPAddr, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		return &net.TCPAddr{IP: ip}, nil
+	}
+	iface, err := net.InterfaceByName(address)
+	if err != nil {
+		return nil, fmt.Errorf("%s is neither an ip address nor an interface: %w", address, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the %s addresses: %w", address, err)
+	}
+	var first net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+		if first == nil {
+			first = ipNet.IP
+		}
+	}
+	if first == nil {
+		return nil, fmt.Errorf("the interface %s has no ip address", address)
+	}
+	return &net.TCPAddr{IP: first}, nil
+}
+
+// localDialer returns the dialer of the reverse tunnel local endpoints,
+// bound to the local_bind_address if set. The interfaces are resolved on
+// every dial: their addresses may change while the tunnel runs. The
+// forward tunnels have no local dial and refuse the local_bind_address
+func (t *Tunnel) localDialer() (*net.Dialer, error) {
+	if t.localBindAddress == "" {
+		return &net.Dialer{}, nil
+	}
+	addr, err := ResolveBindAddress(t.localBindAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &net.Dialer{LocalAddr: addr}, nil
+}
@@ -0,0 +1,117 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ferama/rospo/pkg/rio"
+	"github.com/ferama/rospo/pkg/sshc"
+	"golang.org/x/crypto/ssh"
+)
+
+// errClientClosed is the ReadyWait error once the caller ssh client is closed
+var errClientClosed = errors.New("the ssh client is closed")
+
+// sshConnection is what the tunnels need from the ssh connection.
+// sshc.SshConnection implements it reconnecting on failures, clientConn
+// over a client the caller connected
+type sshConnection interface {
+	// ReadyWait blocks until the connection is established. It returns an
+	// error if the connection can't be used
+	ReadyWait() error
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+	BufferSize() int
+	Subscribe() <-chan sshc.ConnectionEvent
+	Unsubscribe(events <-chan sshc.ConnectionEvent)
+}
+
+// clientConn runs a tunnel on an ssh client owned by the caller. It is
+// never reconnected nor closed: once the client is closed the tunnel
+// listener is closed and the tunnel waits until it is stopped
+type clientConn struct {
+	client *ssh.Client
+	closed chan struct{}
+	// the client Wait error, set before closed is closed
+	err      error
+	closedAt time.Time
+
+	// the unsubscribed signals, by events channel
+	subscribers   map[<-chan sshc.ConnectionEvent]chan struct{}
+	subscribersMU sync.Mutex
+}
+
+func newClientConn(client *ssh.Client) *clientConn {
+	c := &clientConn{
+		client:      client,
+		closed:      make(chan struct{}),
+		subscribers: make(map[<-chan sshc.ConnectionEvent]chan struct{}),
+	}
+	go func() {
+		c.err = client.Wait()
+		c.closedAt = time.Now()
+		close(c.closed)
+	}()
+	return c
+}
+
+func (c *clientConn) ReadyWait() error {
+	select {
+	case <-c.closed:
+		return errClientClosed
+	default:
+		return nil
+	}
+}
+
+func (c *clientConn) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return c.client.DialContext(ctx, "tcp", addr)
+}
+
+func (c *clientConn) Listen(addr string) (net.Listener, error) {
+	return c.client.Listen("tcp", addr)
+}
+
+func (c *clientConn) BufferSize() int {
+	return rio.DefaultBufferSize
+}
+
+// Subscribe returns a new events channel. The only event is the
+// disconnection, when the client is closed. The channel is closed by
+// Unsubscribe
+func (c *clientConn) Subscribe() <-chan sshc.ConnectionEvent {
+	events := make(chan sshc.ConnectionEvent, 1)
+	unsubscribed := make(chan struct{})
+	c.subscribersMU.Lock()
+	c.subscribers[events] = unsubscribed
+	c.subscribersMU.Unlock()
+
+	go func() {
+		// the channel is closed here only, so that it is never closed
+		// while the event is sent
+		defer close(events)
+		select {
+		case <-c.closed:
+			events <- sshc.ConnectionEvent{
+				Type: sshc.EventDisconnected,
+				Time: c.closedAt,
+				Err:  c.err,
+			}
+			<-unsubscribed
+		case <-unsubscribed:
+		}
+	}()
+	return events
+}
+
+func (c *clientConn) Unsubscribe(events <-chan sshc.ConnectionEvent) {
+	c.subscribersMU.Lock()
+	defer c.subscribersMU.Unlock()
+	if unsubscribed, ok := c.subscribers[events]; ok {
+		delete(c.subscribers, events)
+		close(unsubscribed)
+	}
+}
@@ -1,6 +1,12 @@
 package tun
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/utils"
 )
@@ -8,20 +14,214 @@ import (
 // TunnelConf is a struct that holds the tunnel configuration
 type TunnelConf struct {
 	//// Tunnel conf
+	// optional tunnel name used in metrics. Defaults to local-remote
+	Name   string `yaml:"name" json:"name"`
 	Remote string `yaml:"remote" json:"remote"`
 	Local  string `yaml:"local" json:"local"`
+	// the local targets of a reverse tunnel, instead of Local. The
+	// connections are distributed among them round-robin, skipping the
+	// ones that fail to dial
+	Locals []string `yaml:"locals" json:"locals"`
+	// if set, the local targets of a reverse tunnel are dialed at this
+	// interval. The ones failing HealthCheckFailures consecutive times
+	// (default DefaultHealthCheckFailures) are removed from the rotation
+	// until a dial succeeds again
+	HealthCheckInterval time.Duration `yaml:"health_check_interval" json:"health_check_interval"`
+	HealthCheckFailures int           `yaml:"health_check_failures" json:"health_check_failures"`
+	// if set, the local targets of a reverse tunnel are dialed from this
+	// address, an ip or a network interface name. Example: "10.0.0.2"
+	// or "eth1". Useful on the multihomed hosts. The forward tunnels
+	// refuse it: their targets are dialed by the ssh server, the sshclient
+	// bind_address sets the address of the connection to the server
+	LocalBindAddress string `yaml:"local_bind_address" json:"local_bind_address"`
+	// if greater than 0, the host names of the reverse tunnel local
+	// targets are resolved once per DNSCacheTTL. The cached addresses are
+	// served for a while if the DNS fails, see utils.EndpointCache
+	DNSCacheTTL time.Duration `yaml:"dns_cache_ttl" json:"dns_cache_ttl"`
+	// if the server denies the reverse tunnel remote listener, the request
+	// is retried BindRetries times (default DefaultBindRetries, -1 never
+	// retries) waiting BindRetryDelay (default DefaultBindRetryDelay)
+	// between the attempts. After a reconnect the server could still hold
+	// the previous listener
+	BindRetries    int           `yaml:"bind_retries" json:"bind_retries"`
+	BindRetryDelay time.Duration `yaml:"bind_retry_delay" json:"bind_retry_delay"`
+	// if set, only the reverse tunnel clients whose address is in one of
+	// these networks are served. The others are disconnected. Example:
+	// [10.0.0.0/8, 192.168.1.10/32]. Empty allows all
+	AllowedClientCIDRs []string `yaml:"allowed_client_cidrs" json:"allowed_client_cidrs"`
+	// if set, the forward tunnel local listener terminates TLS with this
+	// certificate and key (PEM files). The data is forwarded in plaintext
+	// through the ssh connection. If TLSClientCA is set too, the clients
+	// must present a certificate signed by one of its CAs
+	TLSCert     string `yaml:"tls_cert" json:"tls_cert"`
+	TLSKey      string `yaml:"tls_key" json:"tls_key"`
+	TLSClientCA string `yaml:"tls_client_ca" json:"tls_client_ca"`
 	// indicates if it is a forward or reverse tunnel
 	Forward bool `yaml:"forward" json:"forward"`
 	// use a dedicated ssh client. if nil use the global one
 	SshClientConf *sshc.SshClientConf `yaml:"sshclient" json:"sshclient"`
 }
 
+// GetName returns the tunnel name, building a default one from its
+// endpoints if not set
+func (c *TunnelConf) GetName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return c.getLocal() + "-" + c.Remote
+}
+
+// getLocal returns the Local value, or the comma separated Locals ones
+func (c *TunnelConf) getLocal() string {
+	if len(c.Locals) > 0 {
+		return strings.Join(c.Locals, ",")
+	}
+	return c.Local
+}
+
+// ConfError is a TunnelConf value validation error
+type ConfError struct {
+	// the yaml name of the value. Example: "locals[1]"
+	Field string
+	Err   error
+}
+
+func (e *ConfError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Err)
+}
+
+func (e *ConfError) Unwrap() error {
+	return e.Err
+}
+
+// ConfErrors are all the errors found validating a TunnelConf
+type ConfErrors []*ConfError
+
+func (e ConfErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ce := range e {
+		msgs[i] = ce.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+var (
+	errRequired    = errors.New("required")
+	errNegative    = errors.New("must not be negative")
+	errReverseOnly = errors.New("can only be set on reverse tunnels")
+)
+
+// Validate returns ConfErrors listing the tunnel values that are not set
+// or are not consistent, nil if the tunnel is valid. The address errors
+// wrap an *utils.AddressError
+func (c *TunnelConf) Validate() error {
+	var errs ConfErrors
+	add := func(field string, err error) {
+		errs = append(errs, &ConfError{Field: field, Err: err})
+	}
+	address := func(field string, value string) {
+		if value == "" {
+			add(field, errRequired)
+		} else if err := utils.ValidateSSHUrl(value); err != nil {
+			add(field, err)
+		}
+	}
+
+	address("remote", c.Remote)
+	switch {
+	case len(c.Locals) == 0:
+		address("local", c.Local)
+	case c.Local != "":
+		add("locals", errors.New("can't be set with local"))
+	case c.Forward:
+		add("locals", errReverseOnly)
+	default:
+		for i, l := range c.Locals {
+			address(fmt.Sprintf("locals[%d]", i), l)
+		}
+	}
+	if c.HealthCheckInterval < 0 {
+		add("health_check_interval", errNegative)
+	} else if c.HealthCheckInterval > 0 && c.Forward {
+		add("health_check_interval", errReverseOnly)
+	}
+	if c.HealthCheckFailures < 0 {
+		add("health_check_failures", errNegative)
+	}
+	if c.LocalBindAddress != "" && c.Forward {
+		add("local_bind_address", errForwardLocalBind)
+	}
+	if c.DNSCacheTTL < 0 {
+		add("dns_cache_ttl", errNegative)
+	} else if c.DNSCacheTTL > 0 && c.Forward {
+		add("dns_cache_ttl", errReverseOnly)
+	}
+	if c.BindRetries < -1 {
+		add("bind_retries", errors.New("must be -1, to disable the retries, or greater"))
+	}
+	if c.BindRetryDelay < 0 {
+		add("bind_retry_delay", errNegative)
+	}
+	if len(c.AllowedClientCIDRs) > 0 && c.Forward {
+		add("allowed_client_cidrs", errReverseOnly)
+	} else if _, err := ParseCIDRs(c.AllowedClientCIDRs); err != nil {
+		add("allowed_client_cidrs", err)
+	}
+	switch {
+	case !c.Forward && (c.TLSCert != "" || c.TLSKey != "" || c.TLSClientCA != ""):
+		add("tls_cert", errors.New("the tls termination can only be set on forward tunnels"))
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		add("tls_key", errors.New("tls_cert and tls_key must be both set"))
+	case c.TLSClientCA != "" && c.TLSCert == "":
+		add("tls_client_ca", errors.New("requires tls_cert and tls_key"))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ParseCIDRs parses the networks in CIDR notation. The valid ones are
+// returned along with the error of the first invalid one
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var firstErr error
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks, firstErr
+}
+
 // GetRemotEndpoint Builds a remote endpoint object from the Remote string
 func (c *TunnelConf) GetRemotEndpoint() *utils.Endpoint {
 	return utils.NewEndpoint(c.Remote)
 }
 
-// GetLocalEndpoint Builds a locale endpoint object from the Local string
+// GetLocalEndpoint Builds a locale endpoint object from the Local string.
+// If Locals is set it is the first one
 func (c *TunnelConf) GetLocalEndpoint() *utils.Endpoint {
+	if len(c.Locals) > 0 {
+		return utils.NewEndpoint(c.Locals[0])
+	}
 	return utils.NewEndpoint(c.Local)
 }
+
+// GetLocalEndpoints builds the local endpoints objects, from Locals or
+// from Local if it is not set
+func (c *TunnelConf) GetLocalEndpoints() []*utils.Endpoint {
+	if len(c.Locals) == 0 {
+		return []*utils.Endpoint{c.GetLocalEndpoint()}
+	}
+	endpoints := make([]*utils.Endpoint, len(c.Locals))
+	for i, l := range c.Locals {
+		endpoints[i] = utils.NewEndpoint(l)
+	}
+	return endpoints
+}
@@ -0,0 +1,26 @@
+package tun
+
+import "net"
+
+// countingConn reports the bytes read and written on the wrapped connection
+type countingConn struct {
+	net.Conn
+	onRead  func(n int)
+	onWrite func(n int)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.onRead(n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.onWrite(n)
+	}
+	return n, err
+}
@@ -0,0 +1,159 @@
+package tun
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ferama/rospo/pkg/options"
+	"github.com/ferama/rospo/pkg/rio"
+	"github.com/ferama/rospo/pkg/sshc"
+)
+
+// the max duration of the CONNECT request read
+const httpConnectRequestTimeout = 30 * time.Second
+
+// HTTPConnectConf holds the http CONNECT gateway configuration
+type HTTPConnectConf struct {
+	ListenAddress string `yaml:"listen_address"`
+	// use a dedicated ssh client. if nil use the global one
+	SshClientConf *sshc.SshClientConf `yaml:"sshclient"`
+}
+
+// HTTPConnectGateway is a local http proxy serving the CONNECT requests.
+// The destinations are dialed through the ssh connection with direct-tcpip
+// channels, so that the clients that can't use a SOCKS proxy, like some
+// browsers and the corporate tools, can reach them
+type HTTPConnectGateway struct {
+	sshConn *sshc.SshConnection
+
+	listener   net.Listener
+	listenerMU sync.Mutex
+
+	log *slog.Logger
+}
+
+// NewHTTPConnectGateway builds a gateway dialing through sshConn
+func NewHTTPConnectGateway(sshConn *sshc.SshConnection, opts ...Option) *HTTPConnectGateway {
+	o := options.Build(opts)
+	return &HTTPConnectGateway{
+		sshConn: sshConn,
+		log:     o.Logger.With("subsystem", "httpconnect"),
+	}
+}
+
+// Start listens on listenAddress and serves the clients until Stop is
+// called
+func (g *HTTPConnectGateway) Start(listenAddress string) error {
+	if err := g.sshConn.ReadyWait(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	g.listenerMU.Lock()
+	g.listener = listener
+	g.listenerMU.Unlock()
+
+	g.log.Info("local http CONNECT proxy listening", "addr", listener.Addr().String())
+	for {
+		client, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go g.serveClient(client)
+	}
+}
+
+// GetListenerAddr returns the gateway listener address. nil if it is not
+// listening yet
+func (g *HTTPConnectGateway) GetListenerAddr() net.Addr {
+	g.listenerMU.Lock()
+	defer g.listenerMU.Unlock()
+	if g.listener == nil {
+		return nil
+	}
+	return g.listener.Addr()
+}
+
+// Stop closes the gateway listener
+func (g *HTTPConnectGateway) Stop() {
+	g.listenerMU.Lock()
+	defer g.listenerMU.Unlock()
+	if g.listener != nil {
+		g.listener.Close()
+	}
+}
+
+// reply writes a response without body to the client
+func (g *HTTPConnectGateway) reply(client net.Conn, status int) {
+	fmt.Fprintf(client, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if status == http.StatusMethodNotAllowed {
+		fmt.Fprint(client, "Allow: CONNECT\r\n")
+	}
+	fmt.Fprint(client, "Content-Length: 0\r\n\r\n")
+}
+
+func (g *HTTPConnectGateway) serveClient(client net.Conn) {
+	log := g.log.With("remote_addr", client.RemoteAddr().String())
+
+	client.SetReadDeadline(time.Now().Add(httpConnectRequestTimeout))
+	reader := bufio.NewReader(client)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.Debug("invalid http request", "error", err)
+		g.reply(client, http.StatusBadRequest)
+		client.Close()
+		return
+	}
+	if req.Method != http.MethodConnect {
+		log.Debug("declining request", "method", req.Method)
+		g.reply(client, http.StatusMethodNotAllowed)
+		client.Close()
+		return
+	}
+	addr := req.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpConnectRequestTimeout)
+	remote, err := g.sshConn.DialContext(ctx, addr)
+	cancel()
+	if err != nil {
+		log.Error("dial INTO remote service error", "addr", addr, "error", err)
+		g.reply(client, http.StatusBadGateway)
+		client.Close()
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+	if _, err := fmt.Fprint(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		client.Close()
+		remote.Close()
+		return
+	}
+	// the client could have sent its first bytes along with the request
+	if n := reader.Buffered(); n > 0 {
+		data, _ := reader.Peek(n)
+		if _, err := remote.Write(data); err != nil {
+			client.Close()
+			remote.Close()
+			return
+		}
+	}
+	log.Debug("CONNECT established", "addr", addr)
+	rio.CopyConnWithOnClose(client, remote, false, g.sshConn.BufferSize(), func() {
+		log.Debug("CONNECT closed", "addr", addr)
+	})
+}
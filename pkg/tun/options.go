@@ -0,0 +1,22 @@
+package tun
+
+import (
+	"log/slog"
+
+	"github.com/ferama/rospo/pkg/options"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures the tunnel
+type Option = options.Option
+
+// WithLogger sets the tunnel logger
+func WithLogger(l *slog.Logger) Option {
+	return options.WithLogger(l)
+}
+
+// WithTracer enables the tracing of the tunnel connections, with a span
+// for each one
+func WithTracer(t trace.Tracer) Option {
+	return options.WithTracer(t)
+}
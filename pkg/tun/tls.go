@@ -0,0 +1,43 @@
+package tun
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+
+	"github.com/ferama/rospo/pkg/utils"
+)
+
+// loadTLSConfig builds the server tls config of a forward tunnel local
+// listener. It returns nil if certFile is not set. If clientCAFile is set
+// the clients certificates are required and verified against its CAs
+func loadTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" {
+		return nil, nil
+	}
+	certFile, _ = utils.ExpandUserHome(certFile)
+	keyFile, _ = utils.ExpandUserHome(keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		clientCAFile, _ = utils.ExpandUserHome(clientCAFile)
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
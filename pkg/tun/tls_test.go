@@ -0,0 +1,165 @@
+package tun
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a certificate signed by parent (self signed if nil)
+// and its key into dir. It returns the certificate and its key
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeTestCerts writes a CA and the server and client certificates it
+// signs into dir
+func writeTestCerts(t *testing.T, dir string) {
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rospo test ca"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+}
+
+func TestTunnelForwardTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCerts(t, dir)
+
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	caPEM, err := os.ReadFile(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func(clientCA string, certs []tls.Certificate) error {
+		tunnel := NewTunnel(client, &TunnelConf{
+			Remote:      echoListener.Addr().String(),
+			Local:       "127.0.0.1:0",
+			Forward:     true,
+			TLSCert:     filepath.Join(dir, "server.crt"),
+			TLSKey:      filepath.Join(dir, "server.key"),
+			TLSClientCA: clientCA,
+		}, true)
+		go tunnel.Start(context.Background())
+		defer tunnel.Stop()
+		for tunnel.GetListenerAddr() == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		conn, err := tls.Dial("tcp", tunnel.GetListenerAddr().String(), &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "ping\n" {
+			return fmt.Errorf("unexpected reply '%s'", line)
+		}
+		return nil
+	}
+
+	if err := echo("", nil); err != nil {
+		t.Fatalf("tls termination: %s", err)
+	}
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := echo(caFile, []tls.Certificate{clientCert}); err != nil {
+		t.Fatalf("the client with a certificate was not served: %s", err)
+	}
+	if err := echo(caFile, nil); err == nil {
+		t.Fatal("the client without a certificate was served")
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCerts(t, dir)
+
+	if config, err := loadTLSConfig("", "", ""); config != nil || err != nil {
+		t.Fatalf("expected no config, got %v %v", config, err)
+	}
+	if _, err := loadTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "client.key"), ""); err == nil {
+		t.Fatal("expected an error for the mismatched key")
+	}
+	if _, err := loadTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "server.key")); err == nil {
+		t.Fatal("expected an error for the client ca without certificates")
+	}
+}
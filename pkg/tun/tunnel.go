@@ -1,35 +1,130 @@
 package tun
 
 import (
+	"context"
+	"crypto/tls"
+	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/ferama/rospo/pkg/logger"
+	"github.com/ferama/rospo/pkg/metrics"
+	"github.com/ferama/rospo/pkg/options"
 	"github.com/ferama/rospo/pkg/rio"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
 )
 
-var log = logger.NewLogger("[TUN]  ", logger.Magenta)
+// The reverse tunnel remote listener retries defaults, used if the
+// configuration doesn't set them
+const (
+	DefaultBindRetries    = 3
+	DefaultBindRetryDelay = time.Second
+)
+
+// State is the tunnel connection state
+type State string
+
+// The tunnel states
+const (
+	// the tunnel never established a connection
+	StateConnecting State = "connecting"
+	// the tunnel listener is active
+	StateConnected State = "connected"
+	// the tunnel was connected and it is waiting to reconnect
+	StateDisconnected State = "disconnected"
+	// the tunnel listener was closed by Pause
+	StatePaused State = "paused"
+)
+
+// Stats is a snapshot of the tunnel state and traffic
+type Stats struct {
+	Name    string `json:"name"`
+	Forward bool   `json:"forward"`
+	State   State  `json:"state"`
+	// the tunnel listener address. Empty if not listening
+	ListenerAddr string `json:"listener_addr"`
+	// the configured endpoints
+	Local          string `json:"local"`
+	Remote         string `json:"remote"`
+	ActiveClients  int    `json:"active_clients"`
+	BytesPerSecond int64  `json:"bytes_per_second"`
+	// the counters since the tunnel was built. BytesIn are the bytes
+	// received from the tunnel clients, BytesOut the ones sent to them
+	TotalClients int64 `json:"total_clients"`
+	BytesIn      int64 `json:"bytes_in"`
+	BytesOut     int64 `json:"bytes_out"`
+	// the failed dials of the tunnel endpoint
+	Errors int64 `json:"errors"`
+	// when the listener was established. Zero if it is not active
+	ConnectedSince time.Time `json:"connected_since"`
+	// the reverse tunnel local endpoints health
+	Backends []BackendStats `json:"backends,omitempty"`
+}
 
 // Tunnel object
 type Tunnel struct {
+	name string
 	// indicates if it is a forward or reverse tunnel
 	forward bool
 
 	remoteEndpoint *utils.Endpoint
 	localEndpoint  *utils.Endpoint
-
-	sshConn              *sshc.SshConnection
+	// the reverse tunnel targets, used round-robin. localEndpoint is
+	// the first one
+	backends  []*backend
+	nextLocal atomic.Uint64
+	// the backends health checks. Disabled if the interval is 0
+	healthCheckInterval time.Duration
+	healthCheckFailures int
+	// the local address the backends are dialed from. Any if empty
+	localBindAddress string
+	// the backends host names cache ttl. Not cached if 0
+	dnsCacheTTL time.Duration
+
+	sshConn              sshConnection
 	reconnectionInterval time.Duration
+	// the denied remote listener requests retries
+	bindRetries    int
+	bindRetryDelay time.Duration
+	// the networks of the reverse tunnel clients allowed. nil allows all
+	allowedClients []*net.IPNet
+	// the forward tunnel local listener tls termination files. Disabled
+	// if empty
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
 
 	// the tunnel connection listener
 	listener net.Listener
+	// the remote port actually in use. It could differ from the
+	// remoteEndpoint one if a random port (0) was requested
+	remotePort int
+	// guarded by listenerMU
+	state State
+	// when the state became StateConnected. Guarded by listenerMU
+	connectedAt time.Time
+	// if the tunnel was paused and the state to restore on resume.
+	// Guarded by listenerMU
+	paused      bool
+	resumeState State
+	// signaled by Resume
+	resumed chan struct{}
 
 	// indicate if the tunnel should be terminated
 	terminate chan bool
 	stoppable bool
+	stopOnce  sync.Once
+	// signaled when the ssh connection is established again
+	reconnected chan struct{}
+	// the ssh connection lifecycle events
+	connEvents <-chan sshc.ConnectionEvent
 
 	registryID int
 
@@ -43,76 +138,290 @@ type Tunnel struct {
 	currentBytesPerSecond int64
 	metricsMU             sync.RWMutex
 	metricsSamplerCloser  chan bool
+	// the Stats counters
+	totalClients atomic.Int64
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	dialErrors   atomic.Int64
+
+	recorder metrics.Recorder
+	tracer   trace.Tracer
+
+	log *slog.Logger
 }
 
 // NewTunnel builds a Tunnel object
-func NewTunnel(sshConn *sshc.SshConnection, conf *TunnelConf, stoppable bool) *Tunnel {
+func NewTunnel(sshConn *sshc.SshConnection, conf *TunnelConf, stoppable bool, opts ...Option) *Tunnel {
+	if sshConn == nil {
+		return newTunnel(nil, conf, stoppable, opts...)
+	}
+	return newTunnel(sshConn, conf, stoppable, opts...)
+}
+
+// NewTunnelWithClient builds a stoppable Tunnel running on an ssh client
+// the caller connected and owns. The tunnel never reconnects nor closes
+// the client: once it is closed the tunnel waits until it is stopped
+func NewTunnelWithClient(client *ssh.Client, conf *TunnelConf, opts ...Option) *Tunnel {
+	return newTunnel(newClientConn(client), conf, true, opts...)
+}
+
+func newTunnel(sshConn sshConnection, conf *TunnelConf, stoppable bool, opts ...Option) *Tunnel {
+	o := options.Build(opts)
+	log := o.Logger
 
 	tunnel := &Tunnel{
+		name:           conf.GetName(),
 		forward:        conf.Forward,
 		remoteEndpoint: conf.GetRemotEndpoint(),
 		localEndpoint:  conf.GetLocalEndpoint(),
+		backends:       newBackends(conf.GetLocalEndpoints()),
+
+		healthCheckInterval: conf.HealthCheckInterval,
+		healthCheckFailures: conf.HealthCheckFailures,
+		localBindAddress:    conf.LocalBindAddress,
+		dnsCacheTTL:         conf.DNSCacheTTL,
 
 		sshConn:              sshConn,
 		reconnectionInterval: 5 * time.Second,
+		bindRetries:          conf.BindRetries,
+		bindRetryDelay:       conf.BindRetryDelay,
+		tlsCert:              conf.TLSCert,
+		tlsKey:               conf.TLSKey,
+		tlsClientCA:          conf.TLSClientCA,
 		terminate:            make(chan bool, 1),
 		stoppable:            stoppable,
+		reconnected:          make(chan struct{}, 1),
+		resumed:              make(chan struct{}, 1),
+		state:                StateConnecting,
 
 		clientsMap: make(map[string]net.Conn),
 
 		currentBytes:          0,
 		currentBytesPerSecond: 0,
 		metricsSamplerCloser:  make(chan bool),
+
+		recorder: metrics.Nop,
+		tracer:   o.GetTracer(),
+		log:      log.With("subsystem", "tun", "tunnel_name", conf.GetName()),
+	}
+	if tunnel.healthCheckFailures <= 0 {
+		tunnel.healthCheckFailures = DefaultHealthCheckFailures
+	}
+	switch {
+	case tunnel.bindRetries < 0:
+		tunnel.bindRetries = 0
+	case tunnel.bindRetries == 0:
+		tunnel.bindRetries = DefaultBindRetries
+	}
+	if tunnel.bindRetryDelay <= 0 {
+		tunnel.bindRetryDelay = DefaultBindRetryDelay
+	}
+	if len(conf.AllowedClientCIDRs) > 0 {
+		// the invalid networks are skipped, so that no client is allowed
+		// if none is valid
+		networks, err := ParseCIDRs(conf.AllowedClientCIDRs)
+		if err != nil {
+			tunnel.log.Error("invalid allowed_client_cidrs", "error", err)
+		}
+		tunnel.allowedClients = networks
+	}
+	if sshConn != nil {
+		tunnel.connEvents = sshConn.Subscribe()
+		go tunnel.handleConnEvents()
 	}
 
 	return tunnel
 }
 
-func (t *Tunnel) waitForSshClient() bool {
-	c := make(chan bool)
+func newBackends(endpoints []*utils.Endpoint) []*backend {
+	backends := make([]*backend, len(endpoints))
+	for i, e := range endpoints {
+		backends[i] = &backend{endpoint: e}
+	}
+	return backends
+}
+
+// handleConnEvents follows the ssh connection until the tunnel is
+// stopped. When the connection fails the tunnel listener is closed, and
+// the tunnel is rebuilt as soon as the new connection is established,
+// rebinding the reverse forwards
+func (t *Tunnel) handleConnEvents() {
+	for event := range t.connEvents {
+		switch event.Type {
+		case sshc.EventConnected:
+			select {
+			case t.reconnected <- struct{}{}:
+			default:
+			}
+		case sshc.EventDisconnected:
+			t.listenerMU.RLock()
+			// a listener established after the failure is on the new
+			// connection already
+			if t.listener != nil && !t.connectedAt.After(event.Time) {
+				t.listener.Close()
+			}
+			t.listenerMU.RUnlock()
+		}
+	}
+}
+
+// SetMetricsRecorder sets the recorder that collects the tunnel
+// connections and traffic. It needs to be called before Start
+func (t *Tunnel) SetMetricsRecorder(recorder metrics.Recorder) {
+	t.recorder = recorder
+}
+
+// GetName returns the tunnel name
+func (t *Tunnel) GetName() string {
+	return t.name
+}
+
+func (t *Tunnel) direction() string {
+	if t.forward {
+		return "forward"
+	}
+	return "reverse"
+}
+
+func (t *Tunnel) waitForSshClient(ctx context.Context) bool {
+	c := make(chan bool, 1)
 	go func() {
-		defer close(c)
-		// WARN: if I have issues with sshConn this will wait forever
-		t.sshConn.ReadyWait()
+		// a stopped ssh connection is waited until it is started again
+		for t.sshConn.ReadyWait() != nil {
+			select {
+			case <-t.reconnected:
+			case <-t.terminate:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		c <- true
 	}()
 	select {
 	case <-t.terminate:
 		return false
+	case <-ctx.Done():
+		return false
 	default:
 		select {
 		case <-c:
 			return true
 		case <-t.terminate:
 			return false
+		case <-ctx.Done():
+			return false
 		}
 	}
 }
 
-// Start activates the tunnel connections
-func (t *Tunnel) Start() {
+// Start activates the tunnel connections. It returns when ctx is
+// canceled or Stop is called. The ctx cancellation terminates the
+// tunnel even if it is not stoppable
+func (t *Tunnel) Start(ctx context.Context) {
 	t.registryID = TunRegistry().Add(t)
+	stop := context.AfterFunc(ctx, t.stop)
+	defer stop()
 
 	go t.metricsSampler()
+	if !t.forward && t.healthCheckInterval > 0 {
+		go t.healthCheckLoop(t.healthCheckInterval, t.healthCheckFailures)
+	}
 	for {
+		// a paused tunnel doesn't listen until it is resumed
+		for t.IsPaused() {
+			select {
+			case <-t.resumed:
+			case <-t.terminate:
+				t.log.Info("terminated")
+				return
+			}
+		}
+
 		// waits for the ssh client to be connected to the server or for
 		// a terminate request
 		for {
-			if t.waitForSshClient() {
+			if t.waitForSshClient(ctx) {
 				break
 			} else {
-				log.Println("terminated")
+				t.log.Info("terminated")
 				return
 			}
 		}
 
+		// drop a connect event received before the listener is started
+		select {
+		case <-t.reconnected:
+		default:
+		}
+
 		if t.forward {
 			t.listenLocal()
 		} else {
 			t.listenRemote()
 		}
+		t.listenerMU.Lock()
+		if t.state == StateConnected {
+			t.state = StateDisconnected
+		}
+		t.connectedAt = time.Time{}
+		t.listenerMU.Unlock()
+
+		// retry as soon as the ssh connection is established again
+		select {
+		case <-t.reconnected:
+		case <-t.resumed:
+		case <-t.terminate:
+		case <-ctx.Done():
+		case <-time.After(t.reconnectionInterval):
+		}
+	}
+}
+
+// Pause closes the tunnel listener, so that it doesn't accept new
+// clients until Resume is called. The ssh connection and the active
+// clients connections are kept
+func (t *Tunnel) Pause() {
+	t.listenerMU.Lock()
+	defer t.listenerMU.Unlock()
+	if t.paused {
+		return
+	}
+	t.paused = true
+	t.resumeState = t.state
+	if t.resumeState == StateConnected {
+		t.resumeState = StateDisconnected
+	}
+	t.state = StatePaused
+	t.connectedAt = time.Time{}
+	if t.listener != nil {
+		t.listener.Close()
+		t.listener = nil
+	}
+	t.log.Info("paused")
+}
 
-		time.Sleep(t.reconnectionInterval)
+// Resume opens again the listener of a paused tunnel
+func (t *Tunnel) Resume() {
+	t.listenerMU.Lock()
+	defer t.listenerMU.Unlock()
+	if !t.paused {
+		return
 	}
+	t.paused = false
+	t.state = t.resumeState
+	select {
+	case t.resumed <- struct{}{}:
+	default:
+	}
+	t.log.Info("resumed")
+}
+
+// IsPaused returns true if the tunnel was paused
+func (t *Tunnel) IsPaused() bool {
+	t.listenerMU.RLock()
+	defer t.listenerMU.RUnlock()
+	return t.paused
 }
 
 // IsStoppable return true if the tunnel can be stopped calling the Stop
@@ -126,63 +435,117 @@ func (t *Tunnel) Stop() {
 	if !t.stoppable {
 		return
 	}
-	close(t.metricsSamplerCloser)
-	TunRegistry().Delete(t.registryID)
-	close(t.terminate)
-	go func() {
-		t.listenerMU.RLock()
-		if t.listener != nil {
-			t.listener.Close()
-		}
-		t.listenerMU.RUnlock()
+	t.stop()
+}
 
-		// close all clients connections
-		t.clientsMapMU.Lock()
-		for k, v := range t.clientsMap {
-			v.Close()
-			delete(t.clientsMap, k)
+// stop terminates the tunnel and closes its clients connections. It can
+// be called more than once
+func (t *Tunnel) stop() {
+	t.stopOnce.Do(func() {
+		close(t.metricsSamplerCloser)
+		TunRegistry().Delete(t.registryID)
+		if t.sshConn != nil {
+			t.sshConn.Unsubscribe(t.connEvents)
 		}
-		t.clientsMapMU.Unlock()
-	}()
+		close(t.terminate)
+		go func() {
+			t.listenerMU.RLock()
+			if t.listener != nil {
+				t.listener.Close()
+			}
+			t.listenerMU.RUnlock()
+
+			// close all clients connections
+			t.clientsMapMU.Lock()
+			for k, v := range t.clientsMap {
+				v.Close()
+				delete(t.clientsMap, k)
+			}
+			t.clientsMapMU.Unlock()
+		}()
+	})
 }
 
 func (t *Tunnel) listenLocal() error {
+	if t.localBindAddress != "" {
+		t.log.Error("invalid local_bind_address", "local_bind_address", t.localBindAddress, "error", errForwardLocalBind)
+		return errForwardLocalBind
+	}
 	// Listen on remote server port
+	// the certificates are loaded at each listen, so that the renewed
+	// ones are used after a reconnect
+	tlsConfig, err := loadTLSConfig(t.tlsCert, t.tlsKey, t.tlsClientCA)
+	if err != nil {
+		t.log.Error("tls config error", "error", err)
+		return err
+	}
 	listener, err := net.Listen("tcp", t.localEndpoint.String())
 	if err != nil {
-		log.Printf("dial INTO remote service error. %s\n", err)
+		t.log.Error("listen on local endpoint error", "addr", t.localEndpoint.String(), "error", err)
 		return err
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	defer listener.Close()
 
 	t.listenerMU.Lock()
+	if t.paused {
+		t.listenerMU.Unlock()
+		return nil
+	}
 	t.listener = listener
+	t.state = StateConnected
+	t.connectedAt = time.Now()
 	t.listenerMU.Unlock()
 
-	log.Printf("forward connected. Local: %s <- Remote: %s\n", t.listener.Addr(), t.remoteEndpoint.String())
+	t.log.Info("forward connected", "local", listener.Addr().String(), "remote", t.remoteEndpoint.String())
 	if t.sshConn != nil && listener != nil {
 		for {
-			remote, err := t.sshConn.Client.Dial("tcp", t.remoteEndpoint.String())
-			// Open a (local) connection to localEndpoint whose content will be forwarded so serverEndpoint
-			if err != nil {
-				log.Printf("listen open port ON local server error. %s\n", err)
-				break
-			}
 			client, err := listener.Accept()
 			if err != nil {
-				log.Println("disconnected")
+				t.log.Info("disconnected")
 				return err
 			}
-			t.clientsMapMU.Lock()
-			t.clientsMap[client.RemoteAddr().String()] = client
-			t.clientsMapMU.Unlock()
-
-			t.copyConn(client, remote)
+			go t.serveClient(client, func(ctx context.Context) (net.Conn, error) {
+				// the remote endpoint is reached through the ssh server
+				remote, err := t.sshConn.DialContext(ctx, t.remoteEndpoint.String())
+				if err != nil {
+					t.log.Error("dial INTO remote service error", "remote", t.remoteEndpoint.String(), "error", err)
+				}
+				return remote, err
+			})
 		}
 	}
 	return nil
 }
 
+// serveClient dials the tunnel endpoint for the accepted client and copies
+// the data between them. A span covers the whole client connection
+func (t *Tunnel) serveClient(client net.Conn, dial func(ctx context.Context) (net.Conn, error)) {
+	ctx, span := t.tracer.Start(context.Background(), "tunnel.connection", trace.WithAttributes(
+		attribute.String("tunnel.name", t.name),
+		attribute.String("tunnel.direction", t.direction()),
+		attribute.String("remote.addr", client.RemoteAddr().String()),
+	))
+	t.totalClients.Add(1)
+	target, err := dial(ctx)
+	if err != nil {
+		t.dialErrors.Add(1)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		client.Close()
+		return
+	}
+
+	t.clientsMapMU.Lock()
+	t.clientsMap[client.RemoteAddr().String()] = client
+	t.clientsMapMU.Unlock()
+
+	t.copyConn(client, target, span)
+}
+
 func (t *Tunnel) metricsSampler() {
 	samplingPeriod := 5 // in secs
 	for {
@@ -199,20 +562,48 @@ func (t *Tunnel) metricsSampler() {
 	}
 }
 
-func (t *Tunnel) copyConn(c1, c2 net.Conn) {
-	byteswrittench := rio.CopyConnWithOnClose(c1, c2, true,
+// copyConn copies the data between the client connection c1 and the
+// endpoint one c2. The span is ended when both the directions are closed
+func (t *Tunnel) copyConn(c1, c2 net.Conn, span trace.Span) {
+	direction := t.direction()
+	remoteAddr := c1.RemoteAddr().String()
+	t.log.Debug("client connected", "remote_addr", remoteAddr)
+	t.recorder.TunnelConnectionOpened(t.name, direction)
+	// c1 is the tunnel client connection
+	counted := &countingConn{
+		Conn: c1,
+		onRead: func(n int) {
+			t.bytesIn.Add(int64(n))
+			t.recorder.TunnelBytes(t.name, direction, metrics.FlowReceived, n)
+		},
+		onWrite: func(n int) {
+			t.bytesOut.Add(int64(n))
+			t.recorder.TunnelBytes(t.name, direction, metrics.FlowSent, n)
+		},
+	}
+	bufferSize := rio.DefaultBufferSize
+	if t.sshConn != nil {
+		bufferSize = t.sshConn.BufferSize()
+	}
+	byteswrittench := rio.CopyConnWithOnClose(counted, c2, true, bufferSize,
 		func() {
 			t.clientsMapMU.Lock()
-			delete(t.clientsMap, c1.RemoteAddr().String())
+			delete(t.clientsMap, remoteAddr)
 			t.clientsMapMU.Unlock()
+			t.recorder.TunnelConnectionClosed(t.name, direction)
+			t.log.Debug("client disconnected", "remote_addr", remoteAddr)
 		})
 
 	go func() {
+		var forwarded int64
 		for w := range byteswrittench {
+			forwarded += w
 			t.metricsMU.Lock()
 			t.currentBytes += w
 			t.metricsMU.Unlock()
 		}
+		span.SetAttributes(attribute.Int64("bytes_forwarded", forwarded))
+		span.End()
 	}()
 }
 
@@ -223,7 +614,53 @@ func (t *Tunnel) GetCurrentBytesPerSecond() int64 {
 	return t.currentBytesPerSecond
 }
 
-// GetListenerAddr returns the tunnel listener network address
+// Stats returns the tunnel state and traffic
+func (t *Tunnel) Stats() Stats {
+	stats := Stats{
+		Name:           t.name,
+		Forward:        t.forward,
+		State:          t.State(),
+		Local:          t.localString(),
+		Remote:         t.remoteEndpoint.String(),
+		ActiveClients:  t.GetActiveClientsCount(),
+		BytesPerSecond: t.GetCurrentBytesPerSecond(),
+		TotalClients:   t.totalClients.Load(),
+		BytesIn:        t.bytesIn.Load(),
+		BytesOut:       t.bytesOut.Load(),
+		Errors:         t.dialErrors.Load(),
+	}
+	if !t.forward {
+		for _, b := range t.backends {
+			stats.Backends = append(stats.Backends, b.stats())
+		}
+	}
+	t.listenerMU.RLock()
+	if t.listener != nil {
+		stats.ListenerAddr = t.listener.Addr().String()
+	}
+	stats.ConnectedSince = t.connectedAt
+	t.listenerMU.RUnlock()
+	return stats
+}
+
+// localString returns the local endpoints, comma separated
+func (t *Tunnel) localString() string {
+	locals := make([]string, len(t.backends))
+	for i, b := range t.backends {
+		locals[i] = b.endpoint.String()
+	}
+	return strings.Join(locals, ",")
+}
+
+// State returns the tunnel connection state
+func (t *Tunnel) State() State {
+	t.listenerMU.RLock()
+	defer t.listenerMU.RUnlock()
+	return t.state
+}
+
+// GetListenerAddr returns the tunnel listener address. nil if
+// the tunnel is not connected
 func (t *Tunnel) GetListenerAddr() net.Addr {
 	t.listenerMU.RLock()
 	defer t.listenerMU.RUnlock()
@@ -234,6 +671,18 @@ func (t *Tunnel) GetListenerAddr() net.Addr {
 	return nil
 }
 
+// GetRemotePort returns the tunnel remote port. For reverse tunnels that
+// requested port 0, this is the port allocated by the server. It returns 0
+// if the reverse tunnel is not connected yet
+func (t *Tunnel) GetRemotePort() int {
+	if t.forward {
+		return t.remoteEndpoint.Port
+	}
+	t.listenerMU.RLock()
+	defer t.listenerMU.RUnlock()
+	return t.remotePort
+}
+
 // GetActiveClientsCount returns how many clients are actually using the tunnel
 func (t *Tunnel) GetActiveClientsCount() int {
 	t.clientsMapMU.Lock()
@@ -263,41 +712,132 @@ func (t *Tunnel) listenRemote() error {
 	// Listen on remote server port
 	// you can use port :0 to get a random available tcp port
 	// Example:
-	//	listener, err := t.sshConn.Client.Listen("tcp", "127.0.0.1:0")
-	log.Println("starting remote listener")
-	listener, err := t.sshConn.Client.Listen("tcp", t.remoteEndpoint.String())
+	//	listener, err := t.sshConn.Listen("127.0.0.1:0")
+	t.log.Info("starting remote listener")
+	listener, err := t.bindRemote()
 	if err != nil {
-		log.Printf("listen open port ON remote server error. %s\n", err)
+		t.log.Error("listen open port ON remote server error", "remote", t.remoteEndpoint.String(), "error", err)
 		return err
 	}
 	defer listener.Close()
 
+	remotePort := t.remoteEndpoint.Port
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+		remotePort = tcpAddr.Port
+	}
+	if t.remoteEndpoint.Port == 0 {
+		t.log.Info("remote server allocated port", "port", remotePort)
+	}
+
 	t.listenerMU.Lock()
+	if t.paused {
+		t.listenerMU.Unlock()
+		return nil
+	}
 	t.listener = listener
+	t.remotePort = remotePort
+	t.state = StateConnected
+	t.connectedAt = time.Now()
 	t.listenerMU.Unlock()
 
-	log.Printf("reverse connected. Local: %s -> Remote: %s\n", t.localEndpoint.String(), t.listener.Addr())
+	t.log.Info("reverse connected", "local", t.localString(), "remote", listener.Addr().String())
 	if t.sshConn != nil && listener != nil {
 		for {
-			// Open a (local) connection to localEndpoint whose content will be forwarded so serverEndpoint
-			local, err := net.Dial("tcp", t.localEndpoint.String())
-			if err != nil {
-				log.Printf("dial INTO local service error. %s\n", err)
-				break
-			}
-
 			client, err := listener.Accept()
 			if err != nil {
-				log.Println("disconnected")
+				t.log.Info("disconnected")
 				return err
 			}
+			if !t.clientAllowed(client.RemoteAddr()) {
+				t.log.Warn("client address not allowed, disconnecting", "remote_addr", client.RemoteAddr().String())
+				client.Close()
+				continue
+			}
+			go t.serveClient(client, t.dialLocal)
+		}
+	}
+	return nil
+}
 
-			t.clientsMapMU.Lock()
-			t.clientsMap[client.RemoteAddr().String()] = client
-			t.clientsMapMU.Unlock()
+// clientAllowed reports if the reverse tunnel client address is in the
+// allowed networks
+func (t *Tunnel) clientAllowed(addr net.Addr) bool {
+	if t.allowedClients == nil {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range t.allowedClients {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
 
-			t.copyConn(client, local)
+// bindRemote asks the server for the remote listener. A denied request is
+// retried: after a reconnect the server could still hold the listener of
+// the previous connection for a moment
+func (t *Tunnel) bindRemote() (net.Listener, error) {
+	for attempt := 1; ; attempt++ {
+		listener, err := t.sshConn.Listen(t.remoteEndpoint.String())
+		if err == nil || !isBindDenied(err) || attempt > t.bindRetries {
+			return listener, err
+		}
+		t.log.Warn("remote listener denied, retrying",
+			"remote", t.remoteEndpoint.String(),
+			"attempt", attempt,
+			"max_retries", t.bindRetries,
+			"next_delay", t.bindRetryDelay.String())
+		select {
+		case <-t.terminate:
+			return nil, err
+		case <-time.After(t.bindRetryDelay):
 		}
 	}
-	return nil
+}
+
+// isBindDenied returns true if the server replied false to the
+// tcpip-forward request. The ssh package doesn't export the error
+func isBindDenied(err error) bool {
+	return strings.Contains(err.Error(), "tcpip-forward request denied by peer")
+}
+
+// dialLocal opens the (local) connection whose content will be forwarded
+// to the remote endpoint. The local endpoints are tried round-robin,
+// starting from the one after the previous connection one. The failing
+// ones are skipped, as the unhealthy ones unless all of them are
+func (t *Tunnel) dialLocal(ctx context.Context) (net.Conn, error) {
+	n := uint64(len(t.backends))
+	start := t.nextLocal.Add(1) - 1
+	candidates := []*backend{}
+	for i := uint64(0); i < n; i++ {
+		if b := t.backends[(start+i)%n]; !b.unhealthy.Load() {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		for i := uint64(0); i < n; i++ {
+			candidates = append(candidates, t.backends[(start+i)%n])
+		}
+	}
+	dialer, err := t.localDialer()
+	if err != nil {
+		t.log.Error("invalid local_bind_address", "local_bind_address", t.localBindAddress, "error", err)
+		return nil, err
+	}
+	for _, b := range candidates {
+		var local net.Conn
+		local, err = t.dialBackend(ctx, dialer, b)
+		if err == nil {
+			return local, nil
+		}
+		t.log.Error("dial INTO local service error", "local", b.endpoint.String(), "error", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
 }
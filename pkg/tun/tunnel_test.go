@@ -2,14 +2,33 @@ package tun
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ferama/rospo/pkg/metrics"
 	"github.com/ferama/rospo/pkg/sshc"
 	"github.com/ferama/rospo/pkg/sshd"
+	"github.com/ferama/rospo/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/ssh"
 )
 
 func startEchoService(l net.Listener) {
@@ -44,8 +63,11 @@ func TestTunnelReverse(t *testing.T) {
 		ListenAddress:     "127.0.0.1:0",
 		DisableShell:      false,
 	}
-	sd := sshd.NewSshServer(serverConf)
-	go sd.Start()
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
 	var addr net.Addr
 	for {
 		addr = sd.GetListenerAddr()
@@ -58,14 +80,17 @@ func TestTunnelReverse(t *testing.T) {
 
 	// create an ssh client
 	clientConf := &sshc.SshClientConf{
-		Identity:  "../../testdata/client",
+		Identity:  sshc.Identities{"../../testdata/client"},
 		Insecure:  true, // disable known_hosts check
 		JumpHosts: make([]*sshc.JumpHostConf, 0),
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
 	}
 
-	client := sshc.NewSshConnection(clientConf)
-	go client.Start()
+	client, err := sshc.NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 
 	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -81,7 +106,7 @@ func TestTunnelReverse(t *testing.T) {
 		Forward: false,
 	}
 	tunnel := NewTunnel(client, tunnelConf, true)
-	go tunnel.Start()
+	go tunnel.Start(context.Background())
 
 	if tunnel.GetCurrentBytesPerSecond() != 0 {
 		t.Fail()
@@ -137,8 +162,11 @@ func TestTunnelForward(t *testing.T) {
 		ListenAddress:     "127.0.0.1:0",
 		DisableShell:      false,
 	}
-	sd := sshd.NewSshServer(serverConf)
-	go sd.Start()
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
 	var addr net.Addr
 	for {
 		addr = sd.GetListenerAddr()
@@ -151,14 +179,17 @@ func TestTunnelForward(t *testing.T) {
 
 	// create an ssh client
 	clientConf := &sshc.SshClientConf{
-		Identity:  "../../testdata/client",
+		Identity:  sshc.Identities{"../../testdata/client"},
 		Insecure:  true, // disable known_hosts check
 		JumpHosts: make([]*sshc.JumpHostConf, 0),
 		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
 	}
 
-	client := sshc.NewSshConnection(clientConf)
-	go client.Start()
+	client, err := sshc.NewSshConnection(clientConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
 
 	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -174,7 +205,7 @@ func TestTunnelForward(t *testing.T) {
 		Forward: true,
 	}
 	tunnel := NewTunnel(client, tunnelConf, true)
-	go tunnel.Start()
+	go tunnel.Start(context.Background())
 
 	if tunnel.GetCurrentBytesPerSecond() != 0 {
 		t.Fail()
@@ -219,3 +250,1597 @@ func TestTunnelForward(t *testing.T) {
 
 	tunnel.Stop()
 }
+
+func startD() string {
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		panic(err)
+	}
+	go sd.Start(context.Background())
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return getPort(addr)
+}
+
+func getSSHConn(sshdPort string) *sshc.SshConnection {
+	clientConf := &sshc.SshClientConf{
+		Identity:  sshc.Identities{"../../testdata/client"},
+		Insecure:  true, // disable known_hosts check
+		JumpHosts: make([]*sshc.JumpHostConf, 0),
+		ServerURI: fmt.Sprintf("127.0.0.1:%s", sshdPort),
+	}
+	client, err := sshc.NewSshConnection(clientConf)
+	if err != nil {
+		panic(err)
+	}
+	go client.Start(context.Background())
+	return client
+}
+
+func TestTunnelReverseRandomPort(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	tunnelConf := &TunnelConf{
+		Remote:  "127.0.0.1:0",
+		Local:   "127.0.0.1:9999",
+		Forward: false,
+	}
+	tunnel := NewTunnel(client, tunnelConf, true)
+	if tunnel.GetRemotePort() != 0 {
+		t.Fatalf("expected no remote port before connection")
+	}
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+	port := tunnel.GetRemotePort()
+	if port == 0 {
+		t.Fatalf("expected the server allocated port to be reported")
+	}
+	if fmt.Sprintf("%d", port) != getPort(tunnel.GetListenerAddr()) {
+		t.Fatalf("remote port %d doesn't match listener %s", port, tunnel.GetListenerAddr())
+	}
+}
+
+func TestTunnelMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	recorder := metrics.NewPrometheus(registry)
+
+	sd, err := sshd.NewSshServer(&sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd.SetMetricsRecorder(recorder)
+	go sd.Start(context.Background())
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+	client := getSSHConn(getPort(sd.GetListenerAddr()))
+	client.SetMetricsRecorder(recorder)
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Name:    "echo",
+		Remote:  echoListener.Addr().String(),
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	}, true)
+	tunnel.SetMetricsRecorder(recorder)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "hello\n")
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMetrics := func(expected string, names ...string) {
+		var err error
+		for i := 0; i < 20; i++ {
+			if err = testutil.GatherAndCompare(registry, strings.NewReader(expected), names...); err == nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal(err)
+	}
+
+	waitMetrics(`
+# HELP rospo_tunnel_active_connections The number of active tunnel connections
+# TYPE rospo_tunnel_active_connections gauge
+rospo_tunnel_active_connections{direction="forward",name="echo"} 1
+# HELP rospo_tunnel_bytes_total The bytes transferred through the tunnels
+# TYPE rospo_tunnel_bytes_total counter
+rospo_tunnel_bytes_total{direction="forward",flow="received",name="echo"} 6
+rospo_tunnel_bytes_total{direction="forward",flow="sent",name="echo"} 6
+# HELP rospo_sshd_auth_attempts_total The sshd authentication attempts
+# TYPE rospo_sshd_auth_attempts_total counter
+rospo_sshd_auth_attempts_total{result="success"} 1
+# HELP rospo_sshd_connected_clients The number of clients connected to the sshd server
+# TYPE rospo_sshd_connected_clients gauge
+rospo_sshd_connected_clients 1
+`,
+		"rospo_tunnel_active_connections",
+		"rospo_tunnel_bytes_total",
+		"rospo_sshd_auth_attempts_total",
+		"rospo_sshd_connected_clients",
+	)
+
+	conn.Close()
+	waitMetrics(`
+# HELP rospo_tunnel_active_connections The number of active tunnel connections
+# TYPE rospo_tunnel_active_connections gauge
+rospo_tunnel_active_connections{direction="forward",name="echo"} 0
+`, "rospo_tunnel_active_connections")
+
+	stats := tunnel.Stats()
+	if stats.TotalClients != 1 || stats.BytesIn != 6 || stats.BytesOut != 6 || stats.Errors != 0 {
+		t.Fatalf("unexpected stats counters %+v", stats)
+	}
+	if stats.ConnectedSince.IsZero() || stats.Remote != echoListener.Addr().String() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestTunnelForwardReconnect(t *testing.T) {
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sshdAddr := sd.GetListenerAddr().String()
+
+	client := getSSHConn(getPort(sd.GetListenerAddr()))
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	// the local port needs to be stable across reconnections
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	localAddr := l.Addr().String()
+	l.Close()
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  echoListener.Addr().String(),
+		Local:   localAddr,
+		Forward: true,
+	}, true)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+
+	echo := func() error {
+		conn, err := net.Dial("tcp", localAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "ping\n" {
+			return fmt.Errorf("unexpected reply '%s'", line)
+		}
+		return nil
+	}
+	waitEcho := func() {
+		var err error
+		for i := 0; i < 60; i++ {
+			if err = echo(); err == nil {
+				return
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		t.Fatalf("the tunnel is not working: %s", err)
+	}
+	waitEcho()
+	if state := tunnel.State(); state != StateConnected {
+		t.Fatalf("unexpected tunnel state %s", state)
+	}
+
+	sd.Stop()
+	for client.IsConnected() {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < 50 && tunnel.State() != StateDisconnected; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if state := tunnel.State(); state != StateDisconnected {
+		t.Fatalf("unexpected tunnel state %s", state)
+	}
+
+	serverConf.ListenAddress = sshdAddr
+	sd, err = sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+
+	waitEcho()
+}
+
+// syncBuffer is a goroutine safe log destination
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// find returns the first record with the msg message
+func (b *syncBuffer) find(t *testing.T, msg string) map[string]any {
+	records := b.findAll(t, msg)
+	if len(records) == 0 {
+		return nil
+	}
+	return records[0]
+}
+
+// findAll returns the records with the msg message
+func (b *syncBuffer) findAll(t *testing.T, msg string) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	records := []map[string]any{}
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		record := map[string]any{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestTunnelStructuredLogging(t *testing.T) {
+	sshdPort := startD()
+	client := getSSHConn(sshdPort)
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	tunnel := NewTunnel(client, &TunnelConf{
+		Name:    "echo",
+		Remote:  echoListener.Addr().String(),
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	}, true, WithLogger(logger))
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "hello\n")
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	record := out.find(t, "forward connected")
+	if record == nil {
+		t.Fatal("forward connected record not found")
+	}
+	if record["level"] != "INFO" || record["subsystem"] != "tun" || record["tunnel_name"] != "echo" {
+		t.Fatalf("unexpected record %v", record)
+	}
+
+	for i := 0; i < 20 && record["msg"] != "client disconnected"; i++ {
+		if r := out.find(t, "client disconnected"); r != nil {
+			record = r
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if record["msg"] != "client disconnected" {
+		t.Fatal("client disconnected record not found")
+	}
+	if record["level"] != "DEBUG" || record["tunnel_name"] != "echo" {
+		t.Fatalf("unexpected record %v", record)
+	}
+	if record["remote_addr"] != conn.LocalAddr().String() {
+		t.Fatalf("unexpected remote_addr %v", record["remote_addr"])
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	run := func(fn func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(ctx)
+		}()
+	}
+
+	sd, err := sshd.NewSshServer(&sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(func(ctx context.Context) { sd.Start(ctx) })
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sshdAddr := sd.GetListenerAddr().String()
+
+	client, err := sshc.NewSshConnection(&sshc.SshClientConf{
+		Identity:  sshc.Identities{"../../testdata/client"},
+		Insecure:  true,
+		ServerURI: sshdAddr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(func(ctx context.Context) { client.Start(ctx) })
+
+	// the ctx cancellation ends the not stoppable tunnels too
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  sshdAddr,
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	}, false)
+	run(tunnel.Start)
+	for tunnel.State() != StateConnected {
+		time.Sleep(100 * time.Millisecond)
+	}
+	tunnelAddr := tunnel.GetListenerAddr().String()
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the services didn't return after the context cancellation")
+	}
+
+	if client.IsConnected() {
+		t.Fatal("the client is still connected")
+	}
+	for _, addr := range []string{sshdAddr, tunnelAddr} {
+		var err error
+		for i := 0; i < 20; i++ {
+			var conn net.Conn
+			if conn, err = net.Dial("tcp", addr); err != nil {
+				break
+			}
+			conn.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err == nil {
+			t.Fatalf("%s is still listening", addr)
+		}
+	}
+}
+
+func TestTunnelTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+	tracer := provider.Tracer("rospo")
+
+	sd, err := sshd.NewSshServer(&sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}, sshd.WithTracer(tracer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	client, err := sshc.NewSshConnection(&sshc.SshClientConf{
+		Identity:  sshc.Identities{"../../testdata/client"},
+		Insecure:  true,
+		ServerURI: sd.GetListenerAddr().String(),
+	}, sshc.WithTracer(tracer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Name:    "traced",
+		Remote:  echoListener.Addr().String(),
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	}, true, WithTracer(tracer))
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "ping\n")
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	findSpan := func(name string) (tracetest.SpanStub, bool) {
+		for _, span := range exporter.GetSpans() {
+			if span.Name == name {
+				return span, true
+			}
+		}
+		return tracetest.SpanStub{}, false
+	}
+	var tunnelSpan, sshdSpan tracetest.SpanStub
+	for i := 0; i < 50; i++ {
+		var tunnelOk, sshdOk bool
+		tunnelSpan, tunnelOk = findSpan("tunnel.connection")
+		sshdSpan, sshdOk = findSpan("sshd.direct-tcpip")
+		if tunnelOk && sshdOk {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !tunnelSpan.SpanContext.IsValid() || !sshdSpan.SpanContext.IsValid() {
+		t.Fatalf("missing spans, got %v", exporter.GetSpans().Snapshots())
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range tunnelSpan.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["tunnel.name"].AsString() != "traced" {
+		t.Fatalf("unexpected tunnel.name %v", attrs["tunnel.name"])
+	}
+	if attrs["tunnel.direction"].AsString() != "forward" {
+		t.Fatalf("unexpected tunnel.direction %v", attrs["tunnel.direction"])
+	}
+	if attrs["remote.addr"].AsString() != conn.LocalAddr().String() {
+		t.Fatalf("unexpected remote.addr %v", attrs["remote.addr"])
+	}
+	// ping and its echo
+	if attrs["bytes_forwarded"].AsInt64() != 10 {
+		t.Fatalf("unexpected bytes_forwarded %v", attrs["bytes_forwarded"])
+	}
+
+	// the span context is propagated to the server
+	if sshdSpan.Parent.SpanID() != tunnelSpan.SpanContext.SpanID() ||
+		sshdSpan.SpanContext.TraceID() != tunnelSpan.SpanContext.TraceID() {
+		t.Fatal("the sshd span is not a child of the tunnel connection one")
+	}
+
+	connectSpan, ok := findSpan("ssh.connect")
+	if !ok {
+		t.Fatal("missing ssh.connect span")
+	}
+	for _, name := range []string{"ssh.dial", "ssh.handshake"} {
+		span, ok := findSpan(name)
+		if !ok || span.Parent.SpanID() != connectSpan.SpanContext.SpanID() {
+			t.Fatalf("%s is not a child of the ssh.connect span", name)
+		}
+	}
+}
+
+func TestTunnelsConnectionPool(t *testing.T) {
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+	var addr net.Addr
+	for {
+		addr = sd.GetListenerAddr()
+		if addr != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	pool := sshc.NewConnectionPool()
+	defer pool.Close()
+	newClientConf := func() *sshc.SshClientConf {
+		return &sshc.SshClientConf{
+			Identity:  sshc.Identities{"../../testdata/client"},
+			Insecure:  true,
+			ServerURI: addr.String(),
+		}
+	}
+
+	tunnels := []*Tunnel{}
+	conns := []*sshc.SshConnection{}
+	for i := 0; i < 2; i++ {
+		conn, err := pool.Get(newClientConf())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		tunnel := NewTunnel(conn, &TunnelConf{
+			Remote:  echoListener.Addr().String(),
+			Local:   "127.0.0.1:0",
+			Forward: true,
+		}, true)
+		go tunnel.Start(context.Background())
+		defer tunnel.Stop()
+		tunnels = append(tunnels, tunnel)
+	}
+	if conns[0] != conns[1] || pool.Len() != 1 {
+		t.Fatal("expected a shared connection")
+	}
+
+	for _, tunnel := range tunnels {
+		var tunaddr net.Addr
+		for tunaddr == nil {
+			tunaddr = tunnel.GetListenerAddr()
+			time.Sleep(100 * time.Millisecond)
+		}
+		conn, err := net.Dial("tcp", tunaddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("test\n"))
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil || string(buf) != "test\n" {
+			t.Fatalf("unexpected echo %q %v", buf, err)
+		}
+		conn.Close()
+	}
+	if sd.GetActiveSessionsCount() != 1 {
+		t.Fatalf("expected 1 ssh session, got %d", sd.GetActiveSessionsCount())
+	}
+
+	// the connection is closed when released by all the users
+	pool.Release(conns[0])
+	if pool.Len() != 1 {
+		t.Fatal("expected the connection to be still in use")
+	}
+	pool.Release(conns[1])
+	if pool.Len() != 0 {
+		t.Fatal("expected the idle connection to be closed")
+	}
+	for i := 0; i < 20 && sd.GetActiveSessionsCount() != 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if sd.GetActiveSessionsCount() != 0 {
+		t.Fatalf("expected no ssh sessions, got %d", sd.GetActiveSessionsCount())
+	}
+}
+
+func TestTunnelPauseResume(t *testing.T) {
+	client := getSSHConn(startD())
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Name:    "web",
+		Remote:  echoListener.Addr().String(),
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	}, true)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+
+	waitAddr := func() net.Addr {
+		for i := 0; i < 50; i++ {
+			if addr := tunnel.GetListenerAddr(); addr != nil {
+				return addr
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatal("tunnel not listening")
+		return nil
+	}
+	tunaddr := waitAddr()
+
+	// the active clients survive the pause
+	conn, err := net.Dial("tcp", tunaddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo := func() {
+		conn.Write([]byte("test\n"))
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil || string(buf) != "test\n" {
+			t.Fatalf("unexpected echo %q %v", buf, err)
+		}
+	}
+	echo()
+
+	tunnel.Pause()
+	if tunnel.State() != StatePaused || tunnel.GetListenerAddr() != nil {
+		t.Fatalf("expected a paused tunnel, got %s", tunnel.State())
+	}
+	if _, err := net.Dial("tcp", tunaddr.String()); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+	echo()
+	// the paused tunnel doesn't listen again
+	time.Sleep(500 * time.Millisecond)
+	if tunnel.GetListenerAddr() != nil {
+		t.Fatal("expected the tunnel to stay paused")
+	}
+
+	tunnel.Resume()
+	waitAddr()
+	if tunnel.State() != StateConnected {
+		t.Fatalf("expected a connected tunnel, got %s", tunnel.State())
+	}
+}
+
+func TestTunnelCompression(t *testing.T) {
+	sshdPort := startD()
+	client, err := sshc.NewSshConnection(&sshc.SshClientConf{
+		Identity:         sshc.Identities{"../../testdata/client"},
+		Insecure:         true,
+		ServerURI:        fmt.Sprintf("127.0.0.1:%s", sshdPort),
+		Compression:      true,
+		CompressionLevel: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Start(context.Background())
+	defer client.Stop()
+	client.ReadyWait()
+	if !client.IsCompressed() {
+		t.Fatal("expected the compression to be negotiated")
+	}
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	line := strings.Repeat("rospo compressed tunnel ", 4096) + "\n"
+	for _, forward := range []bool{true, false} {
+		conf := &TunnelConf{
+			Remote:  echoListener.Addr().String(),
+			Local:   "127.0.0.1:0",
+			Forward: forward,
+		}
+		if !forward {
+			conf.Remote, conf.Local = "127.0.0.1:0", echoListener.Addr().String()
+		}
+		tunnel := NewTunnel(client, conf, true)
+		go tunnel.Start(context.Background())
+
+		var tunaddr net.Addr
+		for tunaddr == nil {
+			time.Sleep(100 * time.Millisecond)
+			tunaddr = tunnel.GetListenerAddr()
+		}
+		conn, err := net.Dial("tcp", tunaddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(line))
+		got, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("forward %t: %v", forward, err)
+		}
+		if got != line {
+			t.Fatalf("forward %t: the echoed data doesn't match", forward)
+		}
+		conn.Close()
+		tunnel.Stop()
+	}
+}
+
+// startNamedService starts a service replying with its name to every
+// connection
+func startNamedService(t *testing.T, name string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%s\n", name)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestTunnelReverseRoundRobin(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	// a backend that is not listening
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote: "127.0.0.1:0",
+		Locals: []string{
+			startNamedService(t, "a"),
+			down.Addr().String(),
+			startNamedService(t, "b"),
+		},
+	}, true)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	// the down backend turn goes to the next one
+	replies := []string{}
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, strings.TrimSpace(reply))
+	}
+	if strings.Join(replies, "") != "abba" {
+		t.Fatalf("unexpected backends order %v", replies)
+	}
+	if tunnel.Stats().Errors != 0 {
+		t.Fatalf("the failover was counted as an error")
+	}
+	if !strings.Contains(tunnel.Stats().Local, ",") {
+		t.Fatalf("unexpected local %s", tunnel.Stats().Local)
+	}
+}
+
+func TestTunnelReverseLocalBindAddress(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	// the service replies with the client address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%s\n", conn.RemoteAddr())
+			conn.Close()
+		}
+	}()
+
+	// the kernel would choose 127.0.0.1 anyway: bind another loopback
+	// address, where it is usable, so that the source checks the binding
+	bindAddress := "127.0.0.2"
+	probe, err := (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(bindAddress)}}).Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Skipf("cannot dial from %s: %s", bindAddress, err)
+	}
+	probe.Close()
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:           "127.0.0.1:0",
+		Local:            l.Addr().String(),
+		LocalBindAddress: bindAddress,
+	}, true)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _, err := net.SplitHostPort(strings.TrimSpace(reply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != bindAddress {
+		t.Fatalf("the service was dialed from %s", host)
+	}
+}
+
+func TestTunnelForwardLocalBindAddress(t *testing.T) {
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Remote:           "127.0.0.1:22",
+		Local:            "127.0.0.1:0",
+		Forward:          true,
+		LocalBindAddress: "127.0.0.1",
+	}, true)
+	if err := tunnel.listenLocal(); !errors.Is(err, errForwardLocalBind) {
+		t.Fatalf("expected the local bind address to be refused, got %v", err)
+	}
+	if tunnel.GetListenerAddr() != nil {
+		t.Fatal("unexpected local listener")
+	}
+}
+
+// failingResolver resolves every host to 127.0.0.1 until failing is set
+type failingResolver struct {
+	failing atomic.Bool
+}
+
+func (r *failingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if r.failing.Load() {
+		return nil, errors.New("dns failure")
+	}
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func TestDialBackendStale(t *testing.T) {
+	resolver := &failingResolver{}
+	defaultCache := utils.DefaultEndpointCache
+	utils.DefaultEndpointCache = utils.NewEndpointCache(resolver)
+	defer func() { utils.DefaultEndpointCache = defaultCache }()
+
+	// a port nobody listens on, until the service starts
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	tunnel := NewTunnel(nil, &TunnelConf{
+		Remote:      "127.0.0.1:0",
+		Local:       fmt.Sprintf("backend.test:%d", port),
+		DNSCacheTTL: time.Minute,
+	}, true)
+	b := tunnel.backends[0]
+	if _, err := tunnel.dialBackend(context.Background(), &net.Dialer{}, b); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+
+	// the failed dial keeps the addresses for the DNS failures
+	resolver.failing.Store(true)
+	l, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Skipf("cannot listen again on %d: %s", port, err)
+	}
+	defer l.Close()
+	conn, err := tunnel.dialBackend(context.Background(), &net.Dialer{}, b)
+	if err != nil {
+		t.Fatalf("expected the stale addresses to be dialed, got %s", err)
+	}
+	conn.Close()
+}
+
+func TestTunnelReverseDNSCache(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	_, port, _ := net.SplitHostPort(startNamedService(t, "cached"))
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:      "127.0.0.1:0",
+		Local:       "localhost:" + port,
+		DNSCacheTTL: time.Minute,
+	}, true)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || strings.TrimSpace(reply) != "cached" {
+			t.Fatalf("unexpected reply %q, error %v", reply, err)
+		}
+	}
+}
+
+func TestResolveBindAddress(t *testing.T) {
+	addr, err := ResolveBindAddress("127.0.0.1")
+	if err != nil || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("unexpected address %v, error %v", addr, err)
+	}
+	if _, err := ResolveBindAddress("no-such-interface0"); err == nil {
+		t.Fatal("expected an error for a missing interface")
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+		addr, err := ResolveBindAddress(iface.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addr.IP.IsLoopback() {
+			t.Fatalf("the %s address %s is not a loopback one", iface.Name, addr)
+		}
+		return
+	}
+	t.Skip("no loopback interface")
+}
+
+func TestTunnelReverseHealthCheck(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	// a backend that goes down and comes back on the same address
+	flaky, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flakyAddr := flaky.Addr().String()
+	flaky.Close()
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:              "127.0.0.1:0",
+		Locals:              []string{flakyAddr, startNamedService(t, "a")},
+		HealthCheckInterval: 50 * time.Millisecond,
+		HealthCheckFailures: 2,
+	}, true)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+	for tunnel.GetListenerAddr() == nil {
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	waitHealthy := func(healthy bool) {
+		for i := 0; i < 100; i++ {
+			backends := tunnel.Stats().Backends
+			if len(backends) != 2 {
+				t.Fatalf("unexpected backends %+v", backends)
+			}
+			if backends[0].Healthy == healthy {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("the backend health is not %v", healthy)
+	}
+	waitHealthy(false)
+	if tunnel.Stats().Backends[0].Failures < 2 {
+		t.Fatalf("unexpected failures %+v", tunnel.Stats().Backends[0])
+	}
+
+	// the connections go to the healthy backend
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", tunnel.GetListenerAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if err != nil || strings.TrimSpace(reply) != "a" {
+			t.Fatalf("unexpected reply %q, %v", reply, err)
+		}
+	}
+	flaky, err = net.Listen("tcp", flakyAddr)
+	if err != nil {
+		t.Skipf("cannot listen again on %s: %s", flakyAddr, err)
+	}
+	defer flaky.Close()
+	waitHealthy(true)
+	if tunnel.Stats().Backends[0].Failures != 0 {
+		t.Fatalf("unexpected failures %+v", tunnel.Stats().Backends[0])
+	}
+}
+
+func TestTunnelConfValidate(t *testing.T) {
+	valid := []*TunnelConf{
+		{Remote: ":80", Local: ":80"},
+		{Remote: ":80", Locals: []string{":81", ":82"}},
+		{Remote: ":80", Local: ":81", AllowedClientCIDRs: []string{"10.0.0.0/8", "::1/128"}},
+		{Remote: ":80", Local: ":81", Forward: true, TLSCert: "a.crt", TLSKey: "a.key", TLSClientCA: "ca.crt"},
+		{Remote: "[::1]:80", Local: "[fe80::1%eth0]:81"},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Fatalf("unexpected error %s for %+v", err, c)
+		}
+	}
+	invalid := []*TunnelConf{
+		{Remote: ":80"},
+		{Local: ":80"},
+		{Remote: ":80", Local: ":80", Locals: []string{":81"}},
+		{Remote: ":80", Locals: []string{":81"}, Forward: true},
+		{Remote: ":80", Local: ":81", Forward: true, HealthCheckInterval: time.Second},
+		{Remote: ":80", Local: ":81", HealthCheckFailures: -1},
+		{Remote: ":80", Local: ":81", BindRetries: -2},
+		{Remote: ":80", Local: ":81", AllowedClientCIDRs: []string{"10.0.0.0"}},
+		{Remote: ":80", Local: ":81", Forward: true, AllowedClientCIDRs: []string{"10.0.0.0/8"}},
+		{Remote: ":80", Local: ":81", TLSCert: "a.crt", TLSKey: "a.key"},
+		{Remote: ":80", Local: ":81", Forward: true, TLSCert: "a.crt"},
+		{Remote: ":80", Local: ":81", Forward: true, TLSClientCA: "ca.crt"},
+		{Remote: ":80", Local: ":81", Forward: true, LocalBindAddress: "127.0.0.1"},
+		{Remote: ":80", Local: ":81", DNSCacheTTL: -time.Second},
+		{Remote: ":80", Local: ":81", Forward: true, DNSCacheTTL: time.Minute},
+		{Remote: "[::1:80", Local: ":81"},
+		{Remote: ":80", Locals: []string{":81", "backend:http"}},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("expected an error for %+v", c)
+		}
+	}
+	// all the invalid values are reported
+	var errs ConfErrors
+	err := (&TunnelConf{Locals: []string{":81", "backend:http"}, BindRetries: -2}).Validate()
+	if !errors.As(err, &errs) || len(errs) != 3 ||
+		errs[0].Field != "remote" || errs[1].Field != "locals[1]" || errs[2].Field != "bind_retries" {
+		t.Fatalf("unexpected errors %v", err)
+	}
+	var addrErr *utils.AddressError
+	if !errors.As(errs[1], &addrErr) {
+		t.Fatalf("expected an address error, got %v", errs[1])
+	}
+	if name := (&TunnelConf{Remote: ":80", Locals: []string{":81", ":82"}}).GetName(); name != ":81,:82-:80" {
+		t.Fatalf("unexpected name %s", name)
+	}
+}
+
+func TestHTTPConnectGateway(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "through the gateway")
+	}))
+	defer target.Close()
+
+	gateway := NewHTTPConnectGateway(client)
+	go gateway.Start("127.0.0.1:0")
+	defer gateway.Stop()
+	for gateway.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	gatewayURL, _ := url.Parse("http://" + gateway.GetListenerAddr().String())
+
+	// a CONNECT followed by the tls handshake to the destination
+	httpClient := target.Client()
+	httpClient.Transport.(*http.Transport).Proxy = http.ProxyURL(gatewayURL)
+	resp, err := httpClient.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "through the gateway" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// the plain http requests are declined
+	conn, err := net.Dial("tcp", gateway.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", target.URL, target.Listener.Addr())
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	conn.Close()
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected response %v, %v", resp, err)
+	}
+
+	// an unreachable destination
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+	conn, err = net.Dial("tcp", gateway.GetListenerAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", down.Addr(), down.Addr())
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	conn.Close()
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected response %v, %v", resp, err)
+	}
+}
+
+func TestTunnelReverseReconnect(t *testing.T) {
+	serverConf := &sshd.SshDConf{
+		Key:               "../../testdata/server",
+		AuthorizedKeysURI: []string{"../../testdata/authorized_keys"},
+		ListenAddress:     "127.0.0.1:0",
+	}
+	sd, err := sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	for sd.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sshdAddr := sd.GetListenerAddr().String()
+
+	client := getSSHConn(getPort(sd.GetListenerAddr()))
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	// the remote port needs to be stable across reconnections
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	remoteAddr := l.Addr().String()
+	l.Close()
+
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:  remoteAddr,
+		Local:   echoListener.Addr().String(),
+		Forward: false,
+	}, true)
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+
+	echo := func() error {
+		conn, err := net.Dial("tcp", remoteAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "ping\n" {
+			return fmt.Errorf("unexpected reply '%s'", line)
+		}
+		return nil
+	}
+	waitEcho := func() {
+		var err error
+		for i := 0; i < 60; i++ {
+			if err = echo(); err == nil {
+				return
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		t.Fatalf("the tunnel is not working: %s", err)
+	}
+	waitEcho()
+
+	sd.Stop()
+	for i := 0; i < 50 && tunnel.State() != StateDisconnected; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if state := tunnel.State(); state != StateDisconnected {
+		t.Fatalf("unexpected tunnel state %s", state)
+	}
+
+	serverConf.ListenAddress = sshdAddr
+	sd, err = sshd.NewSshServer(serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sd.Start(context.Background())
+	defer sd.Stop()
+
+	// the reverse forward is bound again on the new connection
+	waitEcho()
+	if state := tunnel.State(); state != StateConnected {
+		t.Fatalf("unexpected tunnel state %s", state)
+	}
+}
+
+func TestTunnelReverseBindRetry(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	// the server side port is busy, like if the previous connection
+	// listener is not released yet
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:         busy.Addr().String(),
+		Local:          "127.0.0.1:9999",
+		Forward:        false,
+		BindRetries:    20,
+		BindRetryDelay: 100 * time.Millisecond,
+	}, true, WithLogger(logger))
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+
+	for i := 0; i < 50 && len(out.findAll(t, "remote listener denied, retrying")) < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	busy.Close()
+	for i := 0; i < 50 && tunnel.State() != StateConnected; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if state := tunnel.State(); state != StateConnected {
+		t.Fatalf("unexpected tunnel state %s", state)
+	}
+	retries := out.findAll(t, "remote listener denied, retrying")
+	if len(retries) < 2 || retries[0]["attempt"] != float64(1) || retries[1]["attempt"] != float64(2) {
+		t.Fatalf("unexpected retries %v", retries)
+	}
+}
+
+func TestTunnelReverseBindRetryExhausted(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	out := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(out, nil))
+	tunnel := NewTunnel(client, &TunnelConf{
+		Remote:         busy.Addr().String(),
+		Local:          "127.0.0.1:9999",
+		Forward:        false,
+		BindRetries:    2,
+		BindRetryDelay: 50 * time.Millisecond,
+	}, true, WithLogger(logger))
+	go tunnel.Start(context.Background())
+	defer tunnel.Stop()
+
+	for i := 0; i < 50 && out.find(t, "listen open port ON remote server error") == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if out.find(t, "listen open port ON remote server error") == nil {
+		t.Fatal("expected the listen to fail")
+	}
+	// the tunnel could have started binding again already
+	retries := out.findAll(t, "remote listener denied, retrying")
+	if len(retries) < 2 {
+		t.Fatalf("expected 2 retries, got %d", len(retries))
+	}
+	for _, retry := range retries {
+		if retry["attempt"].(float64) > 2 {
+			t.Fatalf("unexpected retry %v", retry)
+		}
+	}
+
+	// -1 disables the retries
+	out = &syncBuffer{}
+	logger = slog.New(slog.NewJSONHandler(out, nil))
+	noRetries := NewTunnel(client, &TunnelConf{
+		Remote:         busy.Addr().String(),
+		Local:          "127.0.0.1:9999",
+		BindRetries:    -1,
+		BindRetryDelay: 50 * time.Millisecond,
+	}, true, WithLogger(logger))
+	go noRetries.Start(context.Background())
+	defer noRetries.Stop()
+	for i := 0; i < 50 && out.find(t, "listen open port ON remote server error") == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if out.find(t, "listen open port ON remote server error") == nil {
+		t.Fatal("expected the listen to fail")
+	}
+	if retries := out.findAll(t, "remote listener denied, retrying"); len(retries) != 0 {
+		t.Fatalf("expected no retries, got %d", len(retries))
+	}
+}
+
+func TestTunnelReverseAllowedClients(t *testing.T) {
+	client := getSSHConn(startD())
+	defer client.Stop()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	echo := func(cidrs []string) error {
+		tunnel := NewTunnel(client, &TunnelConf{
+			Remote:             "127.0.0.1:0",
+			Local:              echoListener.Addr().String(),
+			Forward:            false,
+			AllowedClientCIDRs: cidrs,
+		}, true)
+		go tunnel.Start(context.Background())
+		defer tunnel.Stop()
+		for tunnel.GetListenerAddr() == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tunnel.GetRemotePort()))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "ping\n" {
+			return fmt.Errorf("unexpected reply '%s'", line)
+		}
+		return nil
+	}
+
+	if err := echo([]string{"10.0.0.0/8", "127.0.0.0/8"}); err != nil {
+		t.Fatalf("the allowed client was not served: %s", err)
+	}
+	if err := echo([]string{"10.0.0.0/8"}); err == nil {
+		t.Fatal("the not allowed client was served")
+	}
+}
+
+func TestTunnelWithClient(t *testing.T) {
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+startD(), &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go startEchoService(echoListener)
+
+	echo := func(addr string) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line != "ping\n" {
+			return fmt.Errorf("unexpected reply '%s'", line)
+		}
+		return nil
+	}
+	// the first echo is retried: under load the tunnel can take more than
+	// the echo deadline to serve
+	echoRetry := func(addr string) error {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			err := echo(addr)
+			if err == nil || time.Now().After(deadline) {
+				return err
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	reverse := NewTunnelWithClient(client, &TunnelConf{
+		Remote:  "127.0.0.1:0",
+		Local:   echoListener.Addr().String(),
+		Forward: false,
+	})
+	go reverse.Start(context.Background())
+	defer reverse.Stop()
+	for reverse.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := echoRetry(fmt.Sprintf("127.0.0.1:%d", reverse.GetRemotePort())); err != nil {
+		t.Fatalf("reverse tunnel: %s", err)
+	}
+
+	forward := NewTunnelWithClient(client, &TunnelConf{
+		Remote:  echoListener.Addr().String(),
+		Local:   "127.0.0.1:0",
+		Forward: true,
+	})
+	go forward.Start(context.Background())
+	for forward.GetListenerAddr() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	forwardAddr := forward.GetListenerAddr().String()
+	if err := echoRetry(forwardAddr); err != nil {
+		t.Fatalf("forward tunnel: %s", err)
+	}
+
+	// the caller closing the client closes the tunnels listeners, and
+	// they are not listening again
+	client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for echo(forwardAddr) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the forward tunnel is still serving after the client close")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		forward.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tunnel didn't stop")
+	}
+}
+
+func TestClientConnSubscribe(t *testing.T) {
+	auth, err := utils.LoadIdentityFile("../../testdata/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", "127.0.0.1:"+startD(), &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c := newClientConn(client)
+	first := c.Subscribe()
+	second := c.Subscribe()
+	// an unsubscribed channel is closed without events, and the others
+	// are not affected
+	c.Unsubscribe(first)
+	if _, ok := <-first; ok {
+		t.Fatal("expected the unsubscribed channel to be closed")
+	}
+	third := c.Subscribe()
+
+	client.Close()
+	for _, events := range []<-chan sshc.ConnectionEvent{second, third} {
+		select {
+		case e := <-events:
+			if e.Type != sshc.EventDisconnected {
+				t.Fatalf("unexpected event %s", e.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing the disconnected event")
+		}
+		c.Unsubscribe(events)
+		if _, ok := <-events; ok {
+			t.Fatal("expected the channel to be closed")
+		}
+	}
+	// unsubscribing twice is safe
+	c.Unsubscribe(second)
+}
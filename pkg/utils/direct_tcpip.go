@@ -0,0 +1,96 @@
+package utils
+
+import "golang.org/x/crypto/ssh"
+
+// TraceContextRequest is the global request a rospo client sends to check
+// if the server accepts the trace context appended to the direct-tcpip
+// channels extra data. Only rospo servers reply with success
+const TraceContextRequest = "trace-context@rospo"
+
+// CompressionRequest is the global request a rospo client sends to enable
+// the compression of the tunnel channels. Its payload is a
+// CompressionPayload. Only rospo servers reply with success: from then on
+// the forwarded-tcpip channels of the connection are compressed, and so
+// are the direct-tcpip ones asking for it in their extra data
+const CompressionRequest = "compression@rospo"
+
+// CompressionPayload is the CompressionRequest payload
+type CompressionPayload struct {
+	// the flate level used by the server to write
+	Level uint32
+}
+
+// DirectTCPIPPayload is the direct-tcpip channel extra data (RFC 4254
+// section 7.2). Rospo clients can append the W3C traceparent of the
+// connection span and the compression level
+type DirectTCPIPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+	// the optional rospo data following the standard fields
+	Rest []byte `ssh:"rest"`
+}
+
+// DirectTCPIPExtra is the rospo data of the direct-tcpip channels
+type DirectTCPIPExtra struct {
+	TraceParent string
+	// the flate level the server writes the channel data with. 0 if the
+	// data is not compressed. Only sent to the servers accepting the
+	// CompressionRequest
+	CompressionLevel int
+}
+
+type traceContextData struct {
+	TraceParent string
+	// the data appended after the trace context
+	Rest []byte `ssh:"rest"`
+}
+
+type compressionData struct {
+	Level uint32
+}
+
+// MarshalDirectTCPIP encodes the direct-tcpip extra data. The rospo data
+// is appended only if not empty, so that the payload is a standard one
+// otherwise. ssh.Unmarshal rejects the trailing data: the callers set the
+// traceparent only for the servers accepting the TraceContextRequest,
+// and the compression level, that follows it, only for the ones
+// accepting the CompressionRequest
+func MarshalDirectTCPIP(p DirectTCPIPPayload, extra DirectTCPIPExtra) []byte {
+	p.Rest = nil
+	if extra.TraceParent != "" || extra.CompressionLevel > 0 {
+		tc := traceContextData{TraceParent: extra.TraceParent}
+		if extra.CompressionLevel > 0 {
+			tc.Rest = ssh.Marshal(&compressionData{Level: uint32(extra.CompressionLevel)})
+		}
+		p.Rest = ssh.Marshal(&tc)
+	}
+	return ssh.Marshal(&p)
+}
+
+// ParseDirectTCPIP decodes the direct-tcpip extra data returning the
+// payload and the appended rospo data, if any
+func ParseDirectTCPIP(data []byte) (DirectTCPIPPayload, DirectTCPIPExtra, error) {
+	var p DirectTCPIPPayload
+	var extra DirectTCPIPExtra
+	if err := ssh.Unmarshal(data, &p); err != nil {
+		return p, extra, err
+	}
+	if len(p.Rest) == 0 {
+		return p, extra, nil
+	}
+	var tc traceContextData
+	if err := ssh.Unmarshal(p.Rest, &tc); err != nil {
+		return p, extra, err
+	}
+	extra.TraceParent = tc.TraceParent
+	if len(tc.Rest) != 0 {
+		var cd compressionData
+		if err := ssh.Unmarshal(tc.Rest, &cd); err != nil {
+			return p, extra, err
+		}
+		extra.CompressionLevel = int(cd.Level)
+	}
+	return p, extra, nil
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDirectTCPIPExtra(t *testing.T) {
+	p := DirectTCPIPPayload{Addr: "localhost", Port: 80, OriginAddr: "0.0.0.0"}
+	for _, extra := range []DirectTCPIPExtra{
+		{},
+		{TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		{CompressionLevel: 6},
+		{TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", CompressionLevel: 1},
+	} {
+		data := MarshalDirectTCPIP(p, extra)
+		parsed, got, err := ParseDirectTCPIP(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Addr != p.Addr || parsed.Port != p.Port || got != extra {
+			t.Fatalf("expected %+v, got %+v %+v", extra, parsed, got)
+		}
+	}
+
+	// without the rospo data the payload is a standard one
+	var std struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(MarshalDirectTCPIP(p, DirectTCPIPExtra{}), &std); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,17 +2,28 @@ package utils
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Endpoint holds the tunnel endpoint details
 type Endpoint struct {
+	// the IPv6 hosts are bracketed, as [::1]
 	Host string
 	Port int
 }
 
-// NewEndpoint builds an Endpoint object
+// NewEndpoint builds an Endpoint object. s is expected to be checked with
+// ValidateSSHUrl: an invalid one is kept as the host, with a zero port, so
+// that dialing it fails
 func NewEndpoint(s string) *Endpoint {
-	parsed := ParseSSHUrl(s)
+	parsed, err := ParseSSHUrl(s)
+	if err != nil {
+		return &Endpoint{Host: s}
+	}
 	e := &Endpoint{
 		Host: parsed.Host,
 		Port: parsed.Port,
@@ -24,3 +35,28 @@ func NewEndpoint(s string) *Endpoint {
 func (endpoint *Endpoint) String() string {
 	return fmt.Sprintf("%s:%d", endpoint.Host, endpoint.Port)
 }
+
+// Hostname returns the endpoint host without the IPv6 brackets
+func (endpoint *Endpoint) Hostname() string {
+	return strings.TrimSuffix(strings.TrimPrefix(endpoint.Host, "["), "]")
+}
+
+// Addresses returns the endpoint host:port addresses to dial. If ttl is
+// positive the host is resolved through DefaultEndpointCache, caching
+// the addresses for ttl. Otherwise, or if the host is an ip address or
+// empty, the only address is String()
+func (endpoint *Endpoint) Addresses(ttl time.Duration) ([]string, error) {
+	host := endpoint.Hostname()
+	if _, err := netip.ParseAddr(host); ttl <= 0 || host == "" || err == nil {
+		return []string{endpoint.String()}, nil
+	}
+	ips, err := DefaultEndpointCache.Resolve(host, ttl)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), strconv.Itoa(endpoint.Port))
+	}
+	return addrs, nil
+}
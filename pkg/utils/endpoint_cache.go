@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultDNSStaleTTL is how long DefaultEndpointCache serves the expired
+// entries of the hosts that fail to resolve
+const DefaultDNSStaleTTL = 5 * time.Minute
+
+// the timeout of a single host resolution
+const resolveTimeout = 10 * time.Second
+
+// how often the stale entries are looked up again, so that a failing DNS
+// is not waited for on every Resolve
+const staleRetryInterval = 30 * time.Second
+
+// Resolver looks up the host addresses. *net.Resolver implements it
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// DefaultEndpointCache is the cache the endpoints are resolved through
+var DefaultEndpointCache = NewEndpointCache(net.DefaultResolver)
+
+// EndpointCache caches the host resolutions, so that the frequent
+// reconnections don't wait for the DNS every time
+type EndpointCache struct {
+	// if the resolution of a host fails, its entry is served up to
+	// StaleTTL after its expiration. 0 disables the serve-stale
+	StaleTTL time.Duration
+
+	resolver Resolver
+	// host -> *endpointCacheEntry
+	entries sync.Map
+	// the clock. Replaced by the tests
+	now func() time.Time
+}
+
+type endpointCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+	// the stale entry is not looked up again before this time
+	retry time.Time
+}
+
+// NewEndpointCache builds a cache resolving the hosts with resolver. Its
+// StaleTTL is DefaultDNSStaleTTL
+func NewEndpointCache(resolver Resolver) *EndpointCache {
+	return &EndpointCache{
+		StaleTTL: DefaultDNSStaleTTL,
+		resolver: resolver,
+		now:      time.Now,
+	}
+}
+
+// Resolve returns the host addresses. They are looked up again once ttl
+// has passed since the previous lookup. If the lookup fails, the expired
+// addresses are returned within StaleTTL. The stale addresses are looked
+// up again at most once every 30 seconds, the other calls return them
+// without waiting for the DNS
+func (c *EndpointCache) Resolve(host string, ttl time.Duration) ([]net.IP, error) {
+	now := c.now()
+	var (
+		cached *endpointCacheEntry
+		stale  bool
+	)
+	if v, ok := c.entries.Load(host); ok {
+		cached = v.(*endpointCacheEntry)
+		if now.Before(cached.expires) {
+			return cached.ips, nil
+		}
+		stale = now.Before(cached.expires.Add(c.StaleTTL))
+		if stale && now.Before(cached.retry) {
+			return cached.ips, nil
+		}
+		if stale {
+			c.entries.Store(host, &endpointCacheEntry{
+				ips:     cached.ips,
+				expires: cached.expires,
+				retry:   now.Add(staleRetryInterval),
+			})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	if err != nil {
+		if stale {
+			return cached.ips, nil
+		}
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	c.entries.Store(host, &endpointCacheEntry{ips: ips, expires: now.Add(ttl)})
+	return ips, nil
+}
+
+// Invalidate removes the host entry: the next Resolve looks it up
+// again and fails if the lookup does
+func (c *EndpointCache) Invalidate(host string) {
+	c.entries.Delete(host)
+}
+
+// Expire makes the next Resolve look the host up again like Invalidate,
+// but the addresses are kept: they are served stale if the lookup fails
+func (c *EndpointCache) Expire(host string) {
+	v, ok := c.entries.Load(host)
+	if !ok {
+		return
+	}
+	cached := v.(*endpointCacheEntry)
+	if now := c.now(); now.Before(cached.expires) {
+		c.entries.Store(host, &endpointCacheEntry{ips: cached.ips, expires: now})
+	}
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeResolver counts the lookups. err, if set, fails them
+type fakeResolver struct {
+	lookups int
+	ips     []string
+	err     error
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	addrs := []net.IPAddr{}
+	for _, ip := range r.ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestEndpointCache(t *testing.T) {
+	resolver := &fakeResolver{ips: []string{"10.0.0.1", "10.0.0.2"}}
+	cache := NewEndpointCache(resolver)
+	cache.StaleTTL = time.Minute
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	resolve := func() []net.IP {
+		ips, err := cache.Resolve("backend.example.com", 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ips
+	}
+	if ips := resolve(); len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected addresses %v", ips)
+	}
+	resolve()
+	if resolver.lookups != 1 {
+		t.Fatalf("expected 1 lookup within the ttl, got %d", resolver.lookups)
+	}
+
+	// looked up again once expired
+	resolver.ips = []string{"10.0.0.3"}
+	now = now.Add(11 * time.Second)
+	if ips := resolve(); resolver.lookups != 2 || !ips[0].Equal(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("unexpected addresses %v after %d lookups", ips, resolver.lookups)
+	}
+	// the expired entries are looked up again
+	cache.Expire("backend.example.com")
+	resolve()
+	if resolver.lookups != 3 {
+		t.Fatalf("expected a lookup after the expiration, got %d", resolver.lookups)
+	}
+
+	// the expired entry is served while stale, if the DNS fails
+	resolver.err = errors.New("dns failure")
+	cache.Expire("backend.example.com")
+	if ips := resolve(); resolver.lookups != 4 || !ips[0].Equal(net.ParseIP("10.0.0.3")) {
+		t.Fatalf("unexpected stale addresses %v after %d lookups", ips, resolver.lookups)
+	}
+	// without looking it up on every call
+	now = now.Add(10 * time.Second)
+	resolve()
+	if resolver.lookups != 4 {
+		t.Fatalf("expected no lookup before the stale retry, got %d", resolver.lookups)
+	}
+	now = now.Add(staleRetryInterval)
+	resolve()
+	if resolver.lookups != 5 {
+		t.Fatalf("expected a lookup after the stale retry interval, got %d", resolver.lookups)
+	}
+	now = now.Add(time.Minute)
+	if _, err := cache.Resolve("backend.example.com", 10*time.Second); err == nil {
+		t.Fatal("expected the error once the stale ttl passed")
+	}
+	if _, err := cache.Resolve("other.example.com", 10*time.Second); err == nil {
+		t.Fatal("expected the error of a host never resolved")
+	}
+
+	// the invalidated entries are not served stale
+	resolver.err = nil
+	resolve()
+	resolver.err = errors.New("dns failure")
+	cache.Invalidate("backend.example.com")
+	if _, err := cache.Resolve("backend.example.com", 10*time.Second); err == nil {
+		t.Fatal("expected the error after the invalidation")
+	}
+}
+
+func TestEndpointAddresses(t *testing.T) {
+	resolver := &fakeResolver{ips: []string{"10.0.0.1", "fd00::1"}}
+	defaultCache := DefaultEndpointCache
+	DefaultEndpointCache = NewEndpointCache(resolver)
+	defer func() { DefaultEndpointCache = defaultCache }()
+
+	addrs, err := NewEndpoint("backend:8080").Addresses(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0] != "10.0.0.1:8080" || addrs[1] != "[fd00::1]:8080" {
+		t.Fatalf("unexpected addresses %v", addrs)
+	}
+	// not resolved without ttl, nor if the host is an ip address
+	for _, e := range []string{"backend:8080", "127.0.0.1:8080"} {
+		ttl := time.Duration(0)
+		if e != "backend:8080" {
+			ttl = time.Minute
+		}
+		addrs, err := NewEndpoint(e).Addresses(ttl)
+		if err != nil || len(addrs) != 1 || addrs[0] != e {
+			t.Fatalf("unexpected addresses %v for %s, error %v", addrs, e, err)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Fatalf("expected 1 lookup, got %d", resolver.lookups)
+	}
+}
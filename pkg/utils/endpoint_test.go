@@ -1,6 +1,9 @@
 package utils
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestEndpoint(t *testing.T) {
 	val := "localhost:2222"
@@ -13,3 +16,15 @@ func TestEndpoint(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestEndpointIPv6(t *testing.T) {
+	e := NewEndpoint("[fe80::1%eth0]:8080")
+	if e.String() != "[fe80::1%eth0]:8080" || e.Hostname() != "fe80::1%eth0" {
+		t.Fatalf("unexpected endpoint %s, hostname %s", e, e.Hostname())
+	}
+	// the ip addresses are never resolved
+	addrs, err := e.Addresses(time.Minute)
+	if err != nil || len(addrs) != 1 || addrs[0] != e.String() {
+		t.Fatalf("unexpected addresses %v, error %v", addrs, err)
+	}
+}
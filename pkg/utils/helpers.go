@@ -2,9 +2,10 @@ package utils
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"net/netip"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -25,54 +26,96 @@ type sshUrl struct {
 	Port     int
 }
 
-// ParseSSHUrl build an sshUrl object from an url string
-func ParseSSHUrl(url string) *sshUrl {
-	parts := strings.Split(url, "@")
+// AddressError is the error of an address that can't be parsed as a
+// [user@]host[:port] one
+type AddressError struct {
+	Address string
+	Reason  string
+}
 
-	usr := CurrentUser()
-	conf := &sshUrl{}
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("invalid address %q: %s", e.Address, e.Reason)
+}
 
-	var hostPort string
+// ParseSSHUrl build an sshUrl object from an url string. It returns an
+// *AddressError if the url is invalid: see ValidateSSHUrl
+func ParseSSHUrl(url string) (*sshUrl, error) {
+	return parseSSHUrl(url)
+}
 
-	if len(parts) == 2 {
-		conf.Username = parts[0]
-		hostPort = parts[1]
-	} else {
-		conf.Username = usr.Username
-		hostPort = parts[0]
+// ValidateSSHUrl checks a [user@]host[:port] url. The IPv6 hosts may be
+// bracketed, as [2001:db8::1]:2222, or bare without the port, and they
+// may have a zone, as fe80::1%eth0. It returns an *AddressError
+func ValidateSSHUrl(url string) error {
+	_, err := parseSSHUrl(url)
+	return err
+}
+
+func parseSSHUrl(url string) (*sshUrl, error) {
+	conf := &sshUrl{
+		Username: CurrentUser().Username,
+		Host:     defaultHost,
+		Port:     defaultPort,
+	}
+	hostPort := url
+	if i := strings.LastIndex(url, "@"); i >= 0 {
+		conf.Username = url[:i]
+		hostPort = url[i+1:]
 	}
 
-	host, port, err := net.SplitHostPort(hostPort)
+	host, port, err := splitHostPort(hostPort)
 	if err != nil {
-		// error could be "missing port in address" so try again appending defaultPort
-		host, port, err = net.SplitHostPort(fmt.Sprintf("%s:%d", hostPort, defaultPort))
-		if err != nil {
-			log.Fatalln(err)
-		}
+		return nil, &AddressError{Address: url, Reason: err.Error()}
 	}
-
-	conf.Host = defaultHost
 	if host != "" {
-		conf.Host = host
-
-		ip := net.ParseIP(host)
-		if ip != nil { // it could be a domain name
-			if ip.To4() == nil {
-				conf.Host = fmt.Sprintf("[%s]", host)
+		if strings.Contains(host, ":") {
+			// the IPv6 hosts are kept bracketed, so that Host:Port is a
+			// valid address
+			if _, err := netip.ParseAddr(host); err != nil {
+				return nil, &AddressError{Address: url, Reason: fmt.Sprintf("invalid IPv6 address %q", host)}
 			}
+			host = "[" + host + "]"
+		} else if strings.ContainsAny(host, "[]% ") {
+			return nil, &AddressError{Address: url, Reason: fmt.Sprintf("invalid host %q", host)}
 		}
+		conf.Host = host
 	}
-
-	conf.Port = defaultPort
 	if port != "" {
-		port, err := strconv.Atoi(port)
+		n, err := strconv.Atoi(port)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, &AddressError{Address: url, Reason: fmt.Sprintf("invalid port %q", port)}
+		}
+		if n < 0 || n > 65535 {
+			return nil, &AddressError{Address: url, Reason: "port out of range"}
 		}
-		conf.Port = port
+		conf.Port = n
 	}
+	return conf, nil
+}
 
-	return conf
+// splitHostPort splits host[:port] like net.SplitHostPort, but the port
+// is optional. An IPv6 host with a port must be bracketed: the bare ones,
+// having more than a colon, are hosts without the port
+func splitHostPort(hostPort string) (string, string, error) {
+	if strings.HasPrefix(hostPort, "[") {
+		if strings.HasSuffix(hostPort, "]") {
+			return hostPort[1 : len(hostPort)-1], "", nil
+		}
+		host, port, err := net.SplitHostPort(hostPort)
+		if addrErr, ok := err.(*net.AddrError); ok {
+			// the address is in the AddressError already
+			return "", "", errors.New(addrErr.Err)
+		}
+		return host, port, err
+	}
+	switch strings.Count(hostPort, ":") {
+	case 0:
+		return hostPort, "", nil
+	case 1:
+		i := strings.Index(hostPort, ":")
+		return hostPort[:i], hostPort[i+1:], nil
+	}
+	return hostPort, "", nil
 }
 
 // ExpandUserHome resolve paths like "~/.ssh/id_rsa"
@@ -134,6 +177,32 @@ func ByteCountSI(b int64) string {
 		float64(b)/float64(div), "kMGTPE"[exp])
 }
 
+// ParseByteCount parses a byte count such as 1500, 500k or 2M. The k, M
+// and G suffixes are powers of 1000, as ByteCountSI ones. An optional
+// trailing B is allowed
+func ParseByteCount(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.TrimSpace(s), "B")
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'k', 'K':
+			multiplier = 1000
+		case 'M':
+			multiplier = 1000 * 1000
+		case 'G':
+			multiplier = 1000 * 1000 * 1000
+		}
+		if multiplier != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte count %q", s)
+	}
+	return n * multiplier, nil
+}
+
 var currentUserCache struct {
 	sync.Once
 	u *user.User
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"log"
 	"os/user"
 	"testing"
@@ -46,7 +47,10 @@ func TestSSHUrlParser(t *testing.T) {
 		{Username: "user", Host: "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]", Port: 2222},
 	}
 	for idx, s := range list {
-		parsed := ParseSSHUrl(s)
+		parsed, err := ParseSSHUrl(s)
+		if err != nil {
+			t.Fatal(err)
+		}
 		t.Logf("%+v", parsed)
 		if !compare(parsed, &expected[idx]) {
 			t.Fatalf("%+v", &expected[idx])
@@ -54,6 +58,47 @@ func TestSSHUrlParser(t *testing.T) {
 	}
 }
 
+func TestSSHUrlIPv6(t *testing.T) {
+	username := CurrentUser().Username
+	tests := []struct {
+		url      string
+		expected sshUrl
+	}{
+		{"2001:db8::1", sshUrl{Username: username, Host: "[2001:db8::1]", Port: 22}},
+		{"user@2001:db8::1", sshUrl{Username: "user", Host: "[2001:db8::1]", Port: 22}},
+		{"user@[2001:db8::1]:2222", sshUrl{Username: "user", Host: "[2001:db8::1]", Port: 2222}},
+		{"[::1]", sshUrl{Username: username, Host: "[::1]", Port: 22}},
+		{"[::ffff:10.0.0.1]:2222", sshUrl{Username: username, Host: "[::ffff:10.0.0.1]", Port: 2222}},
+		{"fe80::1%eth0", sshUrl{Username: username, Host: "[fe80::1%eth0]", Port: 22}},
+		{"[fe80::1%eth0]:2222", sshUrl{Username: username, Host: "[fe80::1%eth0]", Port: 2222}},
+		{"host1:2222", sshUrl{Username: username, Host: "host1", Port: 2222}},
+		{"user@10.example.com", sshUrl{Username: "user", Host: "10.example.com", Port: 22}},
+		{"user@mail@host2", sshUrl{Username: "user@mail", Host: "host2", Port: 22}},
+	}
+	for _, test := range tests {
+		if err := ValidateSSHUrl(test.url); err != nil {
+			t.Fatalf("%s: %s", test.url, err)
+		}
+		if parsed, _ := ParseSSHUrl(test.url); *parsed != test.expected {
+			t.Fatalf("%s: expected %+v, got %+v", test.url, test.expected, *parsed)
+		}
+	}
+
+	for _, url := range []string{
+		"[2001:db8::1",
+		"[2001:db8::1]x",
+		"2001:db8::zz",
+		"host%eth0",
+		"host:ssh",
+		"host:65536",
+	} {
+		var addrErr *AddressError
+		if err := ValidateSSHUrl(url); !errors.As(err, &addrErr) || addrErr.Address != url {
+			t.Fatalf("%s: expected an AddressError, got %v", url, err)
+		}
+	}
+}
+
 func TestExpandHome(t *testing.T) {
 	_, err := ExpandUserHome("~/.ssh")
 	if err != nil {
@@ -100,3 +145,28 @@ func TestByteCountSI(t *testing.T) {
 	}
 
 }
+
+func TestParseByteCount(t *testing.T) {
+	valid := map[string]int64{
+		"0":     0,
+		"1500":  1500,
+		"500k":  500 * 1000,
+		"500KB": 500 * 1000,
+		"2M":    2 * 1000 * 1000,
+		"1G":    1000 * 1000 * 1000,
+	}
+	for s, expected := range valid {
+		n, err := ParseByteCount(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if n != expected {
+			t.Fatalf("%s: expected %d, got %d", s, expected, n)
+		}
+	}
+	for _, s := range []string{"", "k", "-1", "1T", "fast"} {
+		if _, err := ParseByteCount(s); err == nil {
+			t.Fatalf("%s: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The key sources that are not file paths. A key value starting with
+// KeyInlinePrefix is the PEM key itself, KeyEnvPrefix is followed by the
+// environment variable holding the key and KeyStdin reads it from stdin
+const (
+	KeyInlinePrefix = "-----BEGIN"
+	KeyEnvPrefix    = "env:"
+	KeyStdin        = "-"
+)
+
+// the stdin can be read once only: the key is kept for the reconnections
+var stdinKey struct {
+	sync.Once
+	data []byte
+	err  error
+}
+
+// IsKeyFile reports if the key source is a file path, not an inline,
+// env: or stdin key
+func IsKeyFile(source string) bool {
+	return source != KeyStdin &&
+		!strings.HasPrefix(source, KeyInlinePrefix) &&
+		!strings.HasPrefix(source, KeyEnvPrefix)
+}
+
+// KeySourceName returns the key source as it can be logged: the inline
+// keys are not shown
+func KeySourceName(source string) string {
+	switch {
+	case strings.HasPrefix(source, KeyInlinePrefix):
+		return "inline key"
+	case source == KeyStdin:
+		return "stdin"
+	}
+	return source
+}
+
+// ReadKeySource returns the key of source: an inline PEM key, an env:VAR
+// environment variable, - for the stdin or a file path. The stdin is read
+// once, the next calls return the same key
+func ReadKeySource(source string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(source, KeyInlinePrefix):
+		return []byte(source), nil
+	case strings.HasPrefix(source, KeyEnvPrefix):
+		name := strings.TrimPrefix(source, KeyEnvPrefix)
+		value := os.Getenv(name)
+		if value == "" {
+			return nil, fmt.Errorf("the %s env var is not set", name)
+		}
+		return []byte(value), nil
+	case source == KeyStdin:
+		stdinKey.Do(func() {
+			stdinKey.data, stdinKey.err = io.ReadAll(os.Stdin)
+		})
+		if stdinKey.err != nil {
+			return nil, fmt.Errorf("cannot read the key from stdin: %w", stdinKey.err)
+		}
+		return stdinKey.data, nil
+	}
+	path, _ := ExpandUserHome(source)
+	return os.ReadFile(path)
+}
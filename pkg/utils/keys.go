@@ -1,47 +1,134 @@
 package utils
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/x509"
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
 )
 
-// GeneratePrivateKey generate an rsa key (actually used from the sshd server)
-func GeneratePrivateKey() (*ecdsa.PrivateKey, error) {
-	privateKey, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+// The GeneratePrivateKey supported algorithms. The ecdsa and rsa keys size
+// is chosen with the bits, ecdsa-p256 and rsa-4096 have a fixed one
+const (
+	KeyAlgorithmEd25519   = "ed25519"
+	KeyAlgorithmECDSA     = "ecdsa"
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+	KeyAlgorithmRSA       = "rsa"
+	KeyAlgorithmRSA4096   = "rsa-4096"
+)
 
-	// log.Println("private key generated")
-	return privateKey, nil
+// KeyAlgorithms lists the GeneratePrivateKey supported algorithms
+var KeyAlgorithms = []string{
+	KeyAlgorithmEd25519,
+	KeyAlgorithmECDSA,
+	KeyAlgorithmECDSAP256,
+	KeyAlgorithmRSA,
+	KeyAlgorithmRSA4096,
 }
 
-// EncodePrivateKeyToPEM converts a private key object to PEM
-func EncodePrivateKeyToPEM(privateKey *ecdsa.PrivateKey) []byte {
-	encoded, _ := x509.MarshalECPrivateKey(privateKey)
+// the RSA keys size bounds
+const (
+	minRSABits = 2048
+	maxRSABits = 16384
+)
+
+// ValidateKeyAlgorithm checks the GeneratePrivateKey algorithm and bits.
+// The empty algorithm is ed25519 and the bits 0 are the algorithm default
+func ValidateKeyAlgorithm(algorithm string, bits int) error {
+	switch algorithm {
+	case "", KeyAlgorithmEd25519:
+		if bits != 0 {
+			return fmt.Errorf("the ed25519 keys have a fixed size, bits must not be set")
+		}
+	case KeyAlgorithmECDSAP256, KeyAlgorithmRSA4096:
+		if size := fixedKeyBits(algorithm); bits != 0 && bits != size {
+			return fmt.Errorf("the %s keys are %d bits", algorithm, size)
+		}
+	case KeyAlgorithmECDSA:
+		switch bits {
+		case 0, 256, 384, 521:
+		default:
+			return fmt.Errorf("invalid ecdsa key bits %d. One of: 256, 384, 521", bits)
+		}
+	case KeyAlgorithmRSA:
+		if bits != 0 && (bits < minRSABits || bits > maxRSABits) {
+			return fmt.Errorf("invalid rsa key bits %d. From %d to %d", bits, minRSABits, maxRSABits)
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm %s. One of: %s", algorithm, strings.Join(KeyAlgorithms, ", "))
+	}
+	return nil
+}
 
-	// pem.Block
-	privBlock := pem.Block{
-		Type:    "EC PRIVATE KEY",
-		Headers: nil,
-		Bytes:   encoded,
+func fixedKeyBits(algorithm string) int {
+	if algorithm == KeyAlgorithmECDSAP256 {
+		return 256
 	}
+	return 4096
+}
 
-	// Private key in PEM format
-	privatePEM := pem.EncodeToMemory(&privBlock)
-	return privatePEM
+// GeneratePrivateKey generates a private key using the algorithm and size.
+// If the algorithm is empty an ed25519 key is generated. If bits is 0 the
+// ecdsa keys are 256 bits and the rsa ones 4096
+func GeneratePrivateKey(algorithm string, bits int) (crypto.Signer, error) {
+	if err := ValidateKeyAlgorithm(algorithm, bits); err != nil {
+		return nil, err
+	}
+	switch algorithm {
+	case KeyAlgorithmECDSA, KeyAlgorithmECDSAP256:
+		switch bits {
+		case 384:
+			return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		case 521:
+			return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+		}
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyAlgorithmRSA, KeyAlgorithmRSA4096:
+		if bits == 0 {
+			bits = 4096
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	return privateKey, err
 }
 
-// GeneratePublicKey generates a public key from a private one
-func GeneratePublicKey(key *ecdsa.PublicKey) ([]byte, error) {
+// EncodePrivateKeyToPEM converts a private key object to the OpenSSH
+// PEM format. If passphrase is not nil the key is encrypted with it
+func EncodePrivateKeyToPEM(privateKey crypto.Signer, passphrase []byte) ([]byte, error) {
+	var (
+		block *pem.Block
+		err   error
+	)
+	if passphrase != nil {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(privateKey, "", passphrase)
+	} else {
+		block, err = ssh.MarshalPrivateKey(privateKey, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// GeneratePublicKey generates a public key in the authorized_keys format
+// from a private one
+func GeneratePublicKey(key crypto.PublicKey) ([]byte, error) {
 	publicRsaKey, err := ssh.NewPublicKey(key)
 	if err != nil {
 		return nil, err
@@ -52,11 +139,28 @@ func GeneratePublicKey(key *ecdsa.PublicKey) ([]byte, error) {
 	return pubKeyBytes, nil
 }
 
-// WriteKeyToFile stores a key to the specified path
+// WriteKeyToFile stores a key to the specified path. The file is
+// readable by the owner only
 func WriteKeyToFile(keyBytes []byte, keyPath string) error {
+	return writeKeyFile(keyBytes, keyPath, 0600)
+}
+
+// WritePublicKeyToFile stores a public key to the specified path. The file
+// is readable by everyone
+func WritePublicKeyToFile(keyBytes []byte, keyPath string) error {
+	return writeKeyFile(keyBytes, keyPath, 0644)
+}
+
+func writeKeyFile(keyBytes []byte, keyPath string, perm os.FileMode) error {
 	path, _ := ExpandUserHome(keyPath)
 
-	if err := os.WriteFile(path, keyBytes, 0600); err != nil {
+	if err := os.WriteFile(path, keyBytes, perm); err != nil {
+		log.Println(err)
+		return err
+	}
+	// WriteFile doesn't touch the permissions of an already existent
+	// file and is subject to umask. Enforce them here
+	if err := os.Chmod(path, perm); err != nil {
 		log.Println(err)
 		return err
 	}
@@ -66,55 +170,125 @@ func WriteKeyToFile(keyBytes []byte, keyPath string) error {
 // LoadIdentityFile reads a public key file and loads the keys to
 // an ssh.PublicKeys object
 func LoadIdentityFile(file string) (ssh.AuthMethod, error) {
-	path, _ := ExpandUserHome(file)
+	key, err := LoadIdentitySigner(file)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.PublicKeys(key), nil
+}
+
+// LoadIdentitySigner reads a private key and returns its signer.
+// If the key is passphrase protected, the returned error wraps an
+// *ssh.PassphraseMissingError
+func LoadIdentitySigner(file string) (ssh.Signer, error) {
+	return LoadIdentitySignerWithPassphrase(file, nil)
+}
+
+// LoadIdentitySignerWithPassphrase reads a private key and returns its
+// signer, using passphrase to decrypt the key if it is not nil. The key
+// is read from file as ReadKeySource does
+func LoadIdentitySignerWithPassphrase(file string, passphrase []byte) (ssh.Signer, error) {
+	source, _ := ExpandUserHome(file)
 
 	usr := CurrentUser()
 	// no path is set, try with a reasonable default
-	if path == "" {
-		path = filepath.Join(usr.HomeDir, ".ssh", "id_rsa")
+	if source == "" {
+		source = filepath.Join(usr.HomeDir, ".ssh", "id_rsa")
 	}
 
-	buffer, err := os.ReadFile(path)
+	buffer, err := ReadKeySource(source)
 	if err != nil {
-		return nil, fmt.Errorf("cannot read SSH idendity key file %s", path)
+		return nil, fmt.Errorf("cannot read SSH idendity key %s: %w", KeySourceName(source), err)
 	}
 
-	key, err := ssh.ParsePrivateKey(buffer)
+	var key ssh.Signer
+	if passphrase != nil {
+		key, err = ssh.ParsePrivateKeyWithPassphrase(buffer, passphrase)
+	} else {
+		key, err = ssh.ParsePrivateKey(buffer)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse SSH identity key file %s", file)
+		return nil, fmt.Errorf("cannot parse SSH identity key %s: %w", KeySourceName(source), err)
 	}
 
-	return ssh.PublicKeys(key), nil
+	return key, nil
 }
 
-// AddHostKeyToKnownHosts updates user known_hosts file adding the host key
-func AddHostKeyToKnownHosts(host string, key ssh.PublicKey, knownHostsPath string) error {
-	// add host key if host is not found in known_hosts, error object is return, if nil then connection proceeds,
-	// if not nil then connection stops.
-
-	f, fErr := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_WRONLY, 0600)
-	if fErr != nil {
-		return fErr
+// TerminalPassphrasePrompt asks the passphrase of the keyPath key on the
+// terminal with echo disabled. It fails if stdin is not a terminal. The
+// prompt is written to stderr, so that it doesn't mix with the output
+func TerminalPassphrasePrompt(keyPath string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot ask the passphrase for %s: stdin is not a terminal", keyPath)
 	}
-	defer f.Close()
+	return readSecret(fd, fmt.Sprintf("Enter passphrase for key %s: ", keyPath))
+}
 
-	host, port, err := net.SplitHostPort(host)
+// TerminalNewPassphrasePrompt asks the passphrase to encrypt the new
+// keyPath key like TerminalPassphrasePrompt. It is asked twice and
+// it fails if the two don't match or if it is empty
+func TerminalNewPassphrasePrompt(keyPath string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot ask the passphrase for %s: stdin is not a terminal", keyPath)
+	}
+	secret, err := readSecret(fd, fmt.Sprintf("Enter passphrase for key %s: ", keyPath))
 	if err != nil {
-		port = fmt.Sprintf("%d", defaultPort)
+		return nil, err
 	}
+	if len(secret) == 0 {
+		return nil, errors.New("the passphrase can't be empty")
+	}
+	confirm, err := readSecret(fd, "Enter same passphrase again: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(secret, confirm) {
+		return nil, errors.New("the passphrases don't match")
+	}
+	return secret, nil
+}
 
-	entry := fmt.Sprintf("[%s]:%s", host, port)
-	if ip := net.ParseIP(host); ip != nil {
-		if ip.To4() != nil {
-			if port == fmt.Sprintf("%d", defaultPort) {
-				entry = host
-			}
-		}
+// readSecret writes the prompt to stderr and reads a line from the fd
+// terminal with echo disabled
+func readSecret(fd int, prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return secret, err
+}
+
+// AddHostKeyToKnownHosts updates user known_hosts file adding the host key.
+// The hostname is hashed if the file already contains hashed hostnames.
+// See WriteKnownHostKey for the duplicated and the rotated keys
+func AddHostKeyToKnownHosts(host string, key ssh.PublicKey, knownHostsPath string) error {
+	_, err := WriteKnownHostKey(knownHostsPath, host, key, KnownHostsUsesHashing(knownHostsPath))
+	return err
+}
+
+// KnownHostLine builds the known_hosts line of the host key, in the
+// KnownHostAddress form. If hash is true the hostname is hashed like the
+// OpenSSH HashKnownHosts option does. The hashed IPv6 hosts on port 22
+// are bracketed, as the x/crypto knownhosts verification expects
+func KnownHostLine(address string, key ssh.PublicKey, hash bool) string {
+	entry := KnownHostAddress(address)
+	if hash {
+		entry = knownhosts.HashHostname(knownhosts.Normalize(address))
 	}
+	return fmt.Sprintf("%s %s", entry, SerializePublicKey(key))
+}
 
-	out := fmt.Sprintf("%s %s\n", entry, SerializePublicKey(key))
-	_, fileErr := f.WriteString(out)
-	return fileErr
+// AppendKnownHostLine appends line to the known_hosts file, creating
+// the file if it doesn't exist
+func AppendKnownHostLine(knownHostsPath string, line string) error {
+	f, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(line + "\n")
+	return err
 }
 
 // SerializePublicKey converts an ssh.PublicKey to printable bas64 string
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// CheckKeyFilePermissions returns an error if the private key at path
+// is readable by group or others
+func CheckKeyFilePermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("permissions %#o for '%s' are too open. The key should not be accessible by others", perm, path)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// acl header layout as defined by the win32 ACL struct
+type aclHeader struct {
+	AclRevision byte
+	Sbz1        byte
+	AclSize     uint16
+	AceCount    uint16
+	Sbz2        uint16
+}
+
+// access allowed ace layout as defined by the win32 ACCESS_ALLOWED_ACE struct
+type accessAllowedAce struct {
+	AceType  byte
+	AceFlags byte
+	AceSize  uint16
+	Mask     windows.ACCESS_MASK
+	SidStart uint32
+}
+
+const accessAllowedAceType = 0
+
+// CheckKeyFilePermissions returns an error if the private key at path
+// can be read by someone other than the current user. The SYSTEM account
+// and the Administrators group are allowed as OpenSSH for windows does
+func CheckKeyFilePermissions(path string) error {
+	sd, err := windows.GetNamedSecurityInfo(
+		path,
+		windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	if dacl == nil {
+		return fmt.Errorf("'%s' has no DACL. The key is accessible by everyone", path)
+	}
+
+	tokenUser, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return err
+	}
+	currentUser := tokenUser.User.Sid
+
+	header := (*aclHeader)(unsafe.Pointer(dacl))
+	ptr := unsafe.Add(unsafe.Pointer(dacl), unsafe.Sizeof(aclHeader{}))
+	for i := 0; i < int(header.AceCount); i++ {
+		ace := (*accessAllowedAce)(ptr)
+		ptr = unsafe.Add(ptr, ace.AceSize)
+		if ace.AceType != accessAllowedAceType {
+			continue
+		}
+		sid := (*windows.SID)(unsafe.Pointer(&ace.SidStart))
+		if sid.Equals(currentUser) ||
+			sid.IsWellKnown(windows.WinLocalSystemSid) ||
+			sid.IsWellKnown(windows.WinBuiltinAdministratorsSid) {
+			continue
+		}
+		return fmt.Errorf("'%s' is accessible by %s. The key should not be accessible by others", path, sid.String())
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostEntry is a single known_hosts file line
+type KnownHostEntry struct {
+	// the line number in the known_hosts file
+	Line int
+	// the optional marker without the leading @: cert-authority or revoked
+	Marker string
+	// the host patterns. Hashed hosts are reported as they are
+	Hosts   []string
+	Key     ssh.PublicKey
+	Comment string
+}
+
+// Fingerprint returns the SHA256 fingerprint of the entry key
+func (e KnownHostEntry) Fingerprint() string {
+	return ssh.FingerprintSHA256(e.Key)
+}
+
+// ListKnownHostEntries parses the known_hosts file and returns all of
+// its entries
+func ListKnownHostEntries(file string) ([]KnownHostEntry, error) {
+	path, _ := ExpandUserHome(file)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []KnownHostEntry{}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		marker, hosts, key, comment, _, err := ssh.ParseKnownHosts(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		entries = append(entries, KnownHostEntry{
+			Line:    lineNum,
+			Marker:  marker,
+			Hosts:   hosts,
+			Key:     key,
+			Comment: comment,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// RemoveKnownHostEntry removes all the known_hosts entries of host. If host
+// doesn't carry a port, the entries for any port are removed. Lines that
+// list other host patterns too are kept without the matching patterns.
+// Comments and unrelated lines are preserved
+func RemoveKnownHostEntry(file string, host string) error {
+	path, _ := ExpandUserHome(file)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	removed := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			out.WriteString(line + "\n")
+			continue
+		}
+		// the host patterns field follows the optional marker
+		hostsIdx := 0
+		if strings.HasPrefix(fields[0], "@") {
+			hostsIdx = 1
+		}
+		kept := []string{}
+		for _, pattern := range strings.Split(fields[hostsIdx], ",") {
+			if knownHostMatches(pattern, host) {
+				removed = true
+				continue
+			}
+			kept = append(kept, pattern)
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		fields[hostsIdx] = strings.Join(kept, ",")
+		out.WriteString(strings.Join(fields, " ") + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("host %s not found in %s", host, path)
+	}
+	return os.WriteFile(path, out.Bytes(), info.Mode().Perm())
+}
+
+// WriteKnownHostKey adds the host key to the known_hosts file, creating it
+// if needed. Nothing is written if the file has the key for address
+// already. The entries of address with another key of the same type, like
+// after a key rotation, are replaced: lines that list other host patterns
+// too are kept without the matching ones. The marker lines are never
+// touched. It returns true if the file was changed
+func WriteKnownHostKey(file string, address string, key ssh.PublicKey, hash bool) (bool, error) {
+	path, _ := ExpandUserHome(file)
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, AppendKnownHostLine(path, KnownHostLine(address, key, hash))
+	}
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	var out bytes.Buffer
+	present, stale := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		marker, hosts, entryKey, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil || marker != "" || entryKey.Type() != key.Type() ||
+			!MatchKnownHostPatterns(hosts, address) {
+			// comments, unparsable and unrelated lines are preserved
+			out.WriteString(line + "\n")
+			continue
+		}
+		if bytes.Equal(entryKey.Marshal(), key.Marshal()) {
+			present = true
+			out.WriteString(line + "\n")
+			continue
+		}
+		stale = true
+		fields := strings.Fields(line)
+		kept := []string{}
+		for _, pattern := range strings.Split(fields[0], ",") {
+			if !strings.HasPrefix(pattern, "!") && MatchKnownHostPatterns([]string{pattern}, address) {
+				continue
+			}
+			kept = append(kept, pattern)
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		fields[0] = strings.Join(kept, ",")
+		out.WriteString(strings.Join(fields, " ") + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	if present && !stale {
+		return false, nil
+	}
+	if !present {
+		out.WriteString(KnownHostLine(address, key, hash) + "\n")
+	}
+	return true, os.WriteFile(path, out.Bytes(), info.Mode().Perm())
+}
+
+// KnownHostsUsesHashing reports if the known_hosts file contains hashed
+// hostnames, as written by OpenSSH with the HashKnownHosts option
+func KnownHostsUsesHashing(file string) bool {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		hosts := fields[0]
+		if strings.HasPrefix(hosts, "@") {
+			hosts = fields[1]
+		}
+		if strings.HasPrefix(hosts, "|1|") {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownHostAddress returns address as OpenSSH records it in the
+// known_hosts files: the bare host on port 22, as example.com or ::1, and
+// [host]:port on the other ports, as [::1]:2222
+func KnownHostAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		// a host without the port, maybe a bare IPv6 one
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		port = fmt.Sprintf("%d", defaultPort)
+	}
+	if port == fmt.Sprintf("%d", defaultPort) {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// MatchKnownHostPatterns reports if address matches the known_hosts
+// host patterns, following the OpenSSH rules: the patterns may contain
+// the * and ? wildcards, the ones starting with ! negate the match and
+// take precedence over the others. Hosts on a port other than 22 are
+// matched in the [host]:port form
+func MatchKnownHostPatterns(patterns []string, address string) bool {
+	host := KnownHostAddress(address)
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var m bool
+		if strings.HasPrefix(pattern, "|1|") {
+			m = hashedAddressMatches(pattern, address)
+		} else {
+			m = wildcardMatch(pattern, host)
+		}
+		if m && negated {
+			return false
+		}
+		matched = matched || m
+	}
+	return matched
+}
+
+// wildcardMatch matches s against a pattern where * matches any
+// sequence of characters and ? a single one
+func wildcardMatch(pattern string, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if wildcardMatch(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && wildcardMatch(pattern[1:], s[1:])
+	}
+	return s != "" && pattern[0] == s[0] && wildcardMatch(pattern[1:], s[1:])
+}
+
+// knownHostMatches reports if a known_hosts host pattern refers to host
+func knownHostMatches(pattern string, host string) bool {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = strings.Trim(host, "[]")
+		port = ""
+	}
+
+	if strings.HasPrefix(pattern, "|1|") {
+		// hashed patterns can be matched against a single address only
+		addr := hostname
+		if port != "" {
+			addr = net.JoinHostPort(hostname, port)
+		}
+		return hashedAddressMatches(pattern, addr)
+	}
+
+	patternHost, patternPort, err := net.SplitHostPort(pattern)
+	if err != nil {
+		patternHost = pattern
+		patternPort = fmt.Sprintf("%d", defaultPort)
+	}
+	if patternHost != hostname {
+		return false
+	}
+	return port == "" || port == patternPort
+}
+
+// hashedAddressMatches checks a hashed pattern against address. The
+// IPv6 hosts on port 22 are hashed bracketed by x/crypto knownhosts and
+// bare by OpenSSH: both are matched
+func hashedAddressMatches(pattern string, address string) bool {
+	return hashedHostMatches(pattern, KnownHostAddress(address)) ||
+		hashedHostMatches(pattern, knownhosts.Normalize(address))
+}
+
+// hashedHostMatches checks a "|1|salt|hash" pattern against host
+func hashedHostMatches(pattern string, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
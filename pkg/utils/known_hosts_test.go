@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostEntries(t *testing.T) {
+	key, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+	pubkey, _ := ssh.NewPublicKey(key.Public())
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(file, []byte("# rospo test\n"), 0600)
+
+	AddHostKeyToKnownHosts("testhost:2222", pubkey, file)
+	AddHostKeyToKnownHosts("testhost:2223", pubkey, file)
+	AddHostKeyToKnownHosts("otherhost:2222", pubkey, file)
+
+	entries, err := ListKnownHostEntries(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	if entries[0].Hosts[0] != "[testhost]:2222" {
+		t.Fatalf("unexpected host %s", entries[0].Hosts[0])
+	}
+	if entries[0].Fingerprint() != ssh.FingerprintSHA256(pubkey) {
+		t.Fatal("unexpected fingerprint")
+	}
+
+	if err := RemoveKnownHostEntry(file, "testhost:2222"); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = ListKnownHostEntries(file)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	// without port all the host entries are removed
+	if err := RemoveKnownHostEntry(file, "testhost"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveKnownHostEntry(file, "otherhost:2222"); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(file)
+	if string(content) != "# rospo test\n" {
+		t.Fatalf("expected a clean file, got '%s'", string(content))
+	}
+
+	if err := RemoveKnownHostEntry(file, "testhost"); err == nil {
+		t.Fatal("expected an error for a not existent host")
+	}
+}
+
+func TestRemoveKnownHostPatterns(t *testing.T) {
+	key, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+	pubkey, _ := ssh.NewPublicKey(key.Public())
+	serialized := SerializePublicKey(pubkey)
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	content := "hosta,hostb " + serialized + "\n" +
+		knownhosts.HashHostname("hashed.example.com") + " " + serialized + "\n"
+	os.WriteFile(file, []byte(content), 0600)
+
+	if err := RemoveKnownHostEntry(file, "hosta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveKnownHostEntry(file, "hashed.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	result, _ := os.ReadFile(file)
+	if strings.TrimSpace(string(result)) != "hostb "+serialized {
+		t.Fatalf("unexpected content '%s'", string(result))
+	}
+}
+
+func TestAddHostKeyHashed(t *testing.T) {
+	key, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+	pubkey, _ := ssh.NewPublicKey(key.Public())
+	serialized := SerializePublicKey(pubkey)
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+
+	// plain files get plain entries
+	plain := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(plain, []byte("otherhost "+serialized+"\n"), 0600)
+	AddHostKeyToKnownHosts("testhost:2222", pubkey, plain)
+	content, _ := os.ReadFile(plain)
+	if !strings.HasSuffix(string(content), "[testhost]:2222 "+serialized+"\n") {
+		t.Fatalf("unexpected content '%s'", content)
+	}
+
+	hashed := filepath.Join(t.TempDir(), "known_hosts")
+	os.WriteFile(hashed, []byte(knownhosts.HashHostname("otherhost")+" "+serialized+"\n"), 0600)
+	AddHostKeyToKnownHosts("testhost:2222", pubkey, hashed)
+	AddHostKeyToKnownHosts("testhost:22", pubkey, hashed)
+	content, _ = os.ReadFile(hashed)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "|1|") {
+			t.Fatalf("expected a hashed entry, got '%s'", line)
+		}
+	}
+
+	clb, err := knownhosts.New(hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"testhost:2222", "testhost:22"} {
+		if err := clb(host, remote, pubkey); err != nil {
+			t.Fatalf("%s: %s", host, err)
+		}
+	}
+	if err := RemoveKnownHostEntry(hashed, "testhost:2222"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMatchKnownHostPatterns(t *testing.T) {
+	hashed := knownhosts.HashHostname("hashed.example.com")
+	tests := []struct {
+		patterns []string
+		address  string
+		match    bool
+	}{
+		{[]string{"*.example.com"}, "a.example.com:22", true},
+		{[]string{"*.example.com"}, "example.com:22", false},
+		{[]string{"host?"}, "host1:22", true},
+		{[]string{"*.example.com"}, "a.example.com:2222", false},
+		{[]string{"[*.example.com]:2222"}, "a.example.com:2222", true},
+		{[]string{"*.example.com", "!b.example.com"}, "b.example.com:22", false},
+		{[]string{"!b.example.com"}, "a.example.com:22", false},
+		{[]string{hashed}, "hashed.example.com:22", true},
+		{[]string{"*"}, "10.0.0.1:22", true},
+		{[]string{"::1"}, "[::1]:22", true},
+		{[]string{"::1"}, "[::1]:2222", false},
+		{[]string{"[::1]:2222"}, "[::1]:2222", true},
+		{[]string{knownhosts.HashHostname("::1")}, "[::1]:22", true},
+		{[]string{knownhosts.HashHostname("[::1]")}, "[::1]:22", true},
+	}
+	for _, test := range tests {
+		if MatchKnownHostPatterns(test.patterns, test.address) != test.match {
+			t.Fatalf("%v %s: expected %t", test.patterns, test.address, test.match)
+		}
+	}
+}
+
+func TestKnownHostAddress(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1:22":         "10.0.0.1",
+		"example.com":         "example.com",
+		"example.com:22":      "example.com",
+		"example.com:2222":    "[example.com]:2222",
+		"[2001:db8::1]:22":    "2001:db8::1",
+		"[2001:db8::1]":       "2001:db8::1",
+		"2001:db8::1":         "2001:db8::1",
+		"[2001:db8::1]:2222":  "[2001:db8::1]:2222",
+		"[fe80::1%eth0]:2222": "[fe80::1%eth0]:2222",
+	}
+	for address, expected := range tests {
+		if got := KnownHostAddress(address); got != expected {
+			t.Fatalf("%s: expected %s, got %s", address, expected, got)
+		}
+	}
+
+	// the lines written are the ones verified
+	key, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+	pubkey, _ := ssh.NewPublicKey(key.Public())
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	for _, address := range []string{"[2001:db8::1]:22", "[2001:db8::1]:2222"} {
+		for _, hash := range []bool{false, true} {
+			os.WriteFile(file, []byte(KnownHostLine(address, pubkey, hash)+"\n"), 0600)
+			clb, err := knownhosts.New(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22}
+			if err := clb(address, remote, pubkey); err != nil {
+				t.Fatalf("%s hashed %t: %s", address, hash, err)
+			}
+		}
+	}
+}
+
+func TestWriteKnownHostKeyPresent(t *testing.T) {
+	key, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+	pubkey, _ := ssh.NewPublicKey(key.Public())
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	for _, hash := range []bool{false, true} {
+		os.Remove(file)
+		changed, err := WriteKnownHostKey(file, "testhost:2222", pubkey, hash)
+		if err != nil || !changed {
+			t.Fatalf("expected the key to be written: %t %v", changed, err)
+		}
+		before, _ := os.ReadFile(file)
+		changed, err = WriteKnownHostKey(file, "testhost:2222", pubkey, hash)
+		if err != nil || changed {
+			t.Fatalf("expected the present key to be skipped: %t %v", changed, err)
+		}
+		after, _ := os.ReadFile(file)
+		if string(before) != string(after) {
+			t.Fatalf("the file changed:\n%s\n%s", before, after)
+		}
+	}
+
+	// a line listing more hosts counts too
+	os.WriteFile(file, []byte("otherhost,[testhost]:2222 "+SerializePublicKey(pubkey)+"\n"), 0600)
+	if changed, _ := WriteKnownHostKey(file, "testhost:2222", pubkey, false); changed {
+		t.Fatal("expected the multi host line to match")
+	}
+}
+
+func TestWriteKnownHostKeyRotated(t *testing.T) {
+	oldKey, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+	oldPub, _ := ssh.NewPublicKey(oldKey.Public())
+	newKey, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+	newPub, _ := ssh.NewPublicKey(newKey.Public())
+	ecdsaKey, _ := GeneratePrivateKey(KeyAlgorithmECDSAP256, 0)
+	ecdsaPub, _ := ssh.NewPublicKey(ecdsaKey.Public())
+
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	content := "# rospo test\n" +
+		"[testhost]:2222,otherhost " + SerializePublicKey(oldPub) + "\n" +
+		"[testhost]:2222 " + SerializePublicKey(ecdsaPub) + "\n" +
+		"@revoked [testhost]:2222 " + SerializePublicKey(oldPub) + "\n"
+	os.WriteFile(file, []byte(content), 0600)
+
+	changed, err := WriteKnownHostKey(file, "testhost:2222", newPub, false)
+	if err != nil || !changed {
+		t.Fatalf("expected the rotated key to be written: %t %v", changed, err)
+	}
+	data, _ := os.ReadFile(file)
+	expected := "# rospo test\n" +
+		"otherhost " + SerializePublicKey(oldPub) + "\n" +
+		"[testhost]:2222 " + SerializePublicKey(ecdsaPub) + "\n" +
+		"@revoked [testhost]:2222 " + SerializePublicKey(oldPub) + "\n" +
+		"[testhost]:2222 " + SerializePublicKey(newPub) + "\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected known_hosts:\n%s", data)
+	}
+
+	// hashed entries are replaced too
+	os.WriteFile(file, []byte(KnownHostLine("testhost:2222", oldPub, true)+"\n"), 0600)
+	if _, err := WriteKnownHostKey(file, "testhost:2222", newPub, true); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := ListKnownHostEntries(file)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Hosts[0], "|1|") || entries[0].Fingerprint() != ssh.FingerprintSHA256(newPub) {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
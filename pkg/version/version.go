@@ -0,0 +1,65 @@
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// The build values. They are set during the build process using
+// -ldflags="-X 'github.com/ferama/rospo/pkg/version.version=...'". commit
+// and buildDate default to the version control info recorded by go build
+var (
+	version   = "development"
+	commit    = ""
+	buildDate = ""
+)
+
+// Info describes the running rospo build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	// the go toolchain that built the binary
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	// the main module path and version, as recorded by go build
+	BuildInfo string `json:"build_info"`
+}
+
+// Version returns the running rospo build info, so that the library users
+// can include it in their own diagnostics
+func Version() Info {
+	info := Info{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.GoVersion != "" {
+			info.GoVersion = bi.GoVersion
+		}
+		if bi.Main.Path != "" {
+			info.BuildInfo = bi.Main.Path + "@" + bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	if info.BuildInfo == "" {
+		info.BuildInfo = "unknown@" + info.GoVersion
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
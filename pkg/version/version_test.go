@@ -0,0 +1,26 @@
+package version
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "1.2.3", "abc"
+
+	info := Version()
+	if info.Version != "1.2.3" || info.Commit != "abc" || info.BuildDate == "" {
+		t.Fatalf("unexpected build info %+v", info)
+	}
+	if info.GoVersion == "" || info.BuildInfo == "" {
+		t.Fatalf("missing go version or build info %+v", info)
+	}
+	if !strings.HasPrefix(info.GoVersion, "go") {
+		t.Fatalf("unexpected go version %s, runtime %s", info.GoVersion, runtime.Version())
+	}
+	if info.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Fatalf("unexpected platform %s", info.Platform)
+	}
+}